@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/validation"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v4"
@@ -15,6 +21,8 @@ import (
 type Credentials struct {
 	Username string `json:"email"`
 	Password string `json:"password"`
+	// Org is the id of the organization to log in to; zero picks the oldest one the user belongs to
+	Org int `json:"org"`
 }
 
 func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
@@ -22,25 +30,65 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 	// read a json payload
 	err := app.readJSON(w, r, &creds)
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		app.errorJSON(w, r, errInvalidCredentials)
 		return
 	}
-	// look up user by email address
-	user, err := app.DB.GetUserByEmail(creds.Username)
+	// refuse logins to a locked account, or from a locked address, without checking the password
+	wait, err := app.Lockout.Check(r.Context(), app.DB, creds.Username, app.TrustedProxies.ClientIP(r))
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		app.tooManyAttempts(w, r, wait)
+		return
+	}
+	// look up user by email address
+	user, err := app.DB.GetUserByEmail(r.Context(), creds.Username)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.loginFailed(w, r, creds.Username)
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 	// check password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password))
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		app.loginFailed(w, r, creds.Username)
+		return
+	}
+	err = app.Lockout.Succeed(r.Context(), app.DB, user.Email)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	// depending on the policy, the email address may have to be verified first
+	if !app.EmailVerification.AllowsLogin(user.EmailVerified()) {
+		app.errorJSON(w, r, errEmailUnverified)
 		return
 	}
+	// users with an authenticator finish logging in at /auth/mfa, with a code from it
+	enabled, err := app.MFA.Enabled(r.Context(), app.DB, user.ID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		app.challengeMFA(w, r, user)
+		return
+	}
+
+	app.completeLogin(w, r, user, creds.Org)
+}
+
+// completeLogin issues a token pair to a user who has proved who they are, and sets the refresh
+// token cookie the web client uses.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User, orgID int) {
 	// generate token if password matches
-	tokenPairs, err := app.generateTokenPair(user)
+	tokenPairs, err := app.generateTokenPair(r.Context(), user, orgID)
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -70,36 +118,22 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 	refreshToken := r.Form.Get("refresh_token")
 	claims := &Claims{}
 
-	_, err = jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (any, error) {
-		return []byte(app.JWTSecret), nil
-	})
+	_, err = jwt.ParseWithClaims(refreshToken, claims, app.Keys.keyFunc)
 
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, errMalformedRefreshToken)
 		return
 	}
 
 	if time.Until(time.Unix(claims.ExpiresAt.Unix(), 0)) > 30*time.Second {
-		app.errorJSON(w, errors.New("refresh token does not need renewed yet"), http.StatusTooEarly)
-		return
-	}
-
-	// get user id from the claims
-	userID, err := strconv.Atoi(claims.Subject)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
-		return
-	}
-
-	user, err := app.DB.GetUser(userID)
-	if err != nil {
-		app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
+		app.errorJSON(w, r, newAPIError(codeTooEarly, "refresh token does not need renewed yet"))
 		return
 	}
 
-	tokenPairs, err := app.generateTokenPair(user)
+	// exchange the refresh token for a new pair; this fails if the token was already used
+	tokenPairs, err := app.rotateRefreshToken(r.Context(), refreshToken)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -124,36 +158,22 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 			claims := &Claims{}
 			refreshToken := cookie.Value
 
-			_, err := jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (any, error) {
-				return []byte(app.JWTSecret), nil
-			})
+			_, err := jwt.ParseWithClaims(refreshToken, claims, app.Keys.keyFunc)
 
 			if err != nil {
-				app.errorJSON(w, err, http.StatusBadRequest)
+				app.errorJSON(w, r, errMalformedRefreshToken)
 				return
 			}
 
 			// if time.Until(time.Unix(claims.ExpiresAt.Unix(), 0)) > 30*time.Second {
-			// 	app.errorJSON(w, errors.New("refresh token does not need renewed yet"), http.StatusTooEarly)
+			// 	app.errorJSON(w, r, newAPIError(codeTooEarly, "refresh token does not need renewed yet"))
 			// 	return
 			// }
 
-			// get user id from the claims
-			userID, err := strconv.Atoi(claims.Subject)
-			if err != nil {
-				app.errorJSON(w, err, http.StatusBadRequest)
-				return
-			}
-
-			user, err := app.DB.GetUser(userID)
-			if err != nil {
-				app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
-				return
-			}
-
-			tokenPairs, err := app.generateTokenPair(user)
+			// exchange the refresh token for a new pair; this fails if the token was already used
+			tokenPairs, err := app.rotateRefreshToken(r.Context(), refreshToken)
 			if err != nil {
-				app.errorJSON(w, err, http.StatusBadRequest)
+				app.errorJSON(w, r, err, http.StatusInternalServerError)
 				return
 			}
 
@@ -175,28 +195,136 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+	app.errorJSON(w, r, newAPIError(codeUnauthorized, "no refresh token cookie"))
 }
 
+type pagination struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+type userList struct {
+	Users      []*data.User `json:"users"`
+	Pagination pagination   `json:"pagination"`
+}
+
+// allUsers returns a page of users. It accepts the query parameters limit, cursor, sort (a field
+// name, prefixed with - for descending order), email (a prefix), admin (true or false), and
+// created_after and created_before (RFC 3339 timestamps).
 func (app *application) allUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := app.DB.AllUsers()
+	q, err := userQueryFromRequest(r)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	// callers only ever see the members of their own organization
+	q.OrganizationID, err = app.activeOrg(r)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err)
 		return
 	}
-	_ = app.writeJSON(w, http.StatusOK, users)
+
+	page, err := app.DB.AllUsers(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			err = newAPIError(codeInvalidParameter, "cursor is not valid for this query")
+		}
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// tell the client where the first and next pages are
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(r, ""))}
+	if page.NextCursor != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, page.NextCursor)))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	users := page.Users
+	if users == nil {
+		users = []*data.User{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, userList{
+		Users: users,
+		Pagination: pagination{
+			Limit:      q.Normalize().Limit,
+			NextCursor: page.NextCursor,
+			HasMore:    page.NextCursor != "",
+		},
+	})
+}
+
+// userQueryFromRequest builds a repository.UserQuery from the request's query string.
+func userQueryFromRequest(r *http.Request) (repository.UserQuery, error) {
+	var q repository.UserQuery
+	values := r.URL.Query()
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return q, newAPIError(codeInvalidParameter, "limit must be a positive integer")
+		}
+		q.Limit = limit
+	}
+
+	q.Cursor = values.Get("cursor")
+	q.Sort = values.Get("sort")
+	q.EmailPrefix = values.Get("email")
+
+	q.Role = values.Get("role")
+
+	for param, dst := range map[string]*time.Time{"created_after": &q.CreatedAfter, "created_before": &q.CreatedBefore} {
+		if v := values.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, newAPIErrorf(codeInvalidParameter, "%s must be an RFC 3339 timestamp", param)
+			}
+			*dst = t
+		}
+	}
+
+	if _, _, err := q.Normalize().SortField(); err != nil {
+		return q, newAPIErrorf(codeInvalidParameter, "cannot sort by %q", q.Sort)
+	}
+
+	return q, nil
+}
+
+// pageURL returns the request url with its cursor replaced.
+func pageURL(r *http.Request, cursor string) string {
+	u := *r.URL
+	values := u.Query()
+	values.Del("cursor")
+	if cursor != "" {
+		values.Set("cursor", cursor)
+	}
+	u.RawQuery = values.Encode()
+	return u.RequestURI()
 }
 
 func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, errInvalidUserID)
+		return
+	}
+
+	permitted, err := app.selfOrPermitted(r, userID, data.PermissionReadUsers)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !permitted {
+		app.errorJSON(w, r, errForbidden)
 		return
 	}
 
-	user, err := app.DB.GetUser(userID)
+	user, err := app.DB.GetUser(r.Context(), userID)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -206,13 +334,30 @@ func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
 func (app *application) updateUser(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, errInvalidUserID)
 		return
 	}
 
-	user, err := app.DB.GetUser(userID)
+	permitted, err := app.selfOrPermitted(r, userID, data.PermissionWriteUsers)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !permitted {
+		app.errorJSON(w, r, errForbidden)
+		return
+	}
+
+	app.updateUserFromRequest(w, r, userID)
+}
+
+// updateUserFromRequest updates a user's name and email from the request's json payload. A new
+// email address has to be verified again, and only the user or a caller permitted outside of
+// any organization can change it, as it is where password resets are sent.
+func (app *application) updateUserFromRequest(w http.ResponseWriter, r *http.Request, userID int) {
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -220,51 +365,473 @@ func (app *application) updateUser(w http.ResponseWriter, r *http.Request) {
 
 	err = app.readJSON(w, r, &u)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	user.FirstName = u.FirstName
-	user.LastName = u.LastName
-	user.Email = u.Email
+	emailChanged := data.NormalizeEmail(u.Email) != user.Email
+	if emailChanged {
+		permitted, err := app.credentialsPermitted(r, userID, data.PermissionWriteUsers)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if !permitted {
+			app.errorJSON(w, r, errOthersCredentials)
+			return
+		}
+	}
+	user.FirstName = strings.TrimSpace(u.FirstName)
+	user.LastName = strings.TrimSpace(u.LastName)
+	user.Email = strings.TrimSpace(u.Email)
+
+	errs := validation.User(*user, false, app.PasswordPolicy)
+	if !errs.Valid() {
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
 
-	err = app.DB.UpdateUser(*user)
+	taken, err := app.emailTaken(r.Context(), user.Email, user.ID)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		app.errorJSON(w, r, errDuplicateEmail)
+		return
+	}
+
+	// a new address is unverified, and is sent a link to verify it
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.UpdateUser(r.Context(), *user)
+		if err != nil || !emailChanged {
+			return err
+		}
+		return app.mailEmailVerification(r.Context(), repo, *user)
+	})
+	if errors.Is(err, repository.ErrDuplicate) {
+		// somebody took the address since we checked
+		app.errorJSON(w, r, errDuplicateEmail)
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteUser deletes a user. Users may close their own account and those with permission outside
+// of any organization may delete anyone else, but an admin cannot delete themselves, and the last
+// remaining admin cannot be deleted at all, so that nobody is ever locked out of managing users.
 func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, errInvalidUserID)
 		return
 	}
 
-	err = app.DB.DeleteUser(userID)
+	permitted, err := app.selfOrPermitted(r, userID, data.PermissionDeleteUsers)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !permitted {
+		app.errorJSON(w, r, errForbidden)
+		return
+	}
+
+	permitted, err = app.credentialsPermitted(r, userID, data.PermissionDeleteUsers)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !permitted {
+		app.errorJSON(w, r, errOthersCredentials)
+		return
+	}
+
+	claims, _ := app.claimsFromContext(r.Context())
+	if callerID, _ := claims.UserID(); claims.HasRole(data.RoleAdmin) && callerID == userID {
+		app.errorJSON(w, r, newAPIError(codeForbidden, "you cannot delete your own admin account"))
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if user.HasRole(data.RoleAdmin) {
+		last, err := app.lastAdmin(r.Context(), 0)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if last {
+			app.errorJSON(w, r, newAPIError(codeConflict, "cannot delete the last remaining admin"))
+			return
+		}
+	}
+
+	// nor may an organization be left without an admin
+	memberships, err := app.DB.UserMemberships(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	for _, m := range memberships {
+		if !m.HasRole(data.RoleAdmin) {
+			continue
+		}
+		last, err := app.lastAdmin(r.Context(), m.OrganizationID)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if last {
+			app.errorJSON(w, r, newAPIErrorf(codeConflict, "cannot delete the last admin of %s", m.OrganizationName))
+			return
+		}
+	}
+
+	err = app.DB.DeleteUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// lastAdmin reports whether there is only one admin left in the organization with orgID, or,
+// if it is zero, only one user with the admin role outside of any organization.
+func (app *application) lastAdmin(ctx context.Context, orgID int) (bool, error) {
+	var admins int
+	var err error
+	if orgID == 0 {
+		admins, err = app.DB.CountUsersWithRole(ctx, data.RoleAdmin)
+	} else {
+		admins, err = app.DB.CountMembersWithRole(ctx, orgID, data.RoleAdmin)
+	}
+	if err != nil {
+		return false, err
+	}
+	return admins <= 1, nil
+}
+
+// NewUser is the payload for creating a user. Unlike data.User, it accepts a password. The new
+// user joins the organization of the caller, and Roles are their roles there; giving them roles
+// needs permission to manage roles.
+type NewUser struct {
+	FirstName string   `json:"first_name"`
+	LastName  string   `json:"last_name"`
+	Email     string   `json:"email"`
+	Password  string   `json:"password"`
+	Roles     []string `json:"roles"`
+}
+
 func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
-	var user data.User
+	var payload NewUser
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	user := data.User{
+		FirstName: strings.TrimSpace(payload.FirstName),
+		LastName:  strings.TrimSpace(payload.LastName),
+		Email:     strings.TrimSpace(payload.Email),
+		Password:  payload.Password,
+	}
+
+	orgID, err := app.activeOrg(r)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if len(payload.Roles) > 0 {
+		claims, _ := app.claimsFromContext(r.Context())
+		if !claims.HasPermission(data.PermissionManageRoles) {
+			app.errorJSON(w, r, errForbidden)
+			return
+		}
+	}
+
+	errs := validation.User(user, true, app.PasswordPolicy)
+	err = app.checkRoles(r.Context(), payload.Roles, errs)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !errs.Valid() {
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	taken, err := app.emailTaken(r.Context(), user.Email, 0)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		app.errorJSON(w, r, errDuplicateEmail)
+		return
+	}
+
+	// the user, their membership, their roles and the mail to verify their address are added
+	// together, or not at all
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		user.ID, err = repo.InsertUser(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		err = repo.AddMember(r.Context(), orgID, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, role := range payload.Roles {
+			err = repo.AssignMemberRole(r.Context(), orgID, user.ID, role)
+			if err != nil {
+				return err
+			}
+		}
+		return app.mailEmailVerification(r.Context(), repo, user)
+	})
+	if errors.Is(err, repository.ErrDuplicate) {
+		app.errorJSON(w, r, errDuplicateEmail)
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Registration is the payload for signing up. It has no roles: people who sign themselves up
+// start as ordinary users, in no organization.
+type Registration struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+}
+
+var errSignupClosed = newAPIError(codeForbidden, "signing up is closed; ask an admin for an account")
+
+// register lets someone create an account for themselves, if the signup policy allows it, and
+// mails them a link to verify their address. They log in with it as they would with any other
+// account, once the email verification policy lets them. An address that already has an
+// account gets the same answer, and its owner is mailed instead, so that signing up does not
+// tell anyone who has an account.
+func (app *application) register(w http.ResponseWriter, r *http.Request) {
+	if !app.Signup.Open {
+		app.errorJSON(w, r, errSignupClosed)
+		return
+	}
+
+	var payload Registration
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	user := data.User{
+		FirstName: strings.TrimSpace(payload.FirstName),
+		LastName:  strings.TrimSpace(payload.LastName),
+		Email:     strings.TrimSpace(payload.Email),
+		Password:  payload.Password,
+	}
+
+	errs := validation.User(user, true, app.PasswordPolicy)
+	if errs.Get("email") == "" && !app.Signup.AllowsEmail(user.Email) {
+		errs.Add("email", "cannot be used to sign up here")
+	}
+	if !errs.Valid() {
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	// the account is only created if the mail to verify its address can be sent
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		user.ID, err = repo.InsertUser(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		return app.mailEmailVerification(r.Context(), repo, user)
+	})
+	var dup *repository.DuplicateError
+	if errors.As(err, &dup) && dup.Field == "email" {
+		// a failure here is only logged: an error would tell the caller the account exists
+		err = app.mailAccountExists(r.Context(), user.Email)
+		if err != nil {
+			log.Printf("%s %s: mailing the owner of an existing account: %s", r.Method, r.URL.Path, err)
+		}
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// mailAccountExists tells the owner of the account with email that someone tried to sign up
+// with their address, and how to get back in if it was them.
+func (app *application) mailAccountExists(ctx context.Context, email string) error {
+	user, err := app.DB.GetUserByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
 
-	err := app.readJSON(w, r, &user)
+	return app.Mailer.Queue(ctx, app.DB, user.Email, "account-exists", map[string]any{
+		"Name": user.FirstName,
+		"URL":  strings.TrimSuffix(app.SiteURL, "/") + "/forgot-password",
+	})
+}
+
+// checkRoles adds an error to errs for every name in roles that is not a role we have.
+func (app *application) checkRoles(ctx context.Context, roles []string, errs validation.Errors) error {
+	if len(roles) == 0 {
+		return nil
+	}
+
+	known, err := app.DB.AllRoles(ctx)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(known))
+	for _, role := range known {
+		names[role.Name] = true
+	}
+
+	for _, role := range roles {
+		if !names[role] {
+			errs.Add("roles", fmt.Sprintf("there is no role called %q", role))
+		}
+	}
+	return nil
+}
+
+// allRoles lists every role, and the permissions it grants.
+func (app *application) allRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.AllRoles(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, roles)
+}
+
+// emailTaken reports whether a user other than the one with id exceptID already has the email address.
+func (app *application) emailTaken(ctx context.Context, email string, exceptID int) (bool, error) {
+	existing, err := app.DB.GetUserByEmail(ctx, email)
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return existing.ID != exceptID, nil
+}
+
+// currentUserID returns the id of the caller, taken from the sub claim of their token.
+func (app *application) currentUserID(r *http.Request) (int, error) {
+	claims, ok := app.claimsFromContext(r.Context())
+	if !ok {
+		return 0, errUnauthorized
+	}
+	return claims.UserID()
+}
+
+func (app *application) getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
-	_, err = app.DB.InsertUser(user)
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+func (app *application) updateCurrentUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	app.updateUserFromRequest(w, r, userID)
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	var payload PasswordChange
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	errs := validation.Errors{}
+	for _, problem := range app.PasswordPolicy.Check(payload.NewPassword) {
+		errs.Add("new_password", problem)
+	}
+	if !errs.Valid() {
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// the caller must prove they know the current password
+	valid, err := user.PasswordMatches(payload.CurrentPassword)
+	if err != nil || !valid {
+		app.errorJSON(w, r, newAPIError(codeForbidden, "current password is incorrect"))
+		return
+	}
+
+	// whoever else is logged in as the user logs in again, with the new password; the login the
+	// change was made from stays
+	var sessionID string
+	if claims, ok := app.claimsFromContext(r.Context()); ok {
+		sessionID = claims.SessionID
+	}
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.ResetPassword(r.Context(), userID, payload.NewPassword)
+		if err != nil {
+			return err
+		}
+		return repo.RevokeOtherRefreshTokens(r.Context(), userID, sessionID)
+	})
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -272,6 +839,22 @@ func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) deleteRefreshToken(w http.ResponseWriter, r *http.Request) {
+	// revoke the refresh token server side, whether it came in a cookie or a posted form
+	refreshToken := ""
+	if cookie, err := r.Cookie("__Host-refresh_token"); err == nil {
+		refreshToken = cookie.Value
+	} else if r.Method == http.MethodPost {
+		refreshToken = r.PostFormValue("refresh_token")
+	}
+
+	if refreshToken != "" {
+		err := app.revokeRefreshToken(r.Context(), refreshToken)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	delCookie := http.Cookie{
 		Name:     "__Host-refresh_token",
 		Path:     "/",
@@ -287,3 +870,10 @@ func (app *application) deleteRefreshToken(w http.ResponseWriter, r *http.Reques
 	http.SetCookie(w, &delCookie)
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// jwks publishes the public signing keys, so that other services can verify our tokens
+// without holding a signing key.
+func (app *application) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_ = app.writeJSON(w, http.StatusOK, app.Keys.jwks())
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 	"web-app/pkg/data"
+	"web-app/pkg/validation"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
 )
 
 func Test_app_authenticate(t *testing.T) {
@@ -26,6 +30,7 @@ func Test_app_authenticate(t *testing.T) {
 		{"empty password", `{"email":"","password":""}`, http.StatusUnauthorized},
 		{"invalid user", `{"email":"wrong@email.com","password":"wrongpassword"}`, http.StatusUnauthorized},
 		{"wrong password", `{"email":"admin@example.com","password":"wrongpassword"}`, http.StatusUnauthorized},
+		{"email in another case", `{"email":"Admin@Example.com","password":"secret"}`, http.StatusOK},
 	}
 
 	for _, e := range tests {
@@ -40,6 +45,64 @@ func Test_app_authenticate(t *testing.T) {
 	}
 }
 
+func Test_app_register(t *testing.T) {
+	defer func() { app.Signup = validation.SignupPolicy{} }()
+
+	var tests = []struct {
+		name           string
+		signup         validation.SignupPolicy
+		requestBody    string
+		expectedStatus int
+	}{
+		{"open", validation.SignupPolicy{Open: true}, `{"first_name":"Jill","last_name":"Smith","email":"jill@example.org","password":"secret-password"}`, http.StatusAccepted},
+		{"closed", validation.SignupPolicy{}, `{"first_name":"Jill","last_name":"Smith","email":"jill@example.org","password":"secret-password"}`, http.StatusForbidden},
+		{"allowed domain", validation.SignupPolicy{Open: true, AllowedDomains: []string{"example.org"}}, `{"first_name":"Jill","last_name":"Smith","email":"jill@example.org","password":"secret-password"}`, http.StatusAccepted},
+		{"other domain", validation.SignupPolicy{Open: true, AllowedDomains: []string{"example.net"}}, `{"first_name":"Jill","last_name":"Smith","email":"jill@example.org","password":"secret-password"}`, http.StatusUnprocessableEntity},
+		{"invalid", validation.SignupPolicy{Open: true}, `{"first_name":"","last_name":"Smith","email":"jill","password":"x"}`, http.StatusUnprocessableEntity},
+		{"email taken", validation.SignupPolicy{Open: true}, `{"first_name":"Jack","last_name":"Smith","email":"Jack@example.com","password":"secret-password"}`, http.StatusAccepted},
+		{"roles are not accepted", validation.SignupPolicy{Open: true}, `{"first_name":"Jill","last_name":"Smith","email":"jill@example.org","password":"secret-password","roles":["admin"]}`, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		app.Signup = e.signup
+
+		req, _ := http.NewRequest("POST", "/auth/register", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+		app.register(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if rr.Code != http.StatusAccepted {
+			continue
+		}
+
+		// the owner of an address that is taken is told, and nobody else is
+		if e.name == "email taken" {
+			queued, _ := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+			if len(queued) != 1 || queued[0].To != "jack@example.com" || !strings.Contains(queued[0].Subject, "already have an account") {
+				t.Errorf("%s: expected the owner of the address to be mailed, but got %+v", e.name, queued)
+			}
+			continue
+		}
+
+		// the new user has no roles, and can log in
+		user, err := app.DB.GetUserByEmail(context.Background(), "jill@example.org")
+		if err != nil || len(user.Roles) != 0 {
+			t.Errorf("%s: expected a new user without roles, but got %+v, %v", e.name, user, err)
+		}
+
+		req, _ = http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"jill@example.org","password":"secret-password"}`))
+		rr = httptest.NewRecorder()
+		app.authenticate(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected the new user to log in, but got %d", e.name, rr.Code)
+		}
+	}
+}
+
 func Test_app_refresh(t *testing.T) {
 	var tests = []struct {
 		name               string
@@ -67,7 +130,7 @@ func Test_app_refresh(t *testing.T) {
 			if e.resetRefreshTime {
 				refreshTokenExpiry = time.Second * 1
 			}
-			tokens, _ := app.generateTokenPair(&testUser)
+			tokens, _ := app.generateTokenPair(context.Background(), &testUser, 0)
 			tkn = tokens.RefreshToken
 		} else {
 			tkn = e.token
@@ -101,11 +164,11 @@ func Test_app_userHandlers(t *testing.T) {
 		expectedStatus int
 	}{
 		{"all users", "GET", "", "", app.allUsers, http.StatusOK},
-		{"delete user", "DELETE", "", "1", app.deleteUser, http.StatusNoContent},
+		{"delete user", "DELETE", "", "2", app.deleteUser, http.StatusNoContent},
 		{"delete user bad url param", "DELETE", "", "Y", app.deleteUser, http.StatusBadRequest},
 		{"get valid user", "GET", "", "1", app.getUser, http.StatusOK},
 		{"get valid user bad url param", "GET", "", "Y", app.getUser, http.StatusBadRequest},
-		{"get invalid user", "GET", "", "100", app.getUser, http.StatusBadRequest},
+		{"get invalid user", "GET", "", "100", app.getUser, http.StatusNotFound},
 		{
 			"update valid user",
 			"PUT",
@@ -120,7 +183,7 @@ func Test_app_userHandlers(t *testing.T) {
 			`{"first_name":"Administrator","last_name":"User","email":"admin@example.com"}`,
 			"100",
 			app.updateUser,
-			http.StatusBadRequest,
+			http.StatusNotFound,
 		},
 		{
 			"update valid user - invalid json",
@@ -141,11 +204,67 @@ func Test_app_userHandlers(t *testing.T) {
 		{
 			"insert valid user",
 			"POST",
-			`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`,
+			`{"first_name":"Jill","last_name":"Smith","email":"jill@example.com","password":"secret-password"}`,
+			"",
+			app.insertUser,
+			http.StatusNoContent,
+		},
+		{
+			"insert user with a role",
+			"POST",
+			`{"first_name":"Jill","last_name":"Smith","email":"jill@example.com","password":"secret-password","roles":["admin"]}`,
 			"",
 			app.insertUser,
 			http.StatusNoContent,
 		},
+		{
+			"insert user - unknown role",
+			"POST",
+			`{"first_name":"Jill","last_name":"Smith","email":"jill@example.com","password":"secret-password","roles":["owner"]}`,
+			"",
+			app.insertUser,
+			http.StatusUnprocessableEntity,
+		},
+		{
+			"insert user - invalid fields",
+			"POST",
+			`{"first_name":"","last_name":"Smith","email":"jack","password":"x"}`,
+			"",
+			app.insertUser,
+			http.StatusUnprocessableEntity,
+		},
+		{
+			"insert user - duplicate email",
+			"POST",
+			`{"first_name":"Jack","last_name":"Smith","email":"admin@example.com","password":"secret-password"}`,
+			"",
+			app.insertUser,
+			http.StatusConflict,
+		},
+		{
+			"insert user - duplicate email in another case",
+			"POST",
+			`{"first_name":"Jack","last_name":"Smith","email":"ADMIN@example.com","password":"secret-password"}`,
+			"",
+			app.insertUser,
+			http.StatusConflict,
+		},
+		{
+			"update valid user - invalid email",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"not an email"}`,
+			"2",
+			app.updateUser,
+			http.StatusUnprocessableEntity,
+		},
+		{
+			"update valid user - email belongs to someone else",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"admin@example.com"}`,
+			"2",
+			app.updateUser,
+			http.StatusConflict,
+		},
 		{
 			"insert invalid user",
 			"POST",
@@ -165,6 +284,8 @@ func Test_app_userHandlers(t *testing.T) {
 	}
 
 	for _, e := range tests {
+		resetDB()
+
 		var req *http.Request
 		if e.json == "" {
 			req, _ = http.NewRequest(e.method, "/", nil)
@@ -178,6 +299,8 @@ func Test_app_userHandlers(t *testing.T) {
 			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
 		}
 
+		req = addClaimsToRequest(req, adminClaims)
+
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(e.handler)
 
@@ -189,6 +312,367 @@ func Test_app_userHandlers(t *testing.T) {
 	}
 }
 
+func Test_app_userLifecycle(t *testing.T) {
+	resetDB()
+
+	serve := func(handler http.HandlerFunc, method, userID, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/", strings.NewReader(body))
+		if userID != "" {
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("userID", userID)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		}
+		req = addClaimsToRequest(req, adminClaims)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	newUser := `{"first_name":"Jill","last_name":"Smith","email":"jill@example.com","password":"secret-password"}`
+
+	rr := serve(app.insertUser, "POST", "", newUser)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("insert: expected %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	// the same email address can't be used twice
+	rr = serve(app.insertUser, "POST", "", newUser)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("insert again: expected %d, but got %d", http.StatusConflict, rr.Code)
+	}
+
+	created, err := app.DB.GetUserByEmail(context.Background(), "jill@example.com")
+	if err != nil {
+		t.Fatal("inserted user not stored:", err)
+	}
+	id := strconv.Itoa(created.ID)
+
+	rr = serve(app.getUser, "GET", id, "")
+	var fetched data.User
+	_ = json.NewDecoder(rr.Body).Decode(&fetched)
+	if rr.Code != http.StatusOK || fetched.FirstName != "Jill" {
+		t.Errorf("get: expected Jill with status %d, but got %+v with %d", http.StatusOK, fetched, rr.Code)
+	}
+
+	rr = serve(app.deleteUser, "DELETE", id, "")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("delete: expected %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	rr = serve(app.getUser, "GET", id, "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("get deleted: expected %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func Test_app_validationErrorFields(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/users", strings.NewReader(`{"first_name":"Jack","last_name":"","email":"jack","password":"x"}`))
+	req = addClaimsToRequest(req, adminClaims)
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.insertUser)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("wrong status returned. expected %d, but got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	var payload problem
+	_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+	if payload.Code != codeValidationFailed {
+		t.Errorf("expected code %s, but got %s", codeValidationFailed, payload.Code)
+	}
+
+	for _, field := range []string{"last_name", "email", "password"} {
+		if len(payload.Errors[field]) == 0 {
+			t.Errorf("expected an error for field %s, but got none", field)
+		}
+	}
+
+	if _, ok := payload.Errors["first_name"]; ok {
+		t.Error("did not expect an error for first_name")
+	}
+}
+
+func Test_app_allUsersPagination(t *testing.T) {
+	var tests = []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedUsers  int
+		expectNext     bool
+	}{
+		{"default", "", http.StatusOK, 2, false},
+		{"limit", "?limit=1&sort=id", http.StatusOK, 1, true},
+		{"filter", "?email=jack", http.StatusOK, 1, false},
+		{"bad limit", "?limit=x", http.StatusBadRequest, 0, false},
+		{"bad sort", "?sort=password", http.StatusBadRequest, 0, false},
+		{"role filter", "?role=admin", http.StatusOK, 1, false},
+		{"unknown role", "?role=owner", http.StatusOK, 0, false},
+		{"bad date", "?created_after=yesterday", http.StatusBadRequest, 0, false},
+		{"bad cursor", "?cursor=nope", http.StatusBadRequest, 0, false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/users"+e.query, nil)
+		req = addClaimsToRequest(req, adminClaims)
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.allUsers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		var list userList
+		_ = json.NewDecoder(rr.Body).Decode(&list)
+
+		if len(list.Users) != e.expectedUsers {
+			t.Errorf("%s: expected %d users, but got %d", e.name, e.expectedUsers, len(list.Users))
+		}
+
+		if list.Pagination.HasMore != e.expectNext {
+			t.Errorf("%s: expected has_more to be %v", e.name, e.expectNext)
+		}
+
+		link := rr.Header().Get("Link")
+		if !strings.Contains(link, `rel="first"`) {
+			t.Errorf("%s: no first link in %q", e.name, link)
+		}
+		if e.expectNext && !strings.Contains(link, "cursor="+list.Pagination.NextCursor) {
+			t.Errorf("%s: no next link in %q", e.name, link)
+		}
+	}
+}
+
+func Test_app_userAuthorization(t *testing.T) {
+	var tests = []struct {
+		name           string
+		method         string
+		json           string
+		paramID        string
+		claims         *Claims
+		handler        http.HandlerFunc
+		expectedStatus int
+	}{
+		{"user gets self", "GET", "", "2", userClaims, app.getUser, http.StatusOK},
+		{"user gets someone else", "GET", "", "1", userClaims, app.getUser, http.StatusForbidden},
+		{"admin gets someone else", "GET", "", "2", adminClaims, app.getUser, http.StatusOK},
+		{"reader gets someone else", "GET", "", "1", readerClaims, app.getUser, http.StatusOK},
+		{
+			"reader updates someone else",
+			"PUT",
+			`{"first_name":"Admin","last_name":"User","email":"admin@example.com"}`,
+			"1",
+			readerClaims,
+			app.updateUser,
+			http.StatusForbidden,
+		},
+		{
+			"reader inserts user with a role",
+			"POST",
+			`{"first_name":"Jill","last_name":"Smith","email":"jill@example.com","password":"secret-password","roles":["admin"]}`,
+			"",
+			readerClaims,
+			app.insertUser,
+			http.StatusForbidden,
+		},
+		{
+			"user updates self",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`,
+			"2",
+			userClaims,
+			app.updateUser,
+			http.StatusNoContent,
+		},
+		{
+			"user updates someone else",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`,
+			"1",
+			userClaims,
+			app.updateUser,
+			http.StatusForbidden,
+		},
+		{"user deletes someone else", "DELETE", "", "1", userClaims, app.deleteUser, http.StatusForbidden},
+		{"user deletes self", "DELETE", "", "2", userClaims, app.deleteUser, http.StatusNoContent},
+		{"admin deletes self", "DELETE", "", "1", adminClaims, app.deleteUser, http.StatusForbidden},
+		{"organization admin deletes admin", "DELETE", "", "1", otherAdminClaims, app.deleteUser, http.StatusForbidden},
+		{"no claims", "GET", "", "2", nil, app.getUser, http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		var req *http.Request
+		if e.json == "" {
+			req, _ = http.NewRequest(e.method, "/", nil)
+		} else {
+			req, _ = http.NewRequest(e.method, "/", strings.NewReader(e.json))
+		}
+
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("userID", e.paramID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+
+		if e.claims != nil {
+			req = addClaimsToRequest(req, e.claims)
+		}
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func Test_app_allRoles(t *testing.T) {
+	resetDB()
+
+	// the roles are listed with their permissions
+	req, _ := http.NewRequest("GET", "/roles", nil)
+	rr := httptest.NewRecorder()
+	app.allRoles(rr, req)
+
+	var roles []data.Role
+	_ = json.NewDecoder(rr.Body).Decode(&roles)
+	if rr.Code != http.StatusOK || len(roles) != 1 || len(roles[0].Permissions) != len(adminPermissions) {
+		t.Errorf("all roles: expected the admin role with status %d, but got %+v with %d", http.StatusOK, roles, rr.Code)
+	}
+}
+
+func Test_app_currentUserHandlers(t *testing.T) {
+	var tests = []struct {
+		name           string
+		method         string
+		json           string
+		claims         *Claims
+		handler        http.HandlerFunc
+		expectedStatus int
+	}{
+		{"get me", "GET", "", adminClaims, app.getCurrentUser, http.StatusOK},
+		{"get me without claims", "GET", "", nil, app.getCurrentUser, http.StatusUnauthorized},
+		{
+			"update me",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`,
+			userClaims,
+			app.updateCurrentUser,
+			http.StatusNoContent,
+		},
+		{
+			"update me - invalid json",
+			"PUT",
+			`{first_name:"Jack"}`,
+			userClaims,
+			app.updateCurrentUser,
+			http.StatusBadRequest,
+		},
+		{
+			"change password",
+			"PUT",
+			`{"current_password":"secret","new_password":"n3w-Password"}`,
+			adminClaims,
+			app.changePassword,
+			http.StatusNoContent,
+		},
+		{
+			"change password - wrong current password",
+			"PUT",
+			`{"current_password":"wrong","new_password":"n3w-Password"}`,
+			adminClaims,
+			app.changePassword,
+			http.StatusForbidden,
+		},
+		{
+			"change password - no new password",
+			"PUT",
+			`{"current_password":"secret","new_password":""}`,
+			adminClaims,
+			app.changePassword,
+			http.StatusUnprocessableEntity,
+		},
+		{
+			"change password - new password too short",
+			"PUT",
+			`{"current_password":"secret","new_password":"short"}`,
+			adminClaims,
+			app.changePassword,
+			http.StatusUnprocessableEntity,
+		},
+		{
+			"change password without claims",
+			"PUT",
+			`{"current_password":"secret","new_password":"n3w-Password"}`,
+			nil,
+			app.changePassword,
+			http.StatusUnauthorized,
+		},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		var req *http.Request
+		if e.json == "" {
+			req, _ = http.NewRequest(e.method, "/users/me", nil)
+		} else {
+			req, _ = http.NewRequest(e.method, "/users/me", strings.NewReader(e.json))
+		}
+
+		if e.claims != nil {
+			req = addClaimsToRequest(req, e.claims)
+		}
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func Test_app_changePasswordRevokesOtherLogins(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+	admin, _ := app.DB.GetUser(ctx, 1)
+
+	// the admin is logged in twice, and changes their password from the first login
+	current, _ := app.generateTokenPair(ctx, admin, 0)
+	other, _ := app.generateTokenPair(ctx, admin, 0)
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(current.Token, claims, app.Keys.keyFunc)
+	if err != nil || claims.SessionID == "" {
+		t.Fatalf("expected the access token to name its login, but got %q, %v", claims.SessionID, err)
+	}
+
+	req, _ := http.NewRequest("PUT", "/users/me/password", strings.NewReader(`{"current_password":"secret","new_password":"n3w-Password"}`))
+	req = addClaimsToRequest(req, claims)
+	rr := httptest.NewRecorder()
+	app.changePassword(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	if stored, _ := app.DB.GetRefreshToken(ctx, hashToken(current.RefreshToken)); stored == nil || stored.Revoked() {
+		t.Error("expected the login the password was changed from to stay")
+	}
+	if stored, _ := app.DB.GetRefreshToken(ctx, hashToken(other.RefreshToken)); stored == nil || !stored.Revoked() {
+		t.Error("expected the other login to be revoked")
+	}
+}
+
 func Test_app_refreshUsingToken(t *testing.T) {
 	testUser := data.User{
 		ID:        1,
@@ -197,7 +681,7 @@ func Test_app_refreshUsingToken(t *testing.T) {
 		Email:     "admin@example.com",
 	}
 
-	tokens, _ := app.generateTokenPair(&testUser)
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser, 0)
 
 	testCookie := &http.Cookie{
 		Name:     "__Host-refresh_token",
@@ -274,3 +758,77 @@ func Test_app_deleteRefreshCookie(t *testing.T) {
 		t.Error("__Host-refresh-token cookie not found")
 	}
 }
+
+func Test_app_refreshTokenReuse(t *testing.T) {
+	testUser := data.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+	}
+
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser, 0)
+
+	refreshWithCookie := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "__Host-refresh_token", Value: token})
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.refreshUsingCookie)
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the first use of the token succeeds and hands out a new pair
+	rr := refreshWithCookie(tokens.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("first refresh: expected %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	var rotated TokenPairs
+	_ = json.NewDecoder(rr.Body).Decode(&rotated)
+	if rotated.RefreshToken == tokens.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+
+	// presenting the old token again is treated as theft
+	rr = refreshWithCookie(tokens.RefreshToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("reused token: expected %d, but got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// and the rotated token, from the same family, is revoked as well
+	rr = refreshWithCookie(rotated.RefreshToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("token from revoked family: expected %d, but got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func Test_app_logoutRevokesRefreshToken(t *testing.T) {
+	testUser := data.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+	}
+
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser, 0)
+
+	req, _ := http.NewRequest("GET", "/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "__Host-refresh_token", Value: tokens.RefreshToken})
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.deleteRefreshToken)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("wrong status: expected %d, but got %d", http.StatusAccepted, rr.Code)
+	}
+
+	stored, err := app.DB.GetRefreshToken(context.Background(), hashToken(tokens.RefreshToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stored.Revoked() {
+		t.Error("refresh token was not revoked on logout")
+	}
+}
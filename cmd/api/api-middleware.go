@@ -1,6 +1,33 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type contextKey string
+
+const (
+	contextClaimsKey contextKey = "claims"
+	contextAuthKey   contextKey = "auth"
+)
+
+// verification is the outcome of checking the token a request was made with.
+type verification struct {
+	claims *Claims
+	err    error
+}
+
+// claimsFromContext returns the claims of the verified token, put in the context by authRequired.
+func (app *application) claimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextClaimsKey).(*Claims)
+	return claims, ok
+}
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -16,14 +43,216 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// identify checks the token a request was made with, if it has one, and keeps the outcome in the
+// context, so that the rate limiter and authRequired share one check: an api key is only looked
+// up once. It lets every request through; authRequired refuses the ones that need a token.
+func (app *application) identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, claims, err := app.getTokenFromHeaderAndVerify(w, r)
+		ctx := context.WithValue(r.Context(), contextAuthKey, verification{claims: claims, err: err})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// verify returns the claims of the token r was made with, as identify found them, or checks the
+// token now if identify did not run.
+func (app *application) verify(w http.ResponseWriter, r *http.Request) (*Claims, error) {
+	if v, ok := r.Context().Value(contextAuthKey).(verification); ok {
+		return v.claims, v.err
+	}
+
+	_, claims, err := app.getTokenFromHeaderAndVerify(w, r)
+	return claims, err
+}
+
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _, err := app.getTokenFromHeaderAndVerify(w, r)
+		claims, err := app.verify(w, r)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			app.errorJSON(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		// make the claims available to the handlers, so they can authorize the request
+		ctx := context.WithValue(r.Context(), contextClaimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// accessTokenRequired refuses requests made with an api key. Whatever its scopes, a key cannot
+// manage the account it belongs to: its credentials, second factor and keys take an access token,
+// which only the password gives. It must be used after authRequired.
+func (app *application) accessTokenRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := app.claimsFromContext(r.Context())
+		if !ok {
+			app.errorJSON(w, r, errUnauthorized)
+			return
+		}
+
+		if claims.APIKeyID != 0 {
+			app.errorJSON(w, r, errAPIKeyNotAllowed)
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requirePermission only lets through requests made with a token that grants permission. It
+// must be used after authRequired.
+func (app *application) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := app.claimsFromContext(r.Context())
+			if !ok {
+				app.errorJSON(w, r, errUnauthorized)
+				return
+			}
+
+			if !claims.HasPermission(permission) {
+				app.errorJSON(w, r, errForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireVerifiedEmail only lets through requests made with a token that allows more than managing
+// the caller's own account, under the email verification policy. It must be used after
+// authRequired.
+func (app *application) requireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := app.claimsFromContext(r.Context())
+		if !ok {
+			app.errorJSON(w, r, errUnauthorized)
+			return
+		}
+
+		if !app.EmailVerification.AllowsFullAccess(claims.EmailVerified) {
+			app.errorJSON(w, r, errEmailUnverified)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// activeOrg returns the id of the organization the caller's token acts in, or errNoOrganization if
+// it acts in none.
+func (app *application) activeOrg(r *http.Request) (int, error) {
+	claims, ok := app.claimsFromContext(r.Context())
+	if !ok {
+		return 0, errUnauthorized
+	}
+	if claims.Org == 0 {
+		return 0, errNoOrganization
+	}
+	return claims.Org, nil
+}
+
+// selfOrPermitted reports whether the caller may act on the user with the given id: everybody
+// may act on themselves, and callers granted permission on the members of the organization their
+// token acts in. An api key may only read its own user; anything more takes its scopes. Users
+// outside that organization are reported as repository.ErrNotFound, so that callers cannot tell
+// them from users that do not exist. Only reading is allowed on members that also belong to
+// another organization, so that one organization cannot change what the others see.
+func (app *application) selfOrPermitted(r *http.Request, userID int, permission string) (bool, error) {
+	claims, ok := app.claimsFromContext(r.Context())
+	if !ok {
+		return false, nil
+	}
+
+	if callerID, err := claims.UserID(); err == nil && callerID == userID {
+		if claims.APIKeyID == 0 || permission == data.PermissionReadUsers {
+			return true, nil
+		}
+	}
+
+	if claims.Org == 0 || !claims.HasPermission(permission) {
+		return false, nil
+	}
+
+	memberships, err := app.DB.UserMemberships(r.Context(), userID)
+	if err != nil {
+		return false, err
+	}
+
+	member, elsewhere := false, false
+	for _, m := range memberships {
+		if m.OrganizationID == claims.Org {
+			member = true
+		} else {
+			elsewhere = true
+		}
+	}
+	if !member {
+		return false, repository.ErrNotFound
+	}
+	return !elsewhere || permission == data.PermissionReadUsers, nil
+}
+
+// credentialsPermitted reports whether the caller may change the credentials of the user with the
+// given id, or close their account: their email address, password, second factor and api keys.
+// Roles in an organization never cover these, as anybody can make one and invite people to it,
+// so callers other than the user need the permission outside of any organization. Api keys never
+// cover them either. It does not check membership; callers ask selfOrPermitted first.
+func (app *application) credentialsPermitted(r *http.Request, userID int, permission string) (bool, error) {
+	claims, ok := app.claimsFromContext(r.Context())
+	if !ok || claims.APIKeyID != 0 {
+		return false, nil
+	}
+
+	callerID, err := claims.UserID()
+	if err != nil {
+		return false, nil
+	}
+	if callerID == userID {
+		return true, nil
+	}
+	if !claims.HasPermission(permission) {
+		return false, nil
+	}
+
+	permissions, err := app.DB.UserPermissions(r.Context(), callerID, 0)
+	if err != nil {
+		return false, err
+	}
+
+	return contains(permissions, permission), nil
+}
+
+// permittedUser loads the user named in the URL, if the caller is them or has permission. If not,
+// it writes the error and returns false.
+func (app *application) permittedUser(w http.ResponseWriter, r *http.Request, permission string) (*data.User, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, r, errInvalidUserID)
+		return nil, false
+	}
+
+	permitted, err := app.selfOrPermitted(r, userID, permission)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	if !permitted {
+		app.errorJSON(w, r, errForbidden)
+		return nil, false
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
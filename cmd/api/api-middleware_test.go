@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -48,7 +49,7 @@ func Test_app_authRequired(t *testing.T) {
 		Email:     "admin@example.com",
 	}
 
-	tokens, _ := app.generateTokenPair(&testUser)
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser, 0)
 
 	var tests = []struct {
 		name             string
@@ -79,3 +80,69 @@ func Test_app_authRequired(t *testing.T) {
 		}
 	}
 }
+
+func Test_app_requirePermission(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var tests = []struct {
+		name           string
+		claims         *Claims
+		permission     string
+		expectedStatus int
+	}{
+		{"admin", adminClaims, data.PermissionWriteUsers, http.StatusOK},
+		{"granted", readerClaims, data.PermissionReadUsers, http.StatusOK},
+		{"not granted", readerClaims, data.PermissionWriteUsers, http.StatusForbidden},
+		{"no permissions", userClaims, data.PermissionReadUsers, http.StatusForbidden},
+		{"no claims", nil, data.PermissionReadUsers, http.StatusUnauthorized},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if e.claims != nil {
+			req = addClaimsToRequest(req, e.claims)
+		}
+		rr := httptest.NewRecorder()
+		handlerToTest := app.requirePermission(e.permission)(nextHandler)
+		handlerToTest.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func Test_app_authRequiredSetsClaims(t *testing.T) {
+	testUser := data.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+		Roles:     []string{data.RoleAdmin},
+	}
+
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser, 0)
+
+	var claims *Claims
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ = app.claimsFromContext(r.Context())
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tokens.Token))
+	rr := httptest.NewRecorder()
+	app.authRequired(nextHandler).ServeHTTP(rr, req)
+
+	if claims == nil {
+		t.Fatal("claims not found in request context")
+	}
+
+	if claims.Subject != "1" || !claims.HasRole(data.RoleAdmin) || !claims.HasPermission(data.PermissionManageRoles) {
+		t.Errorf("unexpected claims in context: %+v", claims)
+	}
+
+	// without an organization asked for, the token is for the oldest one the user belongs to
+	if claims.Org != 1 {
+		t.Errorf("expected a token for organization 1, but got %d", claims.Org)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/http"
+	"web-app/pkg/data"
+	"web-app/pkg/mail"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -13,6 +15,10 @@ func (app *application) routes() http.Handler {
 	// register middleware
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.enableCORS)
+	mux.Use(app.identify)
+	mux.Use(app.Limiter.Handler)
+
+	mux.Get("/.well-known/jwks.json", app.jwks)
 
 	mux.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("./html/"))))
 
@@ -24,18 +30,86 @@ func (app *application) routes() http.Handler {
 
 	// authentication routes
 	mux.Post("/auth", app.authenticate)
+	mux.Post("/auth/register", app.register)
+	mux.Post("/auth/forgot-password", app.forgotPassword)
+	mux.Post("/auth/reset-password", app.resetPassword)
+	mux.Post("/auth/verify-email", app.verifyEmail)
+	mux.Post("/auth/verify-email/resend", app.resendEmailVerification)
+	mux.Post("/auth/mfa", app.authenticateMFA)
 	mux.Post("/refresh-token", app.refresh)
+	mux.Post("/logout", app.deleteRefreshToken)
 
 	// protected routes
 	mux.Route("/users", func(mux chi.Router) {
 		// use auth middleware
 		mux.Use(app.authRequired)
-		mux.Get("/", app.allUsers)
-		mux.Post("/", app.insertUser)
-		mux.Get("/{userID}", app.getUser)
-		mux.Delete("/{userID}", app.deleteUser)
-		mux.Put("/{userID}", app.updateUser)
+		// listing and creating users needs permission to act on anyone
+		mux.With(app.requireVerifiedEmail, app.requirePermission(data.PermissionReadUsers)).Get("/", app.allUsers)
+		mux.With(app.requireVerifiedEmail, app.requirePermission(data.PermissionWriteUsers)).Post("/", app.insertUser)
+		// the current user, identified by the sub claim of their token; users whose email address
+		// is not verified can still manage their own account
+		mux.Get("/me", app.getCurrentUser)
+		mux.Get("/me/mfa", app.mfaStatus)
+		// api keys, for scripts to call the api with
+		mux.Get("/me/api-keys", app.myAPIKeys)
+		// changing the account takes an access token, not an api key
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.accessTokenRequired)
+			mux.Put("/me", app.updateCurrentUser)
+			mux.Put("/me/password", app.changePassword)
+			// two-factor authentication; turning it off or making new recovery codes takes a code
+			mux.Post("/me/mfa", app.enrollMFA)
+			mux.Post("/me/mfa/confirm", app.confirmMFA)
+			mux.Post("/me/mfa/recovery-codes", app.regenerateRecoveryCodes)
+			mux.Delete("/me/mfa", app.disableMFA)
+			mux.Post("/me/api-keys", app.createAPIKey)
+			mux.Delete("/me/api-keys/{keyID}", app.revokeMyAPIKey)
+		})
+		// the remaining handlers let users act on themselves, and those with permission on anyone
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requireVerifiedEmail)
+			mux.Get("/{userID}", app.getUser)
+			mux.Delete("/{userID}", app.deleteUser)
+			mux.Put("/{userID}", app.updateUser)
+			mux.Delete("/{userID}/mfa", app.resetMFA)
+			// failed logins; unlocking takes someone else with permission to write users
+			mux.Get("/{userID}/lockout", app.lockoutStatus)
+			mux.Delete("/{userID}/lockout", app.unlockUser)
+			mux.Get("/{userID}/api-keys", app.userAPIKeys)
+			mux.Delete("/{userID}/api-keys/{keyID}", app.revokeUserAPIKey)
+		})
+	})
+
+	mux.Route("/orgs", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+		mux.Use(app.requireVerifiedEmail)
+		// the caller's own organizations, and getting a token for one of them
+		mux.Get("/", app.myOrganizations)
+		mux.Post("/", app.createOrganization)
+		mux.Post("/{orgID}/token", app.switchOrganization)
+		// invitations to join organizations, which only the invited user can answer
+		mux.Get("/invitations", app.myInvitations)
+		mux.Post("/invitations/{orgID}", app.acceptInvitation)
+		mux.Delete("/invitations/{orgID}", app.declineInvitation)
+		// the members of the organization the caller's token is for; new members are invited
+		mux.With(app.requirePermission(data.PermissionManageMembers)).Post("/{orgID}/members", app.addMember)
+		mux.Get("/{orgID}/members/{userID}", app.getMember)
+		mux.Delete("/{orgID}/members/{userID}", app.removeMember)
+		// giving roles in the organization and taking them away
+		mux.With(app.requirePermission(data.PermissionManageRoles)).Put("/{orgID}/members/{userID}/roles/{role}", app.assignMemberRole)
+		mux.With(app.requirePermission(data.PermissionManageRoles)).Delete("/{orgID}/members/{userID}/roles/{role}", app.revokeMemberRole)
 	})
 
+	mux.Route("/roles", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+		mux.Use(app.requireVerifiedEmail)
+		mux.With(app.requirePermission(data.PermissionManageRoles)).Get("/", app.allRoles)
+	})
+
+	// the mail sent in development, for reading in a browser on this machine when asked for
+	if app.Mail.Mode == mail.ModeDev && app.Mail.Viewer {
+		mux.Mount("/dev/mail", mail.LocalOnly(http.StripPrefix("/dev/mail", mail.Viewer(app.Mail.Dir))))
+	}
+
 	return mux
 }
@@ -13,13 +13,50 @@ func Test_app_routes(t *testing.T) {
 		route  string
 		method string
 	}{
+		{"/.well-known/jwks.json", "GET"},
 		{"/auth", "POST"},
+		{"/auth/register", "POST"},
+		{"/auth/forgot-password", "POST"},
+		{"/auth/reset-password", "POST"},
+		{"/auth/verify-email", "POST"},
+		{"/auth/verify-email/resend", "POST"},
+		{"/auth/mfa", "POST"},
 		{"/refresh-token", "POST"},
+		{"/logout", "POST"},
+		{"/web/logout", "GET"},
 		{"/users/", "GET"},
 		{"/users/", "POST"},
+		{"/users/me", "GET"},
+		{"/users/me", "PUT"},
+		{"/users/me/password", "PUT"},
+		{"/users/me/mfa", "GET"},
+		{"/users/me/mfa", "POST"},
+		{"/users/me/mfa/confirm", "POST"},
+		{"/users/me/mfa/recovery-codes", "POST"},
+		{"/users/me/mfa", "DELETE"},
+		{"/users/me/api-keys", "GET"},
+		{"/users/me/api-keys", "POST"},
+		{"/users/me/api-keys/{keyID}", "DELETE"},
 		{"/users/{userID}", "GET"},
 		{"/users/{userID}", "DELETE"},
 		{"/users/{userID}", "PUT"},
+		{"/users/{userID}/mfa", "DELETE"},
+		{"/users/{userID}/lockout", "GET"},
+		{"/users/{userID}/lockout", "DELETE"},
+		{"/users/{userID}/api-keys", "GET"},
+		{"/users/{userID}/api-keys/{keyID}", "DELETE"},
+		{"/orgs/", "GET"},
+		{"/orgs/", "POST"},
+		{"/orgs/{orgID}/token", "POST"},
+		{"/orgs/invitations", "GET"},
+		{"/orgs/invitations/{orgID}", "POST"},
+		{"/orgs/invitations/{orgID}", "DELETE"},
+		{"/orgs/{orgID}/members", "POST"},
+		{"/orgs/{orgID}/members/{userID}", "GET"},
+		{"/orgs/{orgID}/members/{userID}", "DELETE"},
+		{"/orgs/{orgID}/members/{userID}/roles/{role}", "PUT"},
+		{"/orgs/{orgID}/members/{userID}/roles/{role}", "DELETE"},
+		{"/roles/", "GET"},
 	}
 	mux := app.routes()
 	chiRoutes := mux.(chi.Routes)
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"web-app/pkg/apikey"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/validation"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// How long api keys work for, in days.
+const (
+	defaultAPIKeyDays = 90
+	maxAPIKeyDays     = 365
+)
+
+var (
+	errInvalidAPIKey   = newAPIError(codeInvalidToken, "unknown, revoked or expired api key")
+	errInvalidAPIKeyID = newAPIError(codeInvalidParameter, "api key id must be an integer")
+)
+
+// NewAPIKey is the payload for making an api key.
+type NewAPIKey struct {
+	Name string `json:"name"`
+	// Scopes are the permissions the key may use; the caller must have each of them
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is how long the key works for; zero means defaultAPIKeyDays
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// CreatedAPIKey is the response to making an api key. Key is never shown again.
+type CreatedAPIKey struct {
+	Key    string       `json:"key"`
+	APIKey *data.APIKey `json:"api_key"`
+}
+
+// apiKeyClaims returns the claims for a request made with an api key. The key acts in the
+// organization it was made in, with the permissions in its scopes that its user has now.
+func (app *application) apiKeyClaims(ctx context.Context, key string) (*Claims, error) {
+	k, err := apikey.Authenticate(ctx, app.DB, key)
+	if errors.Is(err, apikey.ErrInvalid) {
+		return nil, errInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	user, err := app.DB.GetUser(ctx, k.UserID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, errInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the user may have changed their email address since they made the key
+	if !app.EmailVerification.AllowsLogin(user.EmailVerified()) {
+		return nil, errEmailUnverified
+	}
+
+	roles := user.Roles
+	if k.OrganizationID != 0 {
+		membership, err := app.membership(ctx, user.ID, k.OrganizationID)
+		if errors.Is(err, errNotMember) {
+			return nil, newAPIError(codeInvalidToken, "the api key is for an organization you no longer belong to")
+		} else if err != nil {
+			return nil, err
+		}
+		roles = mergeNames(roles, membership.Roles)
+	}
+
+	permissions, err := app.DB.UserPermissions(ctx, user.ID, k.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	var granted []string
+	for _, p := range permissions {
+		if contains(k.Scopes, p) {
+			granted = append(granted, p)
+		}
+	}
+
+	return &Claims{
+		UserName:      fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		Org:           k.OrganizationID,
+		Roles:         roles,
+		Permissions:   granted,
+		EmailVerified: user.EmailVerified(),
+		APIKeyID:      k.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.ID),
+			Issuer:    app.Domain,
+			ExpiresAt: jwt.NewNumericDate(k.ExpiresAt),
+		},
+	}, nil
+}
+
+// myAPIKeys lists the caller's api keys, newest first.
+func (app *application) myAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	app.writeAPIKeys(w, r, userID)
+}
+
+// userAPIKeys lists a user's api keys, newest first. Users can see their own; seeing anyone
+// else's needs permission to read users.
+func (app *application) userAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.permittedUser(w, r, data.PermissionReadUsers)
+	if !ok {
+		return
+	}
+
+	app.writeAPIKeys(w, r, user.ID)
+}
+
+func (app *application) writeAPIKeys(w http.ResponseWriter, r *http.Request, userID int) {
+	keys, err := app.DB.UserAPIKeys(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []*data.APIKey{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, keys)
+}
+
+// createAPIKey makes an api key for the caller, in the organization their token acts in, and
+// shows it to them, once. Keys can only be made with permissions the caller has, and only with
+// an access token, not with another key; the route makes sure of that.
+func (app *application) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, ok := app.claimsFromContext(r.Context())
+	if !ok {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	var payload NewAPIKey
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	days := payload.ExpiresInDays
+	if days == 0 {
+		days = defaultAPIKeyDays
+	}
+	k := data.APIKey{
+		UserID:         userID,
+		OrganizationID: claims.Org,
+		Name:           strings.TrimSpace(payload.Name),
+		Scopes:         mergeNames(payload.Scopes, nil),
+		ExpiresAt:      time.Now().AddDate(0, 0, days),
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+
+	errs := validation.APIKey(k)
+	if days < 1 || days > maxAPIKeyDays {
+		errs.Add("expires_in_days", fmt.Sprintf("must be between 1 and %d", maxAPIKeyDays))
+	}
+	for _, scope := range k.Scopes {
+		if scope != "" && !claims.HasPermission(scope) {
+			errs.Add("scopes", fmt.Sprintf("you do not have the %s permission", scope))
+		}
+	}
+	if !errs.Valid() {
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	key, stored, err := apikey.Issue(r.Context(), app.DB, k)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, CreatedAPIKey{Key: key, APIKey: stored})
+}
+
+// revokeMyAPIKey revokes one of the caller's api keys.
+func (app *application) revokeMyAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	app.revokeAPIKey(w, r, userID)
+}
+
+// revokeUserAPIKey revokes one of a user's api keys. Users can revoke their own; revoking anyone
+// else's needs permission to write users outside of any organization.
+func (app *application) revokeUserAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.permittedUser(w, r, data.PermissionWriteUsers)
+	if !ok {
+		return
+	}
+
+	permitted, err := app.credentialsPermitted(r, user.ID, data.PermissionWriteUsers)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !permitted {
+		app.errorJSON(w, r, errOthersCredentials)
+		return
+	}
+
+	app.revokeAPIKey(w, r, user.ID)
+}
+
+func (app *application) revokeAPIKey(w http.ResponseWriter, r *http.Request, userID int) {
+	keyID, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if err != nil {
+		app.errorJSON(w, r, errInvalidAPIKeyID)
+		return
+	}
+
+	err = app.DB.RevokeAPIKey(r.Context(), userID, keyID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/apikey"
+	"web-app/pkg/data"
+)
+
+// issueAPIKey makes an api key for a user in the Example organization, and returns it.
+func issueAPIKey(t *testing.T, userID int, scopes []string, expires time.Time) (string, *data.APIKey) {
+	t.Helper()
+	key, stored, err := apikey.Issue(context.Background(), app.DB, data.APIKey{UserID: userID, OrganizationID: 1, Name: "test", Scopes: scopes, ExpiresAt: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, stored
+}
+
+func Test_app_createAPIKey(t *testing.T) {
+	resetDB()
+
+	var tests = []struct {
+		name           string
+		claims         *Claims
+		body           string
+		expectedStatus int
+		expectedDays   int
+	}{
+		{"valid", adminClaims, `{"name":"deploys","scopes":["users:read","users:read"],"expires_in_days":30}`, http.StatusCreated, 30},
+		{"no scopes, default expiry", userClaims, `{"name":"backups"}`, http.StatusCreated, defaultAPIKeyDays},
+		{"blank name", adminClaims, `{"name":" "}`, http.StatusUnprocessableEntity, 0},
+		{"scope the caller lacks", userClaims, `{"name":"ci","scopes":["users:read"]}`, http.StatusUnprocessableEntity, 0},
+		{"unknown scope", adminClaims, `{"name":"ci","scopes":["everything"]}`, http.StatusUnprocessableEntity, 0},
+		{"too long", adminClaims, `{"name":"ci","expires_in_days":366}`, http.StatusUnprocessableEntity, 0},
+		{"negative expiry", adminClaims, `{"name":"ci","expires_in_days":-1}`, http.StatusUnprocessableEntity, 0},
+		{"bad json", adminClaims, `{"name":`, http.StatusBadRequest, 0},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/users/me/api-keys", strings.NewReader(e.body))
+		req = addClaimsToRequest(req, e.claims)
+		rr := httptest.NewRecorder()
+		app.createAPIKey(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d: %s", e.name, e.expectedStatus, rr.Code, rr.Body)
+			continue
+		}
+		if rr.Code != http.StatusCreated {
+			continue
+		}
+
+		var created CreatedAPIKey
+		_ = json.NewDecoder(rr.Body).Decode(&created)
+		k := created.APIKey
+		if !apikey.IsKey(created.Key) || k == nil || !strings.HasPrefix(created.Key, k.Prefix) || k.OrganizationID != 1 {
+			t.Errorf("%s: unexpected key %q: %+v", e.name, created.Key, k)
+			continue
+		}
+		if expected := time.Now().AddDate(0, 0, e.expectedDays); k.ExpiresAt.Sub(expected).Abs() > time.Minute {
+			t.Errorf("%s: expected the key to expire at %v, but got %v", e.name, expected, k.ExpiresAt)
+		}
+		if strings.Contains(rr.Body.String(), apikey.Hash(created.Key)) {
+			t.Errorf("%s: expected the hash of the key not to be shown", e.name)
+		}
+
+		// the key works straight away
+		stored, err := apikey.Lookup(context.Background(), app.DB, created.Key, time.Now())
+		if err != nil || stored.ID != k.ID {
+			t.Errorf("%s: expected the key to work, but got %v", e.name, err)
+		}
+	}
+}
+
+func Test_app_apiKeyAuth(t *testing.T) {
+	resetDB()
+	mux := app.routes()
+
+	reader, _ := issueAPIKey(t, 1, []string{data.PermissionReadUsers}, time.Now().Add(time.Hour))
+	// jack has no permission to read users, so his key cannot use it either
+	jack, _ := issueAPIKey(t, 2, []string{data.PermissionReadUsers}, time.Now().Add(time.Hour))
+	expired, _ := issueAPIKey(t, 1, []string{data.PermissionReadUsers}, time.Now().Add(-time.Second))
+	revoked, revokedKey := issueAPIKey(t, 1, []string{data.PermissionReadUsers}, time.Now().Add(time.Hour))
+	_ = app.DB.RevokeAPIKey(context.Background(), 1, revokedKey.ID)
+
+	var tests = []struct {
+		name           string
+		method         string
+		url            string
+		key            string
+		expectedStatus int
+	}{
+		{"list users", "GET", "/users/", reader, http.StatusOK},
+		{"create a user without the scope", "POST", "/users/", reader, http.StatusForbidden},
+		{"themselves", "GET", "/users/me", reader, http.StatusOK},
+		{"scope the user lacks", "GET", "/users/", jack, http.StatusForbidden},
+		{"another key", "POST", "/users/me/api-keys", reader, http.StatusForbidden},
+		{"expired", "GET", "/users/me", expired, http.StatusUnauthorized},
+		{"revoked", "GET", "/users/me", revoked, http.StatusUnauthorized},
+		{"unknown", "GET", "/users/me", apikey.Prefix + "000000000000_nope", http.StatusUnauthorized},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(`{"name":"ci"}`))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+e.key)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d: %s", e.name, e.expectedStatus, rr.Code, rr.Body)
+		}
+	}
+
+	used, _ := app.DB.GetAPIKey(context.Background(), apikey.Hash(reader))
+	if used.LastUsedAt == nil {
+		t.Error("expected the key's last use to be recorded")
+	}
+
+	// a key stops working once its user leaves its organization
+	_ = app.DB.RemoveMember(context.Background(), 1, 2)
+	_, _, err := app.verifyAuthHeader(context.Background(), "Bearer "+jack)
+	if err == nil || !strings.Contains(err.Error(), "no longer belong") {
+		t.Errorf("expected the key of a former member to be refused, but got %v", err)
+	}
+}
+
+// A key only ever gets the permissions it is scoped to: a key with no scopes cannot manage the
+// account it belongs to, even though its user could with an access token.
+func Test_app_apiKeyCannotManageAccount(t *testing.T) {
+	resetDB()
+	mux := app.routes()
+
+	key, stored := issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+	issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+
+	var tests = []struct {
+		name   string
+		method string
+		url    string
+		body   string
+	}{
+		{"delete self", "DELETE", "/users/2", ""},
+		{"update self", "PUT", "/users/2", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`},
+		{"update me", "PUT", "/users/me", `{"first_name":"Jack","last_name":"Smith","email":"jack-new@example.com"}`},
+		{"change password", "PUT", "/users/me/password", `{"current_password":"secret","new_password":"new-secret-password"}`},
+		{"enroll in mfa", "POST", "/users/me/mfa", ""},
+		{"turn off mfa", "DELETE", "/users/me/mfa", `{"code":"123456"}`},
+		{"new recovery codes", "POST", "/users/me/mfa/recovery-codes", `{"code":"123456"}`},
+		{"make a key", "POST", "/users/me/api-keys", `{"name":"ci"}`},
+		{"revoke a key", "DELETE", fmt.Sprintf("/users/me/api-keys/%d", stored.ID), ""},
+		{"revoke a key by user id", "DELETE", fmt.Sprintf("/users/2/api-keys/%d", stored.ID), ""},
+		{"unlock self", "DELETE", "/users/2/lockout", ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d: %s", e.name, http.StatusForbidden, rr.Code, rr.Body)
+		}
+	}
+
+	user, _ := app.DB.GetUser(context.Background(), 2)
+	if user == nil || user.Email != "jack@example.com" {
+		t.Errorf("expected the user to be unchanged, but got %+v", user)
+	}
+	if keys, _ := app.DB.UserAPIKeys(context.Background(), 2); len(keys) != 2 || keys[0].RevokedAt != nil || keys[1].RevokedAt != nil {
+		t.Errorf("expected both keys to be left alone, but got %+v", keys)
+	}
+
+	// reading itself is still fine
+	for _, url := range []string{"/users/me", "/users/2", "/users/me/mfa", "/users/me/api-keys"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("GET %s: expected %d, but got %d: %s", url, http.StatusOK, rr.Code, rr.Body)
+		}
+	}
+}
+
+func Test_app_userAPIKeys(t *testing.T) {
+	resetDB()
+	issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+
+	var tests = []struct {
+		name           string
+		userID         string
+		claims         *Claims
+		expectedStatus int
+		expectedKeys   int
+	}{
+		{"admin sees a member's", "2", adminClaims, http.StatusOK, 1},
+		{"user sees their own", "2", userClaims, http.StatusOK, 1},
+		{"admin sees their own", "1", adminClaims, http.StatusOK, 0},
+		{"user sees the admin's", "1", userClaims, http.StatusForbidden, 0},
+		{"admin of another organization", "2", tenantAdminClaims, http.StatusNotFound, 0},
+		{"bad id", "two", adminClaims, http.StatusBadRequest, 0},
+	}
+
+	for _, e := range tests {
+		rr := serveRequest(app.userAPIKeys, "GET", "", e.claims, "userID", e.userID)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		var keys []*data.APIKey
+		_ = json.NewDecoder(rr.Body).Decode(&keys)
+		if keys == nil || len(keys) != e.expectedKeys {
+			t.Errorf("%s: expected %d keys, but got %v", e.name, e.expectedKeys, keys)
+		}
+	}
+}
+
+func Test_app_revokeAPIKey(t *testing.T) {
+	resetDB()
+	_, jackKey := issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+	_, adminKey := issueAPIKey(t, 1, nil, time.Now().Add(time.Hour))
+	jackKeyID := strconv.Itoa(jackKey.ID)
+
+	var tests = []struct {
+		name           string
+		handler        http.HandlerFunc
+		userID         string
+		keyID          string
+		claims         *Claims
+		expectedStatus int
+	}{
+		{"user revokes the admin's", app.revokeUserAPIKey, "1", strconv.Itoa(adminKey.ID), userClaims, http.StatusForbidden},
+		{"another user's key in the url", app.revokeUserAPIKey, "1", jackKeyID, adminClaims, http.StatusNotFound},
+		{"bad key id", app.revokeMyAPIKey, "", "one", userClaims, http.StatusBadRequest},
+		{"admin revokes a member's", app.revokeUserAPIKey, "2", jackKeyID, adminClaims, http.StatusNoContent},
+		{"revoked already", app.revokeMyAPIKey, "", jackKeyID, userClaims, http.StatusNotFound},
+		{"admin revokes their own", app.revokeMyAPIKey, "", strconv.Itoa(adminKey.ID), adminClaims, http.StatusNoContent},
+	}
+
+	for _, e := range tests {
+		rr := serveRequest(e.handler, "DELETE", "", e.claims, "userID", e.userID, "keyID", e.keyID)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	keys, _ := app.DB.UserAPIKeys(context.Background(), 2)
+	if len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Errorf("expected jack's key to be revoked, but got %+v", keys)
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"web-app/pkg/apikey"
 	"web-app/pkg/data"
+	"web-app/pkg/repository"
 
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -14,6 +22,14 @@ import (
 var jwtTokenExpiry = time.Minute * 15
 var refreshTokenExpiry = time.Hour * 24
 
+var (
+	errNotMember            = newAPIError(codeForbidden, "you are not a member of that organization")
+	errRefreshTokenNotFound = newAPIError(codeInvalidToken, "unknown refresh token")
+	errRefreshTokenExpired  = newAPIError(codeInvalidToken, "refresh token has expired")
+	errRefreshTokenReused   = newAPIError(codeInvalidToken, "refresh token has already been used")
+	errEmailUnverified      = newAPIError(codeEmailUnverified, "verify your email address first; POST /auth/verify-email/resend for a new link")
+)
+
 type TokenPairs struct {
 	Token        string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -21,96 +37,193 @@ type TokenPairs struct {
 
 type Claims struct {
 	UserName string `json:"name"`
+	// Org is the id of the organization the token acts in, or zero if the user belongs to none
+	Org int `json:"org,omitempty"`
+	// Roles and Permissions are those of the user when the token was issued, both outside of
+	// any organization and in Org
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// EmailVerified is whether the user had verified their email address when the token was issued
+	EmailVerified bool `json:"email_verified,omitempty"`
+	// SessionID is the family of the refresh token issued with the token, so that the login it
+	// came from can be told apart from the user's others
+	SessionID string `json:"sid,omitempty"`
+	// APIKeyID is the id of the api key the request was made with, or zero for an access token;
+	// it is never part of a token
+	APIKeyID int `json:"-"`
 	jwt.RegisteredClaims
 }
 
+// UserID returns the id of the user the token was issued to.
+func (c *Claims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+// HasRole reports whether the user the token was issued to has the named role.
+func (c *Claims) HasRole(role string) bool {
+	return contains(c.Roles, role)
+}
+
+// HasPermission reports whether the token grants the named permission.
+func (c *Claims) HasPermission(permission string) bool {
+	return contains(c.Permissions, permission)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (app *application) getTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Request) (string, *Claims, error) {
 	// add a header
 	w.Header().Add("Vary", "Authorization")
 
 	// get the auth header
-	authHeader := r.Header.Get("Authorization")
+	return app.verifyAuthHeader(r.Context(), r.Header.Get("Authorization"))
+}
 
+// verifyAuthHeader checks the token in an Authorization header, as getTokenFromHeaderAndVerify
+// does, for callers with no response to write to. The token may be an access token or an api key.
+func (app *application) verifyAuthHeader(ctx context.Context, authHeader string) (string, *Claims, error) {
 	// sanity check
 	if authHeader == "" {
-		return "", nil, errors.New("no auth header")
+		return "", nil, newAPIError(codeUnauthorized, "no auth header")
 	}
 
 	// split the header on spaces
 	headerParts := strings.Split(authHeader, " ")
 	if len(headerParts) != 2 {
-		return "", nil, errors.New("invalid auth header")
+		return "", nil, newAPIError(codeUnauthorized, "invalid auth header")
 	}
 
 	// check to see if Bearer exists in auth
 	if headerParts[0] != "Bearer" {
-		return "", nil, errors.New("unauthorized: no Bearer")
+		return "", nil, newAPIError(codeUnauthorized, "unauthorized: no Bearer")
 	}
 
 	token := headerParts[1]
 
+	// api keys are looked up, rather than parsed
+	if apikey.IsKey(token) {
+		claims, err := app.apiKeyClaims(ctx, token)
+		if err != nil {
+			return "", nil, err
+		}
+		return token, claims, nil
+	}
+
 	// declare an empty Claims variable
 	claims := &Claims{}
 
 	// parse the token with the claims
-	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		// validate signing algorithm
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(app.JWTSecret), nil
-	})
+	// the key set picks the key from the token's kid header, and validates the signing algorithm
+	_, err := jwt.ParseWithClaims(token, claims, app.Keys.keyFunc)
 	// check for an error; note that this catches expired tokens as well
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "token is expired by") {
-			return "", nil, errors.New("expired token")
+			return "", nil, newAPIError(codeInvalidToken, "expired token")
 		}
-		return "", nil, err
+		return "", nil, newAPIError(codeInvalidToken, "invalid token")
 	}
 
 	// make sure that we issued this token
 	if claims.Issuer != app.Domain {
-		return "", nil, errors.New("incorrect issuer")
+		return "", nil, newAPIError(codeInvalidToken, "incorrect issuer")
 	}
 
 	// valid token
 	return token, claims, nil
 }
 
-func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
-	// create the jwt token
-	token := jwt.New(jwt.SigningMethodHS256)
+// generateTokenPair issues a token pair for a fresh login, starting a new refresh token family.
+// The tokens act in the organization with orgID, or, if it is zero, in the oldest organization
+// the user belongs to.
+func (app *application) generateTokenPair(ctx context.Context, user *data.User, orgID int) (TokenPairs, error) {
+	familyID, err := randomString(16)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	return app.generateTokenPairInFamily(ctx, user, familyID, orgID)
+}
+
+// generateTokenPairInFamily issues a token pair and stores a hash of the refresh token,
+// tagged with familyID and the organization, so that it can be rotated and revoked later.
+func (app *application) generateTokenPairInFamily(ctx context.Context, user *data.User, familyID string, orgID int) (TokenPairs, error) {
+	membership, err := app.membership(ctx, user.ID, orgID)
+	if err != nil {
+		return TokenPairs{}, err
+	}
 
-	// set the claims
-	claims := token.Claims.(jwt.MapClaims)
+	// set the claims for the jwt token
+	claims := jwt.MapClaims{}
 	claims["name"] = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
 	claims["sub"] = fmt.Sprint(user.ID)
 	claims["aud"] = app.Domain
 	claims["iss"] = app.Domain
-	if user.IsAdmin == 1 {
-		claims["admin"] = true
-	} else {
-		claims["admin"] = false
+	claims["sid"] = familyID
+
+	// carry the user's organization, roles and permissions, so that requests can be authorized
+	// from the token alone
+	roles := user.Roles
+	if membership != nil {
+		orgID = membership.OrganizationID
+		claims["org"] = orgID
+		roles = mergeNames(roles, membership.Roles)
+	}
+	permissions, err := app.DB.UserPermissions(ctx, user.ID, orgID)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	if len(roles) > 0 {
+		claims["roles"] = roles
+	}
+	if len(permissions) > 0 {
+		claims["permissions"] = permissions
+	}
+	if user.EmailVerified() {
+		claims["email_verified"] = true
 	}
 
 	// set the expiry
 	claims["exp"] = time.Now().Add(jwtTokenExpiry).Unix()
 
-	// create the signed token
-	signedAccessToken, err := token.SignedString([]byte(app.JWTSecret))
+	// create the signed token, using the active signing key
+	signedAccessToken, err := app.Keys.sign(claims)
 	if err != nil {
 		return TokenPairs{}, err
 	}
 
 	// create the refresh token
-	refreshToken := jwt.New(jwt.SigningMethodHS256)
-	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
+	refreshTokenClaims := jwt.MapClaims{}
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID)
+	// give every refresh token a unique id, so no two tokens ever hash to the same value
+	jti, err := randomString(16)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	refreshTokenClaims["jti"] = jti
 	// set the expiry; must be longer than jwt expiry
-	refreshTokenClaims["exp"] = time.Now().Add(refreshTokenExpiry).Unix()
+	refreshExpiry := time.Now().Add(refreshTokenExpiry)
+	refreshTokenClaims["exp"] = refreshExpiry.Unix()
 
 	// create signed refresh token
-	signedRefreshToken, err := refreshToken.SignedString([]byte(app.JWTSecret))
+	signedRefreshToken, err := app.Keys.sign(refreshTokenClaims)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	// persist a hash of the refresh token; the token itself is never stored
+	_, err = app.DB.InsertRefreshToken(ctx, data.RefreshToken{
+		UserID:         user.ID,
+		OrganizationID: orgID,
+		TokenHash:      hashToken(signedRefreshToken),
+		FamilyID:       familyID,
+		ExpiresAt:      refreshExpiry,
+	})
 	if err != nil {
 		return TokenPairs{}, err
 	}
@@ -122,3 +235,110 @@ func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
 
 	return TokenPairs, nil
 }
+
+// rotateRefreshToken exchanges a refresh token for a new token pair. The presented token is
+// marked as used, and the new refresh token joins the same family. If a token that has
+// already been used is presented again, it has most likely been stolen, so the whole family
+// is revoked and both the thief and the legitimate user have to log in again.
+func (app *application) rotateRefreshToken(ctx context.Context, refreshToken string) (TokenPairs, error) {
+	stored, err := app.DB.GetRefreshToken(ctx, hashToken(refreshToken))
+	if errors.Is(err, repository.ErrNotFound) {
+		return TokenPairs{}, errRefreshTokenNotFound
+	} else if err != nil {
+		return TokenPairs{}, err
+	}
+
+	if stored.Expired() {
+		return TokenPairs{}, errRefreshTokenExpired
+	}
+
+	// mark the token as used; if it was already used, revoke the family
+	active, err := app.DB.RevokeRefreshToken(ctx, stored.ID)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	if !active {
+		// the thief may hang up straight away; revoke the family regardless
+		_ = app.DB.RevokeRefreshTokenFamily(context.Background(), stored.FamilyID)
+		return TokenPairs{}, errRefreshTokenReused
+	}
+
+	user, err := app.DB.GetUser(ctx, stored.UserID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return TokenPairs{}, newAPIError(codeInvalidToken, "unknown user")
+	} else if err != nil {
+		return TokenPairs{}, err
+	}
+
+	// the user may have changed their email address since they logged in
+	if !app.EmailVerification.AllowsLogin(user.EmailVerified()) {
+		return TokenPairs{}, errEmailUnverified
+	}
+
+	// stay in the same organization, unless the user has left it since
+	tokenPairs, err := app.generateTokenPairInFamily(ctx, user, stored.FamilyID, stored.OrganizationID)
+	if errors.Is(err, errNotMember) {
+		return app.generateTokenPairInFamily(ctx, user, stored.FamilyID, 0)
+	}
+	return tokenPairs, err
+}
+
+// membership returns the membership of a user in the organization with orgID, or errNotMember if
+// they do not belong to it. If orgID is zero, it returns the membership of the oldest organization
+// the user belongs to, or nil if they belong to none.
+func (app *application) membership(ctx context.Context, userID, orgID int) (*data.Membership, error) {
+	if orgID != 0 {
+		membership, err := app.DB.GetMembership(ctx, orgID, userID)
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, errNotMember
+		}
+		return membership, err
+	}
+
+	memberships, err := app.DB.UserMemberships(ctx, userID)
+	if err != nil || len(memberships) == 0 {
+		return nil, err
+	}
+	return memberships[0], nil
+}
+
+// mergeNames returns the names in a and b, sorted, without duplicates.
+func mergeNames(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var names []string
+	for _, name := range append(append([]string{}, a...), b...) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// revokeRefreshToken revokes the family of the given refresh token, if we know about it.
+func (app *application) revokeRefreshToken(ctx context.Context, refreshToken string) error {
+	stored, err := app.DB.GetRefreshToken(ctx, hashToken(refreshToken))
+	if errors.Is(err, repository.ErrNotFound) {
+		// nothing to revoke
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return app.DB.RevokeRefreshTokenFamily(ctx, stored.FamilyID)
+}
+
+// hashToken returns the hex encoded sha256 hash of a token, which is what we store in the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, hex encoded.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -16,7 +17,7 @@ func Test_app_getTokenFromHeaderAndVerify(t *testing.T) {
 		Email:     "admin@example.com",
 	}
 
-	tokens, _ := app.generateTokenPair(&testUser)
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser, 0)
 
 	var tests = []struct {
 		name          string
@@ -37,7 +38,7 @@ func Test_app_getTokenFromHeaderAndVerify(t *testing.T) {
 	for _, e := range tests {
 		if e.issuer != app.Domain {
 			app.Domain = e.issuer
-			tokens, _ = app.generateTokenPair(&testUser)
+			tokens, _ = app.generateTokenPair(context.Background(), &testUser, 0)
 		}
 		req, _ := http.NewRequest("GET", "/", nil)
 		if e.setHeader {
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// retiredKeyDir is the subdirectory of the key directory that retired keys are moved to.
+const retiredKeyDir = "retired"
+
+// signingKey is a single key in the key set. Asymmetric keys carry a private key; the
+// legacy HMAC key carries a shared secret and has no id.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Secret  []byte
+	// Retired keys only verify tokens, until RetireAt if it is set
+	Retired  bool
+	RetireAt time.Time
+}
+
+// verifyKey returns the key jwt needs to check a signature made with k.
+func (k *signingKey) verifyKey() any {
+	if k.Private == nil {
+		return k.Secret
+	}
+	return k.Private.Public()
+}
+
+// keySet holds every key we accept tokens from. Exactly one key is active and used to sign
+// new tokens; the others are only used to verify tokens they signed earlier.
+//
+// To rotate keys without logging anybody out, move the old key into the retired
+// subdirectory of the key directory: keys there verify tokens, across restarts, until they
+// are deleted, which is safe once refreshTokenExpiry has passed. A key that is deleted
+// outright is only remembered by a running api, until refreshTokenExpiry has passed; after
+// a restart, tokens it signed are no longer accepted.
+type keySet struct {
+	mu     sync.RWMutex
+	keys   map[string]*signingKey
+	active string
+}
+
+// newKeySet returns a key set. If dir is empty, tokens are signed with HS256 using secret, as
+// before; otherwise every PEM private key in dir and its retired subdirectory is loaded, and
+// the one in dir named activeKID (or the last one in lexical order, if activeKID is empty) is
+// used for signing.
+func newKeySet(secret, dir, activeKID string) (*keySet, error) {
+	ks := &keySet{keys: make(map[string]*signingKey)}
+
+	if dir == "" {
+		ks.keys[""] = &signingKey{Method: jwt.SigningMethodHS256, Secret: []byte(secret)}
+		return ks, nil
+	}
+
+	err := ks.load(dir, activeKID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// load (re)reads the key directory. Keys that are no longer present are retired rather than
+// dropped.
+func (ks *keySet) load(dir, activeKID string) error {
+	loaded, err := readKeyDir(dir)
+	if err != nil {
+		return err
+	}
+	retired, err := readKeyFiles(filepath.Join(dir, retiredKeyDir))
+	if err != nil {
+		return err
+	}
+	for kid, k := range retired {
+		if _, ok := loaded[kid]; ok {
+			return fmt.Errorf("signing key %q is both in %s and retired", kid, dir)
+		}
+		k.Retired = true
+		loaded[kid] = k
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	for kid, k := range ks.keys {
+		if _, ok := loaded[kid]; ok || k.Private == nil {
+			continue
+		}
+		if k.RetireAt.IsZero() {
+			k.Retired = true
+			k.RetireAt = now.Add(refreshTokenExpiry)
+		}
+		if now.Before(k.RetireAt) {
+			loaded[kid] = k
+		}
+	}
+
+	if activeKID == "" {
+		for kid, k := range loaded {
+			if !k.Retired && kid > activeKID {
+				activeKID = kid
+			}
+		}
+	}
+
+	k, ok := loaded[activeKID]
+	if !ok || k.Retired {
+		return fmt.Errorf("no signing key with id %q in %s", activeKID, dir)
+	}
+
+	ks.keys = loaded
+	ks.active = activeKID
+
+	return nil
+}
+
+// activeKey returns the key new tokens are signed with.
+func (ks *keySet) activeKey() *signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[ks.active]
+}
+
+// lookup returns the key with the given id, unless it has been retired for good.
+func (ks *keySet) lookup(kid string) (*signingKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	k, ok := ks.keys[kid]
+	if !ok || (!k.RetireAt.IsZero() && time.Now().After(k.RetireAt)) {
+		return nil, false
+	}
+	return k, true
+}
+
+// sign signs claims with the active key, setting the kid header so verifiers can find the key.
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	k := ks.activeKey()
+
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+
+	if k.Private == nil {
+		return token.SignedString(k.Secret)
+	}
+	return token.SignedString(k.Private)
+}
+
+// keyFunc is passed to the jwt parser. It picks the key named by the token's kid header, and
+// makes sure the token was signed with that key's algorithm.
+func (ks *keySet) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k, ok := ks.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %q", kid)
+	}
+
+	// validate signing algorithm
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return k.verifyKey(), nil
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517).
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwks returns the public half of every asymmetric key, active and retiring. HMAC secrets
+// are never published.
+func (ks *keySet) jwks() jwkSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := jwkSet{Keys: []jwk{}}
+	for _, k := range ks.keys {
+		if k.Private == nil {
+			continue
+		}
+		if !k.RetireAt.IsZero() && time.Now().After(k.RetireAt) {
+			continue
+		}
+
+		key := jwk{KeyID: k.ID, Use: "sig", Algorithm: k.Method.Alg()}
+		switch pub := k.Private.Public().(type) {
+		case *rsa.PublicKey:
+			key.KeyType = "RSA"
+			key.N = b64(pub.N.Bytes())
+			key.E = b64(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			key.KeyType = "EC"
+			key.Curve = pub.Curve.Params().Name
+			key.X = b64(pub.X.FillBytes(make([]byte, size)))
+			key.Y = b64(pub.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			key.KeyType = "OKP"
+			key.Curve = "Ed25519"
+			key.X = b64(pub)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+
+	return set
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// readKeyDir loads every *.pem file in dir, of which there must be at least one.
+func readKeyDir(dir string) (map[string]*signingKey, error) {
+	keys, err := readKeyFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found in %s", dir)
+	}
+
+	return keys, nil
+}
+
+// readKeyFiles loads every *.pem file in dir, if there are any. The key id is the file name
+// without its extension.
+func readKeyFiles(dir string) (map[string]*signingKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*signingKey)
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+		pemBytes, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := parseSigningKey(kid, pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		keys[kid] = k
+	}
+
+	return keys, nil
+}
+
+// parseSigningKey parses a PEM encoded private key and works out which algorithm it signs with.
+func parseSigningKey(kid string, pemBytes []byte) (*signingKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var priv any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &signingKey{ID: kid}
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		k.Method = jwt.SigningMethodRS256
+		k.Private = key
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			k.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			k.Method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported elliptic curve")
+		}
+		k.Private = key
+	case ed25519.PrivateKey:
+		k.Method = jwt.SigningMethodEdDSA
+		k.Private = key
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+
+	return k, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func writeTestKey(t *testing.T, dir, kid string, key crypto.Signer) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	err = os.WriteFile(filepath.Join(dir, kid+".pem"), pemBytes, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_keySet_signAndVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	var tests = []struct {
+		name        string
+		key         crypto.Signer
+		expectedAlg string
+		expectedKty string
+	}{
+		{"rsa", rsaKey, "RS256", "RSA"},
+		{"ecdsa", ecKey, "ES256", "EC"},
+		{"ed25519", edKey, "EdDSA", "OKP"},
+	}
+
+	for _, e := range tests {
+		dir := t.TempDir()
+		writeTestKey(t, dir, e.name, e.key)
+
+		ks, err := newKeySet("", dir, "")
+		if err != nil {
+			t.Fatalf("%s: could not load key set: %s", e.name, err)
+		}
+
+		signed, err := ks.sign(jwt.MapClaims{"sub": "1"})
+		if err != nil {
+			t.Fatalf("%s: could not sign token: %s", e.name, err)
+		}
+
+		token, err := jwt.Parse(signed, ks.keyFunc)
+		if err != nil {
+			t.Errorf("%s: could not verify token: %s", e.name, err)
+			continue
+		}
+
+		if token.Header["kid"] != e.name {
+			t.Errorf("%s: expected kid %s, but got %v", e.name, e.name, token.Header["kid"])
+		}
+
+		if token.Method.Alg() != e.expectedAlg {
+			t.Errorf("%s: expected alg %s, but got %s", e.name, e.expectedAlg, token.Method.Alg())
+		}
+
+		set := ks.jwks()
+		if len(set.Keys) != 1 || set.Keys[0].KeyType != e.expectedKty {
+			t.Errorf("%s: unexpected jwks %+v", e.name, set)
+		}
+	}
+}
+
+func Test_keySet_rejectsWrongKey(t *testing.T) {
+	ks, _ := newKeySet("verysecret", "", "")
+
+	// a token signed with an asymmetric key we don't know about
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "1"})
+	token.Header["kid"] = "unknown"
+	signed, _ := token.SignedString(ecKey)
+
+	_, err := jwt.Parse(signed, ks.keyFunc)
+	if err == nil {
+		t.Error("expected token with unknown kid to be rejected")
+	}
+
+	// a token claiming a different algorithm than the key it names
+	token = jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{"sub": "1"})
+	signed, _ = token.SignedString([]byte("verysecret"))
+
+	_, err = jwt.Parse(signed, ks.keyFunc)
+	if err == nil {
+		t.Error("expected token with wrong algorithm to be rejected")
+	}
+
+	if len(ks.jwks().Keys) != 0 {
+		t.Error("hmac secret must never be published")
+	}
+}
+
+func Test_keySet_rotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writeTestKey(t, dir, "2023-01", oldKey)
+
+	ks, err := newKeySet("", dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedWithOld, _ := ks.sign(jwt.MapClaims{"sub": "1"})
+
+	// add a newer key, which becomes the active one
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeTestKey(t, dir, "2023-02", newKey)
+
+	err = ks.load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ks.activeKey().ID != "2023-02" {
+		t.Errorf("expected newest key to be active, but got %s", ks.activeKey().ID)
+	}
+
+	if _, err := jwt.Parse(signedWithOld, ks.keyFunc); err != nil {
+		t.Errorf("token signed with previous key no longer verifies: %s", err)
+	}
+
+	// remove the old key entirely; it should keep verifying until its tokens expire
+	_ = os.Remove(filepath.Join(dir, "2023-01.pem"))
+
+	err = ks.load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Parse(signedWithOld, ks.keyFunc); err != nil {
+		t.Errorf("token signed with retiring key no longer verifies: %s", err)
+	}
+
+	if len(ks.jwks().Keys) != 2 {
+		t.Errorf("expected retiring key to still be published, but got %d keys", len(ks.jwks().Keys))
+	}
+
+	// once the retirement period is over the key is gone
+	ks.keys["2023-01"].RetireAt = time.Now().Add(-time.Second)
+
+	if _, err := jwt.Parse(signedWithOld, ks.keyFunc); err == nil {
+		t.Error("token signed with retired key still verifies")
+	}
+
+	// asking for a key that does not exist is an error
+	if err := ks.load(dir, "nope"); err == nil {
+		t.Error("expected an error when the active key does not exist")
+	}
+}
+
+func Test_keySet_retiredDir(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writeTestKey(t, dir, "2023-01", oldKey)
+
+	ks, err := newKeySet("", dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedWithOld, _ := ks.sign(jwt.MapClaims{"sub": "1"})
+
+	// rotate by adding a new key and moving the old one to retired, then restart
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeTestKey(t, dir, "2023-02", newKey)
+	retired := filepath.Join(dir, retiredKeyDir)
+	_ = os.Mkdir(retired, 0700)
+	err = os.Rename(filepath.Join(dir, "2023-01.pem"), filepath.Join(retired, "2023-01.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err = newKeySet("", dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.activeKey().ID != "2023-02" {
+		t.Errorf("expected the key that is not retired to be active, but got %s", ks.activeKey().ID)
+	}
+	if _, err := jwt.Parse(signedWithOld, ks.keyFunc); err != nil {
+		t.Errorf("token signed with a retired key no longer verifies after a restart: %s", err)
+	}
+	if len(ks.jwks().Keys) != 2 {
+		t.Errorf("expected the retired key to still be published, but got %d keys", len(ks.jwks().Keys))
+	}
+
+	// a retired key cannot sign, and a key cannot be both in use and retired
+	if _, err := newKeySet("", dir, "2023-01"); err == nil {
+		t.Error("expected an error when the active key is retired")
+	}
+	writeTestKey(t, dir, "2023-01", oldKey)
+	if _, err := newKeySet("", dir, ""); err == nil {
+		t.Error("expected an error when a key is both in use and retired")
+	}
+}
+
+func Test_app_jwks(t *testing.T) {
+	dir := t.TempDir()
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writeTestKey(t, dir, "test", ecKey)
+
+	oldKeys := app.Keys
+	app.Keys, _ = newKeySet("", dir, "")
+	defer func() { app.Keys = oldKeys }()
+
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.jwks)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status: expected %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	var set jwkSet
+	err := json.NewDecoder(rr.Body).Decode(&set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys) != 1 || set.Keys[0].KeyID != "test" || set.Keys[0].Curve != "P-256" {
+		t.Errorf("unexpected jwks returned: %+v", set)
+	}
+}
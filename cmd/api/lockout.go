@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/lockout"
+	"web-app/pkg/repository"
+)
+
+// lockoutEventLimit is how many of an account's locks and unlocks lockout status shows.
+const lockoutEventLimit = 20
+
+// LockoutStatus says whether a user's account is locked out of logging in, with its most recent
+// locks and unlocks.
+type LockoutStatus struct {
+	Locked      bool                 `json:"locked"`
+	LockedUntil *time.Time           `json:"locked_until,omitempty"`
+	Failures    int                  `json:"failures"`
+	Events      []*data.LockoutEvent `json:"events"`
+}
+
+// loginFailed counts a failed login for email, and answers it: with invalid credentials, or, if
+// it was one too many, with how long to wait. The answer is the same for an address nobody has.
+func (app *application) loginFailed(w http.ResponseWriter, r *http.Request, email string) {
+	wait, err := app.Lockout.Fail(r.Context(), app.DB, email, app.TrustedProxies.ClientIP(r))
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		app.tooManyAttempts(w, r, wait)
+		return
+	}
+
+	app.errorJSON(w, r, errInvalidCredentials)
+}
+
+// tooManyAttempts answers a login that is refused until wait has passed.
+func (app *application) tooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	app.errorJSON(w, r, newAPIErrorf(codeTooManyAttempts, "too many failed logins; try again in %d seconds", seconds))
+}
+
+// mfaLockedOut answers a code from userID with how long to wait, if they have given too many
+// wrong ones lately, and reports whether it did.
+func (app *application) mfaLockedOut(w http.ResponseWriter, r *http.Request, userID int) bool {
+	wait, err := app.Lockout.CheckMFA(r.Context(), app.DB, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return true
+	}
+	if wait > 0 {
+		app.tooManyCodes(w, r, wait)
+		return true
+	}
+	return false
+}
+
+// mfaFailed counts a wrong code from userID, and answers it with wrong, or, if it was one too
+// many, with how long to wait.
+func (app *application) mfaFailed(w http.ResponseWriter, r *http.Request, userID int, wrong http.HandlerFunc) {
+	wait, err := app.Lockout.FailMFA(r.Context(), app.DB, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		app.tooManyCodes(w, r, wait)
+		return
+	}
+
+	wrong(w, r)
+}
+
+// tooManyCodes answers a code that is refused until wait has passed.
+func (app *application) tooManyCodes(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	app.errorJSON(w, r, newAPIErrorf(codeTooManyAttempts, "too many wrong two-factor codes; try again in %d seconds", seconds))
+}
+
+// lockoutStatus says whether a user's account is locked out of logging in. Users can see their
+// own; seeing anyone else's needs permission to read users.
+func (app *application) lockoutStatus(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.permittedUser(w, r, data.PermissionReadUsers)
+	if !ok {
+		return
+	}
+
+	key := lockout.AccountKey(user.Email)
+	var status LockoutStatus
+	throttle, err := app.DB.GetLoginThrottle(r.Context(), data.ThrottleAccount, key)
+	if err == nil {
+		status.Locked = throttle.Locked(time.Now())
+		if status.Locked {
+			status.LockedUntil = throttle.LockedUntil
+		}
+		status.Failures = throttle.Failures
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	status.Events, err = app.DB.LockoutEvents(r.Context(), data.ThrottleAccount, key, lockoutEventLimit)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if status.Events == nil {
+		status.Events = []*data.LockoutEvent{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, status)
+}
+
+// unlockUser lets a locked out user log in again straight away, and records who let them. Users
+// cannot unlock themselves.
+func (app *application) unlockUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.permittedUser(w, r, data.PermissionWriteUsers)
+	if !ok {
+		return
+	}
+
+	callerID, _ := app.currentUserID(r)
+	if callerID == user.ID {
+		app.errorJSON(w, r, newAPIError(codeForbidden, "ask an administrator to unlock your account"))
+		return
+	}
+
+	err := app.Lockout.Unlock(r.Context(), app.DB, user.Email, callerID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
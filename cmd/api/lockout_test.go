@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/lockout"
+)
+
+// login posts credentials to authenticate from remoteAddr.
+func login(email, password, remoteAddr string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+	req.RemoteAddr = remoteAddr
+	rr := httptest.NewRecorder()
+	app.authenticate(rr, req)
+	return rr
+}
+
+func Test_app_authenticateLockout(t *testing.T) {
+	resetDB()
+	override(t, &app.Lockout, lockout.Guard{AccountThreshold: 3, IPThreshold: 8, Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+
+	var tests = []struct {
+		name           string
+		email          string
+		password       string
+		remoteAddr     string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"first failure", "jack@example.com", "wrong", "192.0.2.1:1234", http.StatusUnauthorized, codeInvalidCredentials},
+		{"right password clears failures", "jack@example.com", "secret", "192.0.2.1:1234", http.StatusOK, ""},
+		{"failure 1", "jack@example.com", "wrong", "192.0.2.1:1234", http.StatusUnauthorized, codeInvalidCredentials},
+		{"failure 2", "JACK@example.com", "wrong", "192.0.2.2:1234", http.StatusUnauthorized, codeInvalidCredentials},
+		{"failure 3 locks", "jack@example.com", "wrong", "192.0.2.1:1234", http.StatusTooManyRequests, codeTooManyAttempts},
+		{"right password while locked", "jack@example.com", "secret", "192.0.2.3:1234", http.StatusTooManyRequests, codeTooManyAttempts},
+		{"unknown account", "nobody@example.com", "wrong", "192.0.2.1:1234", http.StatusUnauthorized, codeInvalidCredentials},
+		{"unknown account again", "nobody@example.com", "wrong", "192.0.2.1:1234", http.StatusUnauthorized, codeInvalidCredentials},
+		{"unknown account locks", "nobody@example.com", "wrong", "192.0.2.1:1234", http.StatusTooManyRequests, codeTooManyAttempts},
+		{"another account", "admin@example.com", "wrong", "192.0.2.1:1234", http.StatusUnauthorized, codeInvalidCredentials},
+		{"address locks", "other@example.com", "wrong", "192.0.2.1:1234", http.StatusTooManyRequests, codeTooManyAttempts},
+		{"any account from the address", "admin@example.com", "secret", "192.0.2.1:1234", http.StatusTooManyRequests, codeTooManyAttempts},
+		{"another address", "admin@example.com", "secret", "192.0.2.4:1234", http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		rr := login(e.email, e.password, e.remoteAddr)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if e.expectedCode != "" && !strings.Contains(rr.Body.String(), e.expectedCode) {
+			t.Errorf("%s: expected the %s code, but got %s", e.name, e.expectedCode, rr.Body)
+		}
+		if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected a Retry-After header", e.name)
+		}
+	}
+}
+
+func Test_app_lockoutStatus(t *testing.T) {
+	resetDB()
+	override(t, &app.Lockout, lockout.Guard{AccountThreshold: 2, Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+	for i := 0; i < 2; i++ {
+		login("jack@example.com", "wrong", "192.0.2.1:1234")
+	}
+
+	var tests = []struct {
+		name           string
+		userID         string
+		claims         *Claims
+		expectedStatus int
+		locked         bool
+	}{
+		{"admin sees a member", "2", adminClaims, http.StatusOK, true},
+		{"user sees themselves", "2", userClaims, http.StatusOK, true},
+		{"admin sees themselves", "1", adminClaims, http.StatusOK, false},
+		{"user sees the admin", "1", userClaims, http.StatusForbidden, false},
+		{"admin of another organization", "2", tenantAdminClaims, http.StatusNotFound, false},
+		{"bad id", "two", adminClaims, http.StatusBadRequest, false},
+	}
+
+	for _, e := range tests {
+		rr := serveRequest(app.lockoutStatus, "GET", "", e.claims, "userID", e.userID)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		var status LockoutStatus
+		_ = json.NewDecoder(rr.Body).Decode(&status)
+		if status.Locked != e.locked || (e.locked && (status.LockedUntil == nil || status.Failures != 2 || len(status.Events) != 1)) {
+			t.Errorf("%s: expected locked to be %t, but got %+v", e.name, e.locked, status)
+		}
+	}
+}
+
+func Test_app_unlockUser(t *testing.T) {
+	var tests = []struct {
+		name           string
+		userID         string
+		claims         *Claims
+		expectedStatus int
+		stillLocked    bool
+	}{
+		{"admin unlocks a member", "2", adminClaims, http.StatusNoContent, false},
+		{"user unlocks themselves", "2", userClaims, http.StatusForbidden, true},
+		{"admin of another organization", "2", tenantAdminClaims, http.StatusNotFound, true},
+		{"unknown user", "100", adminClaims, http.StatusNotFound, true},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		override(t, &app.Lockout, lockout.Guard{AccountThreshold: 2, Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+		for i := 0; i < 2; i++ {
+			login("jack@example.com", "wrong", "192.0.2.1:1234")
+		}
+
+		rr := serveRequest(app.unlockUser, "DELETE", "", e.claims, "userID", e.userID)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if locked := login("jack@example.com", "secret", "192.0.2.1:1234").Code == http.StatusTooManyRequests; locked != e.stillLocked {
+			t.Errorf("%s: expected the account to be locked to be %t", e.name, e.stillLocked)
+		}
+		if !e.stillLocked {
+			events, _ := app.DB.LockoutEvents(context.Background(), data.ThrottleAccount, "jack@example.com", 10)
+			if len(events) != 2 || events[0].Event != data.LockoutEventUnlocked || events[0].ActorID != 1 {
+				t.Errorf("%s: expected the unlock to be recorded, but got %+v", e.name, events)
+			}
+		}
+	}
+}
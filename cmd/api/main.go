@@ -1,37 +1,158 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"web-app/pkg/clientip"
+	"web-app/pkg/lockout"
+	"web-app/pkg/mail"
+	"web-app/pkg/mfa"
+	"web-app/pkg/ratelimit"
 	"web-app/pkg/repository"
 	"web-app/pkg/repository/dbrepo"
+	"web-app/pkg/validation"
 )
 
 const port = 8090
 
 type application struct {
-	DSN       string
-	DB        repository.DatabaseRepo
-	Domain    string
-	JWTSecret string
+	DSN         string
+	DBMode      string
+	Fixtures    string
+	DB          repository.DatabaseRepo
+	DBTimeout   time.Duration
+	Migrate     bool
+	Domain      string
+	JWTSecret   string
+	KeyDir      string
+	ActiveKeyID string
+	Keys        *keySet
+
+	PasswordPolicy    validation.PasswordPolicy
+	Signup            validation.SignupPolicy
+	EmailVerification validation.EmailVerification
+
+	// Lockout counts failed logins, and refuses logins for a while after too many
+	Lockout lockout.Guard
+	// MFA checks the codes of users who have turned on two-factor authentication
+	MFA *mfa.Authenticator
+	// TrustedProxies are the proxies in front of the app, whose X-Forwarded-For is believed
+	TrustedProxies clientip.Proxies
+	// Limiter refuses requests from clients that make too many
+	RateLimit ratelimit.Config
+	Limiter   *ratelimit.Limiter
+
+	Mail   mail.Config
+	Mailer *mail.Mailer
+	// SiteURL is where the web app is, for links in mail
+	SiteURL string
 }
 
 func main() {
 	app := application{}
 	flag.StringVar(&app.Domain, "domain", "example.com", "domain for application eg: company.com")
-	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "postgres connection")
-	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "signing secret")
+	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "database connection: a postgres dsn, or sqlite:<file> for a local database")
+	flag.StringVar(&app.DBMode, "db", "sql", "where data is kept: sql, in the database given by -dsn, or memory, for a throwaway store seeded from -fixtures")
+	flag.StringVar(&app.Fixtures, "fixtures", "./sql/fixtures.json", "json file the memory database is seeded from; empty for none")
+	flag.DurationVar(&app.DBTimeout, "db-timeout", dbrepo.DefaultTimeout, "how long a database query may run when the request sets no deadline")
+	flag.BoolVar(&app.Migrate, "migrate", false, "apply pending database migrations on startup")
+	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "signing secret, used when no key directory is given")
+	flag.StringVar(&app.KeyDir, "jwt-key-dir", "", "directory of PEM private keys (RSA, EC or Ed25519) used to sign tokens; file name is the key id. Keys in its retired subdirectory only verify tokens")
+	flag.StringVar(&app.ActiveKeyID, "jwt-active-kid", "", "id of the key to sign with; defaults to the last key id in lexical order")
+	flag.IntVar(&app.PasswordPolicy.MinLength, "password-min-length", validation.DefaultPasswordPolicy.MinLength, "minimum password length")
+	flag.BoolVar(&app.PasswordPolicy.RequireUpper, "password-require-upper", false, "require an upper case letter in passwords")
+	flag.BoolVar(&app.PasswordPolicy.RequireLower, "password-require-lower", false, "require a lower case letter in passwords")
+	flag.BoolVar(&app.PasswordPolicy.RequireDigit, "password-require-digit", false, "require a digit in passwords")
+	flag.BoolVar(&app.PasswordPolicy.RequireSymbol, "password-require-symbol", false, "require a symbol in passwords")
+	flag.BoolVar(&app.Signup.Open, "signup", false, "let anyone create an account with POST /auth/register")
+	flag.Func("signup-domains", "comma separated email domains signup is limited to; empty for any", func(s string) error {
+		app.Signup.AllowedDomains = validation.ParseDomains(s)
+		return nil
+	})
+	app.EmailVerification = validation.VerificationOptional
+	flag.Func("email-verification", "what users who have not verified their email address may do: optional (anything), restricted (only manage their own account) or required (not log in)", func(s string) error {
+		var err error
+		app.EmailVerification, err = validation.ParseEmailVerification(s)
+		return err
+	})
+	app.Lockout = lockout.Default
+	app.Lockout.Flags(flag.CommandLine)
+	var mfaKey, mfaIssuer string
+	flag.StringVar(&mfaKey, "mfa-key", "", "key two-factor secrets are encrypted with; the api and the web app must share it. Required unless -db=memory")
+	flag.StringVar(&mfaIssuer, "mfa-issuer", "web-app", "name authenticator apps list accounts under")
+	app.TrustedProxies.Flags(flag.CommandLine)
+	app.RateLimit.Flags(flag.CommandLine)
+	app.Mail.Flags(flag.CommandLine)
+	flag.StringVar(&app.SiteURL, "site-url", "http://localhost:8080", "address of the web app, for links in mail")
 	flag.Parse()
+	mfaKey, err := mfa.Key(mfaKey, app.DBMode == "memory")
+	if err != nil {
+		log.Fatalf("-mfa-key: %s", err)
+	}
+	app.MFA = mfa.New(mfaKey, mfaIssuer)
+
+	keys, err := newKeySet(app.JWTSecret, app.KeyDir, app.ActiveKeyID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Keys = keys
+
+	// reload signing keys on SIGHUP, so that keys can be rotated without a restart
+	go app.reloadKeysOnSignal()
+
+	switch app.DBMode {
+	case "memory":
+		app.DB, err = openMemoryDB(app.Fixtures, app.DBTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "sql":
+		conn, err := app.connectToDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		if app.Migrate {
+			err = applyMigrations(conn, dbrepo.Dialect(app.DSN))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		app.DB = dbrepo.New(conn, dbrepo.Dialect(app.DSN), app.DBTimeout)
+	default:
+		log.Fatalf("unknown -db %q; use sql or memory", app.DBMode)
+	}
 
-	conn, err := app.connectToDB()
+	// limit requests, forgetting clients that have stopped making them in the background
+	store, rules, err := app.RateLimit.Load(app.DB, defaultRateLimits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Limiter, err = app.newLimiter(store, rules)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
+	go app.Limiter.Run(context.Background())
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	// send queued mail in the background
+	app.Mailer = &mail.Mailer{Templates: "./templates/mail"}
+	sender, err := app.Mail.Sender()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sender != nil {
+		worker := &mail.Worker{DB: app.DB, Sender: sender}
+		go worker.Run(context.Background())
+	}
 
 	log.Printf("starting api on port %d\n", port)
 
@@ -40,3 +161,20 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func (app *application) reloadKeysOnSignal() {
+	if app.KeyDir == "" {
+		return
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		err := app.Keys.load(app.KeyDir, app.ActiveKeyID)
+		if err != nil {
+			log.Println("reloading signing keys:", err)
+			continue
+		}
+		log.Printf("reloaded signing keys; signing with %q\n", app.Keys.activeKey().ID)
+	}
+}
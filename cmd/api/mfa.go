@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"web-app/pkg/data"
+	"web-app/pkg/mfa"
+	"web-app/pkg/repository"
+	"web-app/pkg/usertoken"
+	"web-app/pkg/validation"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	errInvalidMFACode = newAPIError(codeInvalidMFACode, "the two-factor code is wrong or has been used; log in again")
+	errMFAChallenge   = newAPIError(codeInvalidToken, "the mfa token is invalid or has expired; log in again")
+)
+
+// MFAChallenge is the answer to a correct password from a user with an authenticator. They
+// finish logging in by posting the token, with a code, to /auth/mfa.
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// MFALogin is the payload for the second step of logging in.
+type MFALogin struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is the current code from the user's authenticator, or one of their recovery codes
+	Code string `json:"code"`
+	// Org is the id of the organization to log in to; zero picks the oldest one the user belongs to
+	Org int `json:"org"`
+}
+
+// MFACode is the payload for confirming an authenticator, and for the changes that need a code
+// from it.
+type MFACode struct {
+	Code string `json:"code"`
+}
+
+// MFAStatus says whether the caller has two-factor authentication on.
+type MFAStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// RecoveryCodes are shown once, when they are made; only their hashes are kept.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// challengeMFA answers a correct password from a user with an authenticator with a short lived,
+// single use token, instead of a token pair.
+func (app *application) challengeMFA(w http.ResponseWriter, r *http.Request, user *data.User) {
+	token, err := usertoken.Issue(r.Context(), app.DB, user.ID, data.TokenPurposeMFAChallenge, usertoken.MFAChallengeTTL)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, MFAChallenge{MFARequired: true, MFAToken: token})
+}
+
+// authenticateMFA finishes logging in a user who was challenged for a second factor. The mfa token
+// is used up whether the code is right or not, so every guess at a code costs a correct password,
+// and wrong codes count towards locking the user out of giving codes.
+func (app *application) authenticateMFA(w http.ResponseWriter, r *http.Request) {
+	var payload MFALogin
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := usertoken.Redeem(r.Context(), app.DB, data.TokenPurposeMFAChallenge, payload.MFAToken)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.errorJSON(w, r, errMFAChallenge)
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if app.mfaLockedOut(w, r, challenge.UserID) {
+		return
+	}
+	err = app.MFA.Verify(r.Context(), app.DB, challenge.UserID, payload.Code)
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		app.mfaFailed(w, r, challenge.UserID, func(w http.ResponseWriter, r *http.Request) {
+			app.errorJSON(w, r, errInvalidMFACode)
+		})
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	err = app.Lockout.SucceedMFA(r.Context(), app.DB, challenge.UserID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), challenge.UserID)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.errorJSON(w, r, errMFAChallenge)
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.completeLogin(w, r, user, payload.Org)
+}
+
+// mfaStatus says whether the caller has two-factor authentication on, and how many recovery codes
+// they have left.
+func (app *application) mfaStatus(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	var status MFAStatus
+	status.Enabled, err = app.MFA.Enabled(r.Context(), app.DB, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if status.Enabled {
+		status.RecoveryCodesLeft, err = app.DB.CountRecoveryCodes(r.Context(), userID)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, status)
+}
+
+// enrollMFA starts setting up an authenticator for the caller, and returns its secret, to be
+// added to an authenticator app. It is not used until confirmed at /users/me/mfa/confirm.
+func (app *application) enrollMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	enrolment, err := app.MFA.Enroll(r.Context(), app.DB, user)
+	if errors.Is(err, mfa.ErrAlreadyEnabled) {
+		app.errorJSON(w, r, newAPIError(codeConflict, "two-factor authentication is already on; turn it off first"))
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, enrolment)
+}
+
+// confirmMFA turns on the caller's authenticator, given a code from it, and returns their recovery
+// codes. This is the only time the codes are shown.
+func (app *application) confirmMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	var payload MFACode
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if app.mfaLockedOut(w, r, userID) {
+		return
+	}
+	codes, err := app.MFA.Confirm(r.Context(), app.DB, userID, payload.Code)
+	if err == nil {
+		err = app.Lockout.SucceedMFA(r.Context(), app.DB, userID)
+	}
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		app.mfaFailed(w, r, userID, app.invalidMFACode)
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		app.errorJSON(w, r, newAPIError(codeConflict, "start setting up two-factor authentication first"))
+	case errors.Is(err, mfa.ErrAlreadyEnabled):
+		app.errorJSON(w, r, newAPIError(codeConflict, "two-factor authentication is already on"))
+	case err != nil:
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+	default:
+		_ = app.writeJSON(w, http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+	}
+}
+
+// regenerateRecoveryCodes replaces the caller's recovery codes, given a code from their
+// authenticator or one of the codes being replaced.
+func (app *application) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := app.stepUpMFA(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := app.MFA.RegenerateRecoveryCodes(r.Context(), app.DB, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+}
+
+// disableMFA turns off the caller's two-factor authentication, given a code from their
+// authenticator or a recovery code. An enrolment that was never confirmed is dropped without one.
+func (app *application) disableMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	enabled, err := app.MFA.Enabled(r.Context(), app.DB, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		if _, ok := app.stepUpMFA(w, r); !ok {
+			return
+		}
+	}
+
+	err = app.DB.DeleteUserMFA(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetMFA turns off another user's two-factor authentication, for when they have lost both their
+// authenticator and their recovery codes. They can log in with their password alone until they
+// set it up again. It takes permission to write users outside of any organization.
+func (app *application) resetMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, r, errInvalidUserID)
+		return
+	}
+
+	if callerID, _ := app.currentUserID(r); callerID == userID {
+		app.errorJSON(w, r, newAPIError(codeForbidden, "turn off your own two-factor authentication at /users/me/mfa, with a code"))
+		return
+	}
+
+	permitted, err := app.selfOrPermitted(r, userID, data.PermissionWriteUsers)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !permitted {
+		app.errorJSON(w, r, errForbidden)
+		return
+	}
+
+	permitted, err = app.credentialsPermitted(r, userID, data.PermissionWriteUsers)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if !permitted {
+		app.errorJSON(w, r, errOthersCredentials)
+		return
+	}
+
+	// keys made while the account was in other hands are revoked with the second factor
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.DeleteUserMFA(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+		return repo.RevokeUserAPIKeys(r.Context(), userID)
+	})
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stepUpMFA checks the code in the request body against the caller's authenticator, for changes
+// that an access token alone is not enough for. Wrong codes count towards locking the caller out
+// of giving codes. If the code is not right, it writes the error and returns false.
+func (app *application) stepUpMFA(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return 0, false
+	}
+
+	var payload MFACode
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return 0, false
+	}
+
+	if app.mfaLockedOut(w, r, userID) {
+		return 0, false
+	}
+	err = app.MFA.Verify(r.Context(), app.DB, userID, payload.Code)
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		app.mfaFailed(w, r, userID, app.invalidMFACode)
+		return 0, false
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return 0, false
+	}
+	err = app.Lockout.SucceedMFA(r.Context(), app.DB, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// invalidMFACode reports a wrong code given by a logged in user, as a problem with the code field.
+func (app *application) invalidMFACode(w http.ResponseWriter, r *http.Request) {
+	errs := validation.Errors{}
+	errs.Add("code", "is wrong or has been used already")
+	app.validationErrorJSON(w, r, errs)
+}
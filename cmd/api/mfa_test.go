@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/mfa"
+	"web-app/pkg/mfa/mfatest"
+)
+
+func Test_app_mfaEnrolment(t *testing.T) {
+	resetDB()
+
+	var status MFAStatus
+	rr := serveRequest(app.mfaStatus, "GET", "", userClaims)
+	_ = json.NewDecoder(rr.Body).Decode(&status)
+	if rr.Code != http.StatusOK || status.Enabled {
+		t.Errorf("expected two-factor authentication to be off, but got %d %+v", rr.Code, status)
+	}
+
+	// starting again before confirming replaces the secret
+	var enrolment mfa.Enrolment
+	for i := 0; i < 2; i++ {
+		rr = serveRequest(app.enrollMFA, "POST", "", userClaims)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected enrolling to return %d, but got %d", http.StatusCreated, rr.Code)
+		}
+		_ = json.NewDecoder(rr.Body).Decode(&enrolment)
+	}
+	if enrolment.Secret == "" || !strings.HasPrefix(enrolment.URI, "otpauth://totp/") {
+		t.Fatalf("expected a secret and an otpauth URI, but got %+v", enrolment)
+	}
+
+	code := mfatest.Code(t, enrolment.Secret)
+	wrong := mfatest.WrongCode(t, enrolment.Secret)
+
+	var tests = []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+	}{
+		{"wrong code", `{"code":"` + wrong + `"}`, http.StatusUnprocessableEntity},
+		{"right code", `{"code":"` + code + `"}`, http.StatusOK},
+		{"already on", `{"code":"` + code + `"}`, http.StatusConflict},
+	}
+
+	for _, e := range tests {
+		rr := serveRequest(app.confirmMFA, "POST", e.requestBody, userClaims)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if rr.Code == http.StatusOK {
+			var codes RecoveryCodes
+			_ = json.NewDecoder(rr.Body).Decode(&codes)
+			if len(codes.RecoveryCodes) != mfa.RecoveryCodeCount {
+				t.Errorf("%s: expected %d recovery codes, but got %d", e.name, mfa.RecoveryCodeCount, len(codes.RecoveryCodes))
+			}
+		}
+	}
+
+	rr = serveRequest(app.mfaStatus, "GET", "", userClaims)
+	_ = json.NewDecoder(rr.Body).Decode(&status)
+	if !status.Enabled || status.RecoveryCodesLeft != mfa.RecoveryCodeCount {
+		t.Errorf("expected two-factor authentication to be on, with every recovery code left, but got %+v", status)
+	}
+
+	// the secret cannot be replaced without turning it off first
+	rr = serveRequest(app.enrollMFA, "POST", "", userClaims)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected enrolling again to return %d, but got %d", http.StatusConflict, rr.Code)
+	}
+
+	// a user who never started cannot confirm
+	rr = serveRequest(app.confirmMFA, "POST", `{"code":"123456"}`, adminClaims)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected confirming without enrolling to return %d, but got %d", http.StatusConflict, rr.Code)
+	}
+}
+
+func Test_app_authenticateMFA(t *testing.T) {
+	resetDB()
+	secret, recoveryCodes := mfatest.Enable(t, app.MFA, app.DB, 2)
+
+	// login returns a challenge, not tokens
+	login := func() MFAChallenge {
+		req, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"jack@example.com","password":"secret"}`))
+		rr := httptest.NewRecorder()
+		app.authenticate(rr, req)
+
+		var challenge MFAChallenge
+		_ = json.NewDecoder(rr.Body).Decode(&challenge)
+		if rr.Code != http.StatusOK || !challenge.MFARequired || challenge.MFAToken == "" {
+			t.Fatalf("expected an mfa challenge, but got %d %+v", rr.Code, challenge)
+		}
+		if len(rr.Result().Cookies()) != 0 {
+			t.Error("expected no refresh token cookie before the second step")
+		}
+		return challenge
+	}
+
+	// the code for the current step was used to confirm
+	nextCode := mfatest.NextCode(t, secret)
+
+	first := login()
+	var tests = []struct {
+		name           string
+		mfaToken       string
+		code           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"unknown token", "no-such-token", nextCode, http.StatusUnauthorized, codeInvalidToken},
+		{"wrong code", first.MFAToken, "12345", http.StatusUnauthorized, codeInvalidMFACode},
+		{"token used up", first.MFAToken, nextCode, http.StatusUnauthorized, codeInvalidToken},
+		{"totp code", login().MFAToken, nextCode, http.StatusOK, ""},
+		{"totp code reused", login().MFAToken, nextCode, http.StatusUnauthorized, codeInvalidMFACode},
+		{"recovery code", login().MFAToken, recoveryCodes[0], http.StatusOK, ""},
+		{"recovery code reused", login().MFAToken, recoveryCodes[0], http.StatusUnauthorized, codeInvalidMFACode},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/auth/mfa", strings.NewReader(`{"mfa_token":"`+e.mfaToken+`","code":"`+e.code+`"}`))
+		rr := httptest.NewRecorder()
+		app.authenticateMFA(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if e.expectedCode != "" && !strings.Contains(rr.Body.String(), e.expectedCode) {
+			t.Errorf("%s: expected the %s code, but got %s", e.name, e.expectedCode, rr.Body)
+		}
+		if rr.Code == http.StatusOK {
+			var pair TokenPairs
+			_ = json.NewDecoder(rr.Body).Decode(&pair)
+			if pair.Token == "" || pair.RefreshToken == "" {
+				t.Errorf("%s: expected a token pair, but got %+v", e.name, pair)
+			}
+		}
+	}
+}
+
+func Test_app_disableMFA(t *testing.T) {
+	resetDB()
+	_, recoveryCodes := mfatest.Enable(t, app.MFA, app.DB, 2)
+
+	var tests = []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		requestBody    string
+		expectedStatus int
+	}{
+		{"new recovery codes without a code", app.regenerateRecoveryCodes, "POST", `{"code":"wrong"}`, http.StatusUnprocessableEntity},
+		{"new recovery codes", app.regenerateRecoveryCodes, "POST", `{"code":"` + recoveryCodes[0] + `"}`, http.StatusOK},
+		{"turn off with a replaced code", app.disableMFA, "DELETE", `{"code":"` + recoveryCodes[1] + `"}`, http.StatusUnprocessableEntity},
+		{"turn off without a code", app.disableMFA, "DELETE", `{}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, e := range tests {
+		rr := serveRequest(e.handler, e.method, e.requestBody, userClaims)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if rr.Code == http.StatusOK {
+			var codes RecoveryCodes
+			_ = json.NewDecoder(rr.Body).Decode(&codes)
+			recoveryCodes = codes.RecoveryCodes
+		}
+	}
+
+	rr := serveRequest(app.disableMFA, "DELETE", `{"code":"`+recoveryCodes[0]+`"}`, userClaims)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected turning off with a new recovery code to return %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+	if enabled, _ := app.MFA.Enabled(context.Background(), app.DB, 2); enabled {
+		t.Error("expected two-factor authentication to be off")
+	}
+
+	// an unconfirmed enrolment is dropped without a code
+	user, _ := app.DB.GetUser(context.Background(), 2)
+	_, _ = app.MFA.Enroll(context.Background(), app.DB, user)
+	rr = serveRequest(app.disableMFA, "DELETE", "", userClaims)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected dropping an enrolment to return %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+}
+
+func Test_app_resetMFA(t *testing.T) {
+	var tests = []struct {
+		name           string
+		userID         string
+		claims         *Claims
+		expectedStatus int
+		stillEnabled   bool
+	}{
+		{"admin resets a member", "2", adminClaims, http.StatusNoContent, false},
+		{"user resets themselves", "2", userClaims, http.StatusForbidden, true},
+		{"user resets the admin", "1", userClaims, http.StatusForbidden, true},
+		{"admin of another organization", "2", tenantAdminClaims, http.StatusNotFound, true},
+		{"bad id", "two", adminClaims, http.StatusBadRequest, true},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		mfatest.Enable(t, app.MFA, app.DB, 1)
+		mfatest.Enable(t, app.MFA, app.DB, 2)
+		issueAPIKey(t, 1, nil, time.Now().Add(time.Hour))
+		issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+
+		rr := serveRequest(app.resetMFA, "DELETE", "", e.claims, "userID", e.userID)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		target := 2
+		if e.userID == "1" {
+			target = 1
+		}
+		if enabled, _ := app.MFA.Enabled(context.Background(), app.DB, target); enabled != e.stillEnabled {
+			t.Errorf("%s: expected two-factor authentication to be on to be %t", e.name, e.stillEnabled)
+		}
+		// the user's api keys go with their second factor
+		if keys, _ := app.DB.UserAPIKeys(context.Background(), target); len(keys) != 1 || (keys[0].RevokedAt == nil) != e.stillEnabled {
+			t.Errorf("%s: expected the api key to be revoked to be %t, but got %+v", e.name, !e.stillEnabled, keys)
+		}
+	}
+}
+
+func Test_app_mfaCodeLockout(t *testing.T) {
+	resetDB()
+	secret, recoveryCodes := mfatest.Enable(t, app.MFA, app.DB, 2)
+	wrong := `{"code":"` + mfatest.WrongCode(t, secret) + `"}`
+
+	// a right code forgets the wrong ones before it
+	for i := 1; i < app.Lockout.MFAThreshold; i++ {
+		_ = serveRequest(app.regenerateRecoveryCodes, "POST", wrong, userClaims)
+	}
+	rr := serveRequest(app.regenerateRecoveryCodes, "POST", `{"code":"`+recoveryCodes[0]+`"}`, userClaims)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected a right code to return %d, but got %d", http.StatusOK, rr.Code)
+	}
+	var codes RecoveryCodes
+	_ = json.NewDecoder(rr.Body).Decode(&codes)
+
+	// the last wrong code in a row locks the user out of giving codes, right ones included
+	for i := 1; i <= app.Lockout.MFAThreshold; i++ {
+		rr = serveRequest(app.regenerateRecoveryCodes, "POST", wrong, userClaims)
+		expected := http.StatusUnprocessableEntity
+		if i == app.Lockout.MFAThreshold {
+			expected = http.StatusTooManyRequests
+		}
+		if rr.Code != expected {
+			t.Errorf("wrong code %d: expected %d, but got %d", i, expected, rr.Code)
+		}
+	}
+
+	rr = serveRequest(app.disableMFA, "DELETE", `{"code":"`+codes.RecoveryCodes[0]+`"}`, userClaims)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a right code to be refused with a Retry-After, but got %d", rr.Code)
+	}
+	if enabled, _ := app.MFA.Enabled(context.Background(), app.DB, 2); !enabled {
+		t.Error("expected two-factor authentication to stay on")
+	}
+
+	// confirming an authenticator counts too
+	for i := 1; i <= app.Lockout.MFAThreshold; i++ {
+		var enrolment mfa.Enrolment
+		_ = json.NewDecoder(serveRequest(app.enrollMFA, "POST", "", adminClaims).Body).Decode(&enrolment)
+		rr = serveRequest(app.confirmMFA, "POST", `{"code":"`+mfatest.WrongCode(t, enrolment.Secret)+`"}`, adminClaims)
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected too many wrong confirmations to return %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/validation"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NewOrganization is the payload for creating an organization.
+type NewOrganization struct {
+	Name string `json:"name"`
+}
+
+// NewMember is the payload for inviting an existing user to an organization.
+type NewMember struct {
+	Email string `json:"email"`
+}
+
+var (
+	errInvalidOrgID = newAPIError(codeInvalidParameter, "organization id must be an integer")
+	errOtherOrg     = newAPIError(codeForbidden, "the access token is for another organization")
+)
+
+// orgFromURL returns the organization id in the url, which must be the one the caller's token
+// acts in: a token only ever works on one organization at a time.
+func (app *application) orgFromURL(r *http.Request) (int, error) {
+	orgID, err := strconv.Atoi(chi.URLParam(r, "orgID"))
+	if err != nil {
+		return 0, errInvalidOrgID
+	}
+
+	claims, ok := app.claimsFromContext(r.Context())
+	if !ok {
+		return 0, errUnauthorized
+	}
+	if claims.Org != orgID {
+		return 0, errOtherOrg
+	}
+
+	return orgID, nil
+}
+
+// myOrganizations lists the organizations the caller belongs to, with their roles in each.
+func (app *application) myOrganizations(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	memberships, err := app.DB.UserMemberships(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, memberships)
+}
+
+// createOrganization creates an organization, with the caller as its first admin. The caller
+// needs a new token, from switchOrganization, to act in it.
+func (app *application) createOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	var payload NewOrganization
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	org := data.Organization{Name: strings.TrimSpace(payload.Name)}
+
+	errs := validation.Organization(org)
+	if !errs.Valid() {
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	// the organization is never left without an admin, not even for a moment
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		org.ID, err = repo.InsertOrganization(r.Context(), org)
+		if err != nil {
+			return err
+		}
+		err = repo.AddMember(r.Context(), org.ID, userID)
+		if err != nil {
+			return err
+		}
+		return repo.AssignMemberRole(r.Context(), org.ID, userID, data.RoleAdmin)
+	})
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, org)
+}
+
+// switchOrganization issues the caller a new pair of tokens for another organization they belong
+// to. The tokens they already have keep working, for the organization they were issued for.
+func (app *application) switchOrganization(w http.ResponseWriter, r *http.Request) {
+	orgID, err := strconv.Atoi(chi.URLParam(r, "orgID"))
+	if err != nil {
+		app.errorJSON(w, r, errInvalidOrgID)
+		return
+	}
+
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	tokenPairs, err := app.generateTokenPair(r.Context(), user, orgID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
+}
+
+// addMember invites an existing user, found by email address, to the organization. They only
+// become a member once they accept, as the organization's admins can then act on them.
+func (app *application) addMember(w http.ResponseWriter, r *http.Request) {
+	orgID, err := app.orgFromURL(r)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	var payload NewMember
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), strings.TrimSpace(payload.Email))
+	if errors.Is(err, repository.ErrNotFound) {
+		app.errorJSON(w, r, newAPIError(codeNotFound, "there is no user with that email address"))
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.DB.GetMembership(r.Context(), orgID, user.ID)
+	if err == nil {
+		app.errorJSON(w, r, newAPIError(codeConflict, "the user is already a member of this organization"))
+		return
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	org, err := app.DB.GetOrganization(r.Context(), orgID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.InviteMember(r.Context(), orgID, user.ID)
+		if err != nil {
+			return err
+		}
+		return app.Mailer.Queue(r.Context(), repo, user.Email, "invitation", map[string]any{
+			"Name":         user.FirstName,
+			"Organization": org.Name,
+			"URL":          app.SiteURL,
+		})
+	})
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// myInvitations lists the organizations the caller has been invited to and not yet answered.
+func (app *application) myInvitations(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	invitations, err := app.DB.UserInvitations(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, invitations)
+}
+
+// acceptInvitation makes the caller a member of the organization they were invited to, with no
+// roles there. They need a new token, from switchOrganization, to act in it.
+func (app *application) acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	app.answerInvitation(w, r, true)
+}
+
+// declineInvitation turns down an invitation to an organization.
+func (app *application) declineInvitation(w http.ResponseWriter, r *http.Request) {
+	app.answerInvitation(w, r, false)
+}
+
+func (app *application) answerInvitation(w http.ResponseWriter, r *http.Request, accept bool) {
+	orgID, err := strconv.Atoi(chi.URLParam(r, "orgID"))
+	if err != nil {
+		app.errorJSON(w, r, errInvalidOrgID)
+		return
+	}
+
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, r, errUnauthorized)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.DeleteInvitation(r.Context(), orgID, userID)
+		if err != nil || !accept {
+			return err
+		}
+		return repo.AddMember(r.Context(), orgID, userID)
+	})
+	if errors.Is(err, repository.ErrNotFound) {
+		app.errorJSON(w, r, newAPIError(codeNotFound, "there is no invitation to that organization"))
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// memberFromURL returns the organization and user ids in the url, and whether the caller is that
+// user.
+func (app *application) memberFromURL(r *http.Request) (orgID, userID int, self bool, err error) {
+	orgID, err = app.orgFromURL(r)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	userID, err = strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		return 0, 0, false, errInvalidUserID
+	}
+
+	callerID, err := app.currentUserID(r)
+	if err != nil {
+		return 0, 0, false, errUnauthorized
+	}
+
+	return orgID, userID, callerID == userID, nil
+}
+
+// getMember returns a member of the organization, with their roles there. Members can see
+// themselves, and those allowed to read users can see anyone in the organization.
+func (app *application) getMember(w http.ResponseWriter, r *http.Request) {
+	orgID, userID, self, err := app.memberFromURL(r)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	claims, _ := app.claimsFromContext(r.Context())
+	if !self && !claims.HasPermission(data.PermissionReadUsers) {
+		app.errorJSON(w, r, errForbidden)
+		return
+	}
+
+	membership, err := app.DB.GetMembership(r.Context(), orgID, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, membership)
+}
+
+// removeMember takes a user out of the organization. Members can leave, and those allowed to
+// manage members can remove anyone, but the organization always keeps one admin.
+func (app *application) removeMember(w http.ResponseWriter, r *http.Request) {
+	orgID, userID, self, err := app.memberFromURL(r)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	claims, _ := app.claimsFromContext(r.Context())
+	if !self && !claims.HasPermission(data.PermissionManageMembers) {
+		app.errorJSON(w, r, errForbidden)
+		return
+	}
+
+	membership, err := app.DB.GetMembership(r.Context(), orgID, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if membership.HasRole(data.RoleAdmin) {
+		last, err := app.lastAdmin(r.Context(), orgID)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if last {
+			app.errorJSON(w, r, newAPIError(codeConflict, "cannot remove the last admin of the organization"))
+			return
+		}
+	}
+
+	err = app.DB.RemoveMember(r.Context(), orgID, userID)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// assignMemberRole gives a member a role in the organization. The member's tokens carry their old
+// permissions until they are refreshed.
+func (app *application) assignMemberRole(w http.ResponseWriter, r *http.Request) {
+	orgID, userID, _, err := app.memberFromURL(r)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+	role := chi.URLParam(r, "role")
+
+	err = app.DB.AssignMemberRole(r.Context(), orgID, userID, role)
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		app.errorJSON(w, r, newAPIErrorf(codeNotFound, "there is no role called %q", role))
+		return
+	case errors.Is(err, repository.ErrConflict):
+		// the user is not a member
+		app.errorJSON(w, r, newAPIErrorf(codeNotFound, "user %d is not a member of this organization", userID))
+		return
+	case err != nil:
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeMemberRole takes a role in the organization away from a member. The admin role cannot be
+// taken away from its last admin.
+func (app *application) revokeMemberRole(w http.ResponseWriter, r *http.Request) {
+	orgID, userID, _, err := app.memberFromURL(r)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+	role := chi.URLParam(r, "role")
+
+	if role == data.RoleAdmin {
+		membership, err := app.DB.GetMembership(r.Context(), orgID, userID)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		last, err := app.lastAdmin(r.Context(), orgID)
+		if err != nil {
+			app.errorJSON(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if membership.HasRole(data.RoleAdmin) && last {
+			app.errorJSON(w, r, newAPIError(codeConflict, "cannot take the admin role from the last admin of the organization"))
+			return
+		}
+	}
+
+	err = app.DB.RevokeMemberRole(r.Context(), orgID, userID, role)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.errorJSON(w, r, newAPIErrorf(codeNotFound, "user %d does not have the role %q here", userID, role))
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_app_tenantIsolation(t *testing.T) {
+	var tests = []struct {
+		name           string
+		method         string
+		userID         string
+		claims         *Claims
+		handler        http.HandlerFunc
+		expectedStatus int
+	}{
+		{"admin gets user in own org", "GET", "2", adminClaims, app.getUser, http.StatusOK},
+		{"admin gets user in other org", "GET", "3", adminClaims, app.getUser, http.StatusNotFound},
+		{"admin updates user in other org", "PUT", "3", adminClaims, app.updateUser, http.StatusNotFound},
+		{"admin deletes user in other org", "DELETE", "3", adminClaims, app.deleteUser, http.StatusNotFound},
+		{"tenant admin gets user in other org", "GET", "1", tenantAdminClaims, app.getUser, http.StatusNotFound},
+		{"tenant admin deletes user in other org", "DELETE", "2", tenantAdminClaims, app.deleteUser, http.StatusNotFound},
+		{"user gets user in other org", "GET", "3", userClaims, app.getUser, http.StatusForbidden},
+		{"tenant admin gets self", "GET", "3", tenantAdminClaims, app.getUser, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		var req *http.Request
+		if e.method == "PUT" {
+			req, _ = http.NewRequest(e.method, "/", strings.NewReader(`{"first_name":"Sam","last_name":"Jones","email":"sam@other.com"}`))
+		} else {
+			req, _ = http.NewRequest(e.method, "/", nil)
+		}
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("userID", e.userID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = addClaimsToRequest(req, e.claims)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	// each organization only lists its own members
+	resetDB()
+	for _, e := range []struct {
+		claims   *Claims
+		expected []int
+	}{
+		{adminClaims, []int{1, 2}},
+		{tenantAdminClaims, []int{3}},
+	} {
+		req, _ := http.NewRequest("GET", "/users?sort=id", nil)
+		req = addClaimsToRequest(req, e.claims)
+		rr := httptest.NewRecorder()
+		app.allUsers(rr, req)
+
+		var list userList
+		_ = json.NewDecoder(rr.Body).Decode(&list)
+
+		var ids []int
+		for _, u := range list.Users {
+			ids = append(ids, u.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(e.expected) {
+			t.Errorf("org %d: expected users %v, but got %v", e.claims.Org, e.expected, ids)
+		}
+	}
+
+	// a token for no organization cannot list anyone
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req = addClaimsToRequest(req, &Claims{Permissions: adminPermissions})
+	rr := httptest.NewRecorder()
+	app.allUsers(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("no organization: expected %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// users created by an organization's admin belong to it
+	req, _ = http.NewRequest("POST", "/users", strings.NewReader(`{"first_name":"Jill","last_name":"Jones","email":"jill@other.com","password":"secret-password"}`))
+	req = addClaimsToRequest(req, tenantAdminClaims)
+	rr = httptest.NewRecorder()
+	app.insertUser(rr, req)
+
+	jill, err := app.DB.GetUserByEmail(context.Background(), "jill@other.com")
+	if rr.Code != http.StatusNoContent || err != nil {
+		t.Fatalf("insert user: expected %d, but got %d (%v)", http.StatusNoContent, rr.Code, err)
+	}
+	if _, err := app.DB.GetMembership(context.Background(), 2, jill.ID); err != nil {
+		t.Errorf("insert user: expected the user to be a member of organization 2, but got %v", err)
+	}
+}
+
+func Test_app_organizations(t *testing.T) {
+	resetDB()
+
+	// create an organization; its creator is its admin
+	req, _ := http.NewRequest("POST", "/orgs", strings.NewReader(`{"name":"  Acme  "}`))
+	req = addClaimsToRequest(req, userClaims)
+	rr := httptest.NewRecorder()
+	app.createOrganization(rr, req)
+
+	var org data.Organization
+	_ = json.NewDecoder(rr.Body).Decode(&org)
+	if rr.Code != http.StatusCreated || org.ID == 0 || org.Name != "Acme" {
+		t.Fatalf("create: expected %d and the new organization, but got %d and %+v", http.StatusCreated, rr.Code, org)
+	}
+
+	// invalid names are rejected
+	req, _ = http.NewRequest("POST", "/orgs", strings.NewReader(`{"name":" "}`))
+	req = addClaimsToRequest(req, userClaims)
+	rr = httptest.NewRecorder()
+	app.createOrganization(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("create with blank name: expected %d, but got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	// the creator now belongs to both organizations
+	req, _ = http.NewRequest("GET", "/orgs", nil)
+	req = addClaimsToRequest(req, userClaims)
+	rr = httptest.NewRecorder()
+	app.myOrganizations(rr, req)
+
+	var memberships []data.Membership
+	_ = json.NewDecoder(rr.Body).Decode(&memberships)
+	if len(memberships) != 2 || memberships[1].OrganizationID != org.ID || !memberships[1].HasRole(data.RoleAdmin) {
+		t.Errorf("my organizations: expected to be admin of the new organization, but got %+v", memberships)
+	}
+
+	// switching to it gives a token with the permissions of an admin there
+	var tests = []struct {
+		name           string
+		orgID          string
+		expectedStatus int
+	}{
+		{"switch to new org", fmt.Sprint(org.ID), http.StatusOK},
+		{"switch to org not a member of", "2", http.StatusForbidden},
+		{"switch to bad id", "x", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ = http.NewRequest("POST", "/", nil)
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("orgID", e.orgID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = addClaimsToRequest(req, userClaims)
+		rr = httptest.NewRecorder()
+		app.switchOrganization(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		var tokens TokenPairs
+		_ = json.NewDecoder(rr.Body).Decode(&tokens)
+
+		req, _ = http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		_, claims, err := app.getTokenFromHeaderAndVerify(httptest.NewRecorder(), req)
+		if err != nil || claims.Org != org.ID || !claims.HasPermission(data.PermissionManageMembers) {
+			t.Errorf("%s: expected an admin token for organization %d, but got %+v (%v)", e.name, org.ID, claims, err)
+		}
+	}
+
+	// logging in to an organization the user does not belong to fails
+	req, _ = http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"admin@example.com","password":"secret","org":2}`))
+	rr = httptest.NewRecorder()
+	app.authenticate(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("log in to other org: expected %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+}
+
+func Test_app_memberHandlers(t *testing.T) {
+	var tests = []struct {
+		name           string
+		method         string
+		orgID          string
+		userID         string
+		json           string
+		claims         *Claims
+		handler        http.HandlerFunc
+		expectedStatus int
+	}{
+		{"add member", "POST", "1", "", `{"email":"sam@other.com"}`, adminClaims, app.addMember, http.StatusAccepted},
+		{"add existing member", "POST", "1", "", `{"email":"jack@example.com"}`, adminClaims, app.addMember, http.StatusConflict},
+		{"add unknown user", "POST", "1", "", `{"email":"nobody@example.com"}`, adminClaims, app.addMember, http.StatusNotFound},
+		{"add member to other org", "POST", "2", "", `{"email":"jack@example.com"}`, adminClaims, app.addMember, http.StatusForbidden},
+		{"get self", "GET", "1", "2", "", userClaims, app.getMember, http.StatusOK},
+		{"get someone else", "GET", "1", "1", "", userClaims, app.getMember, http.StatusForbidden},
+		{"reader gets someone else", "GET", "1", "1", "", readerClaims, app.getMember, http.StatusOK},
+		{"get non-member", "GET", "1", "3", "", adminClaims, app.getMember, http.StatusNotFound},
+		{"get member of other org", "GET", "2", "3", "", adminClaims, app.getMember, http.StatusForbidden},
+		{"get bad org id", "GET", "x", "1", "", adminClaims, app.getMember, http.StatusBadRequest},
+		{"leave", "DELETE", "1", "2", "", userClaims, app.removeMember, http.StatusNoContent},
+		{"remove someone else", "DELETE", "1", "1", "", userClaims, app.removeMember, http.StatusForbidden},
+		{"remove member", "DELETE", "1", "2", "", adminClaims, app.removeMember, http.StatusNoContent},
+		{"remove last admin", "DELETE", "1", "1", "", adminClaims, app.removeMember, http.StatusConflict},
+		{"remove from other org", "DELETE", "2", "3", "", adminClaims, app.removeMember, http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		var req *http.Request
+		if e.json == "" {
+			req, _ = http.NewRequest(e.method, "/", nil)
+		} else {
+			req, _ = http.NewRequest(e.method, "/", strings.NewReader(e.json))
+		}
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("orgID", e.orgID)
+		chiCtx.URLParams.Add("userID", e.userID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = addClaimsToRequest(req, e.claims)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func Test_app_memberRoleHandlers(t *testing.T) {
+	var tests = []struct {
+		name           string
+		method         string
+		orgID          string
+		userID         string
+		role           string
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectedAdmins int
+	}{
+		{"assign", "PUT", "1", "2", "admin", app.assignMemberRole, http.StatusNoContent, 2},
+		{"assign again", "PUT", "1", "1", "admin", app.assignMemberRole, http.StatusNoContent, 1},
+		{"assign unknown role", "PUT", "1", "2", "owner", app.assignMemberRole, http.StatusNotFound, 1},
+		{"assign to non-member", "PUT", "1", "3", "admin", app.assignMemberRole, http.StatusNotFound, 1},
+		{"assign to bad id", "PUT", "1", "x", "admin", app.assignMemberRole, http.StatusBadRequest, 1},
+		{"assign in other org", "PUT", "2", "3", "admin", app.assignMemberRole, http.StatusForbidden, 1},
+		{"revoke from last admin", "DELETE", "1", "1", "admin", app.revokeMemberRole, http.StatusConflict, 1},
+		{"revoke role not held", "DELETE", "1", "2", "admin", app.revokeMemberRole, http.StatusNotFound, 1},
+		{"revoke from non-member", "DELETE", "1", "3", "admin", app.revokeMemberRole, http.StatusNotFound, 1},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(e.method, "/", nil)
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("orgID", e.orgID)
+		chiCtx.URLParams.Add("userID", e.userID)
+		chiCtx.URLParams.Add("role", e.role)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = addClaimsToRequest(req, adminClaims)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		admins, _ := app.DB.CountMembersWithRole(context.Background(), 1, data.RoleAdmin)
+		if admins != e.expectedAdmins {
+			t.Errorf("%s: expected %d admins, but got %d", e.name, e.expectedAdmins, admins)
+		}
+	}
+
+	// once there is another admin, the first one can give up the role
+	resetDB()
+	_ = app.DB.AssignMemberRole(context.Background(), 1, 2, data.RoleAdmin)
+
+	req, _ := http.NewRequest("DELETE", "/", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("orgID", "1")
+	chiCtx.URLParams.Add("userID", "1")
+	chiCtx.URLParams.Add("role", data.RoleAdmin)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	req = addClaimsToRequest(req, adminClaims)
+	rr := httptest.NewRecorder()
+	app.revokeMemberRole(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("revoke from one of two admins: expected %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+}
+
+func Test_app_invitations(t *testing.T) {
+	resetDB()
+
+	// answer sends the request to the handler as sam, with orgID in the url
+	answer := func(handler http.HandlerFunc, method, orgID string) int {
+		return serveRequest(handler, method, "", tenantAdminClaims, "orgID", orgID).Code
+	}
+
+	// inviting sam to Example mails them, but does not make them a member
+	if code := invite(t, adminClaims, "1", "sam@other.com"); code != http.StatusAccepted {
+		t.Fatalf("invite: expected %d, but got %d", http.StatusAccepted, code)
+	}
+
+	queued, _ := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+	if len(queued) != 1 || queued[0].To != "sam@other.com" || !strings.Contains(queued[0].Text, "Example") {
+		t.Errorf("invite: expected an invitation mailed to sam, but got %+v", queued)
+	}
+
+	if _, err := app.DB.GetMembership(context.Background(), 1, 3); err == nil {
+		t.Error("invite: expected sam not to be a member before accepting")
+	}
+
+	req, _ := http.NewRequest("GET", "/orgs/invitations", nil)
+	req = addClaimsToRequest(req, tenantAdminClaims)
+	rr := httptest.NewRecorder()
+	app.myInvitations(rr, req)
+
+	var invitations []data.Invitation
+	_ = json.NewDecoder(rr.Body).Decode(&invitations)
+	if len(invitations) != 1 || invitations[0].OrganizationID != 1 || invitations[0].OrganizationName != "Example" {
+		t.Errorf("my invitations: expected the invitation to Example, but got %+v", invitations)
+	}
+
+	var tests = []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		orgID          string
+		expectedStatus int
+	}{
+		{"accept uninvited", app.acceptInvitation, "POST", "2", http.StatusNotFound},
+		{"accept bad id", app.acceptInvitation, "POST", "x", http.StatusBadRequest},
+		{"accept", app.acceptInvitation, "POST", "1", http.StatusNoContent},
+		{"accept again", app.acceptInvitation, "POST", "1", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		if code := answer(e.handler, e.method, e.orgID); code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, code)
+		}
+	}
+
+	membership, err := app.DB.GetMembership(context.Background(), 1, 3)
+	if err != nil || len(membership.Roles) != 0 {
+		t.Errorf("accept: expected sam to be a member with no roles, but got %+v, %v", membership, err)
+	}
+
+	// declining leaves the user out
+	resetDB()
+	_ = invite(t, adminClaims, "1", "sam@other.com")
+
+	if code := answer(app.declineInvitation, "DELETE", "1"); code != http.StatusNoContent {
+		t.Errorf("decline: expected %d, but got %d", http.StatusNoContent, code)
+	}
+	if _, err := app.DB.GetMembership(context.Background(), 1, 3); err == nil {
+		t.Error("decline: expected sam not to be a member")
+	}
+	if code := answer(app.acceptInvitation, "POST", "1"); code != http.StatusNotFound {
+		t.Errorf("accept after declining: expected %d, but got %d", http.StatusNotFound, code)
+	}
+}
+
+// Anybody can make an organization and invite people to it, so being its admin must never hand
+// over the accounts of the people in it: changing their email address would let the admin reset
+// their password.
+func Test_app_organizationAdminCannotTakeOverAccounts(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+
+	victimID, err := app.DB.InsertUser(ctx, data.User{FirstName: "Vic", LastName: "Tim", Email: "vic@example.com", Password: "secret-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim := fmt.Sprint(victimID)
+
+	// jack, a plain user, makes an organization and gets an admin token for it
+	req, _ := http.NewRequest("POST", "/orgs", strings.NewReader(`{"name":"Trap"}`))
+	req = addClaimsToRequest(req, userClaims)
+	rr := httptest.NewRecorder()
+	app.createOrganization(rr, req)
+
+	var org data.Organization
+	_ = json.NewDecoder(rr.Body).Decode(&org)
+
+	user, _ := app.DB.GetUser(ctx, 2)
+	tokens, err := app.generateTokenPair(ctx, user, org.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	_, claims, err := app.getTokenFromHeaderAndVerify(httptest.NewRecorder(), req)
+	if err != nil || !claims.HasPermission(data.PermissionWriteUsers) {
+		t.Fatalf("expected an admin token for the new organization, but got %+v (%v)", claims, err)
+	}
+
+	// act sends the request to the handler with jack's token, for the victim
+	act := func(handler http.HandlerFunc, method, body string) int {
+		return serveRequest(handler, method, body, claims, "userID", victim).Code
+	}
+	takeOver := `{"first_name":"Vic","last_name":"Tim","email":"jack-owns-this@example.com"}`
+
+	// adding the victim only invites them, so the admin cannot reach them
+	if code := invite(t, claims, fmt.Sprint(org.ID), "vic@example.com"); code != http.StatusAccepted {
+		t.Fatalf("invite: expected %d, but got %d", http.StatusAccepted, code)
+	}
+	if code := act(app.updateUser, "PUT", takeOver); code != http.StatusNotFound {
+		t.Errorf("change email of invited user: expected %d, but got %d", http.StatusNotFound, code)
+	}
+
+	// even once they join, the admin's role there does not cover their credentials or account
+	_ = app.DB.DeleteInvitation(ctx, org.ID, victimID)
+	_ = app.DB.AddMember(ctx, org.ID, victimID)
+
+	var tests = []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{"change email", app.updateUser, "PUT", takeOver},
+		{"delete account", app.deleteUser, "DELETE", ""},
+		{"reset mfa", app.resetMFA, "DELETE", ""},
+	}
+
+	for _, e := range tests {
+		if code := act(e.handler, e.method, e.body); code != http.StatusForbidden {
+			t.Errorf("%s of member: expected %d, but got %d", e.name, http.StatusForbidden, code)
+		}
+	}
+
+	// changing their name is still fine
+	if code := act(app.updateUser, "PUT", `{"first_name":"Victor","last_name":"Tim","email":"vic@example.com"}`); code != http.StatusNoContent {
+		t.Errorf("change name of member: expected %d, but got %d", http.StatusNoContent, code)
+	}
+
+	found, err := app.DB.GetUser(ctx, victimID)
+	if err != nil || found.Email != "vic@example.com" {
+		t.Errorf("expected the victim to keep their email address, but got %+v (%v)", found, err)
+	}
+}
+
+// invite asks addMember, with claims, to invite the user with email to the organization, and
+// returns the status.
+func invite(t *testing.T, claims *Claims, orgID, email string) int {
+	t.Helper()
+	return serveRequest(app.addMember, "POST", fmt.Sprintf(`{"email":%q}`, email), claims, "orgID", orgID).Code
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/usertoken"
+	"web-app/pkg/validation"
+)
+
+// ForgottenPassword is the payload for asking for a link to reset a password.
+type ForgottenPassword struct {
+	Email string `json:"email"`
+}
+
+// PasswordReset is the payload for choosing a new password, with the token from a reset link.
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// forgotPassword mails a link to reset the password to the address given, if it belongs to a
+// user. The response is the same whether it does or not, so that nobody can use it to find out
+// who has an account.
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload ForgottenPassword
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(payload.Email)
+	if !validation.IsEmail(email) {
+		errs := validation.Errors{}
+		errs.Add("email", "must be a valid email address")
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		// answer as if there were someone to mail
+	case err != nil:
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	default:
+		// a failure here is only logged: an error would tell the caller the account exists
+		err = app.mailPasswordReset(r.Context(), user)
+		if err != nil {
+			log.Printf("%s %s: mailing password reset to user %d: %s", r.Method, r.URL.Path, user.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// mailPasswordReset issues a user a password reset token, in place of any they already have, and
+// mails them a link to the page of the web app that takes it.
+func (app *application) mailPasswordReset(ctx context.Context, user *data.User) error {
+	return app.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		err := repo.RevokeUserTokens(ctx, user.ID, data.TokenPurposeResetPassword)
+		if err != nil {
+			return err
+		}
+
+		token, err := usertoken.Issue(ctx, repo, user.ID, data.TokenPurposeResetPassword, usertoken.ResetPasswordTTL)
+		if err != nil {
+			return err
+		}
+
+		return app.Mailer.Queue(ctx, repo, user.Email, "reset-password", map[string]any{
+			"Name": user.FirstName,
+			"URL":  strings.TrimSuffix(app.SiteURL, "/") + "/reset-password?token=" + url.QueryEscape(token),
+		})
+	})
+}
+
+// resetPassword sets a new password for the user a reset token was issued to. The token can only
+// be used once, and every refresh token of the user is revoked, so that anyone who was logged in
+// with the old password has to log in again.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload PasswordReset
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	errs := validation.Errors{}
+	for _, problem := range app.PasswordPolicy.Check(payload.Password) {
+		errs.Add("password", problem)
+	}
+	if !errs.Valid() {
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	// the token is only used up if the password is changed
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		token, err := usertoken.Redeem(r.Context(), repo, data.TokenPurposeResetPassword, payload.Token)
+		if err != nil {
+			return err
+		}
+		err = repo.ResetPassword(r.Context(), token.UserID, payload.Password)
+		if err != nil {
+			return err
+		}
+		err = repo.RevokeUserTokens(r.Context(), token.UserID, data.TokenPurposeResetPassword)
+		if err != nil {
+			return err
+		}
+		// keys made by whoever knew the old password go with it
+		err = repo.RevokeUserAPIKeys(r.Context(), token.UserID)
+		if err != nil {
+			return err
+		}
+		return repo.RevokeUserRefreshTokens(r.Context(), token.UserID)
+	})
+	if errors.Is(err, repository.ErrNotFound) {
+		errs.Add("token", "is invalid or has expired; ask for a new link")
+		app.validationErrorJSON(w, r, errs)
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
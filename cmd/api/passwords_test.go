@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/usertoken"
+)
+
+// resetLink finds the token in a password reset link.
+var resetLink = regexp.MustCompile(`/reset-password\?token=([A-Za-z0-9_-]+)`)
+
+// queuedResetToken returns the token mailed to to, or "" if nothing was mailed to them.
+func queuedResetToken(t *testing.T, to string) string {
+	t.Helper()
+
+	queued, err := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := ""
+	for _, m := range queued {
+		if m.To != to {
+			continue
+		}
+		match := resetLink.FindStringSubmatch(m.Text)
+		if match == nil || !strings.Contains(m.HTML, match[1]) {
+			t.Fatalf("expected a reset link in both bodies of the mail, but got %q", m.Text)
+		}
+		token = match[1]
+	}
+	return token
+}
+
+func Test_app_forgotPassword(t *testing.T) {
+	var tests = []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+		mailedTo       string
+	}{
+		{"known email", `{"email":"jack@example.com"}`, http.StatusAccepted, "jack@example.com"},
+		{"any case", `{"email":"Jack@Example.com"}`, http.StatusAccepted, "jack@example.com"},
+		{"unknown email", `{"email":"nobody@example.com"}`, http.StatusAccepted, ""},
+		{"invalid email", `{"email":"jack"}`, http.StatusUnprocessableEntity, ""},
+		{"bad json", `{"email":`, http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest("POST", "/auth/forgot-password", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+		app.forgotPassword(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		// an unknown address gets the same empty answer as a known one
+		if rr.Code == http.StatusAccepted && rr.Body.Len() != 0 {
+			t.Errorf("%s: expected no body, but got %q", e.name, rr.Body.String())
+		}
+
+		queued, _ := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+		switch {
+		case e.mailedTo == "" && len(queued) != 0:
+			t.Errorf("%s: expected no mail, but got %d", e.name, len(queued))
+		case e.mailedTo != "" && (len(queued) != 1 || queued[0].To != e.mailedTo):
+			t.Errorf("%s: expected one mail to %s, but got %+v", e.name, e.mailedTo, queued)
+		}
+	}
+}
+
+func Test_app_resetPassword(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+
+	// asking twice leaves only the newest link working
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/auth/forgot-password", strings.NewReader(`{"email":"jack@example.com"}`))
+		app.forgotPassword(httptest.NewRecorder(), req)
+		tokens = append(tokens, queuedResetToken(t, "jack@example.com"))
+	}
+	oldToken, token := tokens[0], tokens[1]
+
+	// jack is logged in somewhere
+	jack, _ := app.DB.GetUser(ctx, 2)
+	pair, err := app.generateTokenPair(ctx, jack, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key := issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+
+	var tests = []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+	}{
+		{"weak password", `{"token":"` + token + `","password":"x"}`, http.StatusUnprocessableEntity},
+		{"replaced token", `{"token":"` + oldToken + `","password":"new-secret-password"}`, http.StatusUnprocessableEntity},
+		{"unknown token", `{"token":"no-such-token","password":"new-secret-password"}`, http.StatusUnprocessableEntity},
+		{"no token", `{"password":"new-secret-password"}`, http.StatusUnprocessableEntity},
+		{"valid", `{"token":"` + token + `","password":"new-secret-password"}`, http.StatusNoContent},
+		{"used token", `{"token":"` + token + `","password":"another-password"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/auth/reset-password", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+		app.resetPassword(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d: %s", e.name, e.expectedStatus, rr.Code, rr.Body)
+		}
+	}
+
+	jack, _ = app.DB.GetUser(ctx, 2)
+	if ok, _ := jack.PasswordMatches("new-secret-password"); !ok {
+		t.Error("expected the password to be changed")
+	}
+
+	// the refresh token issued before the reset no longer works
+	stored, err := app.DB.GetRefreshToken(ctx, hashToken(pair.RefreshToken))
+	if err != nil || !stored.Revoked() {
+		t.Errorf("expected the refresh token from before the reset to be revoked, but got %+v, %v", stored, err)
+	}
+
+	// and neither does the api key
+	keys, _ := app.DB.UserAPIKeys(ctx, 2)
+	if len(keys) != 1 || keys[0].ID != key.ID || keys[0].RevokedAt == nil {
+		t.Errorf("expected the api key from before the reset to be revoked, but got %+v", keys)
+	}
+}
+
+func Test_app_resetPasswordExpiredToken(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+
+	_, err := app.DB.InsertUserToken(ctx, data.UserToken{
+		UserID:    2,
+		Purpose:   data.TokenPurposeResetPassword,
+		TokenHash: usertoken.Hash("expired"),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/auth/reset-password", strings.NewReader(`{"token":"expired","password":"new-secret-password"}`))
+	rr := httptest.NewRecorder()
+	app.resetPassword(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("wrong status returned. expected %d, but got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	jack, _ := app.DB.GetUser(ctx, 2)
+	if ok, _ := jack.PasswordMatches("new-secret-password"); ok || jack.PasswordChangedAt != nil {
+		t.Error("expected the password to be left as it was")
+	}
+}
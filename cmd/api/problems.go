@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"web-app/pkg/repository"
+	"web-app/pkg/validation"
+)
+
+// Error codes. Every error response carries one of these in its code member, so clients can
+// act on the kind of error without parsing messages.
+const (
+	codeBadRequest         = "bad_request"
+	codeInvalidParameter   = "invalid_parameter"
+	codeMalformedJSON      = "malformed_json"
+	codeUnknownField       = "unknown_field"
+	codeWrongType          = "wrong_type"
+	codeEmptyBody          = "empty_body"
+	codeBodyTooLarge       = "body_too_large"
+	codeValidationFailed   = "validation_failed"
+	codeUnauthorized       = "unauthorized"
+	codeInvalidCredentials = "invalid_credentials"
+	codeInvalidToken       = "invalid_token"
+	codeMalformedToken     = "malformed_token"
+	codeForbidden          = "forbidden"
+	codeEmailUnverified    = "email_unverified"
+	codeInvalidMFACode     = "invalid_mfa_code"
+	codeTooManyAttempts    = "too_many_attempts"
+	codeRateLimited        = "rate_limited"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codeDuplicateEmail     = "duplicate_email"
+	codeTooEarly           = "too_early"
+	codeInternal           = "internal_error"
+	codeUnavailable        = "service_unavailable"
+)
+
+type problemType struct {
+	Title  string
+	Status int
+}
+
+// problemTypes is the catalogue of error codes, with the title and status that go with each.
+var problemTypes = map[string]problemType{
+	codeBadRequest:         {"Bad request", http.StatusBadRequest},
+	codeInvalidParameter:   {"Invalid query parameter", http.StatusBadRequest},
+	codeMalformedJSON:      {"Malformed JSON", http.StatusBadRequest},
+	codeUnknownField:       {"Unknown field", http.StatusBadRequest},
+	codeWrongType:          {"Wrong field type", http.StatusBadRequest},
+	codeEmptyBody:          {"Empty request body", http.StatusBadRequest},
+	codeBodyTooLarge:       {"Request body too large", http.StatusRequestEntityTooLarge},
+	codeValidationFailed:   {"Validation failed", http.StatusUnprocessableEntity},
+	codeUnauthorized:       {"Unauthorized", http.StatusUnauthorized},
+	codeInvalidCredentials: {"Invalid credentials", http.StatusUnauthorized},
+	codeInvalidToken:       {"Invalid token", http.StatusUnauthorized},
+	codeMalformedToken:     {"Malformed token", http.StatusBadRequest},
+	codeForbidden:          {"Forbidden", http.StatusForbidden},
+	codeEmailUnverified:    {"Email address not verified", http.StatusForbidden},
+	codeInvalidMFACode:     {"Invalid two-factor code", http.StatusUnauthorized},
+	codeTooManyAttempts:    {"Too many failed attempts", http.StatusTooManyRequests},
+	codeRateLimited:        {"Too many requests", http.StatusTooManyRequests},
+	codeNotFound:           {"Not found", http.StatusNotFound},
+	codeConflict:           {"Conflict", http.StatusConflict},
+	codeDuplicateEmail:     {"Email address already in use", http.StatusConflict},
+	codeTooEarly:           {"Too early", http.StatusTooEarly},
+	codeInternal:           {"Internal server error", http.StatusInternalServerError},
+	codeUnavailable:        {"Service unavailable", http.StatusServiceUnavailable},
+}
+
+// codeForStatus picks the generic code for a status, for errors that don't carry their own.
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusTooEarly:
+		return codeTooEarly
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusRequestEntityTooLarge:
+		return codeBodyTooLarge
+	case http.StatusUnprocessableEntity:
+		return codeValidationFailed
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	if status >= 500 {
+		return codeInternal
+	}
+	return codeBadRequest
+}
+
+// repositoryErrorCode picks the code for an error returned by the repository, if it is one of
+// the repository's sentinel errors.
+func repositoryErrorCode(err error) (string, bool) {
+	var dup *repository.DuplicateError
+
+	switch {
+	case errors.As(err, &dup) && dup.Field == "email":
+		return codeDuplicateEmail, true
+	case errors.Is(err, repository.ErrNotFound):
+		return codeNotFound, true
+	case errors.Is(err, repository.ErrDuplicate), errors.Is(err, repository.ErrConflict):
+		return codeConflict, true
+	case errors.Is(err, repository.ErrUnavailable):
+		return codeUnavailable, true
+	}
+	return "", false
+}
+
+// apiError is an error whose message is safe to show to clients. Any other error is logged,
+// and the client only gets the generic title for its status.
+type apiError struct {
+	Code   string
+	Detail string
+}
+
+func (e *apiError) Error() string {
+	return e.Detail
+}
+
+func newAPIError(code, detail string) *apiError {
+	return &apiError{Code: code, Detail: detail}
+}
+
+func newAPIErrorf(code, format string, args ...any) *apiError {
+	return newAPIError(code, fmt.Sprintf(format, args...))
+}
+
+var (
+	errUnauthorized          = newAPIError(codeUnauthorized, "a valid access token is required")
+	errInvalidCredentials    = newAPIError(codeInvalidCredentials, "invalid email address or password")
+	errMalformedRefreshToken = newAPIError(codeMalformedToken, "refresh token is malformed, expired or not signed by us")
+	errInvalidUserID         = newAPIError(codeInvalidParameter, "user id must be an integer")
+	errForbidden             = newAPIError(codeForbidden, "you do not have permission to do this")
+	errNoOrganization        = newAPIError(codeForbidden, "this needs an access token for an organization")
+	errOthersCredentials     = newAPIError(codeForbidden, "roles in an organization do not cover other users' credentials")
+	errAPIKeyNotAllowed      = newAPIError(codeForbidden, "api keys cannot manage accounts; log in for an access token")
+	errDuplicateEmail        = newAPIError(codeDuplicateEmail, "a user with that email address already exists")
+)
+
+// problem is an RFC 7807 problem details object, extended with our error code and, for
+// validation failures, the problems found with each field.
+type problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	Errors   validation.Errors `json:"errors,omitempty"`
+}
+
+// newProblem fills in a problem from the catalogue entry for code.
+func (app *application) newProblem(r *http.Request, code, detail string) problem {
+	pt, ok := problemTypes[code]
+	if !ok {
+		code = codeInternal
+		pt = problemTypes[codeInternal]
+	}
+
+	return problem{
+		Type:     fmt.Sprintf("https://%s/problems/%s", app.Domain, strings.ReplaceAll(code, "_", "-")),
+		Title:    pt.Title,
+		Status:   pt.Status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		Code:     code,
+	}
+}
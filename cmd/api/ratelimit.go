@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"web-app/pkg/ratelimit"
+)
+
+// defaultRateLimits are the limits used unless -rate-limits names a file of others. The first
+// rule that matches a request applies to it.
+var defaultRateLimits = []ratelimit.Rule{
+	// logging in and the endpoints that send mail, by address, to slow down guessing and spam;
+	// they are closed while the limits cannot be checked, rather than open to guessing
+	{Route: "POST /auth", Limit: ratelimit.Limit{Rate: 10, Per: time.Minute}, FailClosed: true},
+	{Route: "POST /web/auth", Limit: ratelimit.Limit{Rate: 10, Per: time.Minute}, FailClosed: true},
+	{Route: "POST /auth/*", Limit: ratelimit.Limit{Rate: 10, Per: time.Minute}, FailClosed: true},
+	// everything else, by user
+	{Route: "/*", Limit: ratelimit.Limit{Rate: 300, Per: time.Minute, Burst: 50}, By: ratelimit.ByUser},
+}
+
+// newLimiter returns a limiter for rules that tells clients apart by their address and their
+// access token, and answers refused requests with a problem. It must be used after identify.
+func (app *application) newLimiter(store ratelimit.Store, rules []ratelimit.Rule) (*ratelimit.Limiter, error) {
+	limiter, err := ratelimit.New(store, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter.Client = app.rateLimitClient
+	limiter.Denied = func(w http.ResponseWriter, r *http.Request) {
+		app.errorJSON(w, r, newAPIError(codeRateLimited, "too many requests; wait and try again"))
+	}
+	limiter.Unavailable = func(w http.ResponseWriter, r *http.Request) {
+		app.errorJSON(w, r, newAPIError(codeUnavailable, "this cannot be done right now; try again later"))
+	}
+	return limiter, nil
+}
+
+// rateLimitClient returns the address r came from, and the api key it was made with or the user
+// its access token is for, if identify found it valid.
+func (app *application) rateLimitClient(r *http.Request) (string, string) {
+	ip := app.TrustedProxies.ClientIP(r)
+
+	v, ok := r.Context().Value(contextAuthKey).(verification)
+	if !ok || v.err != nil {
+		return ip, ""
+	}
+
+	// each api key has limits of its own, apart from its user's
+	if v.claims.APIKeyID != 0 {
+		return ip, "key:" + strconv.Itoa(v.claims.APIKeyID)
+	}
+
+	userID, err := v.claims.UserID()
+	if err != nil {
+		return ip, ""
+	}
+	return ip, "user:" + strconv.Itoa(userID)
+}
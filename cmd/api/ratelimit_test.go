@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/clientip"
+	"web-app/pkg/data"
+	"web-app/pkg/ratelimit"
+	"web-app/pkg/repository"
+)
+
+// withLimiter runs the test with a limiter for rules, with empty buckets, in place of the default.
+func withLimiter(t *testing.T, rules []ratelimit.Rule) {
+	t.Helper()
+	limiter, err := app.newLimiter(ratelimit.NewMemoryStore(), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &app.Limiter, limiter)
+}
+
+func Test_app_rateLimit(t *testing.T) {
+	resetDB()
+	withLimiter(t, []ratelimit.Rule{
+		{Route: "POST /auth", Limit: ratelimit.Limit{Rate: 2, Per: time.Minute}},
+		{Route: "/users/*", Limit: ratelimit.Limit{Rate: 2, Per: time.Minute}, By: ratelimit.ByUser},
+	})
+	mux := app.routes()
+
+	admin, _ := app.DB.GetUser(context.Background(), 1)
+	jack, _ := app.DB.GetUser(context.Background(), 2)
+	adminTokens, _ := app.generateTokenPair(context.Background(), admin, 0)
+	jackTokens, _ := app.generateTokenPair(context.Background(), jack, 0)
+
+	var tests = []struct {
+		name           string
+		method         string
+		url            string
+		body           string
+		token          string
+		remoteAddr     string
+		expectedStatus int
+		remaining      string
+	}{
+		{"first login", "POST", "/auth", `{"email":"admin@example.com","password":"secret"}`, "", "192.0.2.1:1234", http.StatusOK, "1"},
+		{"second login", "POST", "/auth", `{"email":"admin@example.com","password":"secret"}`, "", "192.0.2.1:1234", http.StatusOK, "0"},
+		{"third login", "POST", "/auth", `{"email":"admin@example.com","password":"secret"}`, "", "192.0.2.1:1234", http.StatusTooManyRequests, "0"},
+		{"login from elsewhere", "POST", "/auth", `{"email":"admin@example.com","password":"secret"}`, "", "192.0.2.2:1234", http.StatusOK, "1"},
+		{"jack", "GET", "/users/me", "", jackTokens.Token, "192.0.2.1:1234", http.StatusOK, "1"},
+		{"jack from elsewhere", "GET", "/users/me", "", jackTokens.Token, "192.0.2.2:1234", http.StatusOK, "0"},
+		{"jack again", "GET", "/users/me", "", jackTokens.Token, "192.0.2.3:1234", http.StatusTooManyRequests, "0"},
+		{"admin from jack's address", "GET", "/users/me", "", adminTokens.Token, "192.0.2.1:1234", http.StatusOK, "1"},
+		{"no token", "GET", "/users/me", "", "", "192.0.2.1:1234", http.StatusUnauthorized, "1"},
+		{"not limited", "GET", "/.well-known/jwks.json", "", "", "192.0.2.1:1234", http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.RemoteAddr = e.remoteAddr
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if remaining := rr.Header().Get("RateLimit-Remaining"); remaining != e.remaining {
+			t.Errorf("%s: expected %q requests remaining, but got %q", e.name, e.remaining, remaining)
+		}
+		if e.remaining != "" && rr.Header().Get("RateLimit-Policy") != "2;w=60;burst=2" {
+			t.Errorf("%s: wrong policy: %q", e.name, rr.Header().Get("RateLimit-Policy"))
+		}
+		if rr.Code == http.StatusTooManyRequests {
+			if rr.Header().Get("Retry-After") == "" {
+				t.Errorf("%s: expected a Retry-After header", e.name)
+			}
+			if !strings.Contains(rr.Body.String(), codeRateLimited) {
+				t.Errorf("%s: expected the %s code, but got %s", e.name, codeRateLimited, rr.Body)
+			}
+		}
+	}
+}
+
+// downStore fails every call, as the database store does when the database is down.
+type downStore struct{}
+
+func (downStore) Take(context.Context, string, ratelimit.Limit, time.Time) (bool, float64, error) {
+	return false, 0, repository.ErrUnavailable
+}
+
+func (downStore) Prune(context.Context, time.Time) error {
+	return repository.ErrUnavailable
+}
+
+func Test_app_rateLimitStoreDown(t *testing.T) {
+	resetDB()
+	limiter, err := app.newLimiter(downStore{}, defaultRateLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &app.Limiter, limiter)
+	mux := app.routes()
+
+	jack, _ := app.DB.GetUser(context.Background(), 2)
+	tokens, _ := app.generateTokenPair(context.Background(), jack, 0)
+
+	// logging in cannot go unlimited, but everything else carries on
+	req, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"admin@example.com","password":"secret"}`))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), codeUnavailable) {
+		t.Errorf("login: expected %d and the %s code, but got %d and %s", http.StatusServiceUnavailable, codeUnavailable, rr.Code, rr.Body)
+	}
+
+	req, _ = http.NewRequest("GET", "/users/me", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("get self: expected %d, but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func Test_app_rateLimitClient(t *testing.T) {
+	resetDB()
+	tokens, _ := app.generateTokenPair(context.Background(), &data.User{ID: 2, Email: "jack@example.com"}, 0)
+	key, stored := issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+	expiredKey, _ := issueAPIKey(t, 2, nil, time.Now().Add(-time.Second))
+
+	var tests = []struct {
+		name              string
+		token             string
+		forwardedFor      string
+		trustedProxies    string
+		expectedIP        string
+		expectedPrincipal string
+	}{
+		{"no token", "", "", "", "192.0.2.1", ""},
+		{"valid token", "Bearer " + tokens.Token, "", "", "192.0.2.1", "user:2"},
+		{"expired token", "Bearer " + expiredToken, "", "", "192.0.2.1", ""},
+		{"not a bearer token", "Basic " + tokens.Token, "", "", "192.0.2.1", ""},
+		{"api key", "Bearer " + key, "", "", "192.0.2.1", "key:" + strconv.Itoa(stored.ID)},
+		{"expired api key", "Bearer " + expiredKey, "", "", "192.0.2.1", ""},
+		{"forwarded", "", "198.51.100.7", "", "192.0.2.1", ""},
+		{"forwarded by trusted proxy", "", "198.51.100.7", "192.0.2.0/24", "198.51.100.7", ""},
+	}
+
+	override(t, &app.TrustedProxies, nil)
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/users/me", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if e.token != "" {
+			req.Header.Set("Authorization", e.token)
+		}
+		if e.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", e.forwardedFor)
+		}
+		app.TrustedProxies, _ = clientip.Parse(e.trustedProxies)
+
+		var ip, principal string
+		app.identify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, principal = app.rateLimitClient(r)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		if ip != e.expectedIP || principal != e.expectedPrincipal {
+			t.Errorf("%s: expected %q and %q, but got %q and %q", e.name, e.expectedIP, e.expectedPrincipal, ip, principal)
+		}
+	}
+}
+
+// countingRepo counts the api keys looked up in the repository it wraps.
+type countingRepo struct {
+	repository.DatabaseRepo
+	lookups int
+}
+
+func (c *countingRepo) GetAPIKey(ctx context.Context, keyHash string) (*data.APIKey, error) {
+	c.lookups++
+	return c.DatabaseRepo.GetAPIKey(ctx, keyHash)
+}
+
+func Test_app_rateLimitLooksUpKeysOnce(t *testing.T) {
+	resetDB()
+	key, _ := issueAPIKey(t, 2, nil, time.Now().Add(time.Hour))
+
+	counting := &countingRepo{DatabaseRepo: app.DB}
+	app.DB = counting
+	t.Cleanup(resetDB)
+
+	req, _ := http.NewRequest("GET", "/users/me", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Authorization", "Bearer "+key)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Remaining") == "" {
+		t.Fatalf("expected %d with rate limit headers, but got %d", http.StatusOK, rr.Code)
+	}
+	if counting.lookups != 1 {
+		t.Errorf("expected the key to be looked up once, but it was looked up %d times", counting.lookups)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"log"
 	"net/http"
+	"strings"
+	"web-app/pkg/validation"
 )
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, wrap ...string) error {
@@ -42,23 +45,57 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 	return nil
 }
 
-func (app *application) errorJSON(w http.ResponseWriter, err error, status ...int) {
-	statusCode := http.StatusBadRequest
-	if len(status) > 0 {
-		statusCode = status[0]
-	}
+// errorJSON sends err to the client as application/problem+json. If err is an *apiError, its code
+// decides the status and its message is sent as the detail. Errors from the repository get the
+// status that goes with their kind (404, 409 or 503). Any other error may come from a driver or
+// library and is not fit for clients, so it is logged and the client only gets the generic
+// title for status (400 if not given).
+func (app *application) errorJSON(w http.ResponseWriter, r *http.Request, err error, status ...int) {
+	var p problem
 
-	type jsonError struct {
-		Message string `json:"message"`
+	var ae *apiError
+	if errors.As(err, &ae) {
+		p = app.newProblem(r, ae.Code, ae.Detail)
+	} else if code, ok := repositoryErrorCode(err); ok {
+		if code == codeUnavailable {
+			log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+			w.Header().Set("Retry-After", "5")
+		}
+		p = app.newProblem(r, code, "")
+	} else {
+		statusCode := http.StatusBadRequest
+		if len(status) > 0 {
+			statusCode = status[0]
+		}
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		p = app.newProblem(r, codeForStatus(statusCode), "")
+		p.Status = statusCode
 	}
 
-	theError := jsonError{
-		Message: err.Error(),
+	app.writeProblem(w, p)
+}
+
+// validationErrorJSON sends back every problem found with the submitted fields, keyed by field name.
+func (app *application) validationErrorJSON(w http.ResponseWriter, r *http.Request, errs validation.Errors) {
+	p := app.newProblem(r, codeValidationFailed, "one or more fields are invalid")
+	p.Errors = errs
+	app.writeProblem(w, p)
+}
+
+func (app *application) writeProblem(w http.ResponseWriter, p problem) {
+	out, err := json.Marshal(p)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	_ = app.writeJSON(w, statusCode, theError, "error")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	_, _ = w.Write(out)
 }
 
+// readJSON decodes a single JSON value from the request body into data. Problems with the body
+// are returned as *apiError, with a message that tells the client exactly what was wrong.
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
 	maxBytes := 1024 * 1024 // one megabyte
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
@@ -68,14 +105,53 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data in
 	// attempt to decode the data
 	err := dec.Decode(data)
 	if err != nil {
-		return err
+		var syntaxError *json.SyntaxError
+		var typeError *json.UnmarshalTypeError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return newAPIErrorf(codeMalformedJSON, "body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return newAPIError(codeMalformedJSON, "body contains badly-formed JSON")
+		case errors.As(err, &typeError):
+			if typeError.Field != "" {
+				return newAPIErrorf(codeWrongType, "field %q must be of type %s", typeError.Field, jsonType(typeError.Type.Kind().String()))
+			}
+			return newAPIErrorf(codeWrongType, "body must be a JSON %s", jsonType(typeError.Type.Kind().String()))
+		case errors.Is(err, io.EOF):
+			return newAPIError(codeEmptyBody, "body must not be empty")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return newAPIErrorf(codeUnknownField, "body contains unknown field %s", field)
+		case errors.As(err, &maxBytesError):
+			return newAPIErrorf(codeBodyTooLarge, "body must not be larger than %d bytes", maxBytesError.Limit)
+		default:
+			return err
+		}
 	}
 
 	// make sure only one JSON value in payload
 	err = dec.Decode(&struct{}{})
 	if err != io.EOF {
-		return errors.New("body must only contain a single JSON value")
+		return newAPIError(codeMalformedJSON, "body must only contain a single JSON value")
 	}
 
 	return nil
 }
+
+// jsonType names a Go kind the way a JSON client would think of it.
+func jsonType(kind string) string {
+	switch kind {
+	case "string":
+		return "string"
+	case "bool":
+		return "boolean"
+	case "struct", "map":
+		return "object"
+	case "slice", "array":
+		return "array"
+	default:
+		return "number"
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"web-app/pkg/repository"
+)
+
+func Test_app_readJSON(t *testing.T) {
+	var tests = []struct {
+		name         string
+		body         string
+		expectedCode string
+	}{
+		{"valid", `{"email":"jack@example.com","password":"secret"}`, ""},
+		{"unknown field", `{"email":"jack@example.com","foo":"bar"}`, codeUnknownField},
+		{"wrong type", `{"email":1}`, codeWrongType},
+		{"not an object", `[1,2]`, codeWrongType},
+		{"badly formed", `{"email":}`, codeMalformedJSON},
+		{"truncated", `{"email":"jack@example.com"`, codeMalformedJSON},
+		{"two values", `{"email":"a"}{"email":"b"}`, codeMalformedJSON},
+		{"empty", ``, codeEmptyBody},
+		{"too large", `{"email":"` + strings.Repeat("a", 1024*1024) + `"}`, codeBodyTooLarge},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(e.body))
+		rr := httptest.NewRecorder()
+
+		var creds Credentials
+		err := app.readJSON(rr, req, &creds)
+
+		if e.expectedCode == "" {
+			if err != nil {
+				t.Errorf("%s: did not expect an error, but got %s", e.name, err)
+			}
+			continue
+		}
+
+		var ae *apiError
+		if !errors.As(err, &ae) {
+			t.Errorf("%s: expected an *apiError, but got %v", e.name, err)
+			continue
+		}
+
+		if ae.Code != e.expectedCode {
+			t.Errorf("%s: expected code %s, but got %s (%s)", e.name, e.expectedCode, ae.Code, ae.Detail)
+		}
+	}
+}
+
+func Test_app_errorJSON(t *testing.T) {
+	var tests = []struct {
+		name           string
+		err            error
+		status         []int
+		expectedStatus int
+		expectedCode   string
+		expectedDetail string
+	}{
+		{"api error", newAPIError(codeDuplicateEmail, "taken"), nil, http.StatusConflict, codeDuplicateEmail, "taken"},
+		{"internal error is hidden", errors.New("pq: connection refused"), []int{http.StatusInternalServerError}, http.StatusInternalServerError, codeInternal, ""},
+		{"raw client error is hidden", errors.New("strconv.Atoi: invalid syntax"), nil, http.StatusBadRequest, codeBadRequest, ""},
+		{"raw error keeps its status", errors.New("nope"), []int{http.StatusNotFound}, http.StatusNotFound, codeNotFound, ""},
+		{"not found", fmt.Errorf("%w: sql: no rows in result set", repository.ErrNotFound), []int{http.StatusInternalServerError}, http.StatusNotFound, codeNotFound, ""},
+		{"duplicate", repository.ErrDuplicate, []int{http.StatusInternalServerError}, http.StatusConflict, codeConflict, ""},
+		{"duplicate email", &repository.DuplicateError{Field: "email"}, []int{http.StatusInternalServerError}, http.StatusConflict, codeDuplicateEmail, ""},
+		{"conflict", repository.ErrConflict, nil, http.StatusConflict, codeConflict, ""},
+		{"unavailable", fmt.Errorf("%w: dial tcp: connection refused", repository.ErrUnavailable), []int{http.StatusInternalServerError}, http.StatusServiceUnavailable, codeUnavailable, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/users/1", nil)
+		rr := httptest.NewRecorder()
+		app.errorJSON(rr, req, e.err, e.status...)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: wrong content type %s", e.name, ct)
+		}
+
+		var p problem
+		_ = json.NewDecoder(rr.Body).Decode(&p)
+
+		if p.Code != e.expectedCode || p.Detail != e.expectedDetail || p.Status != e.expectedStatus {
+			t.Errorf("%s: unexpected problem %+v", e.name, p)
+		}
+
+		if p.Instance != "/users/1" || !strings.HasPrefix(p.Type, "https://"+app.Domain+"/problems/") || p.Title == "" {
+			t.Errorf("%s: incomplete problem %+v", e.name, p)
+		}
+	}
+}
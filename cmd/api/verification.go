@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/usertoken"
+	"web-app/pkg/validation"
+)
+
+// EmailVerification is the payload for verifying an email address, with the token from the link
+// mailed to it.
+type EmailVerification struct {
+	Token string `json:"token"`
+}
+
+// EmailVerificationRequest is the payload for asking for another verification link.
+type EmailVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// mailEmailVerification issues a user an email verification token, in place of any they already
+// have, and mails a link to the page of the web app that takes it to their address. Pass the
+// repository of the transaction that created the user or changed their address.
+func (app *application) mailEmailVerification(ctx context.Context, repo repository.DatabaseRepo, user data.User) error {
+	err := repo.RevokeUserTokens(ctx, user.ID, data.TokenPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	token, err := usertoken.Issue(ctx, repo, user.ID, data.TokenPurposeVerifyEmail, usertoken.VerifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	return app.Mailer.Queue(ctx, repo, data.NormalizeEmail(user.Email), "verify-email", map[string]any{
+		"Name": user.FirstName,
+		"URL":  strings.TrimSuffix(app.SiteURL, "/") + "/verify-email?token=" + url.QueryEscape(token),
+	})
+}
+
+// verifyEmail marks the address of the user a verification token was issued to as verified. The
+// token can only be used once. Tokens issued before the user next logs in or refreshes still say
+// the address is unverified.
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload EmailVerification
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		token, err := usertoken.Redeem(r.Context(), repo, data.TokenPurposeVerifyEmail, payload.Token)
+		if err != nil {
+			return err
+		}
+		return repo.MarkEmailVerified(r.Context(), token.UserID)
+	})
+	if errors.Is(err, repository.ErrNotFound) {
+		errs := validation.Errors{}
+		errs.Add("token", "is invalid or has expired; ask for a new link")
+		app.validationErrorJSON(w, r, errs)
+		return
+	} else if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resendEmailVerification mails a new verification link to the address given, if it belongs to a
+// user who has not verified it. Like forgotPassword, it answers the same either way.
+func (app *application) resendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	var payload EmailVerificationRequest
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(payload.Email)
+	if !validation.IsEmail(email) {
+		errs := validation.Errors{}
+		errs.Add("email", "must be a valid email address")
+		app.validationErrorJSON(w, r, errs)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		// answer as if there were someone to mail
+	case err != nil:
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	case !user.EmailVerified():
+		// a failure here is only logged: an error would tell the caller the account exists
+		err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+			return app.mailEmailVerification(r.Context(), repo, *user)
+		})
+		if err != nil {
+			log.Printf("%s %s: mailing email verification to user %d: %s", r.Method, r.URL.Path, user.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
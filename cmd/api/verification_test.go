@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/validation"
+)
+
+// verifyLink finds the token in an email verification link.
+var verifyLink = regexp.MustCompile(`/verify-email\?token=([A-Za-z0-9_-]+)`)
+
+// queuedVerifyToken returns the verification token last mailed to to, or "" if none was.
+func queuedVerifyToken(t *testing.T, to string) string {
+	t.Helper()
+
+	queued, err := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := ""
+	for _, m := range queued {
+		if match := verifyLink.FindStringSubmatch(m.Text); m.To == to && match != nil {
+			token = match[1]
+		}
+	}
+	return token
+}
+
+func Test_app_verifyEmail(t *testing.T) {
+	resetDB()
+	defer func() { app.Signup = validation.SignupPolicy{} }()
+	app.Signup = validation.SignupPolicy{Open: true}
+
+	// signing up mails a link to verify the address
+	req, _ := http.NewRequest("POST", "/auth/register", strings.NewReader(`{"first_name":"Jill","last_name":"Smith","email":"Jill@example.org","password":"secret-password"}`))
+	rr := httptest.NewRecorder()
+	app.register(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected the user to be registered, but got %d", rr.Code)
+	}
+	user, _ := app.DB.GetUserByEmail(context.Background(), "jill@example.org")
+	if user == nil || user.EmailVerified() {
+		t.Error("expected a new user's address to be unverified")
+	}
+
+	token := queuedVerifyToken(t, "jill@example.org")
+	if token == "" {
+		t.Fatal("expected a verification link to be mailed to the new user")
+	}
+
+	var tests = []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+	}{
+		{"unknown token", `{"token":"no-such-token"}`, http.StatusUnprocessableEntity},
+		{"no token", `{}`, http.StatusUnprocessableEntity},
+		{"valid", `{"token":"` + token + `"}`, http.StatusNoContent},
+		{"used token", `{"token":"` + token + `"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/auth/verify-email", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+		app.verifyEmail(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	verified, _ := app.DB.GetUser(context.Background(), user.ID)
+	if !verified.EmailVerified() {
+		t.Error("expected the address to be verified")
+	}
+}
+
+func Test_app_resendEmailVerification(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+
+	// jill has not verified her address
+	jillID, err := app.DB.InsertUser(ctx, data.User{FirstName: "Jill", LastName: "Smith", Email: "jill@example.org", Password: "secret-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+		mailed         bool
+	}{
+		{"unverified", `{"email":"Jill@example.org"}`, http.StatusAccepted, true},
+		{"already verified", `{"email":"jack@example.com"}`, http.StatusAccepted, false},
+		{"unknown email", `{"email":"nobody@example.com"}`, http.StatusAccepted, false},
+		{"invalid email", `{"email":"jill"}`, http.StatusUnprocessableEntity, false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/auth/verify-email/resend", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+		app.resendEmailVerification(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned. expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		queued, _ := app.DB.ClaimMail(ctx, 100, time.Minute)
+		if mailed := len(queued) > 0; mailed != e.mailed {
+			t.Errorf("%s: expected mail to be sent to be %t, but got %d messages", e.name, e.mailed, len(queued))
+		}
+	}
+
+	// only the newest link works
+	req, _ := http.NewRequest("POST", "/auth/verify-email/resend", strings.NewReader(`{"email":"jill@example.org"}`))
+	app.resendEmailVerification(httptest.NewRecorder(), req)
+	token := queuedVerifyToken(t, "jill@example.org")
+
+	req, _ = http.NewRequest("POST", "/auth/verify-email", strings.NewReader(`{"token":"`+token+`"}`))
+	rr := httptest.NewRecorder()
+	app.verifyEmail(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected the newest link to verify the address, but got %d", rr.Code)
+	}
+	jill, _ := app.DB.GetUser(ctx, jillID)
+	if !jill.EmailVerified() {
+		t.Error("expected the address to be verified")
+	}
+}
+
+func Test_app_updateUserReverifiesEmail(t *testing.T) {
+	var tests = []struct {
+		name          string
+		requestBody   string
+		stillVerified bool
+	}{
+		{"same address", `{"first_name":"Jackie","last_name":"Smith","email":"Jack@example.com"}`, true},
+		{"new address", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.org"}`, false},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		rr := serveRequest(app.updateUser, "PUT", e.requestBody, userClaims, "userID", "2")
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("%s: expected %d, but got %d", e.name, http.StatusNoContent, rr.Code)
+			continue
+		}
+
+		jack, _ := app.DB.GetUser(context.Background(), 2)
+		if jack.EmailVerified() != e.stillVerified {
+			t.Errorf("%s: expected the address to be verified to be %t", e.name, e.stillVerified)
+		}
+
+		token := queuedVerifyToken(t, "jack@example.org")
+		if mailed := token != ""; mailed == e.stillVerified {
+			t.Errorf("%s: expected a verification link to be mailed to be %t", e.name, !e.stillVerified)
+		}
+	}
+}
+
+func Test_app_emailVerificationPolicy(t *testing.T) {
+	defer func() { app.EmailVerification = validation.VerificationOptional }()
+
+	var tests = []struct {
+		name               string
+		policy             validation.EmailVerification
+		verified           bool
+		expectedLogin      int
+		expectedRestricted int
+	}{
+		{"optional, unverified", validation.VerificationOptional, false, http.StatusOK, http.StatusOK},
+		{"restricted, unverified", validation.VerificationRestricted, false, http.StatusOK, http.StatusForbidden},
+		{"restricted, verified", validation.VerificationRestricted, true, http.StatusOK, http.StatusOK},
+		{"required, unverified", validation.VerificationRequired, false, http.StatusForbidden, http.StatusForbidden},
+		{"required, verified", validation.VerificationRequired, true, http.StatusOK, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		app.EmailVerification = e.policy
+
+		// jack changes his address, and verifies it or not
+		jack, _ := app.DB.GetUser(context.Background(), 2)
+		jack.Email = "jack@example.org"
+		_ = app.DB.UpdateUser(context.Background(), *jack)
+		if e.verified {
+			_ = app.DB.MarkEmailVerified(context.Background(), 2)
+		}
+
+		req, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"jack@example.org","password":"secret"}`))
+		rr := httptest.NewRecorder()
+		app.authenticate(rr, req)
+		if rr.Code != e.expectedLogin {
+			t.Errorf("%s: expected login to return %d, but got %d", e.name, e.expectedLogin, rr.Code)
+		}
+		if rr.Code == http.StatusForbidden && !strings.Contains(rr.Body.String(), codeEmailUnverified) {
+			t.Errorf("%s: expected the %s code, but got %s", e.name, codeEmailUnverified, rr.Body)
+		}
+
+		// the token says whether the address was verified, and the policy decides what it allows
+		claims := &Claims{Org: 1, EmailVerified: e.verified, RegisteredClaims: userClaims.RegisteredClaims}
+		req, _ = http.NewRequest("GET", "/orgs/", nil)
+		req = addClaimsToRequest(req, claims)
+		rr = httptest.NewRecorder()
+		app.requireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+		if rr.Code != e.expectedRestricted {
+			t.Errorf("%s: expected restricted routes to return %d, but got %d", e.name, e.expectedRestricted, rr.Code)
+		}
+	}
+}
+
+func Test_app_emailVerifiedClaim(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+
+	for _, verified := range []bool{true, false} {
+		jack, _ := app.DB.GetUser(ctx, 2)
+		if !verified {
+			jack.EmailVerifiedAt = nil
+		}
+
+		pair, err := app.generateTokenPair(ctx, jack, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+pair.Token)
+		_, claims, err := app.getTokenFromHeaderAndVerify(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.EmailVerified != verified {
+			t.Errorf("expected the email_verified claim to be %t, but got %t", verified, claims.EmailVerified)
+		}
+	}
+}
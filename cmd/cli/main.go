@@ -1,10 +1,20 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"time"
+	"web-app/pkg/data"
 
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -12,19 +22,37 @@ import (
 type application struct {
 	JWTSecret string
 	Action    string
+	Alg       string
 }
 
 // This is used to generate a token, so that we can test our api. Run this with go run ./cmd/cli and copy
 // the token that is printed out.
 // go run ./cmd/cli -action=valid     // will produce a valid token
 // go run ./cmd/cli -action=expired   // will produce an expired token
+// These tokens are only good against an api sharing the secret; scripts calling a real api should
+// use an api key, made with POST /users/me/api-keys.
+//
+// It can also generate a private key for the api to sign tokens with; save the output
+// as <key id>.pem in the directory passed to the api with -jwt-key-dir. To rotate, move the old
+// key into the retired subdirectory of that directory, and delete it once refresh tokens it
+// signed have expired.
+// go run ./cmd/cli -action=genkey -alg=ES256 > keys/2023-05.pem
 
 func main() {
 	var app application
 	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "secret")
-	flag.StringVar(&app.Action, "action", "valid", "action: valid|expired")
+	flag.StringVar(&app.Action, "action", "valid", "action: valid|expired|genkey")
+	flag.StringVar(&app.Alg, "alg", "ES256", "algorithm for genkey: RS256|ES256|EdDSA")
 	flag.Parse()
 
+	if app.Action == "genkey" {
+		err := app.generateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// generate a token
 	token := jwt.New(jwt.SigningMethodHS256)
 
@@ -32,7 +60,15 @@ func main() {
 	claims := token.Claims.(jwt.MapClaims)
 	claims["name"] = "John Doe"
 	claims["sub"] = "1"
-	claims["admin"] = true
+	claims["org"] = 1
+	claims["roles"] = []string{data.RoleAdmin}
+	claims["permissions"] = []string{
+		data.PermissionManageMembers,
+		data.PermissionManageRoles,
+		data.PermissionDeleteUsers,
+		data.PermissionReadUsers,
+		data.PermissionWriteUsers,
+	}
 	claims["aud"] = "example.com"
 	claims["iss"] = "example.com"
 	// leave this to 3 days, for easy manual testing
@@ -57,3 +93,29 @@ func main() {
 	// print to console
 	fmt.Println(string(signedAccessToken))
 }
+
+// generateKey writes a new PKCS #8 PEM encoded private key for app.Alg to stdout.
+func (app *application) generateKey() error {
+	var key crypto.Signer
+	var err error
+	switch app.Alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("unsupported algorithm %q", app.Alg)
+	}
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return pem.Encode(os.Stdout, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"web-app/pkg/migrate"
+	"web-app/pkg/repository/dbrepo"
+)
+
+// This manages the database schema. The migrations live in pkg/migrate/migrations and are
+// built into this binary, as well as into the api and web binaries, which apply them on
+// startup when run with -migrate.
+// go run ./cmd/migrate up              // apply every pending migration
+// go run ./cmd/migrate down [steps]    // revert the last migration, or the last steps of them
+// go run ./cmd/migrate status          // list migrations and whether they have been applied
+// go run ./cmd/migrate new add_widgets // create the files for a new migration, for every dialect
+//
+// Pass -dsn=sqlite:users.db to work on a SQLite database instead of Postgres.
+
+type application struct {
+	DSN string
+	Dir string
+}
+
+func main() {
+	var app application
+	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "database connection: a postgres dsn, or sqlite:<file> for a local database")
+	flag.StringVar(&app.Dir, "dir", "./pkg/migrate/migrations", "directory new migrations are written to, with a subdirectory per dialect")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: migrate [flags] up|down [steps]|status|new <name>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "up":
+		err = app.up()
+	case "down":
+		err = app.down(flag.Arg(1))
+	case "status":
+		err = app.status()
+	case "new":
+		err = app.create(flag.Arg(1))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (app *application) migrator() (*migrate.Migrator, error) {
+	conn, err := dbrepo.Open(app.DSN)
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(conn, dbrepo.Dialect(app.DSN))
+}
+
+func (app *application) up() error {
+	m, err := app.migrator()
+	if err != nil {
+		return err
+	}
+	defer m.DB.Close()
+
+	applied, err := m.Up(context.Background())
+	for _, migration := range applied {
+		fmt.Println("applied", migration)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("no pending migrations")
+	}
+	return nil
+}
+
+func (app *application) down(arg string) error {
+	steps := 1
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return fmt.Errorf("steps must be a positive integer, not %q", arg)
+		}
+		steps = n
+	}
+
+	m, err := app.migrator()
+	if err != nil {
+		return err
+	}
+	defer m.DB.Close()
+
+	reverted, err := m.Down(context.Background(), steps)
+	for _, migration := range reverted {
+		fmt.Println("reverted", migration)
+	}
+	return err
+}
+
+func (app *application) status() error {
+	m, err := app.migrator()
+	if err != nil {
+		return err
+	}
+	defer m.DB.Close()
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		state := "pending"
+		if s.AppliedAt != nil {
+			state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		if s.Modified {
+			state += " (modified since it was applied)"
+		}
+		if s.Unknown {
+			state += " (not known to this binary)"
+		}
+		fmt.Printf("%-40s %s\n", s.Migration, state)
+	}
+
+	return nil
+}
+
+func (app *application) create(name string) error {
+	if name == "" {
+		return fmt.Errorf("usage: migrate new <name>")
+	}
+
+	paths, err := migrate.Create(app.Dir, name)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		fmt.Println("created", path)
+	}
+	return nil
+}
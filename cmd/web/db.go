@@ -1,31 +1,55 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
-
-	_ "github.com/jackc/pgconn"
-	_ "github.com/jackc/pgx/v4"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"time"
+	"web-app/pkg/migrate"
+	"web-app/pkg/repository"
+	"web-app/pkg/repository/dbrepo"
 )
 
-func openDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", dsn)
+func (app *application) connectToDB() (*sql.DB, error) {
+	connection, err := dbrepo.Open(app.DSN)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
+	log.Println("connected to", dbrepo.Dialect(app.DSN))
+	return connection, nil
+}
+
+// applyMigrations applies every pending migration. Other instances starting at the same time
+// wait for it to finish.
+func applyMigrations(conn *sql.DB, dialect string) error {
+	m, err := migrate.New(conn, dialect)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	applied, err := m.Up(context.Background())
+	for _, migration := range applied {
+		log.Println("applied migration", migration)
 	}
-	return db, nil
+	return err
 }
 
-func (app *application) connectToDB() (*sql.DB, error) {
-	connection, err := openDB(app.DSN)
-	if err != nil {
-		return nil, err
+// openMemoryDB returns an empty in-memory repository, seeded from a fixtures file if one is given.
+func openMemoryDB(fixtures string, timeout time.Duration) (repository.DatabaseRepo, error) {
+	repo := dbrepo.NewMemoryDBRepo(timeout)
+
+	if fixtures != "" {
+		f, err := dbrepo.LoadFixtures(fixtures)
+		if err != nil {
+			return nil, err
+		}
+
+		err = repo.Seed(f)
+		if err != nil {
+			return nil, err
+		}
 	}
-	log.Println("connected to Postgres")
-	return connection, nil
+
+	log.Println("using an in-memory database; nothing is kept after the server stops")
+	return repo, nil
 }
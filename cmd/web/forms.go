@@ -1,33 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"net/url"
 	"strings"
+	"unicode/utf8"
+	"web-app/pkg/validation"
 )
 
-type errors map[string][]string
-
-func (e errors) Get(field string) string {
-	errorSlice := e[field]
-	if len(errorSlice) == 0 {
-		return ""
-	}
-	return errorSlice[0]
-}
-
-func (e errors) Add(field, message string) {
-	e[field] = append(e[field], message)
-}
-
 type Form struct {
 	Data   url.Values
-	Errors errors
+	Errors validation.Errors
 }
 
 func NewForm(data url.Values) *Form {
 	return &Form{
 		Data:   data,
-		Errors: map[string][]string{},
+		Errors: validation.Errors{},
 	}
 }
 
@@ -51,6 +40,27 @@ func (f *Form) Check(ok bool, key, message string) {
 	}
 }
 
+// IsEmail checks that a field holds a valid email address.
+func (f *Form) IsEmail(field string) {
+	if !validation.IsEmail(f.Data.Get(field)) {
+		f.Errors.Add(field, "must be a valid email address")
+	}
+}
+
+// MaxLength checks that a field is no longer than n characters.
+func (f *Form) MaxLength(field string, n int) {
+	if utf8.RuneCountInString(f.Data.Get(field)) > n {
+		f.Errors.Add(field, fmt.Sprintf("must be no more than %d characters long", n))
+	}
+}
+
+// Password checks that a field holds a password acceptable under policy.
+func (f *Form) Password(field string, policy validation.PasswordPolicy) {
+	for _, problem := range policy.Check(f.Data.Get(field)) {
+		f.Errors.Add(field, problem)
+	}
+}
+
 func (f *Form) Valid() bool {
-	return len(f.Errors) == 0
+	return f.Errors.Valid()
 }
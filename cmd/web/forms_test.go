@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"web-app/pkg/validation"
 )
 
 func TestForm_Has(t *testing.T) {
@@ -62,3 +63,53 @@ func TestForm_Error_Get(t *testing.T) {
 		t.Error("should not have an error, but got one from Get()")
 	}
 }
+
+func TestForm_IsEmail(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("good", "jack@example.com")
+	postedData.Add("bad", "jack")
+	form := NewForm(postedData)
+
+	form.IsEmail("good")
+	if !form.Valid() {
+		t.Error("form shows a valid email as invalid")
+	}
+
+	form.IsEmail("bad")
+	if form.Errors.Get("bad") == "" {
+		t.Error("form shows an invalid email as valid")
+	}
+}
+
+func TestForm_MaxLength(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("name", "Jack")
+	form := NewForm(postedData)
+
+	form.MaxLength("name", 4)
+	if !form.Valid() {
+		t.Error("form shows a field at the maximum length as invalid")
+	}
+
+	form.MaxLength("name", 3)
+	if form.Valid() {
+		t.Error("form shows a field over the maximum length as valid")
+	}
+}
+
+func TestForm_Password(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("good", "correct-horse")
+	postedData.Add("bad", "short")
+	form := NewForm(postedData)
+
+	form.Password("good", validation.DefaultPasswordPolicy)
+	if !form.Valid() {
+		t.Error("form shows a good password as invalid")
+	}
+
+	form.Password("bad", validation.DefaultPasswordPolicy)
+	if form.Errors.Get("bad") == "" {
+		t.Error("form shows a short password as valid")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -9,8 +10,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 	"web-app/pkg/data"
+	"web-app/pkg/lockout"
+	"web-app/pkg/repository"
+	"web-app/pkg/validation"
 )
 
 var pathToTemplates = "./templates/"
@@ -25,11 +30,64 @@ func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 	} else {
 		app.Session.Put(r.Context(), "test", "hit this page at "+time.Now().UTC().String())
 	}
+	td["signup"] = app.Signup.Open
 	_ = app.render(w, r, "home.page.gohtml", &TemplateData{Data: td})
 }
 
+// Profile shows the logged in user's profile, and whether they have two-factor authentication on.
 func (app *application) Profile(w http.ResponseWriter, r *http.Request) {
-	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{})
+	user := app.Session.Get(r.Context(), "user").(data.User)
+	td := map[string]any{}
+
+	enabled, err := app.MFA.Enabled(r.Context(), app.DB, user.ID)
+	if err == nil && enabled {
+		td["recovery_codes_left"], err = app.DB.CountRecoveryCodes(r.Context(), user.ID)
+	}
+	if err != nil {
+		// the rest of the page still works
+		log.Printf("loading two-factor status of user %d: %s", user.ID, err)
+	}
+	td["mfa"] = enabled
+
+	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{Data: td})
+}
+
+// adminUsersPageSize is how many users AdminUsers lists on each page.
+var adminUsersPageSize = repository.MaxUserPageSize
+
+// AdminUsers lists a page of users, with their roles, and which of them are locked out of logging
+// in. The page after the one at ?cursor= is linked to, as the api's users list does.
+func (app *application) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	cursor := r.URL.Query().Get("cursor")
+	page, err := app.DB.AllUsers(r.Context(), repository.UserQuery{Limit: adminUsersPageSize, Cursor: cursor})
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		app.Session.Put(r.Context(), "error", "that page of users no longer exists")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not load the users"))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	locked := make(map[int]bool)
+	now := time.Now()
+	for _, u := range page.Users {
+		throttle, err := app.DB.GetLoginThrottle(r.Context(), data.ThrottleAccount, lockout.AccountKey(u.Email))
+		if err == nil {
+			locked[u.ID] = throttle.Locked(now)
+		} else if !errors.Is(err, repository.ErrNotFound) {
+			// the rest of the page still works
+			log.Printf("loading lockout of user %d: %s", u.ID, err)
+		}
+	}
+
+	_ = app.render(w, r, "users.page.gohtml", &TemplateData{Data: map[string]any{
+		"users":  page.Users,
+		"locked": locked,
+		"cursor": cursor,
+		"next":   page.NextCursor,
+	}})
 }
 
 type TemplateData struct {
@@ -38,6 +96,8 @@ type TemplateData struct {
 	Error string
 	Flash string
 	User  data.User
+	// Form is the submitted form, with its errors, when a page is shown again to correct it
+	Form *Form
 }
 
 func (app *application) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) error {
@@ -80,18 +140,53 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	// get form data
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
-	user, err := app.DB.GetUserByEmail(email)
-	if err != nil {
+	// refuse logins to a locked account, or from a locked address, without checking the password
+	wait, err := app.Lockout.Check(r.Context(), app.DB, email, app.TrustedProxies.ClientIP(r))
+	if err != nil || wait > 0 {
+		app.loginRefused(w, r, wait, err)
+		return
+	}
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.loginFailed(w, r, email)
+		return
+	} else if err != nil {
 		// redirect to the login page with error message
-		app.Session.Put(r.Context(), "error", "invalid login")
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "invalid login"))
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 	// authenticate the user
 	if !app.authenticate(r, user, password) {
-		// if not authenticated, then redirect with error
-		app.Session.Put(r.Context(), "error", "invalid login")
+		// if not authenticated, count the failure and redirect with error
+		app.loginFailed(w, r, email)
+		return
+	}
+	err = app.Lockout.Succeed(r.Context(), app.DB, user.Email)
+	if err != nil {
+		app.Session.Remove(r.Context(), "user")
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "invalid login"))
 		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	// the policy may keep out users who have not verified their address
+	if !app.EmailVerification.AllowsLogin(user.EmailVerified()) {
+		app.Session.Remove(r.Context(), "user")
+		app.Session.Put(r.Context(), "error", "verify your email address before logging in; use the link we mailed you, or ask for a new one")
+		http.Redirect(w, r, "/verify-email/resend", http.StatusSeeOther)
+		return
+	}
+	// users with an authenticator give a code from it before they are logged in
+	enabled, err := app.MFA.Enabled(r.Context(), app.DB, user.ID)
+	if err != nil {
+		app.Session.Remove(r.Context(), "user")
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "invalid login"))
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if enabled {
+		app.startMFALogin(w, r, user)
+		return
 	}
 	// if login successful, prevent a fixation attack
 	_ = app.Session.RenewToken(r.Context())
@@ -101,6 +196,78 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 }
 
+// RegisterPage shows the signup form, if signing up is open.
+func (app *application) RegisterPage(w http.ResponseWriter, r *http.Request) {
+	if !app.Signup.Open {
+		http.NotFound(w, r)
+		return
+	}
+	_ = app.render(w, r, "register.page.gohtml", &TemplateData{Form: NewForm(nil)})
+}
+
+// Register creates an account for the person filling in the signup form and mails them a link to
+// verify their address. They start as an ordinary user, with no roles. If the address already has
+// an account, its owner is mailed instead; either way the page says the same, and nobody is logged
+// in, so that signing up does not tell anyone which addresses have accounts.
+func (app *application) Register(w http.ResponseWriter, r *http.Request) {
+	if !app.Signup.Open {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	// validate data
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password")
+	form.MaxLength("first_name", validation.MaxNameLength)
+	form.MaxLength("last_name", validation.MaxNameLength)
+	form.IsEmail("email")
+	form.Password("password", app.PasswordPolicy)
+	form.Check(form.Data.Get("password") == form.Data.Get("confirm_password"), "confirm_password", "does not match the password")
+	if form.Errors.Get("email") == "" {
+		form.Check(app.Signup.AllowsEmail(form.Data.Get("email")), "email", "cannot be used to sign up here")
+	}
+	if !form.Valid() {
+		_ = app.render(w, r, "register.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	// the account is only created if the verification link can be mailed
+	user := data.User{
+		FirstName: strings.TrimSpace(form.Data.Get("first_name")),
+		LastName:  strings.TrimSpace(form.Data.Get("last_name")),
+		Email:     form.Data.Get("email"),
+		Password:  form.Data.Get("password"),
+	}
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		var err error
+		user.ID, err = repo.InsertUser(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		return app.mailEmailVerification(r.Context(), repo, user)
+	})
+	var dup *repository.DuplicateError
+	if errors.As(err, &dup) && dup.Field == "email" {
+		err = app.mailAccountExists(r.Context(), user.Email)
+		if err != nil {
+			log.Println("mailing the owner of an existing account:", err)
+		}
+	} else if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not create your account"))
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "check your email: we have mailed you a link to verify your address; once you have used it, log in")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
 func (app *application) authenticate(r *http.Request, user *data.User, password string) bool {
 	if valid, err := user.PasswordMatches(password); err != nil || !valid {
 		return false
@@ -124,15 +291,17 @@ func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request)
 		FileName: files[0].OriginalFileName,
 	}
 	// insert the user image into user_images
-	_, err = app.DB.InsertUserImage(i)
+	_, err = app.DB.InsertUserImage(r.Context(), i)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not save your profile picture"))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 		return
 	}
 	// refresh the sessional variable "user"
-	updatedUser, err := app.DB.GetUser(user.ID)
+	updatedUser, err := app.DB.GetUser(r.Context(), user.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not load your profile"))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 		return
 	}
 	app.Session.Put(r.Context(), "user", updatedUser)
@@ -140,6 +309,22 @@ func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request)
 	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 }
 
+// dbErrorMessage returns the message to show a user when the repository fails. If the failure
+// was not the user's fault, they are told so; otherwise they get notFound, which should not give
+// away more than the page would anyway. Unexpected errors are logged.
+func dbErrorMessage(err error, notFound string) string {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return notFound
+	case errors.Is(err, repository.ErrUnavailable):
+		log.Println(err)
+		return "the service is temporarily unavailable, please try again later"
+	default:
+		log.Println(err)
+		return "something went wrong, please try again"
+	}
+}
+
 type UploadedFile struct {
 	OriginalFileName string
 	FileSize         int64
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"html"
 	"image"
 	"image/png"
 	"io"
@@ -14,10 +16,14 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/validation"
 )
 
 func Test_application_handlers(t *testing.T) {
@@ -186,6 +192,106 @@ func TestAppLogin(t *testing.T) {
 	}
 }
 
+func TestAppRegister(t *testing.T) {
+	defer func() { app.Signup = validation.SignupPolicy{} }()
+
+	valid := url.Values{
+		"first_name":       {"Jill"},
+		"last_name":        {"Smith"},
+		"email":            {"jill@example.org"},
+		"password":         {"secret-password"},
+		"confirm_password": {"secret-password"},
+	}
+	with := func(field, value string) url.Values {
+		v := url.Values{}
+		for k, vs := range valid {
+			v[k] = vs
+		}
+		v.Set(field, value)
+		return v
+	}
+
+	var tests = []struct {
+		name               string
+		signup             validation.SignupPolicy
+		postedData         url.Values
+		expectedStatusCode int
+		expectedLoc        string
+		expectedHTML       string
+	}{
+		{"open", validation.SignupPolicy{Open: true}, valid, http.StatusSeeOther, "/", ""},
+		{"closed", validation.SignupPolicy{}, valid, http.StatusNotFound, "", ""},
+		{"allowed domain", validation.SignupPolicy{Open: true, AllowedDomains: []string{"example.org"}}, valid, http.StatusSeeOther, "/", ""},
+		{"other domain", validation.SignupPolicy{Open: true, AllowedDomains: []string{"example.net"}}, valid, http.StatusOK, "", "cannot be used to sign up here"},
+		{"missing name", validation.SignupPolicy{Open: true}, with("first_name", ""), http.StatusOK, "", "this field cannot be blank"},
+		{"short password", validation.SignupPolicy{Open: true}, with("password", "x"), http.StatusOK, "", "must be at least 8 characters long"},
+		{"passwords differ", validation.SignupPolicy{Open: true}, with("confirm_password", "other-password"), http.StatusOK, "", "does not match the password"},
+		{"email taken", validation.SignupPolicy{Open: true}, with("email", "Jack@example.com"), http.StatusSeeOther, "/", ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		app.Signup = e.signup
+
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(e.postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		app.Register(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong status code. expected %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+		if e.expectedLoc != "" && rr.Header().Get("Location") != e.expectedLoc {
+			t.Errorf("%s: expected location %s, but got %s", e.name, e.expectedLoc, rr.Header().Get("Location"))
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %q in response body", e.name, e.expectedHTML)
+		}
+
+		if rr.Code != http.StatusSeeOther {
+			continue
+		}
+		// nobody is logged in, and the address is mailed whether it had an account or not
+		if app.Session.Exists(req.Context(), "user") {
+			t.Errorf("%s: expected nobody to be logged in", e.name)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); !strings.Contains(flash, "check your email") {
+			t.Errorf("%s: expected to be told to check their email, but got %q", e.name, flash)
+		}
+		queued, _ := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+		if len(queued) != 1 || !strings.EqualFold(queued[0].To, e.postedData.Get("email")) {
+			t.Errorf("%s: expected one mail to %s, but got %+v", e.name, e.postedData.Get("email"), queued)
+		}
+
+		// a new user has no roles
+		if e.postedData.Get("email") == "jill@example.org" {
+			user, err := app.DB.GetUserByEmail(context.Background(), "jill@example.org")
+			if err != nil || len(user.Roles) != 0 {
+				t.Errorf("%s: expected the new user without roles, but got %+v (%v)", e.name, user, err)
+			}
+		}
+	}
+
+	// the form is only shown while signing up is open
+	for _, open := range []bool{true, false} {
+		app.Signup.Open = open
+		req, _ := http.NewRequest("GET", "/register", nil)
+		req = addContextAndSessionToRequest(req, app)
+		rr := httptest.NewRecorder()
+		app.RegisterPage(rr, req)
+
+		expected := http.StatusNotFound
+		if open {
+			expected = http.StatusOK
+		}
+		if rr.Code != expected {
+			t.Errorf("register page with signup open %t: expected %d, but got %d", open, expected, rr.Code)
+		}
+	}
+}
+
 func Test_app_UploadFiles(t *testing.T) {
 	// set up pipes
 	pr, pw := io.Pipe()
@@ -268,3 +374,92 @@ func Test_app_uploadProfilePic(t *testing.T) {
 	}
 	_ = os.Remove("./testdata/uploads/img.png")
 }
+
+func Test_app_adminUsers(t *testing.T) {
+	req := httptest.NewRequest("GET", "/admin/users", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.AdminUsers)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	// every user is listed, along with their roles
+	for _, expected := range []string{"admin@example.com", "jack@example.com", "<td>admin</td>"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("did not find %q in the page", expected)
+		}
+	}
+}
+
+func Test_app_adminUsersPaging(t *testing.T) {
+	resetDB()
+	override(t, &adminUsersPageSize, 1)
+	admin, _ := app.DB.GetUser(context.Background(), 1)
+
+	// following the next page links reaches every user, one at a time
+	seen := map[string]bool{}
+	next := regexp.MustCompile(`href="/admin/users\?cursor=([^"]+)"`)
+	target := "/admin/users"
+	for i := 0; target != ""; i++ {
+		if i > len(testFixtures.Users) {
+			t.Fatalf("expected %d pages, but the links kept going", len(testFixtures.Users))
+		}
+		req := httptest.NewRequest("GET", target, nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", *admin)
+		rr := httptest.NewRecorder()
+		app.AdminUsers(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, but got %d", target, http.StatusOK, rr.Code)
+		}
+
+		for _, u := range testFixtures.Users {
+			if strings.Contains(rr.Body.String(), u.Email) {
+				seen[u.Email] = true
+			}
+		}
+		if i > 0 && !strings.Contains(rr.Body.String(), `href="/admin/users">First page`) {
+			t.Errorf("%s: expected a link to the first page", target)
+		}
+
+		target = ""
+		if m := next.FindStringSubmatch(rr.Body.String()); m != nil {
+			target = "/admin/users?cursor=" + html.UnescapeString(m[1])
+		}
+	}
+	if len(seen) != len(testFixtures.Users) {
+		t.Errorf("expected to see all %d users, but saw %v", len(testFixtures.Users), seen)
+	}
+
+	// a cursor that is not one goes back to the first page
+	req := httptest.NewRequest("GET", "/admin/users?cursor=nonsense", nil)
+	req = addContextAndSessionToRequest(req, app)
+	rr := httptest.NewRecorder()
+	app.AdminUsers(rr, req)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/users" {
+		t.Errorf("bad cursor: expected a redirect to /admin/users, but got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func Test_dbErrorMessage(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"not found", fmt.Errorf("%w: sql: no rows in result set", repository.ErrNotFound), "invalid login"},
+		{"unavailable", fmt.Errorf("%w: dial tcp: connection refused", repository.ErrUnavailable), "the service is temporarily unavailable, please try again later"},
+		{"unexpected", errors.New("pq: syntax error"), "something went wrong, please try again"},
+	}
+
+	for _, e := range tests {
+		msg := dbErrorMessage(e.err, "invalid login")
+		if msg != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.name, e.expected, msg)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/mfa"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// loginFailed counts a failed login for email, and sends the user back to the login form: with
+// invalid login, or, if it was one too many, with how long to wait.
+func (app *application) loginFailed(w http.ResponseWriter, r *http.Request, email string) {
+	wait, err := app.Lockout.Fail(r.Context(), app.DB, email, app.TrustedProxies.ClientIP(r))
+	if err != nil || wait > 0 {
+		app.loginRefused(w, r, wait, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "error", "invalid login")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// loginRefused sends the user back to the login form, told to wait, or with err if the failed
+// logins could not be checked.
+func (app *application) loginRefused(w http.ResponseWriter, r *http.Request, wait time.Duration, err error) {
+	if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "invalid login"))
+	} else {
+		app.Session.Put(r.Context(), "error", "too many failed logins; try again in "+waitMessage(wait))
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// mfaLockedError is returned for a code from a user who has given too many wrong ones lately.
+type mfaLockedError struct {
+	wait time.Duration
+}
+
+func (e *mfaLockedError) Error() string {
+	return "too many wrong codes; try again in " + waitMessage(e.wait)
+}
+
+// checkMFACode runs check, which checks a code from the user with userID, unless they have given
+// too many wrong codes lately. Wrong codes are counted, and a right one clears the count. It
+// returns an *mfaLockedError if the code may not be tried, or if it was one wrong code too many.
+func (app *application) checkMFACode(ctx context.Context, userID int, check func() error) error {
+	wait, err := app.Lockout.CheckMFA(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &mfaLockedError{wait}
+	}
+
+	err = check()
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		wait, failErr := app.Lockout.FailMFA(ctx, app.DB, userID)
+		if failErr != nil {
+			return failErr
+		}
+		if wait > 0 {
+			return &mfaLockedError{wait}
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	return app.Lockout.SucceedMFA(ctx, app.DB, userID)
+}
+
+// waitMessage says how long wait is, in whole seconds or minutes, rounded up.
+func waitMessage(wait time.Duration) string {
+	if wait <= time.Minute {
+		return fmt.Sprintf("%d seconds", int(math.Ceil(wait.Seconds())))
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(wait.Minutes())))
+}
+
+// AdminUnlockUser lets a locked out user log in again straight away, and records who let them.
+func (app *application) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	admin := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err == nil {
+		err = app.Lockout.Unlock(r.Context(), app.DB, user.Email, admin.ID)
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "there is no such user"))
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", user.Email+" can log in again")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
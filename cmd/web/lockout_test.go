@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/lockout"
+)
+
+func TestAppLoginLockout(t *testing.T) {
+	resetDB()
+	override(t, &app.Lockout, lockout.Guard{AccountThreshold: 2, Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+
+	var tests = []struct {
+		name          string
+		email         string
+		password      string
+		expectedLoc   string
+		expectedError string
+	}{
+		{"first failure", "jack@example.com", "wrong", "/", "invalid login"},
+		{"right password clears failures", "jack@example.com", "secret", "/user/profile", ""},
+		{"failure 1", "jack@example.com", "wrong", "/", "invalid login"},
+		{"failure 2 locks", "jack@example.com", "wrong", "/", "too many failed logins; try again in 60 seconds"},
+		{"right password while locked", "jack@example.com", "secret", "/", "too many failed logins"},
+		{"unknown account", "nobody@example.com", "wrong", "/", "invalid login"},
+		{"unknown account locks", "nobody@example.com", "wrong", "/", "too many failed logins"},
+		{"another account", "admin@example.com", "secret", "/user/profile", ""},
+	}
+
+	for _, e := range tests {
+		rr, req := postForm(app.Login, "/login", url.Values{"email": {e.email}, "password": {e.password}})
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != e.expectedLoc {
+			t.Errorf("%s: expected a redirect to %s, but got %d %s", e.name, e.expectedLoc, rr.Code, rr.Header().Get("Location"))
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); !strings.HasPrefix(msg, e.expectedError) || (e.expectedError == "") != (msg == "") {
+			t.Errorf("%s: expected the error %q, but got %q", e.name, e.expectedError, msg)
+		}
+		if loggedIn := app.Session.Exists(req.Context(), "user"); loggedIn != (e.expectedError == "") {
+			t.Errorf("%s: expected the user to be logged in to be %t", e.name, e.expectedError == "")
+		}
+	}
+}
+
+func TestWaitMessage(t *testing.T) {
+	var tests = []struct {
+		wait     time.Duration
+		expected string
+	}{
+		{1500 * time.Millisecond, "2 seconds"},
+		{time.Minute, "60 seconds"},
+		{61 * time.Second, "2 minutes"},
+		{15 * time.Minute, "15 minutes"},
+	}
+
+	for _, e := range tests {
+		if msg := waitMessage(e.wait); msg != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.wait, e.expected, msg)
+		}
+	}
+}
+
+func TestAppAdminUnlockUser(t *testing.T) {
+	var tests = []struct {
+		name        string
+		userID      string
+		stillLocked bool
+	}{
+		{"locked user", "2", false},
+		{"unknown user", "100", true},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		override(t, &app.Lockout, lockout.Guard{AccountThreshold: 1, Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+		_, _ = app.Lockout.Fail(context.Background(), app.DB, "jack@example.com", "")
+		admin, _ := app.DB.GetUser(context.Background(), 1)
+
+		// the admin sees who is locked
+		req, _ := http.NewRequest("GET", "/admin/users", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", *admin)
+		rr := httptest.NewRecorder()
+		app.AdminUsers(rr, req)
+		if !strings.Contains(rr.Body.String(), "/admin/users/2/unlock") || strings.Contains(rr.Body.String(), "/admin/users/1/unlock") {
+			t.Errorf("%s: expected only jack to be shown as locked", e.name)
+		}
+
+		rr = serveRequest(app.AdminUnlockUser, "POST", admin, "userID", e.userID)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/users" {
+			t.Errorf("%s: expected a redirect to /admin/users, but got %d %s", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+
+		wait, _ := app.Lockout.Check(context.Background(), app.DB, "jack@example.com", "")
+		if locked := wait > 0; locked != e.stillLocked {
+			t.Errorf("%s: expected jack to be locked to be %t", e.name, e.stillLocked)
+		}
+		if !e.stillLocked {
+			events, _ := app.DB.LockoutEvents(context.Background(), data.ThrottleAccount, "jack@example.com", 10)
+			if len(events) != 2 || events[0].Event != data.LockoutEventUnlocked || events[0].ActorID != admin.ID {
+				t.Errorf("%s: expected the unlock to be recorded, but got %+v", e.name, events)
+			}
+		}
+	}
+}
@@ -1,21 +1,54 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"log"
 	"net/http"
+	"path"
+	"time"
+	"web-app/pkg/clientip"
 	"web-app/pkg/data"
+	"web-app/pkg/lockout"
+	"web-app/pkg/mail"
+	"web-app/pkg/mfa"
+	"web-app/pkg/ratelimit"
 	"web-app/pkg/repository"
 	"web-app/pkg/repository/dbrepo"
+	"web-app/pkg/validation"
 
 	"github.com/alexedwards/scs/v2"
 )
 
 type application struct {
-	DSN     string
-	DB      repository.DatabaseRepo
-	Session *scs.SessionManager
+	DSN       string
+	DBMode    string
+	Fixtures  string
+	DB        repository.DatabaseRepo
+	DBTimeout time.Duration
+	Migrate   bool
+	Session   *scs.SessionManager
+
+	PasswordPolicy validation.PasswordPolicy
+	Signup         validation.SignupPolicy
+	// EmailVerification is what users may do before verifying their email address
+	EmailVerification validation.EmailVerification
+
+	// Lockout counts failed logins, and refuses logins for a while after too many
+	Lockout lockout.Guard
+	// MFA checks the codes of users who have turned on two-factor authentication
+	MFA *mfa.Authenticator
+	// TrustedProxies are the proxies in front of the app, whose X-Forwarded-For is believed
+	TrustedProxies clientip.Proxies
+	// Limiter refuses requests from clients that make too many
+	RateLimit ratelimit.Config
+	Limiter   *ratelimit.Limiter
+
+	Mail   mail.Config
+	Mailer *mail.Mailer
+	// SiteURL is where the app is, for links in mail
+	SiteURL string
 }
 
 func main() {
@@ -23,15 +56,87 @@ func main() {
 	// setup an app config
 	app := application{}
 	// get DSN
-	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "postgres connection")
+	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "database connection: a postgres dsn, or sqlite:<file> for a local database")
+	flag.StringVar(&app.DBMode, "db", "sql", "where data is kept: sql, in the database given by -dsn, or memory, for a throwaway store seeded from -fixtures")
+	flag.StringVar(&app.Fixtures, "fixtures", "./sql/fixtures.json", "json file the memory database is seeded from; empty for none")
+	flag.DurationVar(&app.DBTimeout, "db-timeout", dbrepo.DefaultTimeout, "how long a database query may run when the request sets no deadline")
+	flag.BoolVar(&app.Migrate, "migrate", false, "apply pending database migrations on startup")
+	flag.IntVar(&app.PasswordPolicy.MinLength, "password-min-length", validation.DefaultPasswordPolicy.MinLength, "minimum password length")
+	flag.BoolVar(&app.PasswordPolicy.RequireUpper, "password-require-upper", false, "require an upper case letter in passwords")
+	flag.BoolVar(&app.PasswordPolicy.RequireLower, "password-require-lower", false, "require a lower case letter in passwords")
+	flag.BoolVar(&app.PasswordPolicy.RequireDigit, "password-require-digit", false, "require a digit in passwords")
+	flag.BoolVar(&app.PasswordPolicy.RequireSymbol, "password-require-symbol", false, "require a symbol in passwords")
+	flag.BoolVar(&app.Signup.Open, "signup", false, "let anyone create an account at /register")
+	flag.Func("signup-domains", "comma separated email domains signup is limited to; empty for any", func(s string) error {
+		app.Signup.AllowedDomains = validation.ParseDomains(s)
+		return nil
+	})
+	app.EmailVerification = validation.VerificationOptional
+	flag.Func("email-verification", "what users who have not verified their email address may do: optional (anything), restricted (not see admin pages) or required (not log in)", func(s string) error {
+		var err error
+		app.EmailVerification, err = validation.ParseEmailVerification(s)
+		return err
+	})
+	app.Lockout = lockout.Default
+	app.Lockout.Flags(flag.CommandLine)
+	var mfaKey, mfaIssuer string
+	flag.StringVar(&mfaKey, "mfa-key", "", "key two-factor secrets are encrypted with; the api and the web app must share it. Required unless -db=memory")
+	flag.StringVar(&mfaIssuer, "mfa-issuer", "web-app", "name authenticator apps list accounts under")
+	app.TrustedProxies.Flags(flag.CommandLine)
+	app.RateLimit.Flags(flag.CommandLine)
+	app.Mail.Flags(flag.CommandLine)
+	flag.StringVar(&app.SiteURL, "site-url", "http://localhost:8080", "address of the app, for links in mail")
 	flag.Parse()
-	// connect to database
-	conn, err := app.connectToDB()
+	mfaKey, err := mfa.Key(mfaKey, app.DBMode == "memory")
+	if err != nil {
+		log.Fatalf("-mfa-key: %s", err)
+	}
+	app.MFA = mfa.New(mfaKey, mfaIssuer)
+	// connect to database, or set up one in memory
+	switch app.DBMode {
+	case "memory":
+		db, err := openMemoryDB(app.Fixtures, app.DBTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.DB = db
+	case "sql":
+		conn, err := app.connectToDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		// bring the schema up to date
+		if app.Migrate {
+			err = applyMigrations(conn, dbrepo.Dialect(app.DSN))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		app.DB = dbrepo.New(conn, dbrepo.Dialect(app.DSN), app.DBTimeout)
+	default:
+		log.Fatalf("unknown -db %q; use sql or memory", app.DBMode)
+	}
+	// limit requests, forgetting clients that have stopped making them in the background
+	store, rules, err := app.RateLimit.Load(app.DB, defaultRateLimits)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	app.Limiter, err = app.newLimiter(store, rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go app.Limiter.Run(context.Background())
+	// send queued mail in the background
+	app.Mailer = &mail.Mailer{Templates: path.Join(pathToTemplates, "mail")}
+	sender, err := app.Mail.Sender()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sender != nil {
+		worker := &mail.Worker{DB: app.DB, Sender: sender}
+		go worker.Run(context.Background())
+	}
 	// get a session manager
 	app.Session = getSession()
 	// print out a starting message
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/mfa"
+	"web-app/pkg/repository"
+	"web-app/pkg/usertoken"
+
+	"github.com/go-chi/chi/v5"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// mfaLoginTTL is how long a user who has given their password has to give a code, and
+// maxMFAAttempts how many wrong codes they may give before they have to start again.
+const (
+	mfaLoginTTL    = usertoken.MFAChallengeTTL
+	maxMFAAttempts = 5
+)
+
+// startMFALogin holds on to a user who has given their password, in place of logging them in,
+// and sends them to give a code from their authenticator.
+func (app *application) startMFALogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Remove(r.Context(), "user")
+	app.Session.Put(r.Context(), "mfa_user", *user)
+	app.Session.Put(r.Context(), "mfa_started", time.Now().Unix())
+	app.Session.Put(r.Context(), "mfa_attempts", 0)
+	http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+}
+
+// pendingMFAUser returns the user waiting to give a code, if there is one and they have not run
+// out of time or attempts.
+func (app *application) pendingMFAUser(r *http.Request) (data.User, bool) {
+	user, ok := app.Session.Get(r.Context(), "mfa_user").(data.User)
+	if !ok {
+		return data.User{}, false
+	}
+	started := time.Unix(app.Session.GetInt64(r.Context(), "mfa_started"), 0)
+	if time.Since(started) > mfaLoginTTL || app.Session.GetInt(r.Context(), "mfa_attempts") >= maxMFAAttempts {
+		app.endMFALogin(r)
+		return data.User{}, false
+	}
+	return user, true
+}
+
+// endMFALogin forgets the user waiting to give a code.
+func (app *application) endMFALogin(r *http.Request) {
+	app.Session.Remove(r.Context(), "mfa_user")
+	app.Session.Remove(r.Context(), "mfa_started")
+	app.Session.Remove(r.Context(), "mfa_attempts")
+}
+
+// LoginMFAPage shows the form for the second step of logging in.
+func (app *application) LoginMFAPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.pendingMFAUser(r); !ok {
+		app.Session.Put(r.Context(), "error", "log in first")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	_ = app.render(w, r, "login-mfa.page.gohtml", &TemplateData{Form: NewForm(nil)})
+}
+
+// LoginMFA logs in the user waiting to give a code, if the code in the form is the current code
+// from their authenticator or one of their recovery codes.
+func (app *application) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.pendingMFAUser(r)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "that took too long, or too many tries; please log in again")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// validate data
+	form := NewForm(r.PostForm)
+	form.Required("code")
+	if form.Valid() {
+		err = app.checkMFACode(r.Context(), user.ID, func() error {
+			return app.MFA.Verify(r.Context(), app.DB, user.ID, form.Data.Get("code"))
+		})
+		var locked *mfaLockedError
+		switch {
+		case errors.As(err, &locked):
+			app.Session.Put(r.Context(), "error", locked.Error())
+			http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+			return
+		case errors.Is(err, mfa.ErrInvalidCode):
+			app.Session.Put(r.Context(), "mfa_attempts", app.Session.GetInt(r.Context(), "mfa_attempts")+1)
+			form.Errors.Add("code", "is wrong or has been used already")
+		case err != nil:
+			app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not check your code"))
+			http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+			return
+		}
+	}
+	if !form.Valid() {
+		_ = app.render(w, r, "login-mfa.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	// the code is right: log the user in, as Login would
+	app.endMFALogin(r)
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "user", user)
+	app.Session.Put(r.Context(), "flash", "succesfully logged in")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// EnrollMFA starts setting up an authenticator for the logged in user, and sends them to the page
+// with its QR code. The secret is kept in the session until they confirm it.
+func (app *application) EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	enrolment, err := app.MFA.Enroll(r.Context(), app.DB, &user)
+	if errors.Is(err, mfa.ErrAlreadyEnabled) {
+		app.Session.Put(r.Context(), "error", "two-factor authentication is already on; turn it off first")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not set up two-factor authentication"))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "mfa_secret", enrolment.Secret)
+	app.Session.Put(r.Context(), "mfa_uri", enrolment.URI)
+	http.Redirect(w, r, "/user/mfa/setup", http.StatusSeeOther)
+}
+
+// MFASetupPage shows the QR code of the authenticator being set up, and the form for confirming
+// it with a code.
+func (app *application) MFASetupPage(w http.ResponseWriter, r *http.Request) {
+	app.renderMFASetup(w, r, NewForm(nil))
+}
+
+func (app *application) renderMFASetup(w http.ResponseWriter, r *http.Request, form *Form) {
+	secret := app.Session.GetString(r.Context(), "mfa_secret")
+	uri := app.Session.GetString(r.Context(), "mfa_uri")
+	if secret == "" {
+		app.Session.Put(r.Context(), "error", "start setting up two-factor authentication first")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	qr, err := qrCode(uri)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not draw the QR code", http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.render(w, r, "mfa-setup.page.gohtml", &TemplateData{
+		Form: form,
+		Data: map[string]any{"secret": secret, "qr": qr},
+	})
+}
+
+// ConfirmMFA turns on the authenticator being set up, if the code in the form is right, and shows
+// the recovery codes, which are not shown again.
+func (app *application) ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	// validate data
+	form := NewForm(r.PostForm)
+	form.Required("code")
+	if !form.Valid() {
+		app.renderMFASetup(w, r, form)
+		return
+	}
+
+	var codes []string
+	err = app.checkMFACode(r.Context(), user.ID, func() error {
+		codes, err = app.MFA.Confirm(r.Context(), app.DB, user.ID, form.Data.Get("code"))
+		return err
+	})
+	var locked *mfaLockedError
+	switch {
+	case errors.As(err, &locked):
+		app.Session.Put(r.Context(), "error", locked.Error())
+		http.Redirect(w, r, "/user/mfa/setup", http.StatusSeeOther)
+		return
+	case errors.Is(err, mfa.ErrInvalidCode):
+		form.Errors.Add("code", "is wrong; check the time on your device, and try the next code")
+		app.renderMFASetup(w, r, form)
+		return
+	case errors.Is(err, mfa.ErrNotEnrolled), errors.Is(err, mfa.ErrAlreadyEnabled):
+		app.Session.Remove(r.Context(), "mfa_secret")
+		app.Session.Remove(r.Context(), "mfa_uri")
+		app.Session.Put(r.Context(), "error", "start setting up two-factor authentication again")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	case err != nil:
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not turn on two-factor authentication"))
+		http.Redirect(w, r, "/user/mfa/setup", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Remove(r.Context(), "mfa_secret")
+	app.Session.Remove(r.Context(), "mfa_uri")
+	app.Session.Put(r.Context(), "flash", "two-factor authentication is on")
+	_ = app.render(w, r, "recovery-codes.page.gohtml", &TemplateData{Data: map[string]any{"codes": codes}})
+}
+
+// RegenerateRecoveryCodes replaces the logged in user's recovery codes, given a code from their
+// authenticator or one of the codes being replaced, and shows the new ones.
+func (app *application) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.stepUpMFA(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := app.MFA.RegenerateRecoveryCodes(r.Context(), app.DB, user.ID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not make new recovery codes"))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.render(w, r, "recovery-codes.page.gohtml", &TemplateData{Data: map[string]any{"codes": codes}})
+}
+
+// DisableMFA turns off the logged in user's two-factor authentication, given a code from their
+// authenticator or a recovery code.
+func (app *application) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.stepUpMFA(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.DB.DeleteUserMFA(r.Context(), user.ID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not turn off two-factor authentication"))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "two-factor authentication is off")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// stepUpMFA checks the code in the form against the logged in user's authenticator, for changes
+// that being logged in is not enough for. Wrong codes count towards locking the user out of
+// giving codes. If the code is not right, it redirects to the profile page with an error and
+// returns false.
+func (app *application) stepUpMFA(w http.ResponseWriter, r *http.Request) (data.User, bool) {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return user, false
+	}
+
+	err = app.checkMFACode(r.Context(), user.ID, func() error {
+		return app.MFA.Verify(r.Context(), app.DB, user.ID, r.PostForm.Get("code"))
+	})
+	var locked *mfaLockedError
+	if errors.As(err, &locked) {
+		app.Session.Put(r.Context(), "error", locked.Error())
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return user, false
+	} else if errors.Is(err, mfa.ErrInvalidCode) {
+		app.Session.Put(r.Context(), "error", "that code is wrong or has been used already")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return user, false
+	} else if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "could not check your code"))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return user, false
+	}
+
+	return user, true
+}
+
+// AdminResetMFA turns off another user's two-factor authentication, for when they have lost both
+// their authenticator and their recovery codes.
+func (app *application) AdminResetMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	admin := app.Session.Get(r.Context(), "user").(data.User)
+	if admin.ID == userID {
+		app.Session.Put(r.Context(), "error", "turn off your own two-factor authentication on your profile page, with a code")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err == nil {
+		// keys made while the account was in other hands are revoked with the second factor
+		err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+			err := repo.DeleteUserMFA(r.Context(), userID)
+			if err != nil {
+				return err
+			}
+			return repo.RevokeUserAPIKeys(r.Context(), userID)
+		})
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "there is no such user"))
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "two-factor authentication is off for "+user.Email)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// qrCode draws uri as a QR code, and returns it as a data URL for an img tag.
+func qrCode(uri string) (template.URL, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
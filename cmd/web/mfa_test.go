@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/mfa/mfatest"
+)
+
+// postFormWithSession posts data to handler, as postForm does, with values put in the session
+// first.
+func postFormWithSession(handler http.HandlerFunc, target string, data url.Values, session map[string]any) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest("POST", target, strings.NewReader(data.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for key, value := range session {
+		app.Session.Put(req.Context(), key, value)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr, req
+}
+
+func TestAppLoginWithMFA(t *testing.T) {
+	resetDB()
+	mfatest.Enable(t, app.MFA, app.DB, 2)
+
+	rr, req := postForm(app.Login, "/login", url.Values{"email": {"jack@example.com"}, "password": {"secret"}})
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login/mfa" {
+		t.Errorf("expected a redirect to /login/mfa, but got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if app.Session.Exists(req.Context(), "user") {
+		t.Error("expected the user not to be logged in before giving a code")
+	}
+	if pending, ok := app.Session.Get(req.Context(), "mfa_user").(data.User); !ok || pending.ID != 2 {
+		t.Errorf("expected jack to be waiting to give a code, but got %v", app.Session.Get(req.Context(), "mfa_user"))
+	}
+}
+
+func TestAppLoginMFA(t *testing.T) {
+	resetDB()
+	secret, recoveryCodes := mfatest.Enable(t, app.MFA, app.DB, 2)
+	jack, _ := app.DB.GetUser(context.Background(), 2)
+
+	// the code for the current step was used to confirm
+	nextCode := mfatest.NextCode(t, secret)
+	pending := func(started time.Time, attempts int) map[string]any {
+		return map[string]any{"mfa_user": *jack, "mfa_started": started.Unix(), "mfa_attempts": attempts}
+	}
+
+	var tests = []struct {
+		name               string
+		session            map[string]any
+		code               string
+		expectedStatusCode int
+		expectedLoc        string
+		loggedIn           bool
+	}{
+		{"nobody waiting", nil, nextCode, http.StatusSeeOther, "/", false},
+		{"too late", pending(time.Now().Add(-time.Hour), 0), nextCode, http.StatusSeeOther, "/", false},
+		{"too many tries", pending(time.Now(), maxMFAAttempts), nextCode, http.StatusSeeOther, "/", false},
+		{"no code", pending(time.Now(), 0), "", http.StatusOK, "", false},
+		{"wrong code", pending(time.Now(), 0), "12345", http.StatusOK, "", false},
+		{"totp code", pending(time.Now(), 0), nextCode, http.StatusSeeOther, "/user/profile", true},
+		{"totp code reused", pending(time.Now(), 0), nextCode, http.StatusOK, "", false},
+		{"recovery code", pending(time.Now(), 0), recoveryCodes[0], http.StatusSeeOther, "/user/profile", true},
+	}
+
+	for _, e := range tests {
+		rr, req := postFormWithSession(app.LoginMFA, "/login/mfa", url.Values{"code": {e.code}}, e.session)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong status code. expected %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+		if e.expectedLoc != "" && rr.Header().Get("Location") != e.expectedLoc {
+			t.Errorf("%s: expected location %s, but got %s", e.name, e.expectedLoc, rr.Header().Get("Location"))
+		}
+		if loggedIn := app.Session.Exists(req.Context(), "user"); loggedIn != e.loggedIn {
+			t.Errorf("%s: expected the user to be logged in to be %t", e.name, e.loggedIn)
+		}
+		if e.loggedIn && app.Session.Exists(req.Context(), "mfa_user") {
+			t.Errorf("%s: expected the pending login to be forgotten", e.name)
+		}
+	}
+
+	// every wrong code counts
+	_, req := postFormWithSession(app.LoginMFA, "/login/mfa", url.Values{"code": {"12345"}}, pending(time.Now(), 2))
+	if attempts := app.Session.GetInt(req.Context(), "mfa_attempts"); attempts != 3 {
+		t.Errorf("expected 3 attempts, but got %d", attempts)
+	}
+}
+
+func TestAppMFASetup(t *testing.T) {
+	resetDB()
+	jack, _ := app.DB.GetUser(context.Background(), 2)
+	session := map[string]any{"user": *jack}
+
+	rr, req := postFormWithSession(app.EnrollMFA, "/user/mfa/enroll", nil, session)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/mfa/setup" {
+		t.Fatalf("expected a redirect to /user/mfa/setup, but got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	secret := app.Session.GetString(req.Context(), "mfa_secret")
+	session["mfa_secret"] = secret
+	session["mfa_uri"] = app.Session.GetString(req.Context(), "mfa_uri")
+
+	// the setup page shows the QR code and the key
+	req, _ = http.NewRequest("GET", "/user/mfa/setup", nil)
+	req = addContextAndSessionToRequest(req, app)
+	for key, value := range session {
+		app.Session.Put(req.Context(), key, value)
+	}
+	rr = httptest.NewRecorder()
+	app.MFASetupPage(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "data:image/png;base64,") || !strings.Contains(rr.Body.String(), secret) {
+		t.Errorf("expected the setup page with a QR code and the key, but got %d", rr.Code)
+	}
+
+	code := mfatest.Code(t, secret)
+	wrong := mfatest.WrongCode(t, secret)
+
+	var tests = []struct {
+		name         string
+		code         string
+		expectedHTML string
+	}{
+		{"no code", "", "this field cannot be blank"},
+		{"wrong code", wrong, "is wrong"},
+		{"right code", code, "Recovery Codes"},
+	}
+
+	for _, e := range tests {
+		rr, _ := postFormWithSession(app.ConfirmMFA, "/user/mfa/confirm", url.Values{"code": {e.code}}, session)
+
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: expected %q in the page, but got %d", e.name, e.expectedHTML, rr.Code)
+		}
+	}
+
+	if enabled, _ := app.MFA.Enabled(context.Background(), app.DB, 2); !enabled {
+		t.Error("expected two-factor authentication to be on")
+	}
+
+	// with it on, there is nothing to set up
+	rr, _ = postFormWithSession(app.EnrollMFA, "/user/mfa/enroll", nil, map[string]any{"user": *jack})
+	if rr.Header().Get("Location") != "/user/profile" {
+		t.Errorf("expected a redirect to the profile, but got %s", rr.Header().Get("Location"))
+	}
+}
+
+func TestAppDisableMFA(t *testing.T) {
+	resetDB()
+	_, recoveryCodes := mfatest.Enable(t, app.MFA, app.DB, 2)
+	jack, _ := app.DB.GetUser(context.Background(), 2)
+	session := map[string]any{"user": *jack}
+
+	// new recovery codes need a code, and replace the old ones
+	rr, _ := postFormWithSession(app.RegenerateRecoveryCodes, "/user/mfa/recovery-codes", url.Values{"code": {recoveryCodes[0]}}, session)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Recovery Codes") {
+		t.Errorf("expected the new recovery codes, but got %d", rr.Code)
+	}
+
+	var tests = []struct {
+		name         string
+		code         string
+		stillEnabled bool
+	}{
+		{"no code", "", true},
+		{"replaced recovery code", recoveryCodes[1], true},
+	}
+
+	for _, e := range tests {
+		rr, req := postFormWithSession(app.DisableMFA, "/user/mfa/disable", url.Values{"code": {e.code}}, session)
+
+		if rr.Code != http.StatusSeeOther || app.Session.GetString(req.Context(), "error") == "" {
+			t.Errorf("%s: expected a redirect with an error, but got %d", e.name, rr.Code)
+		}
+		if enabled, _ := app.MFA.Enabled(context.Background(), app.DB, 2); enabled != e.stillEnabled {
+			t.Errorf("%s: expected two-factor authentication to be on to be %t", e.name, e.stillEnabled)
+		}
+	}
+}
+
+func TestAppMFACodeLockout(t *testing.T) {
+	resetDB()
+	secret, recoveryCodes := mfatest.Enable(t, app.MFA, app.DB, 2)
+	jack, _ := app.DB.GetUser(context.Background(), 2)
+	session := map[string]any{"user": *jack}
+
+	// the last wrong code in a row locks the user out of giving codes, right ones included
+	var req *http.Request
+	for i := 1; i <= app.Lockout.MFAThreshold; i++ {
+		_, req = postFormWithSession(app.DisableMFA, "/user/mfa/disable", url.Values{"code": {mfatest.WrongCode(t, secret)}}, session)
+	}
+	if msg := app.Session.GetString(req.Context(), "error"); !strings.Contains(msg, "too many wrong codes") {
+		t.Errorf("expected to be told to wait, but got %q", msg)
+	}
+
+	rr, req := postFormWithSession(app.DisableMFA, "/user/mfa/disable", url.Values{"code": {recoveryCodes[0]}}, session)
+	if rr.Code != http.StatusSeeOther || !strings.Contains(app.Session.GetString(req.Context(), "error"), "too many wrong codes") {
+		t.Errorf("expected a right code to be refused, but got %d", rr.Code)
+	}
+	if enabled, _ := app.MFA.Enabled(context.Background(), app.DB, 2); !enabled {
+		t.Error("expected two-factor authentication to stay on")
+	}
+}
+
+func TestAppAdminResetMFA(t *testing.T) {
+	var tests = []struct {
+		name         string
+		userID       string
+		stillEnabled bool
+	}{
+		{"another user", "2", false},
+		{"themselves", "1", true},
+		{"unknown user", "100", true},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		mfatest.Enable(t, app.MFA, app.DB, 1)
+		mfatest.Enable(t, app.MFA, app.DB, 2)
+		_, _ = app.DB.InsertAPIKey(context.Background(), data.APIKey{UserID: 2, OrganizationID: 1, Name: "test", Prefix: "wak_jack", KeyHash: "jack-key", ExpiresAt: time.Now().Add(time.Hour)})
+		admin, _ := app.DB.GetUser(context.Background(), 1)
+
+		rr := serveRequest(app.AdminResetMFA, "POST", admin, "userID", e.userID)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/users" {
+			t.Errorf("%s: expected a redirect to /admin/users, but got %d %s", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+
+		target := 2
+		if e.userID == "1" {
+			target = 1
+		}
+		if enabled, _ := app.MFA.Enabled(context.Background(), app.DB, target); enabled != e.stillEnabled {
+			t.Errorf("%s: expected two-factor authentication to be on to be %t", e.name, e.stillEnabled)
+		}
+		if key, _ := app.DB.GetAPIKey(context.Background(), "jack-key"); (key.RevokedAt == nil) == (e.userID == "2") {
+			t.Errorf("%s: expected jack's api key to be revoked only when their second factor is reset, but got %+v", e.name, key)
+		}
+	}
+}
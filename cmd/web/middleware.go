@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"net"
+	"errors"
 	"net/http"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
 )
 
 type contextKey string
@@ -15,49 +16,119 @@ func (app *application) ipFromContext(ctx context.Context) string {
 	return ctx.Value(contextUserKey).(string)
 }
 
+// addIPToContext puts the address the request came from in its context, or "unknown" if it is
+// not known.
 func (app *application) addIPToContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var ctx = context.Background()
-		// get the IP as accurately as possible
-		ip, err := getIP(r)
-		if err != nil {
-			ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-			if len(ip) == 0 {
-				ip = "unknown"
-			}
-			ctx = context.WithValue(r.Context(), contextUserKey, ip)
-		} else {
-			ctx = context.WithValue(r.Context(), contextUserKey, ip)
+		ip := app.TrustedProxies.ClientIP(r)
+		if ip == "" {
+			ip = "unknown"
 		}
+		ctx := context.WithValue(r.Context(), contextUserKey, ip)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func getIP(r *http.Request) (string, error) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return "unknown", err
-	}
-	userIP := net.ParseIP(ip)
-	if userIP == nil {
-		return "", fmt.Errorf("userIP: %q is not IP:port", r.RemoteAddr)
-	}
-	forward := r.Header.Get("x-Forwarded-For")
-	if len(forward) > 0 {
-		ip = forward
-	}
-	if len(ip) == 0 {
-		ip = forward
+// auth only lets through logged in users. A session no longer counts once the user's password has
+// changed since they logged in, for example because it was reset, or once the user is deleted.
+func (app *application) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+		if !ok {
+			app.Session.Put(r.Context(), "error", "login first")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		current, err := app.DB.GetUser(r.Context(), user.ID)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			app.Session.Put(r.Context(), "error", dbErrorMessage(err, ""))
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil || passwordChangedSince(user, current) {
+			_ = app.Session.RenewToken(r.Context())
+			app.Session.Remove(r.Context(), "user")
+			app.Session.Put(r.Context(), "error", "your session has ended; please log in again")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// passwordChangedSince reports whether the password of current has changed since the session
+// user was loaded, when they logged in.
+func passwordChangedSince(session data.User, current *data.User) bool {
+	switch {
+	case current.PasswordChangedAt == nil:
+		return false
+	case session.PasswordChangedAt == nil:
+		return true
+	default:
+		return current.PasswordChangedAt.After(*session.PasswordChangedAt)
 	}
-	return ip, nil
 }
 
-func (app *application) auth(next http.Handler) http.Handler {
+// requireVerifiedEmail only lets through users who may use more than their own profile, under the
+// email verification policy. The user is looked up on every request, so that verifying takes
+// effect without logging in again. It must be used after auth.
+func (app *application) requireVerifiedEmail(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !app.Session.Exists(r.Context(), "user") {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+		if !ok {
 			app.Session.Put(r.Context(), "error", "login first")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
 		}
+
+		current, err := app.DB.GetUser(r.Context(), user.ID)
+		if err != nil {
+			app.Session.Put(r.Context(), "error", dbErrorMessage(err, "your session has ended; please log in again"))
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !app.EmailVerification.AllowsFullAccess(current.EmailVerified()) {
+			app.Session.Put(r.Context(), "error", "verify your email address to see that page; use the link we mailed you, or ask for a new one")
+			http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requirePermission only lets through users whose roles grant permission. The permissions are
+// looked up on every request, so that taking a role away takes effect straight away. Only
+// global roles count: the web app works across every organization. It must be used after auth.
+func (app *application) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := app.Session.Get(r.Context(), "user").(data.User)
+			if !ok {
+				app.Session.Put(r.Context(), "error", "login first")
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+
+			permissions, err := app.DB.UserPermissions(r.Context(), user.ID, 0)
+			if err != nil {
+				app.Session.Put(r.Context(), "error", dbErrorMessage(err, "you do not have permission to see that page"))
+				http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+				return
+			}
+
+			for _, p := range permissions {
+				if p == permission {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			app.Session.Put(r.Context(), "error", "you do not have permission to see that page")
+			http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		})
+	}
+}
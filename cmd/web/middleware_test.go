@@ -71,17 +71,19 @@ func Test_application_auth(t *testing.T) {
 	})
 	var tests = []struct {
 		name   string
+		user   *data.User
 		isAuth bool
 	}{
-		{"logged in", true},
-		{"not logged in", false},
+		{"logged in", &data.User{ID: 1}, true},
+		{"not logged in", nil, false},
+		{"deleted user", &data.User{ID: 100}, false},
 	}
 	for _, e := range tests {
 		handlerToTest := app.auth(nextHandler)
 		req := httptest.NewRequest("GET", "http://testing", nil)
 		req = addContextAndSessionToRequest(req, app)
-		if e.isAuth {
-			app.Session.Put(req.Context(), "user", data.User{ID: 1})
+		if e.user != nil {
+			app.Session.Put(req.Context(), "user", *e.user)
 		}
 		rr := httptest.NewRecorder()
 		handlerToTest.ServeHTTP(rr, req)
@@ -93,3 +95,35 @@ func Test_application_auth(t *testing.T) {
 		}
 	}
 }
+
+func Test_application_requirePermission(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var tests = []struct {
+		name             string
+		user             *data.User
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"admin", &data.User{ID: 1}, http.StatusOK, ""},
+		{"no permission", &data.User{ID: 2}, http.StatusSeeOther, "/user/profile"},
+		{"not logged in", nil, http.StatusSeeOther, "/"},
+	}
+
+	for _, e := range tests {
+		handlerToTest := app.requirePermission(data.PermissionReadUsers)(nextHandler)
+		req := httptest.NewRequest("GET", "http://testing", nil)
+		req = addContextAndSessionToRequest(req, app)
+		if e.user != nil {
+			app.Session.Put(req.Context(), "user", *e.user)
+		}
+		rr := httptest.NewRecorder()
+		handlerToTest.ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status code of %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if location := rr.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q, but got %q", e.name, e.expectedLocation, location)
+		}
+	}
+}
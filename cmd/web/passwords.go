@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/usertoken"
+)
+
+// ForgotPasswordPage shows the form for asking for a link to reset a password.
+func (app *application) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "forgot-password.page.gohtml", &TemplateData{Form: NewForm(nil)})
+}
+
+// ForgotPassword mails a link to reset the password to the address in the form, if it belongs to
+// a user. The page that follows is the same whether it does or not, so that nobody can use it to
+// find out who has an account.
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	// validate data
+	form := NewForm(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		_ = app.render(w, r, "forgot-password.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), strings.TrimSpace(form.Data.Get("email")))
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		// answer as if there were someone to mail
+	case err != nil:
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, ""))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	default:
+		// a failure here is only logged: an error would tell the visitor the account exists
+		err = app.mailPasswordReset(r.Context(), user)
+		if err != nil {
+			log.Printf("mailing password reset to user %d: %s", user.ID, err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "if there is an account with that email address, a link to reset its password is on its way")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// mailPasswordReset issues a user a password reset token, in place of any they already have, and
+// mails them a link to the reset page.
+func (app *application) mailPasswordReset(ctx context.Context, user *data.User) error {
+	return app.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		err := repo.RevokeUserTokens(ctx, user.ID, data.TokenPurposeResetPassword)
+		if err != nil {
+			return err
+		}
+
+		token, err := usertoken.Issue(ctx, repo, user.ID, data.TokenPurposeResetPassword, usertoken.ResetPasswordTTL)
+		if err != nil {
+			return err
+		}
+
+		return app.Mailer.Queue(ctx, repo, user.Email, "reset-password", map[string]any{
+			"Name": user.FirstName,
+			"URL":  strings.TrimSuffix(app.SiteURL, "/") + "/reset-password?token=" + url.QueryEscape(token),
+		})
+	})
+}
+
+// ResetPasswordPage shows the form for choosing a new password, for the token in the link that
+// was mailed. The token is only checked when the form is sent.
+func (app *application) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		app.Session.Put(r.Context(), "error", "that link is incomplete; ask for a new one")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+	_ = app.render(w, r, "reset-password.page.gohtml", &TemplateData{Form: NewForm(url.Values{"token": {token}})})
+}
+
+// ResetPassword sets a new password for the user the token in the form was issued to. The token
+// can only be used once. Every session and refresh token of the user from before the change
+// stops working, so anyone who was logged in with the old password has to log in again.
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	// validate data
+	form := NewForm(r.PostForm)
+	form.Required("password")
+	form.Password("password", app.PasswordPolicy)
+	form.Check(form.Data.Get("password") == form.Data.Get("confirm_password"), "confirm_password", "does not match the password")
+	if !form.Valid() {
+		_ = app.render(w, r, "reset-password.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	// the token is only used up if the password is changed
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		token, err := usertoken.Redeem(r.Context(), repo, data.TokenPurposeResetPassword, form.Data.Get("token"))
+		if err != nil {
+			return err
+		}
+		err = repo.ResetPassword(r.Context(), token.UserID, form.Data.Get("password"))
+		if err != nil {
+			return err
+		}
+		err = repo.RevokeUserTokens(r.Context(), token.UserID, data.TokenPurposeResetPassword)
+		if err != nil {
+			return err
+		}
+		// keys made by whoever knew the old password go with it
+		err = repo.RevokeUserAPIKeys(r.Context(), token.UserID)
+		if err != nil {
+			return err
+		}
+		return repo.RevokeUserRefreshTokens(r.Context(), token.UserID)
+	})
+	if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "that link is invalid or has expired; ask for a new one"))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	// whoever is logged in here logs in again, with the new password
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Remove(r.Context(), "user")
+	app.Session.Put(r.Context(), "flash", "your password has been changed; log in with your new password")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
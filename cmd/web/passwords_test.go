@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+)
+
+// resetLink finds the token in a password reset link.
+var resetLink = regexp.MustCompile(`/reset-password\?token=([A-Za-z0-9_-]+)`)
+
+// postForm posts data to handler, as a browser would, and returns the response and the request,
+// whose context holds the session.
+func postForm(handler http.HandlerFunc, target string, data url.Values) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest("POST", target, strings.NewReader(data.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr, req
+}
+
+func TestAppForgotPassword(t *testing.T) {
+	var tests = []struct {
+		name               string
+		email              string
+		expectedStatusCode int
+		expectedHTML       string
+		mailedTo           string
+	}{
+		{"known email", "jack@example.com", http.StatusSeeOther, "", "jack@example.com"},
+		{"any case", "Jack@Example.com", http.StatusSeeOther, "", "jack@example.com"},
+		{"unknown email", "nobody@example.com", http.StatusSeeOther, "", ""},
+		{"invalid email", "jack", http.StatusOK, "must be a valid email address", ""},
+		{"missing email", "", http.StatusOK, "this field cannot be blank", ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		rr, req := postForm(app.ForgotPassword, "/forgot-password", url.Values{"email": {e.email}})
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong status code. expected %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %q in response body", e.name, e.expectedHTML)
+		}
+
+		// known and unknown addresses get the same answer
+		if rr.Code == http.StatusSeeOther {
+			flash := app.Session.GetString(req.Context(), "flash")
+			if rr.Header().Get("Location") != "/" || !strings.Contains(flash, "if there is an account") {
+				t.Errorf("%s: expected the same redirect and flash for every address, but got %s, %q", e.name, rr.Header().Get("Location"), flash)
+			}
+		}
+
+		queued, _ := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+		switch {
+		case e.mailedTo == "" && len(queued) != 0:
+			t.Errorf("%s: expected no mail, but got %d", e.name, len(queued))
+		case e.mailedTo != "" && (len(queued) != 1 || queued[0].To != e.mailedTo || !resetLink.MatchString(queued[0].Text)):
+			t.Errorf("%s: expected one mail with a reset link to %s, but got %+v", e.name, e.mailedTo, queued)
+		}
+	}
+}
+
+func TestAppResetPassword(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+
+	_, _ = postForm(app.ForgotPassword, "/forgot-password", url.Values{"email": {"jack@example.com"}})
+	queued, _ := app.DB.ClaimMail(ctx, 100, time.Minute)
+	if len(queued) != 1 {
+		t.Fatalf("expected one mail, but got %d", len(queued))
+	}
+	token := resetLink.FindStringSubmatch(queued[0].Text)[1]
+
+	// the link opens the form, with the token in it
+	req, _ := http.NewRequest("GET", "/reset-password?token="+token, nil)
+	req = addContextAndSessionToRequest(req, app)
+	rr := httptest.NewRecorder()
+	app.ResetPasswordPage(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), token) {
+		t.Errorf("expected the reset form with the token in it, but got %d", rr.Code)
+	}
+
+	// jack was logged in before the reset, and had made an api key
+	jack, _ := app.DB.GetUser(ctx, 2)
+	_, _ = app.DB.InsertAPIKey(ctx, data.APIKey{UserID: 2, OrganizationID: 1, Name: "test", Prefix: "wak_jack", KeyHash: "jack-key", ExpiresAt: time.Now().Add(time.Hour)})
+
+	valid := url.Values{"token": {token}, "password": {"new-secret-password"}, "confirm_password": {"new-secret-password"}}
+	with := func(field, value string) url.Values {
+		v := url.Values{}
+		for k, vs := range valid {
+			v[k] = vs
+		}
+		v.Set(field, value)
+		return v
+	}
+
+	var tests = []struct {
+		name               string
+		postedData         url.Values
+		expectedStatusCode int
+		expectedLoc        string
+		expectedHTML       string
+	}{
+		{"short password", with("password", "x"), http.StatusOK, "", "must be at least 8 characters long"},
+		{"passwords differ", with("confirm_password", "other-password"), http.StatusOK, "", "does not match the password"},
+		{"unknown token", with("token", "no-such-token"), http.StatusSeeOther, "/forgot-password", ""},
+		{"valid", valid, http.StatusSeeOther, "/", ""},
+		{"used token", valid, http.StatusSeeOther, "/forgot-password", ""},
+	}
+
+	for _, e := range tests {
+		rr, _ := postForm(app.ResetPassword, "/reset-password", e.postedData)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong status code. expected %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+		if e.expectedLoc != "" && rr.Header().Get("Location") != e.expectedLoc {
+			t.Errorf("%s: expected location %s, but got %s", e.name, e.expectedLoc, rr.Header().Get("Location"))
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %q in response body", e.name, e.expectedHTML)
+		}
+	}
+
+	changed, _ := app.DB.GetUser(ctx, 2)
+	if ok, _ := changed.PasswordMatches("new-secret-password"); !ok {
+		t.Error("expected the password to be changed")
+	}
+
+	// the session from before the reset no longer lets jack in
+	req = httptest.NewRequest("GET", "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", *jack)
+	rr = httptest.NewRecorder()
+	app.auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther || app.Session.Exists(req.Context(), "user") {
+		t.Errorf("expected the old session to be logged out, but got %d", rr.Code)
+	}
+	if key, err := app.DB.GetAPIKey(ctx, "jack-key"); err != nil || key.RevokedAt == nil {
+		t.Errorf("expected the api key from before the reset to be revoked, but got %+v, %v", key, err)
+	}
+}
+
+func TestAppResetPasswordPageWithoutToken(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/reset-password", nil)
+	req = addContextAndSessionToRequest(req, app)
+	rr := httptest.NewRecorder()
+	app.ResetPasswordPage(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/forgot-password" {
+		t.Errorf("expected a redirect to /forgot-password, but got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func Test_passwordChangedSince(t *testing.T) {
+	before := time.Now().Add(-time.Hour)
+	after := time.Now()
+
+	var tests = []struct {
+		name     string
+		session  *time.Time
+		current  *time.Time
+		expected bool
+	}{
+		{"never changed", nil, nil, false},
+		{"changed before login", &before, &before, false},
+		{"first change after login", nil, &after, true},
+		{"changed again after login", &before, &after, true},
+	}
+
+	for _, e := range tests {
+		changed := passwordChangedSince(data.User{PasswordChangedAt: e.session}, &data.User{PasswordChangedAt: e.current})
+		if changed != e.expected {
+			t.Errorf("%s: expected %t, but got %t", e.name, e.expected, changed)
+		}
+	}
+}
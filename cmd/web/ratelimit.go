@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/ratelimit"
+)
+
+// defaultRateLimits are the limits used unless -rate-limits names a file of others. The first
+// rule that matches a request applies to it.
+var defaultRateLimits = []ratelimit.Rule{
+	// logging in, by address, to slow down guessing; it is closed while the limits cannot be
+	// checked, rather than open to guessing
+	{Route: "POST /login", Limit: ratelimit.Limit{Rate: 10, Per: time.Minute}, FailClosed: true},
+	{Route: "POST /login/mfa", Limit: ratelimit.Limit{Rate: 10, Per: time.Minute}, FailClosed: true},
+	// the forms that send mail, by address, to keep them from being used for spam
+	{Route: "POST /register", Limit: ratelimit.Limit{Rate: 5, Per: time.Minute}},
+	{Route: "POST /forgot-password", Limit: ratelimit.Limit{Rate: 5, Per: time.Minute}, FailClosed: true},
+	{Route: "POST /verify-email/resend", Limit: ratelimit.Limit{Rate: 5, Per: time.Minute}},
+	// pages pull in several static files each, so they are not limited
+	{Route: "/static/*"},
+	// everything else, by user
+	{Route: "/*", Limit: ratelimit.Limit{Rate: 300, Per: time.Minute, Burst: 50}, By: ratelimit.ByUser},
+}
+
+// newLimiter returns a limiter for rules that tells clients apart by their address and the user
+// logged in to their session. It must be used after addIPToContext and the session middleware.
+func (app *application) newLimiter(store ratelimit.Store, rules []ratelimit.Rule) (*ratelimit.Limiter, error) {
+	limiter, err := ratelimit.New(store, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter.Client = app.rateLimitClient
+	limiter.Denied = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Too many requests. Please wait a moment and try again.", http.StatusTooManyRequests)
+	}
+	limiter.Unavailable = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "This cannot be done right now. Please try again later.", http.StatusServiceUnavailable)
+	}
+	return limiter, nil
+}
+
+// rateLimitClient returns the address r came from, and the user logged in to its session, if
+// there is one.
+func (app *application) rateLimitClient(r *http.Request) (string, string) {
+	ip := app.ipFromContext(r.Context())
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		return ip, ""
+	}
+	return ip, "user:" + strconv.Itoa(user.ID)
+}
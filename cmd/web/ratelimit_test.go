@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/ratelimit"
+)
+
+// withLimiter runs the test with a limiter for rules, with empty buckets, in place of the default.
+func withLimiter(t *testing.T, rules []ratelimit.Rule) {
+	t.Helper()
+	limiter, err := app.newLimiter(ratelimit.NewMemoryStore(), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &app.Limiter, limiter)
+}
+
+func TestAppRateLimit(t *testing.T) {
+	// the session is saved, as it is in main
+	gob.Register(data.User{})
+	resetDB()
+	withLimiter(t, []ratelimit.Rule{
+		{Route: "POST /login", Limit: ratelimit.Limit{Rate: 1, Per: time.Minute}},
+		{Route: "/user/*", Limit: ratelimit.Limit{Rate: 2, Per: time.Minute}, By: ratelimit.ByUser},
+	})
+	mux := app.routes()
+
+	send := func(method, target, remoteAddr string, body url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, target, strings.NewReader(body.Encode()))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	credentials := url.Values{"email": {"jack@example.com"}, "password": {"secret"}}
+	rr := send("POST", "/login", "192.0.2.1:1234", credentials, nil)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected the first login to go through, but got %d", rr.Code)
+	}
+	cookies := rr.Result().Cookies()
+
+	var tests = []struct {
+		name               string
+		method             string
+		target             string
+		remoteAddr         string
+		loggedIn           bool
+		expectedStatusCode int
+		remaining          string
+	}{
+		{"second login", "POST", "/login", "192.0.2.1:1234", false, http.StatusTooManyRequests, "0"},
+		{"login from elsewhere", "POST", "/login", "192.0.2.2:1234", false, http.StatusSeeOther, "0"},
+		{"profile", "GET", "/user/profile", "192.0.2.1:1234", true, http.StatusOK, "1"},
+		{"profile from elsewhere", "GET", "/user/profile", "192.0.2.2:1234", true, http.StatusOK, "0"},
+		{"profile again", "GET", "/user/profile", "192.0.2.3:1234", true, http.StatusTooManyRequests, "0"},
+		{"profile logged out", "GET", "/user/profile", "192.0.2.1:1234", false, http.StatusSeeOther, "1"},
+		{"not limited", "GET", "/", "192.0.2.1:1234", false, http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		var sent []*http.Cookie
+		if e.loggedIn {
+			sent = cookies
+		}
+		rr := send(e.method, e.target, e.remoteAddr, credentials, sent)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong status code. expected %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+		if remaining := rr.Header().Get("RateLimit-Remaining"); remaining != e.remaining {
+			t.Errorf("%s: expected %q requests remaining, but got %q", e.name, e.remaining, remaining)
+		}
+		if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected a Retry-After header", e.name)
+		}
+	}
+}
+
+func TestDefaultRateLimits(t *testing.T) {
+	_, err := ratelimit.New(ratelimit.NewMemoryStore(), defaultRateLimits)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/http"
+	"web-app/pkg/data"
+	"web-app/pkg/mail"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -14,15 +16,44 @@ func (app *application) routes() http.Handler {
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.addIPToContext)
 	mux.Use(app.Session.LoadAndSave)
+	mux.Use(app.Limiter.Handler)
 
 	// register routes
 	mux.Get("/", app.Home)
 	mux.Post("/login", app.Login)
+	mux.Get("/login/mfa", app.LoginMFAPage)
+	mux.Post("/login/mfa", app.LoginMFA)
+	mux.Get("/register", app.RegisterPage)
+	mux.Post("/register", app.Register)
+	mux.Get("/forgot-password", app.ForgotPasswordPage)
+	mux.Post("/forgot-password", app.ForgotPassword)
+	mux.Get("/reset-password", app.ResetPasswordPage)
+	mux.Post("/reset-password", app.ResetPassword)
+	mux.Get("/verify-email", app.VerifyEmailPage)
+	mux.Post("/verify-email", app.VerifyEmail)
+	mux.Get("/verify-email/resend", app.ResendEmailVerificationPage)
+	mux.Post("/verify-email/resend", app.ResendEmailVerification)
 	mux.Route("/user", func(mux chi.Router) {
 		mux.Use(app.auth)
 		mux.Get("/profile", app.Profile)
 		mux.Post("/upload-profile-pic", app.UploadProfilePic)
+		mux.Post("/mfa/enroll", app.EnrollMFA)
+		mux.Get("/mfa/setup", app.MFASetupPage)
+		mux.Post("/mfa/confirm", app.ConfirmMFA)
+		mux.Post("/mfa/recovery-codes", app.RegenerateRecoveryCodes)
+		mux.Post("/mfa/disable", app.DisableMFA)
 	})
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.auth, app.requireVerifiedEmail)
+		mux.With(app.requirePermission(data.PermissionReadUsers)).Get("/users", app.AdminUsers)
+		mux.With(app.requirePermission(data.PermissionWriteUsers)).Post("/users/{userID}/mfa/reset", app.AdminResetMFA)
+		mux.With(app.requirePermission(data.PermissionWriteUsers)).Post("/users/{userID}/unlock", app.AdminUnlockUser)
+	})
+
+	// the mail sent in development, for reading in a browser on this machine when asked for
+	if app.Mail.Mode == mail.ModeDev && app.Mail.Viewer {
+		mux.Mount("/dev/mail", mail.LocalOnly(http.StripPrefix("/dev/mail", mail.Viewer(app.Mail.Dir))))
+	}
 
 	// static assets
 	fileServer := http.FileServer(http.Dir("./static/"))
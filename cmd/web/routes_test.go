@@ -2,8 +2,10 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"web-app/pkg/mail"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -16,7 +18,27 @@ func Test_application_routes(t *testing.T) {
 		{"/", "GET"},
 		{"/static/*", "GET"},
 		{"/login", "POST"},
+		{"/login/mfa", "GET"},
+		{"/login/mfa", "POST"},
+		{"/register", "GET"},
+		{"/register", "POST"},
+		{"/forgot-password", "GET"},
+		{"/forgot-password", "POST"},
+		{"/reset-password", "GET"},
+		{"/reset-password", "POST"},
+		{"/verify-email", "GET"},
+		{"/verify-email", "POST"},
+		{"/verify-email/resend", "GET"},
+		{"/verify-email/resend", "POST"},
 		{"/user/profile", "GET"},
+		{"/user/mfa/enroll", "POST"},
+		{"/user/mfa/setup", "GET"},
+		{"/user/mfa/confirm", "POST"},
+		{"/user/mfa/recovery-codes", "POST"},
+		{"/user/mfa/disable", "POST"},
+		{"/admin/users", "GET"},
+		{"/admin/users/{userID}/mfa/reset", "POST"},
+		{"/admin/users/{userID}/unlock", "POST"},
 	}
 	mux := app.routes()
 	chiRoutes := mux.(chi.Routes)
@@ -38,3 +60,34 @@ func routeExists(testRoute, testMethod string, chiRoutes chi.Routes) bool {
 	})
 	return found
 }
+
+func Test_application_routesMailViewer(t *testing.T) {
+	defer func() { app.Mail = mail.Config{} }()
+
+	var tests = []struct {
+		name     string
+		config   mail.Config
+		expected int
+	}{
+		{"dev with viewer", mail.Config{Mode: mail.ModeDev, Viewer: true}, http.StatusOK},
+		{"dev", mail.Config{Mode: mail.ModeDev}, http.StatusNotFound},
+		{"smtp", mail.Config{Mode: mail.ModeSMTP}, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		app.Mail = e.config
+		app.Mail.Dir = t.TempDir()
+		ts := httptest.NewServer(app.routes())
+
+		res, err := http.Get(ts.URL + "/dev/mail/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		ts.Close()
+
+		if res.StatusCode != e.expected {
+			t.Errorf("%s: expected %d from the mail viewer, but got %d", e.name, e.expected, res.StatusCode)
+		}
+	}
+}
@@ -1,16 +1,81 @@
 package main
 
 import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"web-app/pkg/data"
+	"web-app/pkg/lockout"
+	"web-app/pkg/mail"
+	"web-app/pkg/mfa"
+	"web-app/pkg/ratelimit"
 	"web-app/pkg/repository/dbrepo"
+	"web-app/pkg/validation"
+
+	"github.com/go-chi/chi/v5"
 )
 
 var app application
 
+// testFixtures is the data every test database starts with.
+var testFixtures dbrepo.Fixtures
+
 func TestMain(m *testing.M) {
 	pathToTemplates = "./../../templates/"
 	app.Session = getSession()
-	app.DB = &dbrepo.TestDBRepo{}
+	app.PasswordPolicy = validation.DefaultPasswordPolicy
+	app.Mailer = &mail.Mailer{Templates: "./../../templates/mail"}
+	app.MFA = mfa.New("test-key", "web-app")
+	app.Lockout = lockout.Default
+	app.SiteURL = "http://localhost:8080"
+	app.Limiter, _ = app.newLimiter(ratelimit.NewMemoryStore(), defaultRateLimits)
+
+	var err error
+	testFixtures, err = dbrepo.LoadFixtures("./../../sql/fixtures.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	resetDB()
+
 	os.Exit(m.Run())
 }
+
+// serveRequest sends method to handler in a session logged in as user, or anonymous if user is nil.
+// params are pairs of url parameter names and values, as chi would have read them from the path.
+func serveRequest(handler http.HandlerFunc, method string, user *data.User, params ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "/", nil)
+	rctx := chi.NewRouteContext()
+	for i := 0; i+1 < len(params); i += 2 {
+		rctx.URLParams.Add(params[i], params[i+1])
+	}
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	req = addContextAndSessionToRequest(req, app)
+	if user != nil {
+		app.Session.Put(req.Context(), "user", *user)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// override sets *setting to value for the rest of the test, and puts back what was there after it.
+func override[T any](t *testing.T, setting *T, value T) {
+	t.Helper()
+	saved := *setting
+	*setting = value
+	t.Cleanup(func() { *setting = saved })
+}
+
+// resetDB gives app a fresh in-memory database, seeded with the fixtures, so that a test can
+// change data without affecting the ones after it.
+func resetDB() {
+	db := dbrepo.NewMemoryDBRepo(0)
+	err := db.Seed(testFixtures)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.DB = db
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/usertoken"
+)
+
+// mailEmailVerification issues a user an email verification token, in place of any they already
+// have, and mails a link to the verification page to their address. Pass the repository of the
+// transaction that created the user.
+func (app *application) mailEmailVerification(ctx context.Context, repo repository.DatabaseRepo, user data.User) error {
+	err := repo.RevokeUserTokens(ctx, user.ID, data.TokenPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	token, err := usertoken.Issue(ctx, repo, user.ID, data.TokenPurposeVerifyEmail, usertoken.VerifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	return app.Mailer.Queue(ctx, repo, data.NormalizeEmail(user.Email), "verify-email", map[string]any{
+		"Name": user.FirstName,
+		"URL":  strings.TrimSuffix(app.SiteURL, "/") + "/verify-email?token=" + url.QueryEscape(token),
+	})
+}
+
+// mailAccountExists tells the owner of the account with email that someone tried to sign up
+// with their address, and how to get back in if it was them.
+func (app *application) mailAccountExists(ctx context.Context, email string) error {
+	user, err := app.DB.GetUserByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	return app.Mailer.Queue(ctx, app.DB, user.Email, "account-exists", map[string]any{
+		"Name": user.FirstName,
+		"URL":  strings.TrimSuffix(app.SiteURL, "/") + "/forgot-password",
+	})
+}
+
+// VerifyEmailPage shows a button that verifies the email address the link was mailed to. It takes
+// a click, rather than the link itself, so that mail scanners opening links do not use the token.
+func (app *application) VerifyEmailPage(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		app.Session.Put(r.Context(), "error", "that link is incomplete; ask for a new one")
+		http.Redirect(w, r, "/verify-email/resend", http.StatusSeeOther)
+		return
+	}
+	_ = app.render(w, r, "verify-email.page.gohtml", &TemplateData{Form: NewForm(url.Values{"token": {token}})})
+}
+
+// VerifyEmail marks the address of the user the token in the form was issued to as verified. The
+// token can only be used once.
+func (app *application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		token, err := usertoken.Redeem(r.Context(), repo, data.TokenPurposeVerifyEmail, r.PostForm.Get("token"))
+		if err != nil {
+			return err
+		}
+		return repo.MarkEmailVerified(r.Context(), token.UserID)
+	})
+	if err != nil {
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, "that link is invalid or has expired; ask for a new one"))
+		http.Redirect(w, r, "/verify-email/resend", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "your email address has been verified")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ResendEmailVerificationPage shows the form for asking for another verification link.
+func (app *application) ResendEmailVerificationPage(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "resend-verification.page.gohtml", &TemplateData{Form: NewForm(nil)})
+}
+
+// ResendEmailVerification mails a new verification link to the address in the form, if it belongs
+// to a user who has not verified it. Like ForgotPassword, the page that follows is the same either
+// way.
+func (app *application) ResendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	// validate data
+	form := NewForm(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		_ = app.render(w, r, "resend-verification.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), strings.TrimSpace(form.Data.Get("email")))
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		// answer as if there were someone to mail
+	case err != nil:
+		app.Session.Put(r.Context(), "error", dbErrorMessage(err, ""))
+		http.Redirect(w, r, "/verify-email/resend", http.StatusSeeOther)
+		return
+	case !user.EmailVerified():
+		// a failure here is only logged: an error would tell the visitor the account exists
+		err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+			return app.mailEmailVerification(r.Context(), repo, *user)
+		})
+		if err != nil {
+			log.Printf("mailing email verification to user %d: %s", user.ID, err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "if there is an unverified account with that email address, a new link to verify it is on its way")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/validation"
+)
+
+// verifyLink finds the token in an email verification link.
+var verifyLink = regexp.MustCompile(`/verify-email\?token=([A-Za-z0-9_-]+)`)
+
+// insertUnverifiedUser adds jill, who has not verified her address, and returns her id.
+func insertUnverifiedUser(t *testing.T) int {
+	t.Helper()
+	id, err := app.DB.InsertUser(context.Background(), data.User{FirstName: "Jill", LastName: "Smith", Email: "jill@example.org", Password: "secret-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestAppRegisterMailsVerification(t *testing.T) {
+	defer func() {
+		app.Signup = validation.SignupPolicy{}
+		app.EmailVerification = validation.VerificationOptional
+	}()
+	app.Signup = validation.SignupPolicy{Open: true}
+
+	var tests = []struct {
+		name   string
+		policy validation.EmailVerification
+	}{
+		{"optional", validation.VerificationOptional},
+		{"restricted", validation.VerificationRestricted},
+		{"required", validation.VerificationRequired},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		app.EmailVerification = e.policy
+
+		rr, req := postForm(app.Register, "/register", url.Values{
+			"first_name":       {"Jill"},
+			"last_name":        {"Smith"},
+			"email":            {"jill@example.org"},
+			"password":         {"secret-password"},
+			"confirm_password": {"secret-password"},
+		})
+
+		// whatever the policy, they log in once they have the mail
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+			t.Errorf("%s: expected a redirect to /, but got %d %s", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+		if app.Session.Exists(req.Context(), "user") {
+			t.Errorf("%s: expected the new user not to be logged in", e.name)
+		}
+
+		queued, _ := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+		if len(queued) != 1 || queued[0].To != "jill@example.org" || !verifyLink.MatchString(queued[0].Text) {
+			t.Errorf("%s: expected one mail with a verification link to the new user, but got %+v", e.name, queued)
+		}
+	}
+}
+
+func TestAppVerifyEmail(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+	id := insertUnverifiedUser(t)
+
+	_, _ = postForm(app.ResendEmailVerification, "/verify-email/resend", url.Values{"email": {"jill@example.org"}})
+	queued, _ := app.DB.ClaimMail(ctx, 100, time.Minute)
+	if len(queued) != 1 {
+		t.Fatalf("expected one mail, but got %d", len(queued))
+	}
+	token := verifyLink.FindStringSubmatch(queued[0].Text)[1]
+
+	// the link opens a page with a button, with the token in it
+	req, _ := http.NewRequest("GET", "/verify-email?token="+token, nil)
+	req = addContextAndSessionToRequest(req, app)
+	rr := httptest.NewRecorder()
+	app.VerifyEmailPage(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), token) {
+		t.Errorf("expected the verification page with the token in it, but got %d", rr.Code)
+	}
+
+	var tests = []struct {
+		name        string
+		token       string
+		expectedLoc string
+	}{
+		{"unknown token", "no-such-token", "/verify-email/resend"},
+		{"no token", "", "/verify-email/resend"},
+		{"valid", token, "/"},
+		{"used token", token, "/verify-email/resend"},
+	}
+
+	for _, e := range tests {
+		rr, _ := postForm(app.VerifyEmail, "/verify-email", url.Values{"token": {e.token}})
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != e.expectedLoc {
+			t.Errorf("%s: expected a redirect to %s, but got %d %s", e.name, e.expectedLoc, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	jill, _ := app.DB.GetUser(ctx, id)
+	if !jill.EmailVerified() {
+		t.Error("expected the address to be verified")
+	}
+}
+
+func TestAppResendEmailVerification(t *testing.T) {
+	var tests = []struct {
+		name               string
+		email              string
+		expectedStatusCode int
+		mailed             bool
+	}{
+		{"unverified", "Jill@example.org", http.StatusSeeOther, true},
+		{"already verified", "jack@example.com", http.StatusSeeOther, false},
+		{"unknown email", "nobody@example.com", http.StatusSeeOther, false},
+		{"invalid email", "jill", http.StatusOK, false},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		insertUnverifiedUser(t)
+
+		rr, req := postForm(app.ResendEmailVerification, "/verify-email/resend", url.Values{"email": {e.email}})
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong status code. expected %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+
+		// every address gets the same answer
+		if rr.Code == http.StatusSeeOther {
+			flash := app.Session.GetString(req.Context(), "flash")
+			if rr.Header().Get("Location") != "/" || !strings.Contains(flash, "if there is an unverified account") {
+				t.Errorf("%s: expected the same redirect and flash for every address, but got %s, %q", e.name, rr.Header().Get("Location"), flash)
+			}
+		}
+
+		queued, _ := app.DB.ClaimMail(context.Background(), 100, time.Minute)
+		if mailed := len(queued) > 0; mailed != e.mailed {
+			t.Errorf("%s: expected mail to be sent to be %t, but got %d messages", e.name, e.mailed, len(queued))
+		}
+	}
+}
+
+func TestAppLoginEmailVerificationPolicy(t *testing.T) {
+	defer func() { app.EmailVerification = validation.VerificationOptional }()
+
+	var tests = []struct {
+		name        string
+		policy      validation.EmailVerification
+		email       string
+		expectedLoc string
+	}{
+		{"optional, unverified", validation.VerificationOptional, "jill@example.org", "/user/profile"},
+		{"restricted, unverified", validation.VerificationRestricted, "jill@example.org", "/user/profile"},
+		{"required, unverified", validation.VerificationRequired, "jill@example.org", "/verify-email/resend"},
+		{"required, verified", validation.VerificationRequired, "jack@example.com", "/user/profile"},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		insertUnverifiedUser(t)
+		app.EmailVerification = e.policy
+
+		password := "secret-password"
+		if e.email == "jack@example.com" {
+			password = "secret"
+		}
+		rr, req := postForm(app.Login, "/login", url.Values{"email": {e.email}, "password": {password}})
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != e.expectedLoc {
+			t.Errorf("%s: expected a redirect to %s, but got %d %s", e.name, e.expectedLoc, rr.Code, rr.Header().Get("Location"))
+		}
+		expected := e.expectedLoc == "/user/profile"
+		if loggedIn := app.Session.Exists(req.Context(), "user"); loggedIn != expected {
+			t.Errorf("%s: expected the user to be logged in to be %t", e.name, expected)
+		}
+	}
+}
+
+func Test_application_requireVerifiedEmail(t *testing.T) {
+	defer func() { app.EmailVerification = validation.VerificationOptional }()
+
+	var tests = []struct {
+		name               string
+		policy             validation.EmailVerification
+		verified           bool
+		expectedStatusCode int
+	}{
+		{"optional, unverified", validation.VerificationOptional, false, http.StatusOK},
+		{"restricted, unverified", validation.VerificationRestricted, false, http.StatusSeeOther},
+		{"restricted, verified", validation.VerificationRestricted, true, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		resetDB()
+		id := insertUnverifiedUser(t)
+		app.EmailVerification = e.policy
+		if e.verified {
+			_ = app.DB.MarkEmailVerified(context.Background(), id)
+		}
+		// the session is from before jill verified her address
+		jill, _ := app.DB.GetUser(context.Background(), id)
+		jill.EmailVerifiedAt = nil
+
+		req := httptest.NewRequest("GET", "/admin/users", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", *jill)
+		rr := httptest.NewRecorder()
+		app.requireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
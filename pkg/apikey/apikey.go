@@ -0,0 +1,114 @@
+// Package apikey makes and checks the api keys users make for scripts to call the api with, in
+// place of an access token. Keys are random, and start with a public prefix that identifies them
+// in lists and logs; only a hash of each key is stored, so a copy of the database is no use for
+// calling the api.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// Prefix starts every key, so that keys can be told apart from access tokens, and found by
+// secret scanners.
+const Prefix = "wak_"
+
+const (
+	// idBytes is how many random bytes go into the public part of a key, and secretBytes into
+	// the rest
+	idBytes     = 6
+	secretBytes = 32
+	// touchEvery is how often the time a key was last used is brought up to date
+	touchEvery = time.Minute
+)
+
+// ErrInvalid is returned for a key that is unknown, revoked or expired.
+var ErrInvalid = errors.New("apikey: unknown, revoked or expired key")
+
+// IsKey reports whether token is shaped like an api key, rather than an access token.
+func IsKey(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// Issue makes a key, stores k in db with its prefix and hash, and returns the key itself, to be
+// shown to the user once, along with what was stored.
+func Issue(ctx context.Context, db repository.DatabaseRepo, k data.APIKey) (string, *data.APIKey, error) {
+	id := make([]byte, idBytes)
+	secret := make([]byte, secretBytes)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	k.Prefix = Prefix + hex.EncodeToString(id)
+	key := k.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	k.KeyHash = Hash(key)
+
+	var err error
+	k.ID, err = db.InsertAPIKey(ctx, k)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, &k, nil
+}
+
+// Lookup returns the stored key for key, if it works at the given time; if not, it returns
+// ErrInvalid.
+func Lookup(ctx context.Context, db repository.DatabaseRepo, key string, at time.Time) (*data.APIKey, error) {
+	if !IsKey(key) {
+		return nil, ErrInvalid
+	}
+
+	k, err := db.GetAPIKey(ctx, Hash(key))
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !k.Active(at) {
+		return nil, ErrInvalid
+	}
+	return k, nil
+}
+
+// Authenticate returns the stored key for key, as Lookup does, and records that it was used.
+// The time it was last used is only written once every touchEvery, so that a busy script does
+// not write to the database with every call.
+func Authenticate(ctx context.Context, db repository.DatabaseRepo, key string) (*data.APIKey, error) {
+	now := time.Now()
+	k, err := Lookup(ctx, db, key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= touchEvery {
+		// a key that cannot be marked as used still works
+		err = db.TouchAPIKey(ctx, k.ID, now)
+		if err != nil {
+			log.Printf("recording use of api key %s: %s", k.Prefix, err)
+		} else {
+			k.LastUsedAt = &now
+		}
+	}
+
+	return k, nil
+}
+
+// Hash returns the hex encoded sha256 hash of a key, which is what is stored in the database.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
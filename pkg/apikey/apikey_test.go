@@ -0,0 +1,73 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository/dbrepo"
+)
+
+func TestIssueAndAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	db := dbrepo.NewMemoryDBRepo(0)
+	userID, err := db.InsertUser(ctx, data.User{Email: "jack@example.com", FirstName: "Jack", LastName: "Smith", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, stored, err := Issue(ctx, db, data.APIKey{UserID: userID, Name: "ci", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal("issuing key failed:", err)
+	}
+	if !IsKey(key) || !strings.HasPrefix(key, stored.Prefix+"_") || stored.KeyHash != Hash(key) || stored.ID == 0 {
+		t.Errorf("unexpected key %q, stored as %+v", key, stored)
+	}
+	if strings.Contains(stored.Prefix, key[len(stored.Prefix):]) {
+		t.Error("expected the prefix not to give the key away")
+	}
+
+	other, _, _ := Issue(ctx, db, data.APIKey{UserID: userID, Name: "ci", ExpiresAt: time.Now().Add(time.Hour)})
+	if other == key {
+		t.Error("expected every key to be different")
+	}
+
+	expired, _, _ := Issue(ctx, db, data.APIKey{UserID: userID, Name: "old", ExpiresAt: time.Now().Add(-time.Second)})
+	revoked, revokedKey, _ := Issue(ctx, db, data.APIKey{UserID: userID, Name: "gone", ExpiresAt: time.Now().Add(time.Hour)})
+	_ = db.RevokeAPIKey(ctx, userID, revokedKey.ID)
+
+	var tests = []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{"valid", key, true},
+		{"empty", "", false},
+		{"access token", "eyJhbGciOiJIUzI1NiJ9.e30.sig", false},
+		{"unknown", Prefix + "000000000000_nope", false},
+		{"tampered", key + "x", false},
+		{"expired", expired, false},
+		{"revoked", revoked, false},
+	}
+
+	for _, e := range tests {
+		found, err := Authenticate(ctx, db, e.key)
+		if e.valid {
+			if err != nil || found.UserID != userID || found.LastUsedAt == nil {
+				t.Errorf("%s: expected the key of user %d, marked as used, but got %+v, %v", e.name, userID, found, err)
+			}
+		} else if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, but got %v", e.name, err)
+		}
+	}
+
+	// use is only recorded once a minute
+	first, _ := db.GetAPIKey(ctx, Hash(key))
+	_, _ = Authenticate(ctx, db, key)
+	second, _ := db.GetAPIKey(ctx, Hash(key))
+	if !second.LastUsedAt.Equal(*first.LastUsedAt) {
+		t.Errorf("expected the last use to stay at %v, but got %v", first.LastUsedAt, second.LastUsedAt)
+	}
+}
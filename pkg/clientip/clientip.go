@@ -0,0 +1,104 @@
+// Package clientip finds the address a request came from. Anyone can set X-Forwarded-For, so it
+// is only believed when the request came through a proxy the application is told to trust.
+package clientip
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Proxies are the networks of the proxies in front of an application.
+type Proxies []*net.IPNet
+
+// Parse reads a comma separated list of addresses and networks, such as
+// "10.0.0.0/8, 192.0.2.1". An empty string is no proxies.
+func Parse(s string) (Proxies, error) {
+	var proxies Proxies
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("clientip: %q is not an address or a network", field)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("clientip: %q is not an address or a network", field)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Flags defines the -trusted-proxies command line flag, which sets p, on fs.
+func (p *Proxies) Flags(fs *flag.FlagSet) {
+	fs.Func("trusted-proxies", "comma separated addresses or networks of the proxies in front of the app; X-Forwarded-For is only believed from them", func(s string) error {
+		proxies, err := Parse(s)
+		if err != nil {
+			return err
+		}
+		*p = proxies
+		return nil
+	})
+}
+
+// trusts reports whether ip is one of the proxies.
+func (p Proxies) trusts(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address r came from, without its port, or "" if it is not known. When r
+// came from a trusted proxy, X-Forwarded-For is read from the right, past any more trusted
+// proxies, to the first address that is not one; everything to the left of it could be made up.
+func (p Proxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if !p.trusts(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// a proxy we trust would not have written this, so stop at the last one that did
+			break
+		}
+		client = hop.String()
+		if !p.trusts(hop) {
+			break
+		}
+	}
+	return client
+}
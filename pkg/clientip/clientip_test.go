@@ -0,0 +1,65 @@
+package clientip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected int
+		valid    bool
+	}{
+		{"", 0, true},
+		{"192.0.2.1", 1, true},
+		{"10.0.0.0/8, 2001:db8::1 ,fd00::/8", 3, true},
+		{"proxy.example.com", 0, false},
+		{"10.0.0.0/33", 0, false},
+	}
+
+	for _, e := range tests {
+		proxies, err := Parse(e.in)
+		if (err == nil) != e.valid || len(proxies) != e.expected {
+			t.Errorf("%q: expected %d proxies and valid %t, but got %v, %v", e.in, e.expected, e.valid, proxies, err)
+		}
+	}
+}
+
+func TestProxies_ClientIP(t *testing.T) {
+	proxies, _ := Parse("10.0.0.0/8, 192.0.2.1")
+
+	var tests = []struct {
+		name       string
+		proxies    Proxies
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"direct", proxies, "198.51.100.1:1234", nil, "198.51.100.1"},
+		{"ipv6", proxies, "[2001:db8::1]:1234", nil, "2001:db8::1"},
+		{"no port", proxies, "198.51.100.1", nil, ""},
+		{"not an address", proxies, "hello:world", nil, ""},
+		{"empty", proxies, "", nil, ""},
+		{"forwarded by untrusted", proxies, "198.51.100.1:1234", []string{"203.0.113.9"}, "198.51.100.1"},
+		{"no proxies trusted", nil, "192.0.2.1:1234", []string{"203.0.113.9"}, "192.0.2.1"},
+		{"forwarded by proxy", proxies, "192.0.2.1:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"through two proxies", proxies, "192.0.2.1:1234", []string{"203.0.113.9, 10.1.2.3"}, "203.0.113.9"},
+		{"spoofed on the left", proxies, "192.0.2.1:1234", []string{"1.1.1.1, 203.0.113.9"}, "203.0.113.9"},
+		{"several headers", proxies, "192.0.2.1:1234", []string{"1.1.1.1", "203.0.113.9"}, "203.0.113.9"},
+		{"all proxies", proxies, "192.0.2.1:1234", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"garbage", proxies, "192.0.2.1:1234", []string{"203.0.113.9, not-an-ip"}, "192.0.2.1"},
+		{"no header", proxies, "192.0.2.1:1234", nil, "192.0.2.1"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		for _, f := range e.forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		if ip := e.proxies.ClientIP(req); ip != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.name, e.expected, ip)
+		}
+	}
+}
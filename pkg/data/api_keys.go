@@ -0,0 +1,26 @@
+package data
+
+import "time"
+
+// APIKey is the type for a key a user has made for scripts to call the api as them, in place of
+// an access token. Only a hash of the key is stored; the key itself is shown once, when it is
+// made. Prefix is the start of the key, which identifies it without giving it away.
+type APIKey struct {
+	ID             int    `json:"id"`
+	UserID         int    `json:"user_id"`
+	OrganizationID int    `json:"organization_id,omitempty"`
+	Name           string `json:"name"`
+	Prefix         string `json:"prefix"`
+	KeyHash        string `json:"-"`
+	// Scopes are the permissions the key may use, of those its user has when it is used
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Active reports whether the key works at the given time: it is neither revoked nor expired.
+func (k *APIKey) Active(at time.Time) bool {
+	return k.RevokedAt == nil && at.Before(k.ExpiresAt)
+}
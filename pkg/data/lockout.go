@@ -0,0 +1,48 @@
+package data
+
+import "time"
+
+// The scopes failed logins are counted in. Failures count against the account they were for,
+// by email address, whether or not it exists, and against the address they came from. Wrong
+// codes from an authenticator count against the user who gave them, by id.
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+	ThrottleMFA     = "mfa"
+)
+
+// The kinds of LockoutEvent.
+const (
+	LockoutEventLocked   = "locked"
+	LockoutEventUnlocked = "unlocked"
+)
+
+// LoginThrottle is the type for the failed logins counted against an account or an address. Once
+// there are too many, logins are refused until LockedUntil.
+type LoginThrottle struct {
+	Scope         string     `json:"scope"`
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// Locked reports whether logins are refused at the time at.
+func (t *LoginThrottle) Locked(at time.Time) bool {
+	return t.LockedUntil != nil && at.Before(*t.LockedUntil)
+}
+
+// LockoutEvent is the type for a record of an account or address being locked, or of an
+// administrator unlocking it.
+type LockoutEvent struct {
+	ID    int    `json:"id"`
+	Scope string `json:"scope"`
+	Key   string `json:"key"`
+	Event string `json:"event"`
+	// Failures is how many failed logins in a row led to a lock
+	Failures    int        `json:"failures"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// ActorID is the user who unlocked, or zero for a lock, which nobody does by hand
+	ActorID   int       `json:"actor_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
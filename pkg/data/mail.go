@@ -0,0 +1,26 @@
+package data
+
+import "time"
+
+// Mail is an email waiting in the outbox, or one that has left it. It is sent to To with Subject,
+// and a body in both plain text and HTML. A message that fails to send is tried again at
+// NextAttemptAt, until it is sent or given up on, when FailedAt is set and LastError says why.
+type Mail struct {
+	ID            int        `json:"id"`
+	To            string     `json:"to"`
+	Subject       string     `json:"subject"`
+	Text          string     `json:"text"`
+	HTML          string     `json:"html"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	FailedAt      *time.Time `json:"failed_at,omitempty"`
+	CreatedAt     time.Time  `json:"-"`
+	UpdatedAt     time.Time  `json:"-"`
+}
+
+// Pending reports whether the mail is still to be sent.
+func (m *Mail) Pending() bool {
+	return m.SentAt == nil && m.FailedAt == nil
+}
@@ -0,0 +1,32 @@
+package data
+
+import "time"
+
+// UserMFA is the type for a user's TOTP authenticator. It only counts as a second factor once the
+// user has confirmed it, by entering a code from it; until then it is an enrolment in progress.
+type UserMFA struct {
+	UserID int `json:"user_id"`
+	// Secret is the shared TOTP secret, encrypted; it is never sent back to the user once the
+	// enrolment is confirmed
+	Secret      string     `json:"-"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	// LastUsedStep is the time step of the last code accepted, so that no code is accepted twice
+	LastUsedStep int64     `json:"-"`
+	CreatedAt    time.Time `json:"-"`
+}
+
+// Enabled reports whether the authenticator has been confirmed, so that logging in needs a code
+// from it.
+func (m *UserMFA) Enabled() bool {
+	return m.ConfirmedAt != nil
+}
+
+// RecoveryCode is the type for a one-time code a user can log in with in place of a TOTP code,
+// for when they lose their authenticator. Only a hash of the code is stored.
+type RecoveryCode struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	CodeHash  string     `json:"-"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"-"`
+}
@@ -0,0 +1,40 @@
+package data
+
+import "time"
+
+// Organization is a tenant. Users belong to any number of organizations, and have roles in each
+// of them; what a user may do to other users is limited to the members of one organization at
+// a time.
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// Membership is the place of a user in an organization, and the roles they have there.
+type Membership struct {
+	OrganizationID   int      `json:"organization_id"`
+	OrganizationName string   `json:"organization_name"`
+	UserID           int      `json:"user_id"`
+	Roles            []string `json:"roles"`
+}
+
+// HasRole reports whether the member has the named role in the organization.
+func (m *Membership) HasRole(role string) bool {
+	for _, r := range m.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Invitation asks a user to join an organization. Adding somebody to an organization would let
+// its admins act on them, so they only become a member once they accept.
+type Invitation struct {
+	OrganizationID   int       `json:"organization_id"`
+	OrganizationName string    `json:"organization_name"`
+	UserID           int       `json:"user_id"`
+	CreatedAt        time.Time `json:"created_at"`
+}
@@ -0,0 +1,12 @@
+package data
+
+import "time"
+
+// RateLimitBucket is the type for a token bucket of the rate limiter: it holds up to a burst of
+// tokens, refills at a steady rate, and every request takes a token from it.
+type RateLimitBucket struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+	// RefilledAt is when Tokens was last brought up to date
+	RefilledAt time.Time `json:"refilled_at"`
+}
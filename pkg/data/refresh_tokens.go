@@ -0,0 +1,30 @@
+package data
+
+import "time"
+
+// RefreshToken is the type for a persisted refresh token. Only a hash of the
+// token is stored; the token itself is handed to the client once and never
+// written to the database. Tokens issued from the same login share a FamilyID,
+// so that the whole chain can be revoked if a token is ever reused. OrganizationID is the
+// organization the tokens were issued for, or zero if the user had none.
+type RefreshToken struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	OrganizationID int        `json:"organization_id"`
+	TokenHash      string     `json:"-"`
+	FamilyID       string     `json:"family_id"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt      time.Time  `json:"-"`
+	UpdatedAt      time.Time  `json:"-"`
+}
+
+// Revoked reports whether the token has been used or revoked.
+func (t *RefreshToken) Revoked() bool {
+	return t.RevokedAt != nil
+}
+
+// Expired reports whether the token is past its expiry.
+func (t *RefreshToken) Expired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
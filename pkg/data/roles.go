@@ -0,0 +1,31 @@
+package data
+
+// RoleAdmin is the role of the people who manage users. At least one user always has it, and
+// every organization has at least one member with it.
+const RoleAdmin = "admin"
+
+// Permissions say what a user may do to users other than themselves. They are granted through
+// roles, and carried in access tokens. Roles held in an organization grant their permissions over
+// its members only; roles held outside of any organization grant them in every organization the
+// user belongs to.
+const (
+	// PermissionReadUsers lets a user see anyone, and list users
+	PermissionReadUsers = "users:read"
+	// PermissionWriteUsers lets a user create users, and change anyone's details
+	PermissionWriteUsers = "users:write"
+	// PermissionDeleteUsers lets a user delete anyone
+	PermissionDeleteUsers = "users:delete"
+	// PermissionManageRoles lets a user give roles to users, and take them away
+	PermissionManageRoles = "roles:manage"
+	// PermissionManageMembers lets a user add people to an organization, and remove them
+	PermissionManageMembers = "members:manage"
+)
+
+// Role is a named set of permissions. A user may have any number of roles, and may do whatever
+// any of them permits.
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
@@ -0,0 +1,35 @@
+package data
+
+import "time"
+
+// The purposes a UserToken can be issued for. A token only works for the purpose it was issued
+// for.
+const (
+	TokenPurposeResetPassword = "reset_password"
+	TokenPurposeVerifyEmail   = "verify_email"
+	// TokenPurposeMFAChallenge tokens are handed to a user who has given their password, to
+	// finish logging in with a second factor
+	TokenPurposeMFAChallenge = "mfa_challenge"
+)
+
+// UserToken is the type for a one-time token mailed to a user. Only a hash of the token is
+// stored; the token itself goes out in the mail and is never written to the database.
+type UserToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Purpose   string     `json:"purpose"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"-"`
+}
+
+// Used reports whether the token has been used or revoked.
+func (t *UserToken) Used() bool {
+	return t.UsedAt != nil
+}
+
+// Expired reports whether the token is past its expiry.
+func (t *UserToken) Expired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
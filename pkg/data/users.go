@@ -2,6 +2,7 @@ package data
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -14,10 +15,16 @@ type User struct {
 	LastName   string    `json:"last_name"`
 	Email      string    `json:"email"`
 	Password   string    `json:"-"`
-	IsAdmin    int       `json:"is_admin"`
+	Roles      []string  `json:"roles"`
 	CreatedAt  time.Time `json:"-"`
 	UpdatedAt  time.Time `json:"-"`
 	ProfilePic UserImage `json:"-"`
+	// PasswordChangedAt is when the password was last changed, if it ever was; sessions from
+	// before then are no longer honoured
+	PasswordChangedAt *time.Time `json:"-"`
+	// EmailVerifiedAt is when the user proved they own their email address, or nil if they have
+	// not since it last changed
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 }
 
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
@@ -37,3 +44,24 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 
 	return true, nil
 }
+
+// EmailVerified reports whether the user has proved they own their email address.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// HasRole reports whether the user has the named role.
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeEmail returns an email address in the form it is stored and looked up in. Email
+// addresses are matched without regard to case, so they are kept in lower case.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,232 @@
+// Package lockout slows down password guessing. Failed logins are counted against the account
+// they were for, by email address, and against the address they came from. Past a threshold,
+// each failure locks the account or address out for twice as long as the one before, up to a
+// limit, and logins are refused without checking the password until the lock runs out. The
+// counts are kept in the database, so every application sharing it sees the same ones.
+//
+// Wrong codes from an authenticator are counted the same way, against the user who gave them,
+// and lock them out of giving codes.
+package lockout
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// Guard counts failed logins and decides when to lock. A zero threshold turns off counting for
+// its scope.
+type Guard struct {
+	// AccountThreshold is how many failures in a row an account is allowed before it is locked
+	AccountThreshold int
+	// IPThreshold is how many failures in a row an address is allowed; it is higher, since many
+	// users may share one
+	IPThreshold int
+	// MFAThreshold is how many wrong codes from their authenticator a user is allowed in a row
+	// before they are locked out of giving codes
+	MFAThreshold int
+	// Delay is how long the first lock lasts
+	Delay time.Duration
+	// MaxDelay is the longest any lock lasts
+	MaxDelay time.Duration
+	// Window is how long failures are remembered; after a quiet spell this long, the count
+	// starts again
+	Window time.Duration
+}
+
+// Default is the Guard the applications start with.
+var Default = Guard{
+	AccountThreshold: 5,
+	IPThreshold:      50,
+	MFAThreshold:     5,
+	Delay:            30 * time.Second,
+	MaxDelay:         15 * time.Minute,
+	Window:           24 * time.Hour,
+}
+
+// Flags defines the command line flags that set g on fs, with g's values as their defaults.
+func (g *Guard) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&g.AccountThreshold, "lockout-threshold", g.AccountThreshold, "failed logins in a row before an account is locked for a while; 0 for no limit")
+	fs.IntVar(&g.IPThreshold, "lockout-ip-threshold", g.IPThreshold, "failed logins in a row before an address is locked for a while; 0 for no limit")
+	fs.IntVar(&g.MFAThreshold, "lockout-mfa-threshold", g.MFAThreshold, "wrong two-factor codes in a row before a user is locked out of giving codes for a while; 0 for no limit")
+	fs.DurationVar(&g.Delay, "lockout-delay", g.Delay, "how long the first lock lasts; each failure after it doubles it")
+	fs.DurationVar(&g.MaxDelay, "lockout-max-delay", g.MaxDelay, "the longest a lock lasts")
+	fs.DurationVar(&g.Window, "lockout-window", g.Window, "how long failed logins are remembered")
+}
+
+// AccountKey is the key failures against email are counted under. Addresses are matched
+// whatever their case, as they are for logging in.
+func AccountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// MFAKey is the key wrong codes from the user with userID are counted under.
+func MFAKey(userID int) string {
+	return strconv.Itoa(userID)
+}
+
+// Check returns how long until a login for email from ip may be tried, or zero if it may be
+// now. An empty ip is not checked.
+func (g *Guard) Check(ctx context.Context, db repository.DatabaseRepo, email, ip string) (time.Duration, error) {
+	return g.check(ctx, db, g.scopes(email, ip))
+}
+
+// Fail counts a failed login for email from ip, locks the account or the address if it has had
+// too many, and records each lock. It returns how long until a login may be tried again, or zero
+// if there is no lock.
+func (g *Guard) Fail(ctx context.Context, db repository.DatabaseRepo, email, ip string) (time.Duration, error) {
+	return g.fail(ctx, db, g.scopes(email, ip))
+}
+
+// CheckMFA returns how long until the user with userID may give a code from their authenticator,
+// or zero if they may now.
+func (g *Guard) CheckMFA(ctx context.Context, db repository.DatabaseRepo, userID int) (time.Duration, error) {
+	return g.check(ctx, db, g.mfaScopes(userID))
+}
+
+// FailMFA counts a wrong code from the user with userID, and locks them out of giving codes if
+// they have given too many. It returns how long until they may give one again, or zero if there
+// is no lock.
+func (g *Guard) FailMFA(ctx context.Context, db repository.DatabaseRepo, userID int) (time.Duration, error) {
+	return g.fail(ctx, db, g.mfaScopes(userID))
+}
+
+// SucceedMFA forgets the wrong codes from the user with userID after a right one.
+func (g *Guard) SucceedMFA(ctx context.Context, db repository.DatabaseRepo, userID int) error {
+	return db.ClearLoginFailures(ctx, data.ThrottleMFA, MFAKey(userID))
+}
+
+// check returns how long until none of scopes is locked.
+func (g *Guard) check(ctx context.Context, db repository.DatabaseRepo, scopes []scope) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, s := range scopes {
+		throttle, err := db.GetLoginThrottle(ctx, s.scope, s.key)
+		if errors.Is(err, repository.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if throttle.Locked(now) && throttle.LockedUntil.Sub(now) > wait {
+			wait = throttle.LockedUntil.Sub(now)
+		}
+	}
+	return wait, nil
+}
+
+// fail counts a failure in each of scopes, locks those that have had too many and records each
+// lock. It returns how long the longest lock lasts, or zero if there is none.
+func (g *Guard) fail(ctx context.Context, db repository.DatabaseRepo, scopes []scope) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, s := range scopes {
+		failures, err := db.RecordLoginFailure(ctx, s.scope, s.key, now.Add(-g.Window))
+		if err != nil {
+			return 0, err
+		}
+
+		d := g.lockFor(s.threshold, failures)
+		if d == 0 {
+			continue
+		}
+		until := now.Add(d)
+		err = db.LockLogin(ctx, s.scope, s.key, until)
+		if err != nil {
+			return 0, err
+		}
+		_, err = db.InsertLockoutEvent(ctx, data.LockoutEvent{
+			Scope:       s.scope,
+			Key:         s.key,
+			Event:       data.LockoutEventLocked,
+			Failures:    failures,
+			LockedUntil: &until,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Succeed forgets the failed logins for email after a login with the right password. Those from
+// the address are kept, or knowing the password of one account would reset the count for
+// guessing at the others.
+func (g *Guard) Succeed(ctx context.Context, db repository.DatabaseRepo, email string) error {
+	return db.ClearLoginFailures(ctx, data.ThrottleAccount, AccountKey(email))
+}
+
+// Unlock forgets the failed logins for email, so that it can be logged in to straight away, and
+// records that actorID did it. Unlocking an account with no failures does nothing.
+func (g *Guard) Unlock(ctx context.Context, db repository.DatabaseRepo, email string, actorID int) error {
+	key := AccountKey(email)
+	return db.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		throttle, err := repo.GetLoginThrottle(ctx, data.ThrottleAccount, key)
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = repo.ClearLoginFailures(ctx, data.ThrottleAccount, key)
+		if err != nil {
+			return err
+		}
+		_, err = repo.InsertLockoutEvent(ctx, data.LockoutEvent{
+			Scope:    data.ThrottleAccount,
+			Key:      key,
+			Event:    data.LockoutEventUnlocked,
+			Failures: throttle.Failures,
+			ActorID:  actorID,
+		})
+		return err
+	})
+}
+
+// lockFor returns how long to lock for after failures in a row, or zero if that is not too many:
+// Delay at the threshold, doubling with each failure after it, up to MaxDelay.
+func (g *Guard) lockFor(threshold, failures int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	d := g.Delay
+	for i := threshold; i < failures && d < g.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > g.MaxDelay {
+		d = g.MaxDelay
+	}
+	return d
+}
+
+type scope struct {
+	scope, key string
+	threshold  int
+}
+
+// scopes returns the scopes a login for email from ip counts in.
+func (g *Guard) scopes(email, ip string) []scope {
+	var scopes []scope
+	if g.AccountThreshold > 0 {
+		scopes = append(scopes, scope{data.ThrottleAccount, AccountKey(email), g.AccountThreshold})
+	}
+	if g.IPThreshold > 0 && ip != "" {
+		scopes = append(scopes, scope{data.ThrottleIP, ip, g.IPThreshold})
+	}
+	return scopes
+}
+
+// mfaScopes returns the scopes a code from the user with userID counts in.
+func (g *Guard) mfaScopes(userID int) []scope {
+	if g.MFAThreshold > 0 {
+		return []scope{{data.ThrottleMFA, MFAKey(userID), g.MFAThreshold}}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository/dbrepo"
+)
+
+func TestLockFor(t *testing.T) {
+	g := Guard{Delay: 30 * time.Second, MaxDelay: 5 * time.Minute}
+
+	var tests = []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, 30 * time.Second},
+		{6, time.Minute},
+		{7, 2 * time.Minute},
+		{8, 4 * time.Minute},
+		{9, 5 * time.Minute},
+		{1000, 5 * time.Minute},
+	}
+
+	for _, e := range tests {
+		if d := g.lockFor(5, e.failures); d != e.expected {
+			t.Errorf("%d failures: expected %s, but got %s", e.failures, e.expected, d)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	db := dbrepo.NewMemoryDBRepo(0)
+	g := Guard{AccountThreshold: 3, IPThreshold: 5, Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+
+	// the account is locked at the third failure, whatever the case of the address
+	for i, email := range []string{"jack@example.com", "JACK@example.com", "jack@example.com"} {
+		wait, err := g.Check(ctx, db, email, "192.0.2.1")
+		if err != nil || wait != 0 {
+			t.Fatalf("attempt %d: expected no wait, but got %s, %v", i+1, wait, err)
+		}
+		wait, err = g.Fail(ctx, db, email, "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked := wait > 0; locked != (i == 2) {
+			t.Errorf("attempt %d: expected locked to be %t, but waited %s", i+1, i == 2, wait)
+		}
+	}
+
+	wait, _ := g.Check(ctx, db, "jack@example.com", "192.0.2.2")
+	if wait <= 55*time.Second || wait > time.Minute {
+		t.Errorf("expected to wait about a minute, from any address, but got %s", wait)
+	}
+	if wait, _ := g.Check(ctx, db, "admin@example.com", "192.0.2.2"); wait != 0 {
+		t.Errorf("expected other accounts not to wait, but got %s", wait)
+	}
+
+	events, _ := db.LockoutEvents(ctx, data.ThrottleAccount, "jack@example.com", 10)
+	if len(events) != 1 || events[0].Event != data.LockoutEventLocked || events[0].Failures != 3 {
+		t.Errorf("expected the lock to be recorded, but got %+v", events)
+	}
+
+	// guessing at other accounts from the same address locks the address
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		_, _ = g.Fail(ctx, db, email, "192.0.2.1")
+	}
+	if wait, _ := g.Check(ctx, db, "admin@example.com", "192.0.2.1"); wait == 0 {
+		t.Error("expected the address to be locked")
+	}
+
+	// logging in clears the account's failures, but not the address's
+	_ = g.Succeed(ctx, db, "b@example.com")
+	if _, err := db.GetLoginThrottle(ctx, data.ThrottleAccount, "b@example.com"); err == nil {
+		t.Error("expected the account's failures to be forgotten")
+	}
+	if wait, _ := g.Check(ctx, db, "b@example.com", "192.0.2.1"); wait == 0 {
+		t.Error("expected the address to stay locked")
+	}
+
+	// an administrator unlocks the account
+	err := g.Unlock(ctx, db, "Jack@example.com", 1)
+	if err != nil {
+		t.Fatal("unlocking failed:", err)
+	}
+	if wait, _ := g.Check(ctx, db, "jack@example.com", "192.0.2.2"); wait != 0 {
+		t.Errorf("expected the account to be unlocked, but got %s", wait)
+	}
+	events, _ = db.LockoutEvents(ctx, data.ThrottleAccount, "jack@example.com", 10)
+	if len(events) != 2 || events[0].Event != data.LockoutEventUnlocked || events[0].ActorID != 1 {
+		t.Errorf("expected the unlock to be recorded, but got %+v", events)
+	}
+
+	// unlocking an account with no failures records nothing
+	_ = g.Unlock(ctx, db, "jack@example.com", 1)
+	if events, _ = db.LockoutEvents(ctx, data.ThrottleAccount, "jack@example.com", 10); len(events) != 2 {
+		t.Errorf("expected no new event, but got %d events", len(events))
+	}
+}
+
+func TestGuardMFA(t *testing.T) {
+	ctx := context.Background()
+	db := dbrepo.NewMemoryDBRepo(0)
+	g := Guard{AccountThreshold: 3, MFAThreshold: 2, Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+
+	// the second wrong code locks the user out of giving codes, but not out of logging in
+	for i := 0; i < 2; i++ {
+		wait, err := g.FailMFA(ctx, db, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked := wait > 0; locked != (i == 1) {
+			t.Errorf("code %d: expected locked to be %t, but waited %s", i+1, i == 1, wait)
+		}
+	}
+	if wait, _ := g.CheckMFA(ctx, db, 2); wait == 0 {
+		t.Error("expected the user to be locked out of giving codes")
+	}
+	if wait, _ := g.CheckMFA(ctx, db, 1); wait != 0 {
+		t.Errorf("expected other users not to wait, but got %s", wait)
+	}
+	if wait, _ := g.Check(ctx, db, "jack@example.com", ""); wait != 0 {
+		t.Errorf("expected logins not to wait for wrong codes, but got %s", wait)
+	}
+
+	// a right code forgets the wrong ones
+	_, _ = g.FailMFA(ctx, db, 1)
+	_ = g.SucceedMFA(ctx, db, 1)
+	if _, err := db.GetLoginThrottle(ctx, data.ThrottleMFA, MFAKey(1)); err == nil {
+		t.Error("expected the wrong codes to be forgotten")
+	}
+}
+
+func TestGuardOff(t *testing.T) {
+	ctx := context.Background()
+	db := dbrepo.NewMemoryDBRepo(0)
+	g := Guard{Delay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+
+	for i := 0; i < 100; i++ {
+		if wait, err := g.Fail(ctx, db, "jack@example.com", "192.0.2.1"); err != nil || wait != 0 {
+			t.Fatalf("expected no lock with no thresholds, but got %s, %v", wait, err)
+		}
+		if wait, err := g.FailMFA(ctx, db, 2); err != nil || wait != 0 {
+			t.Fatalf("expected no lock on codes with no thresholds, but got %s, %v", wait, err)
+		}
+	}
+}
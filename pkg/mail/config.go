@@ -0,0 +1,58 @@
+package mail
+
+import (
+	"flag"
+	"fmt"
+)
+
+// The ways mail can be sent, chosen by Config.Mode.
+const (
+	// ModeNone sends nothing; mail waits in the outbox
+	ModeNone = "none"
+	// ModeDev writes mail to Config.Dir, for the Viewer to show if Config.Viewer is set
+	ModeDev = "dev"
+	// ModeSMTP sends mail through Config.SMTP
+	ModeSMTP = "smtp"
+)
+
+// Config is how an application sends mail.
+type Config struct {
+	Mode string
+	From string
+	Dir  string
+	// Viewer is whether the mail written in ModeDev is served at /dev/mail. It holds every reset
+	// and verification link, so it is off unless asked for, and only shown to this machine.
+	Viewer bool
+	SMTP   SMTPSender
+}
+
+// Flags defines the command line flags that set c on fs.
+func (c *Config) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Mode, "mail", ModeNone, "how mail is sent: dev, written to -mail-dir; smtp; or none, leaving it in the outbox")
+	fs.StringVar(&c.From, "mail-from", "Example <noreply@example.com>", "address mail is sent from")
+	fs.StringVar(&c.Dir, "mail-dir", "./tmp/mail", "directory dev mail is written to")
+	fs.BoolVar(&c.Viewer, "mail-viewer", false, "show dev mail at /dev/mail, to requests from this machine only")
+	fs.StringVar(&c.SMTP.Addr, "smtp-addr", "localhost:1025", "host:port of the smtp server")
+	fs.StringVar(&c.SMTP.Username, "smtp-username", "", "smtp user name; empty for none")
+	fs.StringVar(&c.SMTP.Password, "smtp-password", "", "smtp password")
+}
+
+// Sender returns the sender for c.Mode, or nil if mail is not to be sent.
+func (c *Config) Sender() (Sender, error) {
+	if c.Viewer && c.Mode != ModeDev {
+		return nil, fmt.Errorf("-mail-viewer needs -mail %s", ModeDev)
+	}
+
+	switch c.Mode {
+	case ModeNone:
+		return nil, nil
+	case ModeDev:
+		return &FileSender{Dir: c.Dir, From: c.From}, nil
+	case ModeSMTP:
+		s := c.SMTP
+		s.From = c.From
+		return &s, nil
+	default:
+		return nil, fmt.Errorf("unknown -mail %q; use dev, smtp or none", c.Mode)
+	}
+}
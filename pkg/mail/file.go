@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// FileSender "sends" each message by writing it to Dir, as an .eml file that mail clients can
+// open. It is meant for development, where mail should be seen but not sent.
+type FileSender struct {
+	Dir  string
+	From string
+}
+
+// Send writes msg to a new file in s.Dir, which is created if need be.
+func (s *FileSender) Send(ctx context.Context, msg Message) error {
+	now := time.Now()
+	b, err := encode(s.From, msg, now)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// the time comes first, so that the files sort in the order they were sent
+	f, err := os.CreateTemp(s.Dir, now.UTC().Format("20060102T150405.000000000")+"-*.eml")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return f.Close()
+}
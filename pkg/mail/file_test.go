@@ -0,0 +1,113 @@
+package mail
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileSender_Send(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSender{Dir: dir, From: "Example <noreply@example.com>"}
+
+	msg := Message{To: "jack@example.com", Subject: "Grüße", Text: "Hello, a line that is long enough to have to be wrapped when it is encoded as quoted-printable.", HTML: "<p>Hello</p>"}
+	err := s.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ".eml") {
+		t.Fatalf("expected one .eml file, but got %v", entries)
+	}
+
+	m, err := readMail(dir + "/" + entries[0].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From != s.From || m.To != msg.To || m.Subject != msg.Subject || m.Text != msg.Text || m.HTML != msg.HTML || m.Date.IsZero() {
+		t.Errorf("expected to read back what was sent, but got %+v", m)
+	}
+
+	// headers cannot be smuggled in
+	err = s.Send(context.Background(), Message{To: "jack@example.com\r\nBcc: jill@example.com", Subject: "Hi"})
+	if err != errHeaderInjection {
+		t.Errorf("expected %v, but got %v", errHeaderInjection, err)
+	}
+}
+
+func TestViewer(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSender{Dir: dir, From: "noreply@example.com"}
+	_ = s.Send(context.Background(), Message{To: "jack@example.com", Subject: "First", Text: "first text", HTML: "<p>first</p>"})
+	_ = s.Send(context.Background(), Message{To: "jill@example.com", Subject: "Second", Text: "second text", HTML: "<p>second</p>"})
+	entries, _ := os.ReadDir(dir)
+
+	ts := httptest.NewServer(http.StripPrefix("/dev/mail", Viewer(dir)))
+	defer ts.Close()
+
+	var tests = []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"list", "/dev/mail/", http.StatusOK, "Second"},
+		{"html", "/dev/mail/" + entries[0].Name(), http.StatusOK, "<p>first</p>"},
+		{"text", "/dev/mail/" + entries[0].Name() + "?part=text", http.StatusOK, "first text"},
+		{"raw", "/dev/mail/" + entries[1].Name() + "?part=raw", http.StatusOK, "Subject: Second"},
+		{"unknown", "/dev/mail/nope.eml", http.StatusNotFound, ""},
+		{"not mail", "/dev/mail/..%2fsecret.txt", http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		res, err := http.Get(ts.URL + e.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != e.expectedStatus {
+			t.Errorf("%s: expected %d, but got %d", e.name, e.expectedStatus, res.StatusCode)
+		}
+		if !strings.Contains(string(body), e.expectedBody) {
+			t.Errorf("%s: did not find %q in %q", e.name, e.expectedBody, body)
+		}
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	h := LocalOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var tests = []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   string
+		expectedStatus int
+	}{
+		{"ipv4 loopback", "127.0.0.1:1234", "", http.StatusOK},
+		{"ipv6 loopback", "[::1]:1234", "", http.StatusOK},
+		{"other machine", "192.0.2.1:1234", "", http.StatusNotFound},
+		{"through a local proxy", "127.0.0.1:1234", "192.0.2.1", http.StatusNotFound},
+		{"no port", "127.0.0.1", "", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		if e.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", e.forwardedFor)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
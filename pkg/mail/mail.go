@@ -0,0 +1,88 @@
+// Package mail sends email. Messages are rendered from templates and written to the outbox by a
+// Mailer, usually in the same transaction as the change that called for them, and a Worker sends
+// them from there through a Sender, trying again later when sending fails.
+package mail
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// Message is one email, ready to send.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Sender delivers messages. An error means the message was not sent, and may be tried again.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Mailer renders messages from templates, and puts them in the outbox.
+//
+// A template is a file in Templates called <name>.mail.gohtml, which defines a "subject", a
+// plain "text" body, and the "content" of the HTML body, which goes into the "base" layout in
+// base.layout.gohtml. The subject and the text body are not HTML, and are not escaped as such.
+type Mailer struct {
+	Templates string
+}
+
+// Render renders the template called name, with td, into a message to to.
+func (m *Mailer) Render(to, name string, td any) (Message, error) {
+	file := path.Join(m.Templates, name+".mail.gohtml")
+
+	text, err := texttemplate.ParseFiles(file)
+	if err != nil {
+		return Message{}, err
+	}
+	html, err := htmltemplate.ParseFiles(file, path.Join(m.Templates, "base.layout.gohtml"))
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{To: to}
+	var buf bytes.Buffer
+
+	for _, part := range []struct {
+		name string
+		dst  *string
+		exec func() error
+	}{
+		{"subject", &msg.Subject, func() error { return text.ExecuteTemplate(&buf, "subject", td) }},
+		{"text", &msg.Text, func() error { return text.ExecuteTemplate(&buf, "text", td) }},
+		{"base", &msg.HTML, func() error { return html.ExecuteTemplate(&buf, "base", td) }},
+	} {
+		buf.Reset()
+		err = part.exec()
+		if err != nil {
+			return Message{}, err
+		}
+		*part.dst = strings.TrimSpace(buf.String())
+	}
+
+	// a subject is a single line
+	msg.Subject = strings.Join(strings.Fields(msg.Subject), " ")
+
+	return msg, nil
+}
+
+// Queue renders the template called name, with td, and puts the message to to in the outbox of
+// db. Pass the repository of a transaction to send the message only if the transaction commits.
+func (m *Mailer) Queue(ctx context.Context, db repository.DatabaseRepo, to, name string, td any) error {
+	msg, err := m.Render(to, name, td)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.InsertMail(ctx, data.Mail{To: msg.To, Subject: msg.Subject, Text: msg.Text, HTML: msg.HTML})
+	return err
+}
@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/repository/dbrepo"
+)
+
+var testData = map[string]string{"Name": "Jack & Jill", "Site": "<Example>", "URL": "https://example.com/"}
+
+func TestMailer_Render(t *testing.T) {
+	m := &Mailer{Templates: "./testdata"}
+
+	msg, err := m.Render("jack@example.com", "hello", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.To != "jack@example.com" {
+		t.Errorf("expected the message to be to jack@example.com, but got %q", msg.To)
+	}
+	// the subject and text are not HTML, so they are not escaped
+	if msg.Subject != "Hello, Jack & Jill" {
+		t.Errorf("unexpected subject %q", msg.Subject)
+	}
+	if msg.Text != "Hello Jack & Jill, welcome to <Example>." {
+		t.Errorf("unexpected text %q", msg.Text)
+	}
+	expected := `<html><body>
+<p>Hello Jack &amp; Jill, welcome to <a href="https://example.com/">&lt;Example&gt;</a>.</p>
+</body></html>`
+	if msg.HTML != expected {
+		t.Errorf("unexpected html %q", msg.HTML)
+	}
+
+	_, err = m.Render("jack@example.com", "no-such-template", testData)
+	if err == nil {
+		t.Error("expected an error rendering a template that does not exist")
+	}
+}
+
+func TestMailer_Queue(t *testing.T) {
+	db := dbrepo.NewMemoryDBRepo(0)
+	m := &Mailer{Templates: "./testdata"}
+
+	err := m.Queue(context.Background(), db, "jack@example.com", "hello", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued, _ := db.ClaimMail(context.Background(), 10, time.Minute)
+	if len(queued) != 1 || queued[0].To != "jack@example.com" || queued[0].Subject != "Hello, Jack & Jill" || !strings.Contains(queued[0].HTML, "<p>") {
+		t.Errorf("expected the rendered message in the outbox, but got %+v", queued)
+	}
+}
@@ -0,0 +1,90 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts one connection on l, and records the envelope and data of the message
+// sent over it.
+func fakeSMTPServer(t *testing.T, l net.Listener, got chan<- []string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	var lines []string
+	_ = tp.PrintfLine("220 localhost fake smtp")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			got <- lines
+			return
+		}
+		lines = append(lines, line)
+
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, _ := tp.ReadDotLines()
+			lines = append(lines, data...)
+			_ = tp.PrintfLine("250 queued")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			got <- lines
+			return
+		default:
+			_ = tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func TestSMTPSender_Send(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	got := make(chan []string, 1)
+	go fakeSMTPServer(t, l, got)
+
+	s := &SMTPSender{Addr: l.Addr().String(), From: "Example <noreply@example.com>"}
+	err = s.Send(context.Background(), Message{To: "jack@example.com", Subject: "Hello", Text: "hello", HTML: "<p>hello</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := strings.Join(<-got, "\n")
+	for _, expected := range []string{"MAIL FROM:<noreply@example.com>", "RCPT TO:<jack@example.com>", "Subject: Hello", "<p>hello</p>"} {
+		if !strings.Contains(session, expected) {
+			t.Errorf("did not find %q in the smtp session:\n%s", expected, session)
+		}
+	}
+}
+
+func TestSMTPSender_SendUnreachable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	s := &SMTPSender{Addr: addr, From: "noreply@example.com"}
+	err := s.Send(context.Background(), Message{To: "jack@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Error("expected an error sending to a server that is not there")
+	}
+
+	// a bad address never reaches the server
+	err = s.Send(context.Background(), Message{To: "not an address", Subject: "Hello"})
+	if err == nil {
+		t.Error("expected an error sending to a bad address")
+	}
+}
@@ -0,0 +1,196 @@
+package mail
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// viewedMail is a message read back from a file written by a FileSender.
+type viewedMail struct {
+	Name    string
+	From    string
+	To      string
+	Subject string
+	Date    time.Time
+	Text    string
+	HTML    string
+}
+
+var viewerList = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Sent mail</title></head>
+<body>
+  <h1>Sent mail</h1>
+  {{if not .}}<p>Nothing has been sent yet.</p>{{end}}
+  <table>
+    {{range .}}
+    <tr>
+      <td>{{.Date.Format "2006-01-02 15:04:05"}}</td>
+      <td>{{.To}}</td>
+      <td><a href="{{.Name}}">{{.Subject}}</a></td>
+      <td><a href="{{.Name}}?part=text">text</a> <a href="{{.Name}}?part=raw">raw</a></td>
+    </tr>
+    {{end}}
+  </table>
+</body>
+</html>`))
+
+// Viewer serves the mail a FileSender has written to dir, newest first, so that it can be read in
+// a browser during development. Mount it with http.StripPrefix; it serves a list at its root,
+// and each message at its file name, as HTML, or with ?part=text or ?part=raw as plain text or
+// the file itself.
+func Viewer(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" {
+			listMail(w, dir)
+			return
+		}
+
+		// only files directly in dir are served
+		if name != filepath.Base(name) || filepath.Ext(name) != ".eml" {
+			http.NotFound(w, r)
+			return
+		}
+
+		path := filepath.Join(dir, name)
+		switch r.URL.Query().Get("part") {
+		case "raw":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.ServeFile(w, r, path)
+			return
+		case "text":
+			m, err := readMail(path)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = io.WriteString(w, m.Text)
+		default:
+			m, err := readMail(path)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			// the mail is shown as it would be in a mail client, without running anything in it
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, m.HTML)
+		}
+	})
+}
+
+// LocalOnly serves next only to requests made from this machine, and not found to anyone else. A
+// proxy on this machine makes the requests it forwards look local, so those are turned away too.
+func LocalOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ip.IsLoopback() || r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func listMail(w http.ResponseWriter, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("listing mail:", err)
+		http.Error(w, "could not list the mail", http.StatusInternalServerError)
+		return
+	}
+
+	var mails []*viewedMail
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".eml" {
+			continue
+		}
+		m, err := readMail(filepath.Join(dir, e.Name()))
+		if err != nil {
+			log.Printf("reading mail %s: %s", e.Name(), err)
+			continue
+		}
+		mails = append(mails, m)
+	}
+	// file names start with the time they were written
+	sort.Slice(mails, func(i, j int) bool { return mails[i].Name > mails[j].Name })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = viewerList.Execute(w, mails)
+	if err != nil {
+		log.Println("listing mail:", err)
+	}
+}
+
+// readMail reads back a message written by a FileSender.
+func readMail(path string) (*viewedMail, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msg, err := netmail.ReadMessage(f)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	date, _ := msg.Header.Date()
+
+	m := &viewedMail{
+		Name:    filepath.Base(path),
+		From:    msg.Header.Get("From"),
+		To:      msg.Header.Get("To"),
+		Subject: subject,
+		Date:    date,
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		b, err := io.ReadAll(msg.Body)
+		m.Text = string(b)
+		return m, err
+	}
+
+	// multipart decodes quoted-printable parts as it reads them
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := io.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(p.Header.Get("Content-Type"), "text/plain"):
+			m.Text = string(b)
+		case strings.HasPrefix(p.Header.Get("Content-Type"), "text/html"):
+			m.HTML = string(b)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"context"
+	"log"
+	"time"
+	"web-app/pkg/repository"
+)
+
+// Defaults for the zero values of a Worker's settings.
+const (
+	DefaultInterval    = 5 * time.Second
+	DefaultBatchSize   = 10
+	DefaultMaxAttempts = 5
+	DefaultSendTimeout = 30 * time.Second
+)
+
+// Worker sends the mail in the outbox. Any number of workers can share an outbox: a message is
+// claimed by one of them at a time.
+type Worker struct {
+	DB     repository.DatabaseRepo
+	Sender Sender
+
+	// Interval is how often to look for mail that is due
+	Interval time.Duration
+	// BatchSize is how many messages to claim at a time
+	BatchSize int
+	// MaxAttempts is how many times to try a message before giving up on it
+	MaxAttempts int
+	// SendTimeout bounds each attempt to send a message
+	SendTimeout time.Duration
+	// Backoff returns how long to wait before trying a message again, after attempts failures;
+	// nil means Backoff
+	Backoff func(attempts int) time.Duration
+}
+
+// Backoff waits a minute after the first failure, and twice as long after each one after that,
+// but never more than an hour.
+func Backoff(attempts int) time.Duration {
+	wait := time.Minute
+	for i := 1; i < attempts && wait < time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+	return wait
+}
+
+// Run sends mail as it falls due, until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := w.SendDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("sending mail:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendDue sends every message that is due, a batch at a time, and returns how many were sent.
+// Messages that cannot be sent are put back to be tried again, or given up on once they have
+// been tried MaxAttempts times; only a failure of the outbox itself is returned as an error.
+func (w *Worker) SendDue(ctx context.Context) (int, error) {
+	batchSize := w.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	maxAttempts := w.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	sendTimeout := w.SendTimeout
+	if sendTimeout <= 0 {
+		sendTimeout = DefaultSendTimeout
+	}
+	backoff := w.Backoff
+	if backoff == nil {
+		backoff = Backoff
+	}
+
+	sent := 0
+	for {
+		// the lease outlasts the time it could take to send the whole batch
+		batch, err := w.DB.ClaimMail(ctx, batchSize, time.Duration(batchSize+1)*sendTimeout)
+		if err != nil {
+			return sent, err
+		}
+		if len(batch) == 0 {
+			return sent, nil
+		}
+
+		for _, m := range batch {
+			sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+			err = w.Sender.Send(sendCtx, Message{To: m.To, Subject: m.Subject, Text: m.Text, HTML: m.HTML})
+			cancel()
+
+			switch {
+			case err == nil:
+				err = w.DB.MarkMailSent(ctx, m.ID)
+				sent++
+			case m.Attempts >= maxAttempts:
+				log.Printf("giving up on mail %d to %s after %d attempts: %s", m.ID, m.To, m.Attempts, err)
+				err = w.DB.FailMail(ctx, m.ID, err.Error())
+			default:
+				err = w.DB.RetryMail(ctx, m.ID, err.Error(), time.Now().Add(backoff(m.Attempts)))
+			}
+			if err != nil {
+				return sent, err
+			}
+		}
+	}
+}
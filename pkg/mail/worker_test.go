@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository/dbrepo"
+)
+
+// flakySender fails the first failures sends, then records the messages it sends.
+type flakySender struct {
+	mu       sync.Mutex
+	failures int
+	sent     []Message
+}
+
+func (s *flakySender) Send(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("connection refused")
+	}
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func TestWorker_SendDue(t *testing.T) {
+	var tests = []struct {
+		name          string
+		failures      int
+		expectedSent  int
+		expectPending bool
+	}{
+		{"sends", 0, 2, false},
+		{"retries", 2, 2, false},
+		{"gives up", 100, 0, false},
+	}
+
+	for _, e := range tests {
+		db := dbrepo.NewMemoryDBRepo(0)
+		_, _ = db.InsertMail(context.Background(), data.Mail{To: "jack@example.com", Subject: "One"})
+		_, _ = db.InsertMail(context.Background(), data.Mail{To: "jill@example.com", Subject: "Two"})
+
+		sender := &flakySender{failures: e.failures}
+		w := &Worker{DB: db, Sender: sender, MaxAttempts: 3, Backoff: func(int) time.Duration { return 0 }}
+
+		sent, err := w.SendDue(context.Background())
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+		}
+		if sent != e.expectedSent || len(sender.sent) != e.expectedSent {
+			t.Errorf("%s: expected %d sent, but got %d (%d)", e.name, e.expectedSent, sent, len(sender.sent))
+		}
+
+		// nothing is left to send, either way
+		claimed, _ := db.ClaimMail(context.Background(), 10, time.Minute)
+		if len(claimed) != 0 {
+			t.Errorf("%s: expected nothing left to send, but got %+v", e.name, claimed)
+		}
+	}
+}
+
+func TestWorker_backsOff(t *testing.T) {
+	db := dbrepo.NewMemoryDBRepo(0)
+	_, _ = db.InsertMail(context.Background(), data.Mail{To: "jack@example.com", Subject: "One"})
+
+	sender := &flakySender{failures: 1}
+	w := &Worker{DB: db, Sender: sender}
+
+	sent, _ := w.SendDue(context.Background())
+	if sent != 0 {
+		t.Errorf("expected the failed message to wait before it is tried again, but %d were sent", sent)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var tests = []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{10, time.Hour},
+		{1000, time.Hour},
+	}
+
+	for _, e := range tests {
+		if got := Backoff(e.attempts); got != e.expected {
+			t.Errorf("after %d attempts: expected %s, but got %s", e.attempts, e.expected, got)
+		}
+	}
+}
+
+func TestWorker_Run(t *testing.T) {
+	db := dbrepo.NewMemoryDBRepo(0)
+	_, _ = db.InsertMail(context.Background(), data.Mail{To: "jack@example.com", Subject: "One"})
+
+	sender := &flakySender{}
+	w := &Worker{DB: db, Sender: sender, Interval: time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		sender.mu.Lock()
+		n := len(sender.sent)
+		sender.mu.Unlock()
+		if n == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if len(sender.sent) != 1 {
+		t.Errorf("expected the worker to send the message, but it sent %d", len(sender.sent))
+	}
+}
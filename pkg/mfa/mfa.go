@@ -0,0 +1,302 @@
+// Package mfa adds a second factor to logging in: a TOTP authenticator app (RFC 6238), with
+// one-time recovery codes for when the user loses it. Secrets are stored encrypted, so a copy of
+// the database alone is no use for making codes, and only hashes of recovery codes are stored.
+package mfa
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+var (
+	// ErrInvalidCode is returned for a code that is wrong, has been used already, or is too old.
+	ErrInvalidCode = errors.New("mfa: invalid code")
+	// ErrAlreadyEnabled is returned for enrolling a user who already has an authenticator; it has
+	// to be turned off first, with a code from it.
+	ErrAlreadyEnabled = errors.New("mfa: already enabled")
+	// ErrNotEnrolled is returned for confirming an enrolment that was never started.
+	ErrNotEnrolled = errors.New("mfa: not enrolled")
+	// ErrNoKey is returned by Key for a database that is kept, with no key of its own.
+	ErrNoKey = errors.New("mfa: a key of its own is required to encrypt secrets in a database that is kept")
+)
+
+// DevelopmentKey is the key secrets in a throwaway database are encrypted with when none is
+// given. Anyone can read it here, so it is refused for any other database.
+const DevelopmentKey = "verysecret"
+
+// RecoveryCodeCount is how many recovery codes a user is given at a time.
+const RecoveryCodeCount = 10
+
+// recoveryCodeBytes is how many random bytes go into a recovery code.
+const recoveryCodeBytes = 10
+
+// Authenticator enrols users' authenticators and checks the codes they give.
+type Authenticator struct {
+	// Issuer is the name authenticator apps list accounts under
+	Issuer string
+	key    [32]byte
+}
+
+// New returns an Authenticator that encrypts secrets with a key derived from key. Every app
+// sharing a database must use the same key; changing it turns off every authenticator in effect,
+// since their secrets can no longer be read.
+func New(key, issuer string) *Authenticator {
+	return &Authenticator{Issuer: issuer, key: sha256.Sum256([]byte(key))}
+}
+
+// Key returns the key to encrypt secrets with: key, or DevelopmentKey if key is empty and the
+// database is throwaway. A database that is kept has to be given a key, other than
+// DevelopmentKey, or it returns ErrNoKey.
+func Key(key string, throwaway bool) (string, error) {
+	if throwaway && key == "" {
+		return DevelopmentKey, nil
+	}
+	if !throwaway && (key == "" || key == DevelopmentKey) {
+		return "", ErrNoKey
+	}
+	return key, nil
+}
+
+// Enrolment is an authenticator that has been set up but not yet confirmed.
+type Enrolment struct {
+	// Secret is the TOTP secret, base32 encoded, for typing into an authenticator app
+	Secret string `json:"secret"`
+	// URI is the otpauth URI of the secret, for showing as a QR code
+	URI string `json:"uri"`
+}
+
+// Enroll starts setting up an authenticator for a user, in place of any unconfirmed one. It only
+// counts once confirmed with a code from it. It returns ErrAlreadyEnabled if the user already
+// has a confirmed authenticator.
+func (a *Authenticator) Enroll(ctx context.Context, db repository.DatabaseRepo, user *data.User) (*Enrolment, error) {
+	enabled, err := a.Enabled(ctx, db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrAlreadyEnabled
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := a.encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.SaveUserMFA(ctx, user.ID, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Enrolment{Secret: secret, URI: URI(a.Issuer, user.Email, secret)}, nil
+}
+
+// Confirm turns on a user's authenticator, if code is the current code from it, and returns a
+// fresh set of recovery codes, to be shown to the user once. It returns ErrNotEnrolled if the
+// user has no authenticator, and ErrAlreadyEnabled if it is already on.
+func (a *Authenticator) Confirm(ctx context.Context, db repository.DatabaseRepo, userID int, code string) ([]string, error) {
+	var codes []string
+	err := db.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		mfa, err := repo.GetUserMFA(ctx, userID)
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrNotEnrolled
+		} else if err != nil {
+			return err
+		}
+		if mfa.Enabled() {
+			return ErrAlreadyEnabled
+		}
+
+		err = a.checkTOTP(ctx, repo, mfa, code)
+		if err != nil {
+			return err
+		}
+
+		err = repo.ConfirmUserMFA(ctx, userID)
+		if err != nil {
+			return err
+		}
+
+		codes, err = a.replaceRecoveryCodes(ctx, repo, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Enabled reports whether a user has a confirmed authenticator, so that logging in needs a code.
+func (a *Authenticator) Enabled(ctx context.Context, db repository.DatabaseRepo, userID int) (bool, error) {
+	mfa, err := db.GetUserMFA(ctx, userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return mfa.Enabled(), nil
+}
+
+// Verify checks a code a user gives as their second factor: either the current code from their
+// authenticator, or one of their recovery codes, which is used up. It returns ErrInvalidCode if
+// the code is neither, or if the user has no confirmed authenticator.
+func (a *Authenticator) Verify(ctx context.Context, db repository.DatabaseRepo, userID int, code string) error {
+	mfa, err := db.GetUserMFA(ctx, userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrInvalidCode
+	} else if err != nil {
+		return err
+	}
+	if !mfa.Enabled() {
+		return ErrInvalidCode
+	}
+
+	code = normalizeCode(code)
+	if len(code) == digits {
+		return a.checkTOTP(ctx, db, mfa, code)
+	}
+
+	err = db.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrInvalidCode
+	}
+	return err
+}
+
+// RegenerateRecoveryCodes gives a user a fresh set of recovery codes, in place of the ones they
+// had, and returns them, to be shown to the user once.
+func (a *Authenticator) RegenerateRecoveryCodes(ctx context.Context, db repository.DatabaseRepo, userID int) ([]string, error) {
+	var codes []string
+	err := db.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+		codes, err = a.replaceRecoveryCodes(ctx, repo, userID)
+		return err
+	})
+	return codes, err
+}
+
+// checkTOTP returns ErrInvalidCode unless code is a current code from mfa that has not been used.
+func (a *Authenticator) checkTOTP(ctx context.Context, db repository.DatabaseRepo, mfa *data.UserMFA, code string) error {
+	secret, err := a.decrypt(mfa.Secret)
+	if err != nil {
+		return err
+	}
+
+	s, ok := validate(secret, normalizeCode(code), time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	// a code can only be used once, even within its step
+	first, err := db.UseMFAStep(ctx, mfa.UserID, s)
+	if err != nil {
+		return err
+	}
+	if !first {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes generates a set of recovery codes, stores their hashes, and returns them.
+func (a *Authenticator) replaceRecoveryCodes(ctx context.Context, db repository.DatabaseRepo, userID int) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+		// split into groups of four, to be easier to read and type
+		var groups []string
+		for len(code) > 4 {
+			groups = append(groups, code[:4])
+			code = code[4:]
+		}
+		codes[i] = strings.Join(append(groups, code), "-")
+		hashes[i] = hashRecoveryCode(normalizeCode(codes[i]))
+	}
+
+	err := db.ReplaceRecoveryCodes(ctx, userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeCode drops the spaces and dashes people type codes with, and folds recovery codes to
+// lower case.
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, code)
+}
+
+// hashRecoveryCode returns the hex encoded sha256 hash of a normalized recovery code.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// encrypt seals a secret with AES-GCM, under a random nonce that is kept with it.
+func (a *Authenticator) encrypt(secret string) (string, error) {
+	gcm, err := a.cipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a secret sealed by encrypt.
+func (a *Authenticator) decrypt(encrypted string) (string, error) {
+	gcm, err := a.cipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("mfa: malformed secret")
+	}
+
+	secret, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("mfa: secret cannot be decrypted; has the key changed?")
+	}
+	return string(secret), nil
+}
+
+func (a *Authenticator) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(a.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,141 @@
+package mfa
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository/dbrepo"
+)
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	db := dbrepo.NewMemoryDBRepo(0)
+	userID, err := db.InsertUser(ctx, data.User{Email: "jack@example.com", FirstName: "Jack", LastName: "Smith", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := db.GetUser(ctx, userID)
+	a := New("test-key", "Web App")
+
+	enrolment, err := a.Enroll(ctx, db, user)
+	if err != nil {
+		t.Fatal("enrolling failed:", err)
+	}
+	if !strings.Contains(enrolment.URI, enrolment.Secret) {
+		t.Errorf("expected the URI to carry the secret, but got %s", enrolment.URI)
+	}
+
+	// the secret is not stored as it is
+	stored, _ := db.GetUserMFA(ctx, userID)
+	if strings.Contains(stored.Secret, enrolment.Secret) {
+		t.Error("expected the secret to be stored encrypted")
+	}
+
+	// until it is confirmed, the authenticator does nothing
+	code, _ := Code(enrolment.Secret, time.Now())
+	if enabled, _ := a.Enabled(ctx, db, userID); enabled {
+		t.Error("expected an unconfirmed authenticator to be off")
+	}
+	if err := a.Verify(ctx, db, userID, code); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected ErrInvalidCode before confirming, but got %v", err)
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	_, err = a.Confirm(ctx, db, userID, wrong)
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected ErrInvalidCode confirming with a wrong code, but got %v", err)
+	}
+	recoveryCodes, err := a.Confirm(ctx, db, userID, code)
+	if err != nil {
+		t.Fatal("confirming failed:", err)
+	}
+	if len(recoveryCodes) != RecoveryCodeCount {
+		t.Errorf("expected %d recovery codes, but got %d", RecoveryCodeCount, len(recoveryCodes))
+	}
+	if enabled, _ := a.Enabled(ctx, db, userID); !enabled {
+		t.Error("expected a confirmed authenticator to be on")
+	}
+
+	_, err = a.Enroll(ctx, db, user)
+	if !errors.Is(err, ErrAlreadyEnabled) {
+		t.Errorf("expected ErrAlreadyEnabled enrolling again, but got %v", err)
+	}
+
+	var tests = []struct {
+		name     string
+		code     string
+		expected error
+	}{
+		{"code used to confirm", code, ErrInvalidCode},
+		{"wrong code", "12345", ErrInvalidCode},
+		{"recovery code", recoveryCodes[0], nil},
+		{"recovery code typed differently", strings.ToUpper(strings.ReplaceAll(recoveryCodes[1], "-", " ")), nil},
+		{"used recovery code", recoveryCodes[0], ErrInvalidCode},
+	}
+
+	for _, e := range tests {
+		err := a.Verify(ctx, db, userID, e.code)
+		if !errors.Is(err, e.expected) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expected, err)
+		}
+	}
+
+	if n, _ := db.CountRecoveryCodes(ctx, userID); n != RecoveryCodeCount-2 {
+		t.Errorf("expected %d recovery codes left, but got %d", RecoveryCodeCount-2, n)
+	}
+
+	fresh, err := a.RegenerateRecoveryCodes(ctx, db, userID)
+	if err != nil {
+		t.Fatal("regenerating recovery codes failed:", err)
+	}
+	if err := a.Verify(ctx, db, userID, recoveryCodes[2]); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected an old recovery code to stop working, but got %v", err)
+	}
+	if err := a.Verify(ctx, db, userID, fresh[0]); err != nil {
+		t.Errorf("expected a new recovery code to work, but got %v", err)
+	}
+
+	// a different key cannot read the secret
+	other := New("other-key", "Web App")
+	next, _ := Code(enrolment.Secret, time.Now().Add(period))
+	if err := other.Verify(ctx, db, userID, next); err == nil || errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected an error decrypting with another key, but got %v", err)
+	}
+}
+
+func TestConfirmWithoutEnrolment(t *testing.T) {
+	db := dbrepo.NewMemoryDBRepo(0)
+	_, err := New("test-key", "Web App").Confirm(context.Background(), db, 1, "123456")
+	if !errors.Is(err, ErrNotEnrolled) {
+		t.Errorf("expected ErrNotEnrolled, but got %v", err)
+	}
+}
+
+func TestKey(t *testing.T) {
+	var tests = []struct {
+		name      string
+		key       string
+		throwaway bool
+		expected  string
+		err       error
+	}{
+		{"throwaway without a key", "", true, DevelopmentKey, nil},
+		{"throwaway with a key", "test-key", true, "test-key", nil},
+		{"kept without a key", "", false, "", ErrNoKey},
+		{"kept with the development key", DevelopmentKey, false, "", ErrNoKey},
+		{"kept with a key", "test-key", false, "test-key", nil},
+	}
+
+	for _, e := range tests {
+		key, err := Key(e.key, e.throwaway)
+		if key != e.expected || !errors.Is(err, e.err) {
+			t.Errorf("%s: expected %q, %v, but got %q, %v", e.name, e.expected, e.err, key, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Package mfatest sets up two-factor authentication for the tests of the apps, so that they start
+// from users with an authenticator in the same state:
+//
+//	secret, recoveryCodes := mfatest.Enable(t, app.MFA, app.DB, userID)
+//	code := mfatest.NextCode(t, secret)
+package mfatest
+
+import (
+	"context"
+	"testing"
+	"time"
+	"web-app/pkg/mfa"
+	"web-app/pkg/repository"
+)
+
+// Enable turns on two-factor authentication for the user with userID, and returns their secret
+// and recovery codes. The code for the current step has been used, to confirm it.
+func Enable(t testing.TB, a *mfa.Authenticator, db repository.DatabaseRepo, userID int) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	user, err := db.GetUser(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrolment, err := a.Enroll(ctx, db, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryCodes, err := a.Confirm(ctx, db, userID, Code(t, enrolment.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enrolment.Secret, recoveryCodes
+}
+
+// Code returns the code for the current step of secret.
+func Code(t testing.TB, secret string) string {
+	t.Helper()
+	code, err := mfa.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// NextCode returns the code for the step after the current one, which Enable has not used.
+func NextCode(t testing.TB, secret string) string {
+	t.Helper()
+	code, err := mfa.Code(secret, time.Now().Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// WrongCode returns a code that is not the one for the current step of secret.
+func WrongCode(t testing.TB, secret string) string {
+	t.Helper()
+	if Code(t, secret) == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
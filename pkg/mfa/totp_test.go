@@ -0,0 +1,92 @@
+package mfa
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCode(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238, whose codes are eight digits; six digit codes are their
+	// last six
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	var tests = []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, e := range tests {
+		code, err := Code(secret, time.Unix(e.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != e.expected[2:] {
+			t.Errorf("at %d: expected %s, but got %s", e.unix, e.expected[2:], code)
+		}
+	}
+}
+
+func Test_validate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code := func(t time.Time) string {
+		c, _ := Code(secret, t)
+		return c
+	}
+
+	var tests = []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"current", code(now), true},
+		{"previous step", code(now.Add(-period)), true},
+		{"next step", code(now.Add(period)), true},
+		{"too old", code(now.Add(-3 * period)), false},
+		{"too short", code(now)[:5], false},
+		{"not a code", "abcdef", false},
+	}
+
+	for _, e := range tests {
+		if _, valid := validate(secret, e.code, now); valid != e.valid {
+			t.Errorf("%s: expected %t, but got %t", e.name, e.valid, valid)
+		}
+	}
+
+	// the secret can be typed in lower case and with spaces
+	typed := strings.ToLower(secret[:4] + " " + secret[4:])
+	if _, valid := validate(typed, code(now), now); !valid {
+		t.Error("expected a typed secret to work")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Web App", "jack@example.com", "JBSWY3DPEHPK3PXP")
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("expected an otpauth://totp URI, but got %s", uri)
+	}
+	if label, _ := url.PathUnescape(strings.TrimPrefix(u.EscapedPath(), "/")); label != "Web App:jack@example.com" {
+		t.Errorf("expected the label to be issuer:account, but got %q", label)
+	}
+	if q := u.Query(); q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "Web App" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected parameters in %s", uri)
+	}
+}
@@ -0,0 +1,439 @@
+// Package migrate keeps the database schema up to date. Migrations are pairs of sql files in
+// migrations/<dialect>, named <version>_<name>.up.sql and <version>_<name>.down.sql, which are
+// embedded in every binary that imports this package. Each dialect (postgres, sqlite) has its
+// own copy of every migration, under the same version. Applied migrations are recorded in the
+// schema_migrations table, together with a checksum of their up script, so that editing a
+// migration after it has been applied is caught.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*/*.sql
+var embedded embed.FS
+
+// lockID is the key of the postgres advisory lock held while migrating, so that two instances
+// starting at the same time don't both apply the same migration. SQLite has no such lock, but
+// is only ever used by a single instance.
+const lockID = 0x6d696772 // "migr"
+
+var (
+	ErrChecksumMismatch = errors.New("migration has changed since it was applied")
+	ErrIrreversible     = errors.New("migration cannot be reverted")
+	ErrUnknownMigration = errors.New("applied migration is not known to this binary")
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one step in the evolution of the schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum returns the hex encoded sha256 hash of the up script.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// Reversible reports whether the down script does anything; a down file holding nothing but
+// comments means the migration cannot be reverted.
+func (m Migration) Reversible() bool {
+	for _, line := range strings.Split(m.Down, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Embedded returns the migrations for dialect built into the binary.
+func Embedded(dialect string) ([]Migration, error) {
+	if _, err := fs.Stat(embedded, path.Join("migrations", dialect)); err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %q", dialect)
+	}
+
+	sub, err := fs.Sub(embedded, path.Join("migrations", dialect))
+	if err != nil {
+		return nil, err
+	}
+	return Load(sub)
+}
+
+// Load reads the migrations in the root of fsys, sorted by version. Every migration needs both
+// an up and a down file; the down file may be empty if the migration cannot be reverted.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	seen := make(map[string]bool)
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%s: migration files must be named <version>_<name>.up.sql or .down.sql", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		name, direction := match[2], match[3]
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("%s: version %d is already used by %s", entry.Name(), version, m)
+		}
+
+		key := fmt.Sprintf("%d.%s", version, direction)
+		if seen[key] {
+			return nil, fmt.Errorf("%s: duplicate %s migration for version %d", entry.Name(), direction, version)
+		}
+		seen[key] = true
+
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	var migrations []Migration
+	for version, m := range byVersion {
+		if !seen[fmt.Sprintf("%d.up", version)] {
+			return nil, fmt.Errorf("migration %s has no up file", m)
+		}
+		if !seen[fmt.Sprintf("%d.down", version)] {
+			return nil, fmt.Errorf("migration %s has no down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Status is a migration, and whether and when it was applied.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+	// Modified is set if the migration's checksum differs from the one recorded when it was applied
+	Modified bool
+	// Unknown is set for migrations that were applied, but are not known to this binary
+	Unknown bool
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    string
+	Migrations []Migration
+}
+
+// New returns a Migrator for the embedded migrations of dialect.
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+	migrations, err := Embedded(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Dialect: dialect, Migrations: migrations}, nil
+}
+
+type appliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// Up applies every pending migration, oldest first, and returns the ones it applied. Each
+// migration runs in its own transaction.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.Migrations {
+			if a, ok := applied[migration.Version]; ok {
+				if a.Checksum != migration.Checksum() {
+					return fmt.Errorf("%s: %w", migration, ErrChecksumMismatch)
+				}
+				continue
+			}
+
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, migration.Up)
+				if err != nil {
+					return err
+				}
+				_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, checksum, applied_at) values ($1, $2, $3, $4)`,
+					migration.Version, migration.Name, migration.Checksum(), time.Now().UTC())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("applying %s: %w", migration, err)
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns the ones it reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	known := make(map[int]Migration)
+	for _, migration := range m.Migrations {
+		known[migration.Version] = migration
+	}
+
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		var versions []int
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for i := 0; i < steps && i < len(versions); i++ {
+			migration, ok := known[versions[i]]
+			if !ok {
+				return fmt.Errorf("%04d_%s: %w", versions[i], applied[versions[i]].Name, ErrUnknownMigration)
+			}
+			if !migration.Reversible() {
+				return fmt.Errorf("%s: %w", migration, ErrIrreversible)
+			}
+
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, migration.Down)
+				if err != nil {
+					return err
+				}
+				_, err = tx.ExecContext(ctx, `delete from schema_migrations where version = $1`, migration.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting %s: %w", migration, err)
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Status returns every known migration and every applied one, sorted by version.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.Migrations {
+			s := Status{Migration: migration}
+			if a, ok := applied[migration.Version]; ok {
+				appliedAt := a.AppliedAt
+				s.AppliedAt = &appliedAt
+				s.Modified = a.Checksum != migration.Checksum()
+				delete(applied, migration.Version)
+			}
+			statuses = append(statuses, s)
+		}
+
+		// whatever is left was applied by a newer binary, or from a branch we don't have
+		for _, a := range applied {
+			appliedAt := a.AppliedAt
+			statuses = append(statuses, Status{
+				Migration: Migration{Version: a.Version, Name: a.Name},
+				AppliedAt: &appliedAt,
+				Unknown:   true,
+			})
+		}
+
+		return nil
+	})
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, err
+}
+
+// withLock runs fn on a single connection, holding the migration lock and with the
+// schema_migrations table in place.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// advisory locks belong to the session, so lock and unlock must use the same connection
+	if m.Dialect == "postgres" {
+		_, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockID)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, lockID)
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `create table if not exists schema_migrations (
+		version bigint primary key,
+		name varchar(255) not null,
+		checksum varchar(64) not null,
+		applied_at timestamp not null
+	)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, `select version, name, checksum, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		err := rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[a.Version] = a
+	}
+
+	return applied, rows.Err()
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Create writes an empty up and down file for a new migration to every dialect directory in
+// root, numbered after the newest migration in any of them, and returns their paths.
+func Create(root, name string) ([]string, error) {
+	if !regexp.MustCompile(`^\w+$`).MatchString(name) {
+		return nil, fmt.Errorf("migration name %q may only contain letters, digits and underscores", name)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	version := 1
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		dirs = append(dirs, dir)
+
+		existing, err := Load(os.DirFS(dir))
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 && existing[len(existing)-1].Version >= version {
+			version = existing[len(existing)-1].Version + 1
+		}
+	}
+
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no dialect directories in %s", root)
+	}
+
+	var paths []string
+	for _, dir := range dirs {
+		base := filepath.Join(dir, Migration{Version: version, Name: name}.String())
+		up, down := base+".up.sql", base+".down.sql"
+
+		err = os.WriteFile(up, []byte(fmt.Sprintf("-- %s: describe the change here\n", name)), 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.WriteFile(down, []byte(fmt.Sprintf("-- revert %s; leave empty if it cannot be reverted\n", name)), 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, up, down)
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	var tests = []struct {
+		name          string
+		files         fstest.MapFS
+		expectedNames []string
+		errorExpected bool
+	}{
+		{
+			"sorted by version",
+			fstest.MapFS{
+				"0010_later.up.sql":   {Data: []byte("create table b (id int);")},
+				"0010_later.down.sql": {Data: []byte("drop table b;")},
+				"0002_first.up.sql":   {Data: []byte("create table a (id int);")},
+				"0002_first.down.sql": {Data: []byte("drop table a;")},
+				"README.md":           {Data: []byte("not a migration")},
+			},
+			[]string{"0002_first", "0010_later"},
+			false,
+		},
+		{
+			"missing down file",
+			fstest.MapFS{"0001_first.up.sql": {Data: []byte("select 1;")}},
+			nil,
+			true,
+		},
+		{
+			"missing up file",
+			fstest.MapFS{"0001_first.down.sql": {Data: []byte("select 1;")}},
+			nil,
+			true,
+		},
+		{
+			"version used twice",
+			fstest.MapFS{
+				"0001_first.up.sql":    {Data: []byte("select 1;")},
+				"0001_first.down.sql":  {Data: []byte("select 1;")},
+				"0001_second.up.sql":   {Data: []byte("select 2;")},
+				"0001_second.down.sql": {Data: []byte("select 2;")},
+			},
+			nil,
+			true,
+		},
+		{
+			"badly named file",
+			fstest.MapFS{"first.sql": {Data: []byte("select 1;")}},
+			nil,
+			true,
+		},
+	}
+
+	for _, e := range tests {
+		migrations, err := Load(e.files)
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: expected an error, but got none", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if len(migrations) != len(e.expectedNames) {
+			t.Errorf("%s: expected %d migrations, but got %d", e.name, len(e.expectedNames), len(migrations))
+			continue
+		}
+
+		for i, m := range migrations {
+			if m.String() != e.expectedNames[i] {
+				t.Errorf("%s: expected %s at position %d, but got %s", e.name, e.expectedNames[i], i, m)
+			}
+		}
+	}
+}
+
+func TestMigration_Reversible(t *testing.T) {
+	var tests = []struct {
+		down     string
+		expected bool
+	}{
+		{"drop table a;", true},
+		{"", false},
+		{"-- nothing to do here\n\n", false},
+		{"-- drop the table\ndrop table a;\n", true},
+	}
+
+	for _, e := range tests {
+		m := Migration{Down: e.down}
+		if m.Reversible() != e.expected {
+			t.Errorf("%q: expected reversible to be %v", e.down, e.expected)
+		}
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	postgres, err := Embedded("postgres")
+	if err != nil {
+		t.Fatal("embedded postgres migrations do not load:", err)
+	}
+
+	sqlite, err := Embedded("sqlite")
+	if err != nil {
+		t.Fatal("embedded sqlite migrations do not load:", err)
+	}
+
+	if len(postgres) == 0 || postgres[0].Name != "baseline" {
+		t.Errorf("expected the baseline migration first, but got %v", postgres)
+	}
+
+	// every migration must exist for every dialect, under the same version
+	if len(postgres) != len(sqlite) {
+		t.Fatalf("postgres has %d migrations, but sqlite has %d", len(postgres), len(sqlite))
+	}
+	for i := range postgres {
+		if postgres[i].String() != sqlite[i].String() {
+			t.Errorf("migration %d is %s for postgres, but %s for sqlite", i, postgres[i], sqlite[i])
+		}
+	}
+
+	if _, err := Embedded("oracle"); err == nil {
+		t.Error("expected an error for an unknown dialect")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	root := t.TempDir()
+	for _, dialect := range []string{"postgres", "sqlite"} {
+		if err := os.Mkdir(filepath.Join(root, dialect), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := Create(root, "add_widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) != 4 || filepath.Base(paths[0]) != "0001_add_widgets.up.sql" || filepath.Base(paths[1]) != "0001_add_widgets.down.sql" {
+		t.Errorf("unexpected files %v", paths)
+	}
+
+	// a migration that only exists for one dialect still moves the version on for both
+	_ = os.WriteFile(filepath.Join(root, "sqlite", "0002_sqlite_only.up.sql"), []byte("select 1;"), 0644)
+	_ = os.WriteFile(filepath.Join(root, "sqlite", "0002_sqlite_only.down.sql"), nil, 0644)
+
+	paths, _ = Create(root, "add_gadgets")
+	if len(paths) != 4 || filepath.Base(paths[0]) != "0003_add_gadgets.up.sql" {
+		t.Errorf("expected the next version to follow the newest, but got %v", paths)
+	}
+
+	migrations, err := Load(os.DirFS(filepath.Join(root, "postgres")))
+	if err != nil || len(migrations) != 2 {
+		t.Errorf("created migrations do not load: %v, %v", migrations, err)
+	}
+
+	if migrations[0].Reversible() {
+		t.Error("a new migration should not be reversible until its down file is written")
+	}
+
+	if _, err := Create(root, "bad name!"); err == nil {
+		t.Error("expected an error for an invalid name")
+	}
+}
@@ -0,0 +1,34 @@
+-- The schema as it was in sql/users.sql. Every statement is conditional, so that databases
+-- created from that dump are adopted as they are.
+
+create table if not exists users (
+    id integer generated always as identity primary key,
+    first_name character varying(255),
+    last_name character varying(255),
+    email character varying(255),
+    password character varying(60),
+    is_admin integer,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+create table if not exists user_images (
+    id integer generated always as identity primary key,
+    user_id integer references users(id) on update cascade on delete cascade,
+    file_name character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+create table if not exists refresh_tokens (
+    id integer generated always as identity primary key,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    token_hash character varying(64) not null unique,
+    family_id character varying(64) not null,
+    expires_at timestamp without time zone not null,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+create index if not exists refresh_tokens_family_id_idx on refresh_tokens using btree (family_id);
@@ -0,0 +1,2 @@
+-- Addresses stay in lower case; there is no telling what case they were in before.
+drop index if exists users_email_lower_idx;
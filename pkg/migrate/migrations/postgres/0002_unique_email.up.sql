@@ -0,0 +1,7 @@
+-- Email addresses are unique, whatever their case, and are stored in lower case from now on.
+-- Existing addresses are brought into line first. If two users' addresses only differ in case,
+-- creating the index fails; one of them has to be changed or removed by hand, and the migration
+-- run again.
+update users set email = lower(trim(email)) where email <> lower(trim(email));
+
+create unique index if not exists users_email_lower_idx on users (lower(email));
@@ -0,0 +1,11 @@
+-- Only the admin role survives, as is_admin; every other role is lost.
+alter table users add column is_admin integer default 0;
+
+update users set is_admin = 1 where id in (
+    select ur.user_id from user_roles ur join roles r on r.id = ur.role_id where r.name = 'admin'
+);
+
+drop table user_roles;
+drop table role_permissions;
+drop table permissions;
+drop table roles;
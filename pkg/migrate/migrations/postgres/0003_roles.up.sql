@@ -0,0 +1,44 @@
+-- Roles and permissions replace the is_admin flag. A user has any number of roles, and may do
+-- whatever the permissions of their roles allow. Users that were admins get the admin role.
+
+create table roles (
+    id integer generated always as identity primary key,
+    name character varying(64) not null unique,
+    description character varying(255) not null default ''
+);
+
+create table permissions (
+    id integer generated always as identity primary key,
+    name character varying(64) not null unique,
+    description character varying(255) not null default ''
+);
+
+create table role_permissions (
+    role_id integer not null references roles(id) on delete cascade,
+    permission_id integer not null references permissions(id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table user_roles (
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    role_id integer not null references roles(id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+create index user_roles_role_id_idx on user_roles (role_id);
+
+insert into permissions (name, description) values
+    ('users:read', 'see anyone, and list users'),
+    ('users:write', 'create users, and change anyone''s details'),
+    ('users:delete', 'delete anyone'),
+    ('roles:manage', 'give roles to users, and take them away');
+
+insert into roles (name, description) values ('admin', 'manages users and their roles');
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p where r.name = 'admin';
+
+insert into user_roles (user_id, role_id)
+    select u.id, r.id from users u, roles r where u.is_admin = 1 and r.name = 'admin';
+
+alter table users drop column is_admin;
@@ -0,0 +1,2 @@
+alter table users drop column password_changed_at;
+drop table user_tokens;
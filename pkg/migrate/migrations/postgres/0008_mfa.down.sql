@@ -0,0 +1,2 @@
+drop table mfa_recovery_codes;
+drop table user_mfa;
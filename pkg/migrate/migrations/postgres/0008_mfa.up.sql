@@ -0,0 +1,20 @@
+-- Users may add a second factor to their password: a TOTP authenticator app, with one-time
+-- recovery codes for when they lose it. The TOTP secret is stored encrypted, and only hashes of
+-- the recovery codes are stored.
+
+create table user_mfa (
+    user_id integer primary key references users(id) on update cascade on delete cascade,
+    secret character varying(255) not null,
+    confirmed_at timestamp without time zone,
+    last_used_step bigint not null default 0,
+    created_at timestamp without time zone
+);
+
+create table mfa_recovery_codes (
+    id integer generated always as identity primary key,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    code_hash character varying(255) not null,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone,
+    unique (user_id, code_hash)
+);
@@ -0,0 +1,25 @@
+-- Failed logins are counted against the account they were for, by email address, and against
+-- the address they came from; too many in a row lock either out for a while. Every lock, and
+-- every unlock by an administrator, is recorded in lockout_events.
+
+create table login_throttles (
+    scope character varying(16) not null,
+    key character varying(255) not null,
+    failures integer not null default 0,
+    last_failure_at timestamp without time zone not null,
+    locked_until timestamp without time zone,
+    primary key (scope, key)
+);
+
+create table lockout_events (
+    id integer generated always as identity primary key,
+    scope character varying(16) not null,
+    key character varying(255) not null,
+    event character varying(16) not null,
+    failures integer not null default 0,
+    locked_until timestamp without time zone,
+    actor_id integer not null default 0,
+    created_at timestamp without time zone
+);
+
+create index lockout_events_scope_key_idx on lockout_events (scope, key);
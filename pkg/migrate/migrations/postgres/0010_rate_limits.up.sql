@@ -0,0 +1,11 @@
+-- The token buckets of the rate limiter, when it keeps them in the database so that every
+-- instance of an application shares them. refilled_at is in microseconds since the epoch, so that
+-- refilling is plain arithmetic in every dialect.
+
+create table rate_limit_buckets (
+    key character varying(255) primary key,
+    tokens double precision not null,
+    refilled_at bigint not null
+);
+
+create index rate_limit_buckets_refilled_at_idx on rate_limit_buckets (refilled_at);
@@ -0,0 +1,4 @@
+-- buckets only last a few minutes, so those with longer keys can go
+delete from rate_limit_buckets where length(key) > 255;
+
+alter table rate_limit_buckets alter column key type character varying(255);
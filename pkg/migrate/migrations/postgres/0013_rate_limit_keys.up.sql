@@ -0,0 +1,3 @@
+-- Bucket keys hold a route, which comes from the rules and has no set length, so they are text.
+
+alter table rate_limit_buckets alter column key type text;
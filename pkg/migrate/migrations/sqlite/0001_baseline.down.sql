@@ -0,0 +1,3 @@
+drop table if exists refresh_tokens;
+drop table if exists user_images;
+drop table if exists users;
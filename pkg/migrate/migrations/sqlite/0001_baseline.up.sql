@@ -0,0 +1,31 @@
+create table users (
+    id integer primary key autoincrement,
+    first_name varchar(255),
+    last_name varchar(255),
+    email varchar(255),
+    password varchar(60),
+    is_admin integer,
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create table user_images (
+    id integer primary key autoincrement,
+    user_id integer references users(id) on update cascade on delete cascade,
+    file_name varchar(255),
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create table refresh_tokens (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    token_hash varchar(64) not null unique,
+    family_id varchar(64) not null,
+    expires_at timestamp not null,
+    revoked_at timestamp,
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create index refresh_tokens_family_id_idx on refresh_tokens (family_id);
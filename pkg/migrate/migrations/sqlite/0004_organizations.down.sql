@@ -0,0 +1,8 @@
+-- Roles held in organizations are lost.
+alter table refresh_tokens drop column organization_id;
+
+drop table organization_member_roles;
+drop table organization_members;
+drop table organizations;
+
+delete from permissions where name = 'members:manage';
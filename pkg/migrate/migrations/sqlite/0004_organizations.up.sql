@@ -0,0 +1,45 @@
+-- Organizations are tenants. A user belongs to any number of them, with roles in each; roles in
+-- user_roles still apply everywhere. Every existing user joins one organization, in which the
+-- existing admins are its admins, so that nobody loses sight of anyone they could see before.
+
+create table organizations (
+    id integer primary key autoincrement,
+    name varchar(255) not null,
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create table organization_members (
+    organization_id integer not null references organizations(id) on delete cascade,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    created_at timestamp,
+    primary key (organization_id, user_id)
+);
+
+create index organization_members_user_id_idx on organization_members (user_id);
+
+create table organization_member_roles (
+    organization_id integer not null,
+    user_id integer not null,
+    role_id integer not null references roles(id) on delete cascade,
+    primary key (organization_id, user_id, role_id),
+    foreign key (organization_id, user_id) references organization_members (organization_id, user_id) on delete cascade
+);
+
+insert into permissions (name, description) values ('members:manage', 'add people to an organization, and remove them');
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p where r.name = 'admin' and p.name = 'members:manage';
+
+insert into organizations (name, created_at, updated_at)
+    select 'Default', current_timestamp, current_timestamp where exists (select 1 from users);
+
+insert into organization_members (organization_id, user_id, created_at)
+    select o.id, u.id, current_timestamp from organizations o, users u;
+
+insert into organization_member_roles (organization_id, user_id, role_id)
+    select m.organization_id, ur.user_id, ur.role_id from organization_members m join user_roles ur on ur.user_id = m.user_id;
+
+-- the organization refresh tokens were issued for; tokens outlive organizations, so there is no
+-- foreign key
+alter table refresh_tokens add column organization_id integer not null default 0;
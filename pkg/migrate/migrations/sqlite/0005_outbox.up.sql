@@ -0,0 +1,20 @@
+-- Mail is written to the outbox, in the same transaction as whatever caused it, and a worker
+-- sends it from there, trying again later if it fails.
+
+create table outbox (
+    id integer primary key autoincrement,
+    recipient varchar(255) not null,
+    subject varchar(255) not null,
+    text_body text not null default '',
+    html_body text not null default '',
+    attempts integer not null default 0,
+    last_error text not null default '',
+    next_attempt_at timestamp not null,
+    sent_at timestamp,
+    failed_at timestamp,
+    created_at timestamp,
+    updated_at timestamp
+);
+
+-- the worker looks for pending mail that is due
+create index outbox_pending_idx on outbox (next_attempt_at) where sent_at is null and failed_at is null;
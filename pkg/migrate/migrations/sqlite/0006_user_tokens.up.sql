@@ -0,0 +1,17 @@
+-- One-time tokens are mailed to users to prove they own their email address, for example to
+-- reset a forgotten password. Only a hash of each token is stored.
+
+create table user_tokens (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    purpose varchar(32) not null,
+    token_hash varchar(255) not null unique,
+    expires_at timestamp not null,
+    used_at timestamp,
+    created_at timestamp
+);
+
+create index user_tokens_user_id_idx on user_tokens (user_id, purpose);
+
+-- sessions and tokens from before a password change are no longer honoured
+alter table users add column password_changed_at timestamp;
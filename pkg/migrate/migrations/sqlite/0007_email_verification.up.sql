@@ -0,0 +1,3 @@
+-- Users prove they own their email address by following a link mailed to it. Until they do, and
+-- again whenever the address changes, it is unverified. Existing users start unverified.
+alter table users add column email_verified_at timestamp;
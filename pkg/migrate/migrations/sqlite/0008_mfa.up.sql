@@ -0,0 +1,20 @@
+-- Users may add a second factor to their password: a TOTP authenticator app, with one-time
+-- recovery codes for when they lose it. The TOTP secret is stored encrypted, and only hashes of
+-- the recovery codes are stored.
+
+create table user_mfa (
+    user_id integer primary key references users(id) on update cascade on delete cascade,
+    secret varchar(255) not null,
+    confirmed_at timestamp,
+    last_used_step integer not null default 0,
+    created_at timestamp
+);
+
+create table mfa_recovery_codes (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    code_hash varchar(255) not null,
+    used_at timestamp,
+    created_at timestamp,
+    unique (user_id, code_hash)
+);
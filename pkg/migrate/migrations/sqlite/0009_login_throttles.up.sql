@@ -0,0 +1,25 @@
+-- Failed logins are counted against the account they were for, by email address, and against
+-- the address they came from; too many in a row lock either out for a while. Every lock, and
+-- every unlock by an administrator, is recorded in lockout_events.
+
+create table login_throttles (
+    scope varchar(16) not null,
+    key varchar(255) not null,
+    failures integer not null default 0,
+    last_failure_at timestamp not null,
+    locked_until timestamp,
+    primary key (scope, key)
+);
+
+create table lockout_events (
+    id integer primary key autoincrement,
+    scope varchar(16) not null,
+    key varchar(255) not null,
+    event varchar(16) not null,
+    failures integer not null default 0,
+    locked_until timestamp,
+    actor_id integer not null default 0,
+    created_at timestamp
+);
+
+create index lockout_events_scope_key_idx on lockout_events (scope, key);
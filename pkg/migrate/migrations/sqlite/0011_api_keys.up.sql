@@ -0,0 +1,19 @@
+-- Users may make named api keys for scripts to call the api with, in place of an access token.
+-- Only a hash of each key is stored, along with its prefix, which identifies it in lists. Scopes
+-- are the permission names the key may use, separated by spaces.
+
+create table api_keys (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    organization_id integer not null default 0,
+    name varchar(255) not null,
+    prefix varchar(32) not null unique,
+    key_hash varchar(255) not null unique,
+    scopes varchar(255) not null default '',
+    expires_at timestamp not null,
+    last_used_at timestamp,
+    revoked_at timestamp,
+    created_at timestamp
+);
+
+create index api_keys_user_id_idx on api_keys (user_id);
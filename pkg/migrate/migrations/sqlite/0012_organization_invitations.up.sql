@@ -0,0 +1,11 @@
+-- Users are invited to organizations, and only become members once they accept, so that nobody
+-- can make an organization and take charge of whoever they add to it.
+
+create table organization_invitations (
+    organization_id integer not null references organizations(id) on delete cascade,
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    created_at timestamp,
+    primary key (organization_id, user_id)
+);
+
+create index organization_invitations_user_id_idx on organization_invitations (user_id);
@@ -0,0 +1,9 @@
+drop table rate_limit_buckets;
+
+create table rate_limit_buckets (
+    key varchar(255) primary key,
+    tokens real not null,
+    refilled_at integer not null
+);
+
+create index rate_limit_buckets_refilled_at_idx on rate_limit_buckets (refilled_at);
@@ -0,0 +1,13 @@
+-- Bucket keys hold a route, which comes from the rules and has no set length, so they are text.
+-- SQLite cannot change the type of a column, and buckets only last a few minutes, so the table
+-- is made again, empty.
+
+drop table rate_limit_buckets;
+
+create table rate_limit_buckets (
+    key text primary key,
+    tokens real not null,
+    refilled_at integer not null
+);
+
+create index rate_limit_buckets_refilled_at_idx on rate_limit_buckets (refilled_at);
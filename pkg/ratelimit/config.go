@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"flag"
+	"fmt"
+	"web-app/pkg/repository"
+)
+
+// Where buckets are kept, chosen by Config.Store.
+const (
+	// StoreMemory keeps buckets in each instance, with a MemoryStore
+	StoreMemory = "memory"
+	// StoreDB keeps buckets in the database, with a DBStore, so limits hold across instances
+	StoreDB = "db"
+)
+
+// Config is how an application limits requests.
+type Config struct {
+	// Rules is a json file of rules, read by LoadRules; empty means the application's defaults
+	Rules string
+	Store string
+}
+
+// Flags defines the command line flags that set c on fs.
+func (c *Config) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Rules, "rate-limits", "", "json file of per-route rate limits; empty for the defaults")
+	fs.StringVar(&c.Store, "rate-limit-store", StoreMemory, "where rate limits are counted: memory, in each instance, or db, shared by every instance using the database")
+}
+
+// Load returns the store for c.Store, keeping buckets in db if it is StoreDB, and the rules in
+// c.Rules, or defaults if there is no file.
+func (c *Config) Load(db repository.DatabaseRepo, defaults []Rule) (Store, []Rule, error) {
+	var store Store
+	switch c.Store {
+	case StoreMemory:
+		store = NewMemoryStore()
+	case StoreDB:
+		store = &DBStore{DB: db}
+	default:
+		return nil, nil, fmt.Errorf("unknown -rate-limit-store %q; use memory or db", c.Store)
+	}
+
+	if c.Rules == "" {
+		return store, defaults, nil
+	}
+	rules, err := LoadRules(c.Rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, rules, nil
+}
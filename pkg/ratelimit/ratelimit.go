@@ -0,0 +1,279 @@
+// Package ratelimit limits how often clients may call an application. Each rule gives every
+// client a token bucket for the routes it covers: the bucket holds up to a burst of requests and
+// refills at a steady rate, and a request that finds it empty is refused with 429 Too Many
+// Requests. Every answer says how the client stands, in RateLimit headers.
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The ways a Rule tells clients apart.
+const (
+	// ByIP counts requests by the address they came from
+	ByIP = "ip"
+	// ByUser counts requests by the user or key they are authenticated as, and requests that are
+	// not by their address
+	ByUser = "user"
+)
+
+// pruneEvery is how often a running Limiter forgets buckets that have refilled.
+const pruneEvery = time.Minute
+
+// Limit is how fast a bucket refills, and how many tokens it holds.
+type Limit struct {
+	// Rate is how many requests are allowed every Per; zero means no limit
+	Rate int
+	Per  time.Duration
+	// Burst is how many requests may be made at once; zero means Rate
+	Burst int
+}
+
+func (l Limit) perSecond() float64 {
+	return float64(l.Rate) / l.Per.Seconds()
+}
+
+// fill returns how long an empty bucket takes to refill from tokens to full.
+func (l Limit) fill(tokens float64) time.Duration {
+	return time.Duration((float64(l.Burst) - tokens) / l.perSecond() * float64(time.Second))
+}
+
+// Rule is the limit for the requests to a route.
+type Rule struct {
+	// Route is a method and a chi route pattern, like "POST /auth" or "GET /users/{userID}", or a
+	// pattern alone, for every method
+	Route string
+	Limit
+	// By is how clients are told apart, ByIP or ByUser; empty means ByIP
+	By string
+	// FailClosed refuses requests while the store is failing, rather than letting them through
+	// unlimited; it is for routes that guard credentials, where guessing must never go unchecked
+	FailClosed bool
+}
+
+// Limiter refuses requests over the limit of the first rule that matches them. Requests no rule
+// matches are not limited.
+type Limiter struct {
+	Store Store
+	// Client returns the address a request came from, and the user or key it is authenticated as,
+	// or "" if it is not
+	Client func(r *http.Request) (ip, principal string)
+	// Denied answers a refused request, once the headers are set; nil answers with a plain 429
+	Denied http.HandlerFunc
+	// Unavailable answers a request refused because the store failed, under a rule that fails
+	// closed; nil answers with a plain 503
+	Unavailable http.HandlerFunc
+
+	rules []rule
+	// longest is how long the slowest bucket takes to refill from empty
+	longest time.Duration
+}
+
+type rule struct {
+	Rule
+	mux *chi.Mux
+}
+
+// New returns a Limiter for rules, keeping its buckets in store. It returns an error for a rule
+// that is not valid.
+func New(store Store, rules []Rule) (*Limiter, error) {
+	l := &Limiter{Store: store}
+	for _, r := range rules {
+		compiled, err := compile(r)
+		if err != nil {
+			return nil, err
+		}
+		l.rules = append(l.rules, compiled)
+		if compiled.Rate > 0 && compiled.fill(0) > l.longest {
+			l.longest = compiled.fill(0)
+		}
+	}
+	return l, nil
+}
+
+// compile checks r, fills in its defaults and builds the router that matches its route.
+func compile(r Rule) (c rule, err error) {
+	if r.By == "" {
+		r.By = ByIP
+	}
+	if r.Burst == 0 {
+		r.Burst = r.Rate
+	}
+	switch {
+	case r.By != ByIP && r.By != ByUser:
+		return rule{}, fmt.Errorf("ratelimit: rule %q: by must be %s or %s", r.Route, ByIP, ByUser)
+	case r.Rate < 0 || r.Burst < 0:
+		return rule{}, fmt.Errorf("ratelimit: rule %q: rate and burst cannot be negative", r.Route)
+	case r.Rate > 0 && r.Per <= 0:
+		return rule{}, fmt.Errorf("ratelimit: rule %q: per must be more than zero", r.Route)
+	}
+
+	// chi panics on a pattern or method it does not support
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("ratelimit: rule %q: %v", r.Route, p)
+		}
+	}()
+
+	mux := chi.NewRouter()
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	switch fields := strings.Fields(r.Route); len(fields) {
+	case 1:
+		mux.Handle(fields[0], noop)
+	case 2:
+		mux.Method(fields[0], fields[1], noop)
+	default:
+		return rule{}, fmt.Errorf("ratelimit: rule %q: route must be a pattern, with a method or not", r.Route)
+	}
+
+	return rule{Rule: r, mux: mux}, nil
+}
+
+// LoadRules reads rules from a json file holding a list of objects like
+//
+//	{"route": "POST /auth", "rate": 10, "per": "1m", "burst": 5, "by": "ip", "fail_closed": true}
+func LoadRules(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Route      string `json:"route"`
+		Rate       int    `json:"rate"`
+		Per        string `json:"per"`
+		Burst      int    `json:"burst"`
+		By         string `json:"by"`
+		FailClosed bool   `json:"fail_closed"`
+	}
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: %s: %w", path, err)
+	}
+
+	rules := make([]Rule, len(entries))
+	for i, e := range entries {
+		rules[i] = Rule{Route: e.Route, Limit: Limit{Rate: e.Rate, Burst: e.Burst}, By: e.By, FailClosed: e.FailClosed}
+		if e.Per != "" {
+			rules[i].Per, err = time.ParseDuration(e.Per)
+			if err != nil {
+				return nil, fmt.Errorf("ratelimit: %s: rule %q: %w", path, e.Route, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Handler refuses requests that are over their limit, and tells every client it limits how it
+// stands. If the store fails, requests are let through, unless their rule fails closed; the
+// failure is logged.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl, ok := l.match(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, tokens, err := l.Store.Take(r.Context(), rl.Route+" "+l.client(r, rl.By), rl.Limit, time.Now())
+		switch {
+		case err != nil && rl.FailClosed:
+			log.Printf("rate limiting %s %s, refused: %s", r.Method, r.URL.Path, err)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(rl.Per)))
+			if l.Unavailable != nil {
+				l.Unavailable(w, r)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			log.Printf("rate limiting %s %s: %s", r.Method, r.URL.Path, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(rl.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(tokens)))))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(rl.fill(tokens))))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", rl.Rate, seconds(rl.Per), rl.Burst))
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the time until there is a whole token again
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(time.Duration((1-tokens)/rl.perSecond()*float64(time.Second)))))
+		if l.Denied != nil {
+			l.Denied(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	})
+}
+
+// Run forgets buckets that have refilled, so that the store does not grow with every client
+// ever seen, until ctx is done.
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.Store.Prune(ctx, time.Now().Add(-l.longest))
+			if err != nil {
+				log.Println("pruning rate limits:", err)
+			}
+		}
+	}
+}
+
+// match returns the first rule for r, if it limits r.
+func (l *Limiter) match(r *http.Request) (rule, bool) {
+	for _, rl := range l.rules {
+		if rl.mux.Match(chi.NewRouteContext(), r.Method, r.URL.Path) {
+			return rl, rl.Rate > 0
+		}
+	}
+	return rule{}, false
+}
+
+// client returns the key of the client that made r, told apart by. It is hashed, as it comes
+// from the request, so that keys are always the same short length whatever the client sends.
+func (l *Limiter) client(r *http.Request, by string) string {
+	var ip, principal string
+	if l.Client != nil {
+		ip, principal = l.Client(r)
+	}
+
+	client := principal
+	if by != ByUser || principal == "" {
+		if ip == "" {
+			ip = "unknown"
+		}
+		client = "ip:" + ip
+	}
+
+	sum := sha256.Sum256([]byte(client))
+	return hex.EncodeToString(sum[:])
+}
+
+// seconds returns d in whole seconds, rounded up.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
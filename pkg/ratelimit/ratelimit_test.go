@@ -0,0 +1,290 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l, err := New(NewMemoryStore(), []Rule{
+		{Route: "/static/*"},
+		{Route: "POST /auth", Limit: Limit{Rate: 2, Per: time.Minute}},
+		{Route: "/users/*", Limit: Limit{Rate: 60, Per: time.Minute, Burst: 1}, By: ByUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Client = func(r *http.Request) (string, string) {
+		return r.Header.Get("X-IP"), r.Header.Get("X-User")
+	}
+
+	var tests = []struct {
+		name              string
+		method            string
+		path              string
+		ip                string
+		user              string
+		expectedStatus    int
+		expectedRemaining string
+	}{
+		{"first", "POST", "/auth", "192.0.2.1", "", http.StatusOK, "1"},
+		{"second", "POST", "/auth", "192.0.2.1", "", http.StatusOK, "0"},
+		{"over the limit", "POST", "/auth", "192.0.2.1", "", http.StatusTooManyRequests, "0"},
+		{"users do not count for ip rules", "POST", "/auth", "192.0.2.1", "user:1", http.StatusTooManyRequests, "0"},
+		{"another address", "POST", "/auth", "192.0.2.2", "", http.StatusOK, "1"},
+		{"another method", "GET", "/auth", "192.0.2.1", "", http.StatusOK, ""},
+		{"no limit", "GET", "/static/app.js", "192.0.2.1", "", http.StatusOK, ""},
+		{"user", "GET", "/users/1", "192.0.2.1", "user:1", http.StatusOK, "0"},
+		{"same user, another address", "GET", "/users/2", "192.0.2.2", "user:1", http.StatusTooManyRequests, "0"},
+		{"another user, same address", "GET", "/users/1", "192.0.2.1", "user:2", http.StatusOK, "0"},
+		{"anonymous by address", "GET", "/users/1", "192.0.2.1", "", http.StatusOK, "0"},
+		{"anonymous again", "GET", "/users/1", "192.0.2.1", "", http.StatusTooManyRequests, "0"},
+	}
+
+	handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, e := range tests {
+		req := httptest.NewRequest(e.method, e.path, nil)
+		req.Header.Set("X-IP", e.ip)
+		req.Header.Set("X-User", e.user)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if remaining := rr.Header().Get("RateLimit-Remaining"); remaining != e.expectedRemaining {
+			t.Errorf("%s: expected %q remaining, but got %q", e.name, e.expectedRemaining, remaining)
+		}
+		if retry := rr.Header().Get("Retry-After"); (retry != "") != (rr.Code == http.StatusTooManyRequests) {
+			t.Errorf("%s: expected Retry-After only on refused requests, but got %q", e.name, retry)
+		}
+	}
+
+	// the headers on the first refused request to /auth
+	req := httptest.NewRequest("POST", "/auth", nil)
+	req.Header.Set("X-IP", "192.0.2.1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	for header, expected := range map[string]string{
+		"RateLimit-Limit":  "2",
+		"RateLimit-Policy": "2;w=60;burst=2",
+		"Retry-After":      "30",
+	} {
+		if got := rr.Header().Get(header); got != expected {
+			t.Errorf("expected %s to be %q, but got %q", header, expected, got)
+		}
+	}
+	if reset := rr.Header().Get("RateLimit-Reset"); reset != "60" && reset != "59" {
+		t.Errorf("expected the bucket to be full in a minute, but got %q", reset)
+	}
+}
+
+func TestLimiterDenied(t *testing.T) {
+	l, _ := New(NewMemoryStore(), []Rule{{Route: "/*", Limit: Limit{Rate: 1, Per: time.Second}}})
+	l.Denied = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+
+	handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, expected := range []int{http.StatusOK, http.StatusTeapot} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != expected {
+			t.Errorf("expected %d, but got %d", expected, rr.Code)
+		}
+	}
+}
+
+// failingStore fails every call, as a database store does when the database is down.
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, Limit, time.Time) (bool, float64, error) {
+	return false, 0, errors.New("database unavailable")
+}
+
+func (failingStore) Prune(context.Context, time.Time) error {
+	return errors.New("database unavailable")
+}
+
+func TestLimiterStoreFailure(t *testing.T) {
+	l, _ := New(failingStore{}, []Rule{
+		{Route: "POST /auth", Limit: Limit{Rate: 1, Per: time.Minute}, FailClosed: true},
+		{Route: "/*", Limit: Limit{Rate: 1, Per: time.Minute}},
+	})
+
+	handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// routes that guard credentials are refused while the store is down; the rest carry on
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/auth", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("fail closed: expected %d with Retry-After, but got %d and %q", http.StatusServiceUnavailable, rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/users", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("fail open: expected %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	l.Unavailable = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/auth", nil))
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("unavailable: expected %d, but got %d", http.StatusTeapot, rr.Code)
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	var keys []string
+	l, _ := New(recordingStore{&keys}, []Rule{{Route: "/*", Limit: Limit{Rate: 1, Per: time.Minute}}})
+	l.Client = func(r *http.Request) (string, string) {
+		return r.Header.Get("X-IP"), ""
+	}
+
+	handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, ip := range []string{"192.0.2.1", strings.Repeat("198.51.100.1, ", 1000)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-IP", ip)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// whatever the client sends, keys are the route and a hash of the client
+	if len(keys) != 2 || keys[0] == keys[1] {
+		t.Fatalf("expected two different keys, but got %q", keys)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "/* ") || len(key) != len("/* ")+64 {
+			t.Errorf("expected the route and a hash, but got %q", key)
+		}
+	}
+}
+
+// recordingStore records the keys taken from, and always has a token.
+type recordingStore struct {
+	keys *[]string
+}
+
+func (s recordingStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, float64, error) {
+	*s.keys = append(*s.keys, key)
+	return true, 0, nil
+}
+
+func (s recordingStore) Prune(context.Context, time.Time) error {
+	return nil
+}
+
+func TestNewInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		rule Rule
+	}{
+		{"unknown by", Rule{Route: "/*", Limit: Limit{Rate: 1, Per: time.Second}, By: "browser"}},
+		{"no period", Rule{Route: "/*", Limit: Limit{Rate: 1}}},
+		{"negative rate", Rule{Route: "/*", Limit: Limit{Rate: -1, Per: time.Second}}},
+		{"unknown method", Rule{Route: "FETCH /auth", Limit: Limit{Rate: 1, Per: time.Second}}},
+		{"relative pattern", Rule{Route: "auth", Limit: Limit{Rate: 1, Per: time.Second}}},
+		{"too many fields", Rule{Route: "POST /auth now", Limit: Limit{Rate: 1, Per: time.Second}}},
+	}
+
+	for _, e := range tests {
+		if _, err := New(NewMemoryStore(), []Rule{e.rule}); err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rate-limits.json")
+	_ = os.WriteFile(path, []byte(`[
+		{"route": "POST /auth", "rate": 10, "per": "1m", "burst": 5, "fail_closed": true},
+		{"route": "/*", "rate": 300, "per": "1m", "by": "user"}
+	]`), 0o644)
+
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Per != time.Minute || rules[0].Burst != 5 || !rules[0].FailClosed || rules[1].By != ByUser || rules[1].FailClosed {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+
+	_ = os.WriteFile(path, []byte(`[{"route": "/*", "rate": 1, "per": "often"}]`), 0o644)
+	if _, err := LoadRules(path); err == nil {
+		t.Error("expected an error for a bad period")
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	defaults := []Rule{{Route: "/*", Limit: Limit{Rate: 1, Per: time.Second}}}
+
+	var tests = []struct {
+		name      string
+		config    Config
+		memory    bool
+		expectErr bool
+	}{
+		{"memory", Config{Store: StoreMemory}, true, false},
+		{"db", Config{Store: StoreDB}, false, false},
+		{"unknown store", Config{Store: "redis"}, false, true},
+		{"missing rules", Config{Store: StoreMemory, Rules: filepath.Join(t.TempDir(), "missing.json")}, false, true},
+	}
+
+	for _, e := range tests {
+		store, rules, err := e.config.Load(nil, defaults)
+		if (err != nil) != e.expectErr {
+			t.Errorf("%s: expected an error to be %t, but got %v", e.name, e.expectErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := store.(*MemoryStore); ok != e.memory {
+			t.Errorf("%s: expected a memory store to be %t, but got %T", e.name, e.memory, store)
+		}
+		if len(rules) != 1 || rules[0].Route != "/*" {
+			t.Errorf("%s: expected the default rules, but got %+v", e.name, rules)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	limit := Limit{Rate: 1, Per: time.Second, Burst: 2}
+	start := time.Now()
+
+	var tests = []struct {
+		at       time.Duration
+		allowed  bool
+		expected float64
+	}{
+		{0, true, 1},
+		{0, true, 0},
+		{0, false, 0},
+		{500 * time.Millisecond, false, 0.5},
+		{time.Second, true, 0},
+		{time.Hour, true, 1},
+	}
+
+	for i, e := range tests {
+		allowed, tokens, _ := s.Take(ctx, "a", limit, start.Add(e.at))
+		if allowed != e.allowed || tokens < e.expected-0.001 || tokens > e.expected+0.001 {
+			t.Errorf("take %d: expected %t with %.3f tokens left, but got %t with %.3f", i+1, e.allowed, e.expected, allowed, tokens)
+		}
+	}
+
+	_ = s.Prune(ctx, start.Add(2*time.Hour))
+	if _, tokens, _ := s.Take(ctx, "a", limit, start.Add(2*time.Hour)); tokens != 1 {
+		t.Errorf("expected a pruned bucket to start full, but got %.3f tokens", tokens)
+	}
+}
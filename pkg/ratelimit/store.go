@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+	"web-app/pkg/repository"
+)
+
+// Store keeps the token buckets of a Limiter.
+type Store interface {
+	// Take takes a token, at the time now, from the bucket for key, filled at limit, and reports
+	// whether there was one to take and how many tokens are left.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, float64, error)
+	// Prune forgets the buckets last refilled before the given time.
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// MemoryStore keeps buckets in the memory of the process, so each instance of an application
+// counts on its own. It is safe for concurrent use.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens     float64
+	refilledAt time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+// Take takes a token from the bucket for key, if it has one once refilled; a new bucket starts
+// full.
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), refilledAt: now}
+		s.buckets[key] = b
+	}
+
+	if now.After(b.refilledAt) {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.refilledAt).Seconds()*limit.perSecond())
+		b.refilledAt = now
+	}
+	if b.tokens < 1 {
+		return false, b.tokens, nil
+	}
+
+	b.tokens--
+	return true, b.tokens, nil
+}
+
+// Prune forgets the buckets last refilled before the given time.
+func (s *MemoryStore) Prune(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		if b.refilledAt.Before(before) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// DBStore keeps buckets in the database, so that every instance of an application sharing it
+// counts against the same limits.
+type DBStore struct {
+	DB repository.DatabaseRepo
+}
+
+// Take takes a token from the bucket for key, if it has one once refilled; a new bucket starts
+// full.
+func (s *DBStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, float64, error) {
+	return s.DB.TakeRateLimitToken(ctx, key, limit.Burst, limit.perSecond(), now)
+}
+
+// Prune forgets the buckets last refilled before the given time.
+func (s *DBStore) Prune(ctx context.Context, before time.Time) error {
+	return s.DB.PruneRateLimitBuckets(ctx, before)
+}
@@ -0,0 +1,140 @@
+package dbrepo
+
+import (
+	"context"
+	"sort"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// InsertAPIKey stores the hash of a newly made api key, and returns the ID of the new row
+func (m *MemoryDBRepo) InsertAPIKey(ctx context.Context, k data.APIKey) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	err = m.db.requireUser(k.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, existing := range m.db.apiKeys {
+		if existing.Prefix == k.Prefix {
+			return 0, &repository.DuplicateError{Field: "prefix"}
+		}
+		if existing.KeyHash == k.KeyHash {
+			return 0, &repository.DuplicateError{Field: "key_hash"}
+		}
+	}
+
+	k.ID = m.db.nextID("api_keys")
+	k.Scopes = append([]string{}, k.Scopes...)
+	k.LastUsedAt = nil
+	k.RevokedAt = nil
+	k.CreatedAt = time.Now()
+	m.db.apiKeys[k.ID] = &k
+
+	return k.ID, nil
+}
+
+// GetAPIKey returns the api key with keyHash
+func (m *MemoryDBRepo) GetAPIKey(ctx context.Context, keyHash string) (*data.APIKey, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for _, k := range m.db.apiKeys {
+		if k.KeyHash == keyHash {
+			return copyAPIKey(k), nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// UserAPIKeys returns every api key a user has made, newest first
+func (m *MemoryDBRepo) UserAPIKeys(ctx context.Context, userID int) ([]*data.APIKey, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var keys []*data.APIKey
+	for _, k := range m.db.apiKeys {
+		if k.UserID == userID {
+			keys = append(keys, copyAPIKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID > keys[j].ID })
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of a user's api keys, if it is not revoked already
+func (m *MemoryDBRepo) RevokeAPIKey(ctx context.Context, userID, id int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	k, ok := m.db.apiKeys[id]
+	if !ok || k.UserID != userID || k.RevokedAt != nil {
+		return repository.ErrNotFound
+	}
+
+	now := time.Now()
+	k.RevokedAt = &now
+
+	return nil
+}
+
+// RevokeUserAPIKeys revokes every api key of a user that is not revoked already
+func (m *MemoryDBRepo) RevokeUserAPIKeys(ctx context.Context, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := time.Now()
+	for _, k := range m.db.apiKeys {
+		if k.UserID == userID && k.RevokedAt == nil {
+			revoked := now
+			k.RevokedAt = &revoked
+		}
+	}
+
+	return nil
+}
+
+// TouchAPIKey records when an api key was last used
+func (m *MemoryDBRepo) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	k, ok := m.db.apiKeys[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	k.LastUsedAt = &at
+
+	return nil
+}
+
+// copyAPIKey returns a copy of k that shares nothing with it.
+func copyAPIKey(k *data.APIKey) *data.APIKey {
+	c := *k
+	c.Scopes = append([]string{}, k.Scopes...)
+	return &c
+}
@@ -0,0 +1,121 @@
+package dbrepo
+
+import (
+	"context"
+	"strings"
+	"time"
+	"web-app/pkg/data"
+)
+
+// InsertAPIKey stores the hash of a newly made api key, and returns the ID of the new row
+func (m *SQLiteDBRepo) InsertAPIKey(ctx context.Context, k data.APIKey) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into api_keys (user_id, organization_id, name, prefix, key_hash, scopes, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := m.conn().QueryRowContext(ctx, stmt,
+		k.UserID,
+		k.OrganizationID,
+		k.Name,
+		k.Prefix,
+		k.KeyHash,
+		strings.Join(k.Scopes, " "),
+		k.ExpiresAt.UTC(),
+		time.Now().UTC(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+
+	return newID, nil
+}
+
+// GetAPIKey returns the api key with keyHash
+func (m *SQLiteDBRepo) GetAPIKey(ctx context.Context, keyHash string) (*data.APIKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + apiKeyColumns + ` from api_keys where key_hash = $1`
+
+	k, err := scanAPIKey(m.conn().QueryRowContext(ctx, query, keyHash))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return k, nil
+}
+
+// UserAPIKeys returns every api key a user has made, newest first
+func (m *SQLiteDBRepo) UserAPIKeys(ctx context.Context, userID int) ([]*data.APIKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + apiKeyColumns + ` from api_keys where user_id = $1 order by id desc`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+
+	var keys []*data.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, sqliteError(err)
+		}
+		keys = append(keys, k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of a user's api keys, if it is not revoked already
+func (m *SQLiteDBRepo) RevokeAPIKey(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = $1 where id = $2 and user_id = $3 and revoked_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now().UTC(), id, userID)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return requireRows(res)
+}
+
+// RevokeUserAPIKeys revokes every api key of a user that is not revoked already
+func (m *SQLiteDBRepo) RevokeUserAPIKeys(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = $1 where user_id = $2 and revoked_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now().UTC(), userID)
+
+	return sqliteError(err)
+}
+
+// TouchAPIKey records when an api key was last used
+func (m *SQLiteDBRepo) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set last_used_at = $1 where id = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, at.UTC(), id)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return requireRows(res)
+}
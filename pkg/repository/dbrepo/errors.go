@@ -0,0 +1,36 @@
+package dbrepo
+
+import (
+	"strings"
+	"web-app/pkg/repository"
+)
+
+// uniqueFields names the field each unique index or constraint keeps unique. Postgres reports
+// the name of the constraint; SQLite reports the index, or the table and column.
+var uniqueFields = map[string]string{
+	"users_email_lower_idx":                                    "email",
+	"refresh_tokens_token_hash_key":                            "token_hash",
+	"refresh_tokens.token_hash":                                "token_hash",
+	"user_tokens_token_hash_key":                               "token_hash",
+	"user_tokens.token_hash":                                   "token_hash",
+	"mfa_recovery_codes_user_id_code_hash_key":                 "code_hash",
+	"mfa_recovery_codes.user_id, mfa_recovery_codes.code_hash": "code_hash",
+	"api_keys_prefix_key":                                      "prefix",
+	"api_keys.prefix":                                          "prefix",
+	"api_keys_key_hash_key":                                    "key_hash",
+	"api_keys.key_hash":                                        "key_hash",
+}
+
+// duplicateError returns the repository.DuplicateError for err, a unique violation reported
+// against constraint, which may be a whole error message that names it.
+func duplicateError(constraint string, err error) error {
+	var field string
+	for name, f := range uniqueFields {
+		if strings.Contains(constraint, name) {
+			field = f
+			break
+		}
+	}
+
+	return &repository.DuplicateError{Field: field, Err: err}
+}
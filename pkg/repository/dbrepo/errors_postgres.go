@@ -0,0 +1,63 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"web-app/pkg/repository"
+
+	"github.com/jackc/pgconn"
+)
+
+// pgError wraps an error from the database in the matching repository error, so that callers
+// never have to look at driver specific errors.
+func pgError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pgErr *pgconn.PgError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: %w", repository.ErrNotFound, err)
+	case errors.As(err, &pgErr):
+		switch {
+		case pgErr.Code == "23505": // unique_violation
+			return duplicateError(pgErr.ConstraintName, err)
+		case pgErr.Code == "23503", // foreign_key_violation
+			pgErr.Code == "40001", // serialization_failure
+			pgErr.Code == "40P01": // deadlock_detected
+			return fmt.Errorf("%w: %w", repository.ErrConflict, err)
+		case strings.HasPrefix(pgErr.Code, "08"), // connection exceptions
+			strings.HasPrefix(pgErr.Code, "53"),  // insufficient resources
+			strings.HasPrefix(pgErr.Code, "57P"): // operator intervention, such as a shutdown
+			return fmt.Errorf("%w: %w", repository.ErrUnavailable, err)
+		}
+	case errors.As(err, &netErr),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, context.DeadlineExceeded),
+		pgconn.Timeout(err):
+		return fmt.Errorf("%w: %w", repository.ErrUnavailable, err)
+	}
+
+	return err
+}
+
+// requireRows returns repository.ErrNotFound if a statement did not touch any rows.
+func requireRows(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return pgError(err)
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"web-app/pkg/repository"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteError wraps an error from SQLite in the matching repository error, like pgError does
+// for Postgres.
+func sqliteError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var sqliteErr *sqlite.Error
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: %w", repository.ErrNotFound, err)
+	case errors.As(err, &sqliteErr):
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return duplicateError(sqliteErr.Error(), err)
+		case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+			return fmt.Errorf("%w: %w", repository.ErrConflict, err)
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_INTERRUPT:
+			return fmt.Errorf("%w: %w", repository.ErrUnavailable, err)
+		}
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", repository.ErrUnavailable, err)
+	}
+
+	return err
+}
@@ -0,0 +1,151 @@
+package dbrepo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// Fixtures is the data a MemoryDBRepo can be seeded with. In a fixtures file it is written as
+// json, for example:
+//
+//	{
+//	  "users": [
+//	    {"id": 1, "first_name": "Admin", "last_name": "User", "email": "admin@example.com",
+//	     "password_hash": "$2a$14$...", "roles": ["admin"]}
+//	  ],
+//	  "user_images": [{"id": 1, "user_id": 1, "file_name": "admin.png"}],
+//	  "organizations": [{"id": 1, "name": "Example"}],
+//	  "memberships": [{"organization_id": 1, "user_id": 1, "roles": ["admin"]}]
+//	}
+type Fixtures struct {
+	Users         []FixtureUser       `json:"users"`
+	UserImages    []data.UserImage    `json:"user_images"`
+	Organizations []data.Organization `json:"organizations"`
+	Memberships   []data.Membership   `json:"memberships"`
+}
+
+// FixtureUser is a user as written in a fixtures file. The password is given as a bcrypt hash,
+// as it is stored; it is never hashed again. Roles must be ones the repository has.
+type FixtureUser struct {
+	data.User
+	PasswordHash string `json:"password_hash"`
+}
+
+// LoadFixtures reads fixtures from a json file.
+func LoadFixtures(path string) (Fixtures, error) {
+	var f Fixtures
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return f, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return f, nil
+}
+
+// Seed adds the fixtures to the repository, keeping their ids. Rows without an id get the next
+// one, and later inserts carry on after the highest id seeded. The fixtures must keep to the
+// same rules as any other write; if they don't, nothing is added.
+func (m *MemoryDBRepo) Seed(f Fixtures) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	t := m.db.memoryTables.clone()
+
+	for _, fu := range f.Users {
+		u := fu.User
+		if u.ID == 0 {
+			u.ID = t.nextID("users")
+		}
+		if _, ok := t.users[u.ID]; ok {
+			return fmt.Errorf("%w: user %d is seeded twice", repository.ErrDuplicate, u.ID)
+		}
+		err := t.requireUniqueEmail(u.Email, u.ID)
+		if err != nil {
+			return err
+		}
+
+		u.Password = fu.PasswordHash
+		u.CreatedAt = time.Now()
+		u.UpdatedAt = time.Now()
+		u.ProfilePic = data.UserImage{}
+		u.Roles = nil
+		t.users[u.ID] = &u
+		if u.ID > t.lastIDs["users"] {
+			t.lastIDs["users"] = u.ID
+		}
+
+		for _, role := range fu.Roles {
+			err := t.assignRole(u.ID, role)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, fi := range f.UserImages {
+		i := fi
+		err := t.requireUser(i.UserID)
+		if err != nil {
+			return err
+		}
+
+		if i.ID == 0 {
+			i.ID = t.nextID("user_images")
+		}
+		if _, ok := t.userImages[i.ID]; ok {
+			return fmt.Errorf("%w: user image %d is seeded twice", repository.ErrDuplicate, i.ID)
+		}
+
+		i.CreatedAt = time.Now()
+		i.UpdatedAt = time.Now()
+		t.userImages[i.ID] = &i
+		if i.ID > t.lastIDs["user_images"] {
+			t.lastIDs["user_images"] = i.ID
+		}
+	}
+
+	for _, fo := range f.Organizations {
+		o := fo
+		if o.ID == 0 {
+			o.ID = t.nextID("organizations")
+		}
+		if _, ok := t.organizations[o.ID]; ok {
+			return fmt.Errorf("%w: organization %d is seeded twice", repository.ErrDuplicate, o.ID)
+		}
+
+		o.CreatedAt = time.Now()
+		o.UpdatedAt = time.Now()
+		t.organizations[o.ID] = &o
+		if o.ID > t.lastIDs["organizations"] {
+			t.lastIDs["organizations"] = o.ID
+		}
+	}
+
+	for _, ms := range f.Memberships {
+		err := t.addMember(ms.OrganizationID, ms.UserID)
+		if err != nil {
+			return err
+		}
+
+		for _, role := range ms.Roles {
+			err = t.assignMemberRole(ms.OrganizationID, ms.UserID, role)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	m.db.memoryTables = t
+
+	return nil
+}
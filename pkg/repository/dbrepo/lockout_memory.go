@@ -0,0 +1,124 @@
+package dbrepo
+
+import (
+	"context"
+	"sort"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// throttleKey is the primary key of a login throttle.
+type throttleKey struct {
+	scope, key string
+}
+
+// RecordLoginFailure counts a failed login against scope and key, starting again from one if the
+// last was before since, and returns the count
+func (m *MemoryDBRepo) RecordLoginFailure(ctx context.Context, scope, key string, since time.Time) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	throttle, ok := m.db.loginThrottles[throttleKey{scope, key}]
+	if !ok {
+		throttle = &data.LoginThrottle{Scope: scope, Key: key}
+		m.db.loginThrottles[throttleKey{scope, key}] = throttle
+	}
+	if throttle.LastFailureAt.Before(since) {
+		throttle.Failures = 0
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+
+	return throttle.Failures, nil
+}
+
+// LockLogin refuses logins for scope and key until the given time
+func (m *MemoryDBRepo) LockLogin(ctx context.Context, scope, key string, until time.Time) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	throttle, ok := m.db.loginThrottles[throttleKey{scope, key}]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	throttle.LockedUntil = &until
+
+	return nil
+}
+
+// GetLoginThrottle returns the failed logins counted against scope and key
+func (m *MemoryDBRepo) GetLoginThrottle(ctx context.Context, scope, key string) (*data.LoginThrottle, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	throttle, ok := m.db.loginThrottles[throttleKey{scope, key}]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	found := *throttle
+	return &found, nil
+}
+
+// ClearLoginFailures deletes the failed logins counted against scope and key
+func (m *MemoryDBRepo) ClearLoginFailures(ctx context.Context, scope, key string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	delete(m.db.loginThrottles, throttleKey{scope, key})
+
+	return nil
+}
+
+// InsertLockoutEvent records a lock or an unlock, and returns the ID of the newly inserted row
+func (m *MemoryDBRepo) InsertLockoutEvent(ctx context.Context, e data.LockoutEvent) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	e.ID = m.db.nextID("lockout_events")
+	e.CreatedAt = time.Now()
+	m.db.lockoutEvents[e.ID] = &e
+
+	return e.ID, nil
+}
+
+// LockoutEvents returns up to limit of the events for scope and key, newest first
+func (m *MemoryDBRepo) LockoutEvents(ctx context.Context, scope, key string, limit int) ([]*data.LockoutEvent, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var events []*data.LockoutEvent
+	for _, e := range m.db.lockoutEvents {
+		if e.Scope == scope && e.Key == key {
+			event := *e
+			events = append(events, &event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID > events[j].ID })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
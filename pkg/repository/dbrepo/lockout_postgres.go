@@ -0,0 +1,148 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+)
+
+// RecordLoginFailure counts a failed login against scope and key, starting again from one if the
+// last was before since, and returns the count. Counting is one statement, so no failure is lost
+// to a concurrent one.
+func (m *PostgresDBRepo) RecordLoginFailure(ctx context.Context, scope, key string, since time.Time) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into login_throttles (scope, key, failures, last_failure_at) values ($1, $2, 1, $3)
+		on conflict (scope, key) do update
+		set failures = case when login_throttles.last_failure_at < $4 then 1 else login_throttles.failures + 1 end,
+			last_failure_at = excluded.last_failure_at
+		returning failures`
+
+	var failures int
+	err := m.conn().QueryRowContext(ctx, stmt, scope, key, time.Now(), since).Scan(&failures)
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return failures, nil
+}
+
+// LockLogin refuses logins for scope and key until the given time
+func (m *PostgresDBRepo) LockLogin(ctx context.Context, scope, key string, until time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update login_throttles set locked_until = $1 where scope = $2 and key = $3`
+
+	res, err := m.conn().ExecContext(ctx, stmt, until, scope, key)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return requireRows(res)
+}
+
+// GetLoginThrottle returns the failed logins counted against scope and key
+func (m *PostgresDBRepo) GetLoginThrottle(ctx context.Context, scope, key string) (*data.LoginThrottle, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select scope, key, failures, last_failure_at, locked_until from login_throttles where scope = $1 and key = $2`
+
+	var throttle data.LoginThrottle
+	row := m.conn().QueryRowContext(ctx, query, scope, key)
+
+	err := row.Scan(
+		&throttle.Scope,
+		&throttle.Key,
+		&throttle.Failures,
+		&throttle.LastFailureAt,
+		&throttle.LockedUntil,
+	)
+
+	if err != nil {
+		return nil, pgError(err)
+	}
+
+	return &throttle, nil
+}
+
+// ClearLoginFailures deletes the failed logins counted against scope and key
+func (m *PostgresDBRepo) ClearLoginFailures(ctx context.Context, scope, key string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `delete from login_throttles where scope = $1 and key = $2`, scope, key)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return nil
+}
+
+// InsertLockoutEvent records a lock or an unlock, and returns the ID of the newly inserted row
+func (m *PostgresDBRepo) InsertLockoutEvent(ctx context.Context, e data.LockoutEvent) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into lockout_events (scope, key, event, failures, locked_until, actor_id, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.conn().QueryRowContext(ctx, stmt,
+		e.Scope,
+		e.Key,
+		e.Event,
+		e.Failures,
+		e.LockedUntil,
+		e.ActorID,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return newID, nil
+}
+
+// LockoutEvents returns up to limit of the events for scope and key, newest first
+func (m *PostgresDBRepo) LockoutEvents(ctx context.Context, scope, key string, limit int) ([]*data.LockoutEvent, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select id, scope, key, event, failures, locked_until, actor_id, created_at
+		from lockout_events where scope = $1 and key = $2 order by id desc limit $3`
+
+	rows, err := m.conn().QueryContext(ctx, query, scope, key, limit)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	var events []*data.LockoutEvent
+	for rows.Next() {
+		var e data.LockoutEvent
+		err := rows.Scan(
+			&e.ID,
+			&e.Scope,
+			&e.Key,
+			&e.Event,
+			&e.Failures,
+			&e.LockedUntil,
+			&e.ActorID,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, pgError(err)
+		}
+		events = append(events, &e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,171 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// SaveUserMFA starts enrolling a user's authenticator with an encrypted secret, replacing any they had
+func (m *MemoryDBRepo) SaveUserMFA(ctx context.Context, userID int, secret string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = m.db.requireUser(userID)
+	if err != nil {
+		return err
+	}
+
+	m.db.userMFA[userID] = &data.UserMFA{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+
+	return nil
+}
+
+// GetUserMFA returns a user's authenticator
+func (m *MemoryDBRepo) GetUserMFA(ctx context.Context, userID int) (*data.UserMFA, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mfa, ok := m.db.userMFA[userID]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	found := *mfa
+	return &found, nil
+}
+
+// ConfirmUserMFA marks a user's authenticator as confirmed
+func (m *MemoryDBRepo) ConfirmUserMFA(ctx context.Context, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mfa, ok := m.db.userMFA[userID]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	now := time.Now()
+	mfa.ConfirmedAt = &now
+
+	return nil
+}
+
+// UseMFAStep records that a code from step was accepted, if none from it or a later step was
+func (m *MemoryDBRepo) UseMFAStep(ctx context.Context, userID int, step int64) (bool, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	mfa, ok := m.db.userMFA[userID]
+	if !ok || mfa.LastUsedStep >= step {
+		return false, nil
+	}
+
+	mfa.LastUsedStep = step
+
+	return true, nil
+}
+
+// DeleteUserMFA deletes a user's authenticator and recovery codes
+func (m *MemoryDBRepo) DeleteUserMFA(ctx context.Context, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	delete(m.db.userMFA, userID)
+	m.db.deleteRecoveryCodes(userID)
+
+	return nil
+}
+
+// ReplaceRecoveryCodes deletes a user's recovery codes, and stores the hashes of new ones
+func (m *MemoryDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = m.db.requireUser(userID)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(codeHashes))
+	for _, hash := range codeHashes {
+		if seen[hash] {
+			return &repository.DuplicateError{Field: "code_hash"}
+		}
+		seen[hash] = true
+	}
+
+	m.db.deleteRecoveryCodes(userID)
+	now := time.Now()
+	for _, hash := range codeHashes {
+		id := m.db.nextID("mfa_recovery_codes")
+		m.db.recoveryCodes[id] = &data.RecoveryCode{ID: id, UserID: userID, CodeHash: hash, CreatedAt: now}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode marks one of a user's unused recovery codes as used
+func (m *MemoryDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, c := range m.db.recoveryCodes {
+		if c.UserID == userID && c.CodeHash == codeHash && c.UsedAt == nil {
+			now := time.Now()
+			c.UsedAt = &now
+			return nil
+		}
+	}
+
+	return repository.ErrNotFound
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has
+func (m *MemoryDBRepo) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	count := 0
+	for _, c := range m.db.recoveryCodes {
+		if c.UserID == userID && c.UsedAt == nil {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// deleteRecoveryCodes deletes every recovery code a user has, used or not.
+func (t *memoryTables) deleteRecoveryCodes(userID int) {
+	for id, c := range t.recoveryCodes {
+		if c.UserID == userID {
+			delete(t.recoveryCodes, id)
+		}
+	}
+}
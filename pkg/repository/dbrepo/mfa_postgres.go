@@ -0,0 +1,157 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+)
+
+// SaveUserMFA starts enrolling a user's authenticator with an encrypted secret, replacing any they had
+func (m *PostgresDBRepo) SaveUserMFA(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into user_mfa (user_id, secret, created_at) values ($1, $2, $3)
+		on conflict (user_id) do update
+		set secret = excluded.secret, confirmed_at = null, last_used_step = 0, created_at = excluded.created_at`
+
+	_, err := m.conn().ExecContext(ctx, stmt, userID, secret, time.Now())
+	if err != nil {
+		return pgError(err)
+	}
+
+	return nil
+}
+
+// GetUserMFA returns a user's authenticator
+func (m *PostgresDBRepo) GetUserMFA(ctx context.Context, userID int) (*data.UserMFA, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select user_id, secret, confirmed_at, last_used_step, created_at from user_mfa where user_id = $1`
+
+	var mfa data.UserMFA
+	row := m.conn().QueryRowContext(ctx, query, userID)
+
+	err := row.Scan(
+		&mfa.UserID,
+		&mfa.Secret,
+		&mfa.ConfirmedAt,
+		&mfa.LastUsedStep,
+		&mfa.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, pgError(err)
+	}
+
+	return &mfa, nil
+}
+
+// ConfirmUserMFA marks a user's authenticator as confirmed
+func (m *PostgresDBRepo) ConfirmUserMFA(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update user_mfa set confirmed_at = $1 where user_id = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return requireRows(res)
+}
+
+// UseMFAStep records that a code from step was accepted, if none from it or a later step was.
+// Checking and recording is one statement, so only one caller can ever use a step.
+func (m *PostgresDBRepo) UseMFAStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update user_mfa set last_used_step = $1 where user_id = $2 and last_used_step < $1`
+
+	res, err := m.conn().ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return false, pgError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, pgError(err)
+	}
+
+	return n == 1, nil
+}
+
+// DeleteUserMFA deletes a user's authenticator and recovery codes
+func (m *PostgresDBRepo) DeleteUserMFA(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `delete from mfa_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	_, err = m.conn().ExecContext(ctx, `delete from user_mfa where user_id = $1`, userID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return nil
+}
+
+// ReplaceRecoveryCodes deletes a user's recovery codes, and stores the hashes of new ones
+func (m *PostgresDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `delete from mfa_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	now := time.Now()
+	for _, hash := range codeHashes {
+		_, err = m.conn().ExecContext(ctx,
+			`insert into mfa_recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`,
+			userID, hash, now)
+		if err != nil {
+			return pgError(err)
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode marks one of a user's unused recovery codes as used
+func (m *PostgresDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update mfa_recovery_codes set used_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID, codeHash)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return requireRows(res)
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has
+func (m *PostgresDBRepo) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var count int
+	query := `select count(*) from mfa_recovery_codes where user_id = $1 and used_at is null`
+
+	err := m.conn().QueryRowContext(ctx, query, userID).Scan(&count)
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,102 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+	"web-app/pkg/repository"
+
+	_ "github.com/jackc/pgconn"
+	_ "github.com/jackc/pgx/v4"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// The databases a repository can be backed by.
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// Dialect returns which database dsn points at. A dsn of the form sqlite:<path> (or
+// sqlite://<path>) is a SQLite database file, and sqlite::memory: a private in-memory database;
+// anything else is handed to Postgres.
+func Dialect(dsn string) string {
+	if strings.HasPrefix(dsn, "sqlite:") {
+		return DialectSQLite
+	}
+	return DialectPostgres
+}
+
+// Open connects to the database dsn points at, and checks that it is reachable.
+func Open(dsn string) (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+
+	switch Dialect(dsn) {
+	case DialectSQLite:
+		db, err = openSQLite(dsn)
+	default:
+		db, err = sql.Open("pgx", dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// openSQLite opens a SQLite database with foreign keys enforced. SQLite allows one writer at a
+// time, so the pool is limited to a single connection; that also keeps an in-memory database
+// from being a different, empty one on every connection.
+func openSQLite(dsn string) (*sql.DB, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(dsn, "sqlite://"), "sqlite:")
+
+	pragmas := "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+	if path != ":memory:" {
+		pragmas += "&_pragma=journal_mode(WAL)"
+	}
+	if strings.Contains(path, "?") {
+		path += "&" + pragmas
+	} else {
+		path += "?" + pragmas
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+// New returns the repository for db, which was opened for dialect. Queries are limited to
+// timeout unless the caller sets its own deadline.
+func New(db *sql.DB, dialect string, timeout time.Duration) repository.DatabaseRepo {
+	if dialect == DialectSQLite {
+		return &SQLiteDBRepo{DB: db, Timeout: timeout}
+	}
+	return &PostgresDBRepo{DB: db, Timeout: timeout}
+}
+
+// boundContext returns ctx with timeout applied (DefaultTimeout if it is zero), unless ctx
+// already has a deadline, which then wins.
+func boundContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
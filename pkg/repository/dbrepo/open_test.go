@@ -0,0 +1,38 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"web-app/pkg/migrate"
+)
+
+// createTables applies every migration to db.
+func createTables(db *sql.DB, dialect string) error {
+	m, err := migrate.New(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Up(context.Background())
+	return err
+}
+
+func TestDialect(t *testing.T) {
+	var tests = []struct {
+		dsn      string
+		expected string
+	}{
+		{"host=localhost port=5432 user=postgres dbname=users", DialectPostgres},
+		{"postgres://postgres@localhost/users", DialectPostgres},
+		{"sqlite:users.db", DialectSQLite},
+		{"sqlite://./data/users.db", DialectSQLite},
+		{"sqlite::memory:", DialectSQLite},
+	}
+
+	for _, e := range tests {
+		if d := Dialect(e.dsn); d != e.expected {
+			t.Errorf("%s: expected %s, but got %s", e.dsn, e.expected, d)
+		}
+	}
+}
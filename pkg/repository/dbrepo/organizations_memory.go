@@ -0,0 +1,272 @@
+package dbrepo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// InsertOrganization inserts a new organization, and returns the ID of the new row
+func (m *MemoryDBRepo) InsertOrganization(ctx context.Context, o data.Organization) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	o.ID = m.db.nextID("organizations")
+	o.CreatedAt = time.Now()
+	o.UpdatedAt = time.Now()
+	m.db.organizations[o.ID] = &o
+
+	return o.ID, nil
+}
+
+// GetOrganization returns one organization by id
+func (m *MemoryDBRepo) GetOrganization(ctx context.Context, id int) (*data.Organization, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	o, ok := m.db.organizations[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	org := *o
+	return &org, nil
+}
+
+// AddMember adds a user to an organization. It returns repository.ErrConflict if either of them
+// does not exist.
+func (m *MemoryDBRepo) AddMember(ctx context.Context, orgID, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return m.db.addMember(orgID, userID)
+}
+
+// addMember adds a user to an organization, under the same rules as AddMember.
+func (t *memoryTables) addMember(orgID, userID int) error {
+	if _, ok := t.organizations[orgID]; !ok {
+		return fmt.Errorf("%w: organization %d does not exist", repository.ErrConflict, orgID)
+	}
+
+	err := t.requireUser(userID)
+	if err != nil {
+		return err
+	}
+
+	if t.members[orgID] == nil {
+		t.members[orgID] = make(map[int]map[string]bool)
+	}
+	if t.members[orgID][userID] == nil {
+		t.members[orgID][userID] = make(map[string]bool)
+	}
+
+	return nil
+}
+
+// RemoveMember takes a user out of an organization, along with their roles in it
+func (m *MemoryDBRepo) RemoveMember(ctx context.Context, orgID, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if m.db.members[orgID][userID] == nil {
+		return repository.ErrNotFound
+	}
+	delete(m.db.members[orgID], userID)
+
+	return nil
+}
+
+// GetMembership returns the membership of a user in an organization
+func (m *MemoryDBRepo) GetMembership(ctx context.Context, orgID, userID int) (*data.Membership, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if m.db.members[orgID][userID] == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return m.db.membership(orgID, userID), nil
+}
+
+// UserMemberships returns every organization a user belongs to, oldest organization first
+func (m *MemoryDBRepo) UserMemberships(ctx context.Context, userID int) ([]*data.Membership, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	memberships := []*data.Membership{}
+	for orgID, members := range m.db.members {
+		if members[userID] != nil {
+			memberships = append(memberships, m.db.membership(orgID, userID))
+		}
+	}
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].OrganizationID < memberships[j].OrganizationID })
+
+	return memberships, nil
+}
+
+// membership returns the membership of a member of an organization, as the database queries do.
+func (t *memoryTables) membership(orgID, userID int) *data.Membership {
+	ms := &data.Membership{
+		OrganizationID:   orgID,
+		OrganizationName: t.organizations[orgID].Name,
+		UserID:           userID,
+		Roles:            []string{},
+	}
+	for name := range t.members[orgID][userID] {
+		ms.Roles = append(ms.Roles, name)
+	}
+	sort.Strings(ms.Roles)
+
+	return ms
+}
+
+// AssignMemberRole gives a member a role in an organization. It returns repository.ErrNotFound
+// if there is no such role, and repository.ErrConflict if the user is not a member.
+func (m *MemoryDBRepo) AssignMemberRole(ctx context.Context, orgID, userID int, role string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return m.db.assignMemberRole(orgID, userID, role)
+}
+
+// assignMemberRole gives a member a role, under the same rules as AssignMemberRole.
+func (t *memoryTables) assignMemberRole(orgID, userID int, role string) error {
+	if _, ok := t.roles[role]; !ok {
+		return fmt.Errorf("%w: role %q", repository.ErrNotFound, role)
+	}
+
+	roles := t.members[orgID][userID]
+	if roles == nil {
+		return fmt.Errorf("%w: user %d is not a member of organization %d", repository.ErrConflict, userID, orgID)
+	}
+	roles[role] = true
+
+	return nil
+}
+
+// RevokeMemberRole takes a role in an organization away from a member. It returns
+// repository.ErrNotFound if the member does not have the role.
+func (m *MemoryDBRepo) RevokeMemberRole(ctx context.Context, orgID, userID int, role string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !m.db.members[orgID][userID][role] {
+		return repository.ErrNotFound
+	}
+	delete(m.db.members[orgID][userID], role)
+
+	return nil
+}
+
+// CountMembersWithRole returns the number of members of an organization that have a role there.
+func (m *MemoryDBRepo) CountMembersWithRole(ctx context.Context, orgID int, role string) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var count int
+	for _, roles := range m.db.members[orgID] {
+		if roles[role] {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// InviteMember invites a user to join an organization. It returns repository.ErrConflict if
+// either of them does not exist.
+func (m *MemoryDBRepo) InviteMember(ctx context.Context, orgID, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := m.db.organizations[orgID]; !ok {
+		return fmt.Errorf("%w: organization %d does not exist", repository.ErrConflict, orgID)
+	}
+
+	err = m.db.requireUser(userID)
+	if err != nil {
+		return err
+	}
+
+	if m.db.invitations[orgID] == nil {
+		m.db.invitations[orgID] = make(map[int]time.Time)
+	}
+	if _, ok := m.db.invitations[orgID][userID]; !ok {
+		m.db.invitations[orgID][userID] = time.Now()
+	}
+
+	return nil
+}
+
+// UserInvitations returns the invitations a user has not answered, oldest organization first
+func (m *MemoryDBRepo) UserInvitations(ctx context.Context, userID int) ([]*data.Invitation, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	invitations := []*data.Invitation{}
+	for orgID, invited := range m.db.invitations {
+		if at, ok := invited[userID]; ok {
+			invitations = append(invitations, &data.Invitation{
+				OrganizationID:   orgID,
+				OrganizationName: m.db.organizations[orgID].Name,
+				UserID:           userID,
+				CreatedAt:        at,
+			})
+		}
+	}
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].OrganizationID < invitations[j].OrganizationID })
+
+	return invitations, nil
+}
+
+// DeleteInvitation removes the invitation of a user to an organization
+func (m *MemoryDBRepo) DeleteInvitation(ctx context.Context, orgID, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := m.db.invitations[orgID][userID]; !ok {
+		return repository.ErrNotFound
+	}
+	delete(m.db.invitations[orgID], userID)
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+)
+
+// pgMembershipQuery selects memberships, with the organization name and the comma separated names
+// of the member's roles in it.
+const pgMembershipQuery = `
+	select
+		o.id, o.name, om.user_id,
+		coalesce((select string_agg(r.name, ',') from organization_member_roles omr join roles r on r.id = omr.role_id
+			where omr.organization_id = om.organization_id and omr.user_id = om.user_id), '')
+	from
+		organization_members om
+		join organizations o on (o.id = om.organization_id)`
+
+// InsertOrganization inserts a new organization, and returns the ID of the new row
+func (m *PostgresDBRepo) InsertOrganization(ctx context.Context, o data.Organization) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into organizations (name, created_at, updated_at) values ($1, $2, $3) returning id`
+
+	err := m.conn().QueryRowContext(ctx, stmt, o.Name, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return newID, nil
+}
+
+// GetOrganization returns one organization by id
+func (m *PostgresDBRepo) GetOrganization(ctx context.Context, id int) (*data.Organization, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select id, name, created_at, updated_at from organizations where id = $1`
+
+	var o data.Organization
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(&o.ID, &o.Name, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return nil, pgError(err)
+	}
+
+	return &o, nil
+}
+
+// AddMember adds a user to an organization. It returns repository.ErrConflict if either of them
+// does not exist.
+func (m *PostgresDBRepo) AddMember(ctx context.Context, orgID, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into organization_members (organization_id, user_id, created_at) values ($1, $2, $3)
+		on conflict do nothing`
+
+	_, err := m.conn().ExecContext(ctx, stmt, orgID, userID, time.Now())
+
+	return pgError(err)
+}
+
+// RemoveMember takes a user out of an organization, along with their roles in it
+func (m *PostgresDBRepo) RemoveMember(ctx context.Context, orgID, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from organization_members where organization_id = $1 and user_id = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, orgID, userID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return requireRows(res)
+}
+
+// GetMembership returns the membership of a user in an organization
+func (m *PostgresDBRepo) GetMembership(ctx context.Context, orgID, userID int) (*data.Membership, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := pgMembershipQuery + ` where om.organization_id = $1 and om.user_id = $2`
+
+	var ms data.Membership
+	var roles string
+	err := m.conn().QueryRowContext(ctx, query, orgID, userID).Scan(&ms.OrganizationID, &ms.OrganizationName, &ms.UserID, &roles)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	ms.Roles = splitNames(roles)
+
+	return &ms, nil
+}
+
+// UserMemberships returns every organization a user belongs to, oldest organization first
+func (m *PostgresDBRepo) UserMemberships(ctx context.Context, userID int) ([]*data.Membership, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := pgMembershipQuery + ` where om.user_id = $1 order by o.id`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	memberships := []*data.Membership{}
+
+	for rows.Next() {
+		var ms data.Membership
+		var roles string
+		err := rows.Scan(&ms.OrganizationID, &ms.OrganizationName, &ms.UserID, &roles)
+		if err != nil {
+			return nil, pgError(err)
+		}
+
+		ms.Roles = splitNames(roles)
+		memberships = append(memberships, &ms)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	return memberships, nil
+}
+
+// AssignMemberRole gives a member a role in an organization. It returns repository.ErrNotFound
+// if there is no such role, and repository.ErrConflict if the user is not a member.
+func (m *PostgresDBRepo) AssignMemberRole(ctx context.Context, orgID, userID int, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var roleID int
+	err := m.conn().QueryRowContext(ctx, `select id from roles where name = $1`, role).Scan(&roleID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	stmt := `insert into organization_member_roles (organization_id, user_id, role_id) values ($1, $2, $3)
+		on conflict do nothing`
+	_, err = m.conn().ExecContext(ctx, stmt, orgID, userID, roleID)
+
+	return pgError(err)
+}
+
+// RevokeMemberRole takes a role in an organization away from a member. It returns
+// repository.ErrNotFound if the member does not have the role.
+func (m *PostgresDBRepo) RevokeMemberRole(ctx context.Context, orgID, userID int, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from organization_member_roles
+		where organization_id = $1 and user_id = $2 and role_id = (select id from roles where name = $3)`
+
+	res, err := m.conn().ExecContext(ctx, stmt, orgID, userID, role)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return requireRows(res)
+}
+
+// CountMembersWithRole returns the number of members of an organization that have a role there.
+func (m *PostgresDBRepo) CountMembersWithRole(ctx context.Context, orgID int, role string) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var count int
+	query := `select count(*) from organization_member_roles omr join roles r on r.id = omr.role_id
+		where omr.organization_id = $1 and r.name = $2`
+
+	err := m.conn().QueryRowContext(ctx, query, orgID, role).Scan(&count)
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return count, nil
+}
+
+// InviteMember invites a user to join an organization. It returns repository.ErrConflict if
+// either of them does not exist.
+func (m *PostgresDBRepo) InviteMember(ctx context.Context, orgID, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into organization_invitations (organization_id, user_id, created_at) values ($1, $2, $3)
+		on conflict do nothing`
+
+	_, err := m.conn().ExecContext(ctx, stmt, orgID, userID, time.Now())
+
+	return pgError(err)
+}
+
+// UserInvitations returns the invitations a user has not answered, oldest organization first
+func (m *PostgresDBRepo) UserInvitations(ctx context.Context, userID int) ([]*data.Invitation, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select o.id, o.name, i.user_id, i.created_at
+		from organization_invitations i join organizations o on (o.id = i.organization_id)
+		where i.user_id = $1 order by o.id`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	invitations := []*data.Invitation{}
+
+	for rows.Next() {
+		var i data.Invitation
+		err := rows.Scan(&i.OrganizationID, &i.OrganizationName, &i.UserID, &i.CreatedAt)
+		if err != nil {
+			return nil, pgError(err)
+		}
+		invitations = append(invitations, &i)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	return invitations, nil
+}
+
+// DeleteInvitation removes the invitation of a user to an organization
+func (m *PostgresDBRepo) DeleteInvitation(ctx context.Context, orgID, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from organization_invitations where organization_id = $1 and user_id = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, orgID, userID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return requireRows(res)
+}
@@ -0,0 +1,110 @@
+package dbrepo
+
+import (
+	"context"
+	"sort"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// InsertMail puts a message in the outbox, and returns its ID
+func (m *MemoryDBRepo) InsertMail(ctx context.Context, mail data.Mail) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if mail.NextAttemptAt.IsZero() {
+		mail.NextAttemptAt = time.Now()
+	}
+
+	mail.ID = m.db.nextID("outbox")
+	mail.Attempts = 0
+	mail.LastError = ""
+	mail.SentAt = nil
+	mail.FailedAt = nil
+	mail.CreatedAt = time.Now()
+	mail.UpdatedAt = time.Now()
+	m.db.outbox[mail.ID] = &mail
+
+	return mail.ID, nil
+}
+
+// ClaimMail takes up to limit pending messages that are due for sending
+func (m *MemoryDBRepo) ClaimMail(ctx context.Context, limit int, lease time.Duration) ([]*data.Mail, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	var due []*data.Mail
+	for _, mail := range m.db.outbox {
+		if mail.Pending() && !mail.NextAttemptAt.After(now) {
+			due = append(due, mail)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]*data.Mail, 0, len(due))
+	for _, mail := range due {
+		mail.Attempts++
+		mail.NextAttemptAt = now.Add(lease)
+		mail.UpdatedAt = now
+		c := *mail
+		claimed = append(claimed, &c)
+	}
+
+	return claimed, nil
+}
+
+// MarkMailSent records that a message has been sent
+func (m *MemoryDBRepo) MarkMailSent(ctx context.Context, id int) error {
+	return m.updateMail(ctx, id, func(mail *data.Mail, now time.Time) {
+		mail.SentAt = &now
+		mail.LastError = ""
+	})
+}
+
+// RetryMail records why a message could not be sent, and when to try it again
+func (m *MemoryDBRepo) RetryMail(ctx context.Context, id int, reason string, at time.Time) error {
+	return m.updateMail(ctx, id, func(mail *data.Mail, now time.Time) {
+		mail.LastError = reason
+		mail.NextAttemptAt = at
+	})
+}
+
+// FailMail records why a message could not be sent, and gives up on it
+func (m *MemoryDBRepo) FailMail(ctx context.Context, id int, reason string) error {
+	return m.updateMail(ctx, id, func(mail *data.Mail, now time.Time) {
+		mail.LastError = reason
+		mail.FailedAt = &now
+	})
+}
+
+// updateMail applies update to one message, or returns repository.ErrNotFound if there is no
+// such message.
+func (m *MemoryDBRepo) updateMail(ctx context.Context, id int, update func(mail *data.Mail, now time.Time)) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mail, ok := m.db.outbox[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	now := time.Now()
+	update(mail, now)
+	mail.UpdatedAt = now
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// mailColumns are the columns scanned by scanMail, in order.
+const mailColumns = `id, recipient, subject, text_body, html_body, attempts, last_error, next_attempt_at, sent_at,
+	failed_at, created_at, updated_at`
+
+// scanMail scans the columns in mailColumns from one row of rows.
+func scanMail(rows *sql.Rows) (*data.Mail, error) {
+	var m data.Mail
+	err := rows.Scan(
+		&m.ID,
+		&m.To,
+		&m.Subject,
+		&m.Text,
+		&m.HTML,
+		&m.Attempts,
+		&m.LastError,
+		&m.NextAttemptAt,
+		&m.SentAt,
+		&m.FailedAt,
+		&m.CreatedAt,
+		&m.UpdatedAt,
+	)
+	return &m, err
+}
+
+// InsertMail puts a message in the outbox, and returns the ID of the new row
+func (m *PostgresDBRepo) InsertMail(ctx context.Context, mail data.Mail) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	if mail.NextAttemptAt.IsZero() {
+		mail.NextAttemptAt = time.Now()
+	}
+
+	var newID int
+	stmt := `insert into outbox (recipient, subject, text_body, html_body, next_attempt_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.conn().QueryRowContext(ctx, stmt,
+		mail.To,
+		mail.Subject,
+		mail.Text,
+		mail.HTML,
+		mail.NextAttemptAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return newID, nil
+}
+
+// ClaimMail takes up to limit pending messages that are due for sending. Rows another caller
+// has locked are skipped rather than waited for.
+func (m *PostgresDBRepo) ClaimMail(ctx context.Context, limit int, lease time.Duration) ([]*data.Mail, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	query := `
+		update outbox set attempts = attempts + 1, next_attempt_at = $2, updated_at = $1
+		where id in (
+			select id from outbox
+			where sent_at is null and failed_at is null and next_attempt_at <= $1
+			order by id
+			limit $3
+			for update skip locked
+		)
+		returning ` + mailColumns
+
+	rows, err := m.conn().QueryContext(ctx, query, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	var claimed []*data.Mail
+	for rows.Next() {
+		mail, err := scanMail(rows)
+		if err != nil {
+			return nil, pgError(err)
+		}
+		claimed = append(claimed, mail)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	// returning gives no order
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].ID < claimed[j].ID })
+
+	return claimed, nil
+}
+
+// MarkMailSent records that a message has been sent
+func (m *PostgresDBRepo) MarkMailSent(ctx context.Context, id int) error {
+	return m.updateMail(ctx, `update outbox set sent_at = $1, last_error = '', updated_at = $1 where id = $2`, time.Now(), id)
+}
+
+// RetryMail records why a message could not be sent, and when to try it again
+func (m *PostgresDBRepo) RetryMail(ctx context.Context, id int, reason string, at time.Time) error {
+	return m.updateMail(ctx, `update outbox set last_error = $1, next_attempt_at = $2, updated_at = $3 where id = $4`, reason, at, time.Now(), id)
+}
+
+// FailMail records why a message could not be sent, and gives up on it
+func (m *PostgresDBRepo) FailMail(ctx context.Context, id int, reason string) error {
+	return m.updateMail(ctx, `update outbox set last_error = $1, failed_at = $2, updated_at = $2 where id = $3`, reason, time.Now(), id)
+}
+
+// updateMail runs stmt, which updates one message, and returns repository.ErrNotFound if there
+// was no such message.
+func (m *PostgresDBRepo) updateMail(ctx context.Context, stmt string, args ...any) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return pgError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return pgError(err)
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
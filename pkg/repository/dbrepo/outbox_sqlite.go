@@ -0,0 +1,117 @@
+package dbrepo
+
+import (
+	"context"
+	"sort"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// InsertMail puts a message in the outbox, and returns the ID of the new row
+func (m *SQLiteDBRepo) InsertMail(ctx context.Context, mail data.Mail) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	if mail.NextAttemptAt.IsZero() {
+		mail.NextAttemptAt = time.Now()
+	}
+
+	var newID int
+	stmt := `insert into outbox (recipient, subject, text_body, html_body, next_attempt_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.conn().QueryRowContext(ctx, stmt,
+		mail.To,
+		mail.Subject,
+		mail.Text,
+		mail.HTML,
+		mail.NextAttemptAt.UTC(),
+		time.Now().UTC(),
+		time.Now().UTC(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+
+	return newID, nil
+}
+
+// ClaimMail takes up to limit pending messages that are due for sending. SQLite lets one writer
+// in at a time, so no two callers can claim the same message.
+func (m *SQLiteDBRepo) ClaimMail(ctx context.Context, limit int, lease time.Duration) ([]*data.Mail, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	query := `
+		update outbox set attempts = attempts + 1, next_attempt_at = $2, updated_at = $1
+		where id in (
+			select id from outbox
+			where sent_at is null and failed_at is null and next_attempt_at <= $1
+			order by id
+			limit $3
+		)
+		returning ` + mailColumns
+
+	rows, err := m.conn().QueryContext(ctx, query, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+
+	var claimed []*data.Mail
+	for rows.Next() {
+		mail, err := scanMail(rows)
+		if err != nil {
+			return nil, sqliteError(err)
+		}
+		claimed = append(claimed, mail)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, sqliteError(err)
+	}
+
+	// returning gives no order
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].ID < claimed[j].ID })
+
+	return claimed, nil
+}
+
+// MarkMailSent records that a message has been sent
+func (m *SQLiteDBRepo) MarkMailSent(ctx context.Context, id int) error {
+	return m.updateMail(ctx, `update outbox set sent_at = $1, last_error = '', updated_at = $1 where id = $2`, time.Now().UTC(), id)
+}
+
+// RetryMail records why a message could not be sent, and when to try it again
+func (m *SQLiteDBRepo) RetryMail(ctx context.Context, id int, reason string, at time.Time) error {
+	return m.updateMail(ctx, `update outbox set last_error = $1, next_attempt_at = $2, updated_at = $3 where id = $4`, reason, at.UTC(), time.Now().UTC(), id)
+}
+
+// FailMail records why a message could not be sent, and gives up on it
+func (m *SQLiteDBRepo) FailMail(ctx context.Context, id int, reason string) error {
+	return m.updateMail(ctx, `update outbox set last_error = $1, failed_at = $2, updated_at = $2 where id = $3`, reason, time.Now().UTC(), id)
+}
+
+// updateMail runs stmt, which updates one message, and returns repository.ErrNotFound if there
+// was no such message.
+func (m *SQLiteDBRepo) updateMail(ctx context.Context, stmt string, args ...any) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return sqliteError(err)
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package dbrepo
+
+import (
+	"context"
+	"math"
+	"time"
+	"web-app/pkg/data"
+)
+
+// TakeRateLimitToken takes a token from the bucket for key, if it has one once refilled
+func (m *MemoryDBRepo) TakeRateLimitToken(ctx context.Context, key string, burst int, perSecond float64, now time.Time) (bool, float64, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer unlock()
+
+	// kept to the microsecond, as in the database
+	now = time.UnixMicro(now.UnixMicro())
+	bucket, ok := m.db.rateLimitBuckets[key]
+	if !ok {
+		bucket = &data.RateLimitBucket{Key: key, Tokens: float64(burst), RefilledAt: now}
+		m.db.rateLimitBuckets[key] = bucket
+	}
+
+	tokens := bucket.Tokens
+	if now.After(bucket.RefilledAt) {
+		tokens = math.Min(float64(burst), tokens+now.Sub(bucket.RefilledAt).Seconds()*perSecond)
+	}
+	if tokens < 1 {
+		return false, tokens, nil
+	}
+
+	bucket.Tokens = tokens - 1
+	if now.After(bucket.RefilledAt) {
+		bucket.RefilledAt = now
+	}
+
+	return true, bucket.Tokens, nil
+}
+
+// PruneRateLimitBuckets deletes the buckets last refilled before the given time
+func (m *MemoryDBRepo) PruneRateLimitBuckets(ctx context.Context, before time.Time) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for key, b := range m.db.rateLimitBuckets {
+		if b.RefilledAt.Before(before) {
+			delete(m.db.rateLimitBuckets, key)
+		}
+	}
+
+	return nil
+}
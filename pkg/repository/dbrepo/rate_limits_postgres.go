@@ -0,0 +1,62 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TakeRateLimitToken takes a token from the bucket for key, if it has one once refilled. The
+// refill and the take are one statement, and the row is locked while it runs, so every instance
+// sharing the database sees the same bucket.
+func (m *PostgresDBRepo) TakeRateLimitToken(ctx context.Context, key string, burst int, perSecond float64, now time.Time) (bool, float64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	at := now.UnixMicro()
+	perMicro := perSecond / 1e6
+
+	_, err := m.conn().ExecContext(ctx,
+		`insert into rate_limit_buckets (key, tokens, refilled_at) values ($1, $2, $3) on conflict (key) do nothing`,
+		key, float64(burst), at)
+	if err != nil {
+		return false, 0, pgError(err)
+	}
+
+	refilled := `least($2::double precision, tokens + greatest($3::bigint - refilled_at, 0) * $4::double precision)`
+
+	var tokens float64
+	err = m.conn().QueryRowContext(ctx,
+		`update rate_limit_buckets set tokens = `+refilled+` - 1, refilled_at = greatest($3::bigint, refilled_at)
+		where key = $1 and `+refilled+` >= 1 returning tokens`,
+		key, float64(burst), at, perMicro).Scan(&tokens)
+	if err == nil {
+		return true, tokens, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return false, 0, pgError(err)
+	}
+
+	// there was no token; say how far the bucket has refilled
+	err = m.conn().QueryRowContext(ctx,
+		`select `+refilled+` from rate_limit_buckets where key = $1`,
+		key, float64(burst), at, perMicro).Scan(&tokens)
+	if err != nil {
+		return false, 0, pgError(err)
+	}
+
+	return false, tokens, nil
+}
+
+// PruneRateLimitBuckets deletes the buckets last refilled before the given time
+func (m *PostgresDBRepo) PruneRateLimitBuckets(ctx context.Context, before time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `delete from rate_limit_buckets where refilled_at < $1`, before.UnixMicro())
+	if err != nil {
+		return pgError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// InsertRefreshToken stores the hash of a newly issued refresh token, and returns the ID of the new row
+func (m *MemoryDBRepo) InsertRefreshToken(ctx context.Context, t data.RefreshToken) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	err = m.db.requireUser(t.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, existing := range m.db.refreshTokens {
+		if existing.TokenHash == t.TokenHash {
+			return 0, &repository.DuplicateError{Field: "token_hash"}
+		}
+	}
+
+	t.ID = m.db.nextID("refresh_tokens")
+	t.RevokedAt = nil
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = time.Now()
+	m.db.refreshTokens[t.ID] = &t
+
+	return t.ID, nil
+}
+
+// GetRefreshToken returns one refresh token by the hash of its value
+func (m *MemoryDBRepo) GetRefreshToken(ctx context.Context, tokenHash string) (*data.RefreshToken, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for _, t := range m.db.refreshTokens {
+		if t.TokenHash == tokenHash {
+			found := *t
+			return &found, nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// RevokeRefreshToken marks one refresh token as used. It reports whether the token
+// was still active, so that two concurrent refreshes cannot both succeed with it.
+func (m *MemoryDBRepo) RevokeRefreshToken(ctx context.Context, id int) (bool, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	t, ok := m.db.refreshTokens[id]
+	if !ok || t.Revoked() {
+		return false, nil
+	}
+
+	now := time.Now()
+	t.RevokedAt = &now
+	t.UpdatedAt = now
+
+	return true, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descended from the same login
+func (m *MemoryDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m.db.revokeRefreshTokens(func(t *data.RefreshToken) bool { return t.FamilyID == familyID })
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every active refresh token belonging to a user
+func (m *MemoryDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m.db.revokeRefreshTokens(func(t *data.RefreshToken) bool { return t.UserID == userID })
+
+	return nil
+}
+
+// RevokeOtherRefreshTokens revokes every active refresh token of a user outside familyID
+func (m *MemoryDBRepo) RevokeOtherRefreshTokens(ctx context.Context, userID int, familyID string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m.db.revokeRefreshTokens(func(t *data.RefreshToken) bool { return t.UserID == userID && t.FamilyID != familyID })
+
+	return nil
+}
+
+// revokeRefreshTokens revokes every active refresh token that match reports true for.
+func (t *memoryTables) revokeRefreshTokens(match func(t *data.RefreshToken) bool) {
+	now := time.Now()
+	for _, token := range t.refreshTokens {
+		if match(token) && !token.Revoked() {
+			token.RevokedAt = &now
+			token.UpdatedAt = now
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+)
+
+// InsertRefreshToken stores the hash of a newly issued refresh token, and returns the ID of the new row
+func (m *SQLiteDBRepo) InsertRefreshToken(ctx context.Context, t data.RefreshToken) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into refresh_tokens (user_id, organization_id, token_hash, family_id, expires_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.conn().QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.OrganizationID,
+		t.TokenHash,
+		t.FamilyID,
+		t.ExpiresAt.UTC(),
+		time.Now().UTC(),
+		time.Now().UTC(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+
+	return newID, nil
+}
+
+// GetRefreshToken returns one refresh token by the hash of its value
+func (m *SQLiteDBRepo) GetRefreshToken(ctx context.Context, tokenHash string) (*data.RefreshToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select
+			id, user_id, organization_id, token_hash, family_id, expires_at, revoked_at, created_at, updated_at
+		from
+			refresh_tokens
+		where
+			token_hash = $1`
+
+	var t data.RefreshToken
+	row := m.conn().QueryRowContext(ctx, query, tokenHash)
+
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.OrganizationID,
+		&t.TokenHash,
+		&t.FamilyID,
+		&t.ExpiresAt,
+		&t.RevokedAt,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return &t, nil
+}
+
+// RevokeRefreshToken marks one refresh token as used. It reports whether the token
+// was still active, so that two concurrent refreshes cannot both succeed with it.
+func (m *SQLiteDBRepo) RevokeRefreshToken(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1, updated_at = $1 where id = $2 and revoked_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now().UTC(), id)
+	if err != nil {
+		return false, sqliteError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, sqliteError(err)
+	}
+
+	return n == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descended from the same login
+func (m *SQLiteDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1, updated_at = $1 where family_id = $2 and revoked_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now().UTC(), familyID)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every active refresh token belonging to a user
+func (m *SQLiteDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1, updated_at = $1 where user_id = $2 and revoked_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now().UTC(), userID)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return nil
+}
+
+// RevokeOtherRefreshTokens revokes every active refresh token of a user outside familyID
+func (m *SQLiteDBRepo) RevokeOtherRefreshTokens(ctx context.Context, userID int, familyID string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1, updated_at = $1 where user_id = $2 and family_id <> $3 and revoked_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now().UTC(), userID, familyID)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package dbrepo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// AllRoles returns every role, and the permissions it grants, in name order
+func (m *MemoryDBRepo) AllRoles(ctx context.Context) ([]*data.Role, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	roles := make([]*data.Role, 0, len(m.db.roles))
+	for _, r := range m.db.roles {
+		role := *r
+		role.Permissions = append([]string{}, r.Permissions...)
+		sort.Strings(role.Permissions)
+		roles = append(roles, &role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+
+	return roles, nil
+}
+
+// AssignRole gives a user a role. It returns repository.ErrNotFound if there is no such role,
+// and repository.ErrConflict if there is no such user.
+func (m *MemoryDBRepo) AssignRole(ctx context.Context, userID int, role string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return m.db.assignRole(userID, role)
+}
+
+// assignRole gives a user a role, under the same rules as AssignRole.
+func (t *memoryTables) assignRole(userID int, role string) error {
+	if _, ok := t.roles[role]; !ok {
+		return fmt.Errorf("%w: role %q", repository.ErrNotFound, role)
+	}
+
+	err := t.requireUser(userID)
+	if err != nil {
+		return err
+	}
+
+	if t.userRoles[userID] == nil {
+		t.userRoles[userID] = make(map[string]bool)
+	}
+	t.userRoles[userID][role] = true
+
+	return nil
+}
+
+// RevokeRole takes a role away from a user. It returns repository.ErrNotFound if the user does
+// not have the role.
+func (m *MemoryDBRepo) RevokeRole(ctx context.Context, userID int, role string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !m.db.userRoles[userID][role] {
+		return repository.ErrNotFound
+	}
+	delete(m.db.userRoles[userID], role)
+
+	return nil
+}
+
+// UserPermissions returns every permission granted to a user, in name order, by their roles
+// and by their roles in the organization with orgID.
+func (m *MemoryDBRepo) UserPermissions(ctx context.Context, userID, orgID int) ([]string, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	granted := make(map[string]bool)
+	for _, roles := range []map[string]bool{m.db.userRoles[userID], m.db.members[orgID][userID]} {
+		for name := range roles {
+			for _, p := range m.db.roles[name].Permissions {
+				granted[p] = true
+			}
+		}
+	}
+
+	permissions := make([]string, 0, len(granted))
+	for p := range granted {
+		permissions = append(permissions, p)
+	}
+	sort.Strings(permissions)
+
+	return permissions, nil
+}
+
+// CountUsersWithRole returns the number of users that have a role.
+func (m *MemoryDBRepo) CountUsersWithRole(ctx context.Context, role string) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var count int
+	for _, names := range m.db.userRoles {
+		if names[role] {
+			count++
+		}
+	}
+
+	return count, nil
+}
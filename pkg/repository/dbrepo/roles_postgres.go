@@ -0,0 +1,166 @@
+package dbrepo
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"web-app/pkg/data"
+)
+
+// userRolesColumn returns a column with the comma separated role names of the user in the row
+// aliased as users.
+func (m *PostgresDBRepo) userRolesColumn(users string) string {
+	return `coalesce((select string_agg(r.name, ',') from user_roles ur join roles r on r.id = ur.role_id
+		where ur.user_id = ` + users + `.id), '')`
+}
+
+// splitNames splits a comma separated list of names, as aggregated by a query, and sorts them.
+func splitNames(s string) []string {
+	names := []string{}
+	if s == "" {
+		return names
+	}
+
+	names = strings.Split(s, ",")
+	sort.Strings(names)
+	return names
+}
+
+// AllRoles returns every role, and the permissions it grants, in name order
+func (m *PostgresDBRepo) AllRoles(ctx context.Context) ([]*data.Role, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select
+			r.id, r.name, r.description, coalesce(string_agg(p.name, ','), '')
+		from
+			roles r
+			left join role_permissions rp on (rp.role_id = r.id)
+			left join permissions p on (p.id = rp.permission_id)
+		group by
+			r.id, r.name, r.description
+		order by
+			r.name`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	var roles []*data.Role
+
+	for rows.Next() {
+		var role data.Role
+		var permissions string
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, &permissions)
+		if err != nil {
+			return nil, pgError(err)
+		}
+
+		role.Permissions = splitNames(permissions)
+		roles = append(roles, &role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	return roles, nil
+}
+
+// AssignRole gives a user a role. It returns repository.ErrNotFound if there is no such role,
+// and repository.ErrConflict if there is no such user.
+func (m *PostgresDBRepo) AssignRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var roleID int
+	err := m.conn().QueryRowContext(ctx, `select id from roles where name = $1`, role).Scan(&roleID)
+	if err != nil {
+		return pgError(err)
+	}
+
+	stmt := `insert into user_roles (user_id, role_id) values ($1, $2) on conflict do nothing`
+	_, err = m.conn().ExecContext(ctx, stmt, userID, roleID)
+
+	return pgError(err)
+}
+
+// RevokeRole takes a role away from a user. It returns repository.ErrNotFound if the user does
+// not have the role.
+func (m *PostgresDBRepo) RevokeRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from user_roles where user_id = $1 and role_id = (select id from roles where name = $2)`
+
+	res, err := m.conn().ExecContext(ctx, stmt, userID, role)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return requireRows(res)
+}
+
+// UserPermissions returns every permission granted to a user, in name order, by their roles
+// and by their roles in the organization with orgID.
+func (m *PostgresDBRepo) UserPermissions(ctx context.Context, userID, orgID int) ([]string, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select distinct
+			p.name
+		from
+			role_permissions rp
+			join permissions p on (p.id = rp.permission_id)
+		where
+			rp.role_id in (
+				select role_id from user_roles where user_id = $1
+				union
+				select role_id from organization_member_roles where user_id = $1 and organization_id = $2
+			)
+		order by
+			p.name`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID, orgID)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, pgError(err)
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	return permissions, nil
+}
+
+// CountUsersWithRole returns the number of users that have a role.
+func (m *PostgresDBRepo) CountUsersWithRole(ctx context.Context, role string) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var count int
+	query := `select count(*) from user_roles ur join roles r on r.id = ur.role_id where r.name = $1`
+
+	err := m.conn().QueryRowContext(ctx, query, role).Scan(&count)
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return count, nil
+}
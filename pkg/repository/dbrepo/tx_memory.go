@@ -0,0 +1,151 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// WithTx runs fn in a transaction. If fn returns an error, or panics, every table is put back the
+// way it was before fn ran. Transactions run one at a time, but are not isolated from calls made
+// outside of one: those see changes straight away, and are undone along with a failed
+// transaction. Calling WithTx on a repo that is already in a transaction runs fn in that
+// transaction.
+func (m *MemoryDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) (err error) {
+	if m.tx {
+		return fn(m)
+	}
+
+	m.db.txMu.Lock()
+	defer m.db.txMu.Unlock()
+
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	snapshot := m.db.memoryTables.clone()
+	unlock()
+
+	// roll back if fn fails, or panics
+	defer func() {
+		if p := recover(); p != nil {
+			m.db.rollback(snapshot)
+			panic(p)
+		}
+		if err != nil {
+			m.db.rollback(snapshot)
+		}
+	}()
+
+	return fn(&MemoryDBRepo{Timeout: m.Timeout, db: m.db, tx: true})
+}
+
+func (db *memoryDB) rollback(snapshot memoryTables) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.memoryTables = snapshot
+}
+
+// clone returns a copy of every table, which shares nothing that is ever changed in place.
+func (t *memoryTables) clone() memoryTables {
+	c := memoryTables{
+		users:            make(map[int]*data.User, len(t.users)),
+		userImages:       make(map[int]*data.UserImage, len(t.userImages)),
+		refreshTokens:    make(map[int]*data.RefreshToken, len(t.refreshTokens)),
+		userTokens:       make(map[int]*data.UserToken, len(t.userTokens)),
+		userMFA:          make(map[int]*data.UserMFA, len(t.userMFA)),
+		recoveryCodes:    make(map[int]*data.RecoveryCode, len(t.recoveryCodes)),
+		apiKeys:          make(map[int]*data.APIKey, len(t.apiKeys)),
+		loginThrottles:   make(map[throttleKey]*data.LoginThrottle, len(t.loginThrottles)),
+		lockoutEvents:    make(map[int]*data.LockoutEvent, len(t.lockoutEvents)),
+		rateLimitBuckets: make(map[string]*data.RateLimitBucket, len(t.rateLimitBuckets)),
+		roles:            make(map[string]*data.Role, len(t.roles)),
+		userRoles:        make(map[int]map[string]bool, len(t.userRoles)),
+		organizations:    make(map[int]*data.Organization, len(t.organizations)),
+		members:          make(map[int]map[int]map[string]bool, len(t.members)),
+		invitations:      make(map[int]map[int]time.Time, len(t.invitations)),
+		outbox:           make(map[int]*data.Mail, len(t.outbox)),
+		lastIDs:          make(map[string]int, len(t.lastIDs)),
+	}
+
+	for id, u := range t.users {
+		user := *u
+		c.users[id] = &user
+	}
+	for id, i := range t.userImages {
+		image := *i
+		c.userImages[id] = &image
+	}
+	for id, rt := range t.refreshTokens {
+		token := *rt
+		c.refreshTokens[id] = &token
+	}
+	for id, ut := range t.userTokens {
+		token := *ut
+		c.userTokens[id] = &token
+	}
+	for id, um := range t.userMFA {
+		mfa := *um
+		c.userMFA[id] = &mfa
+	}
+	for id, rc := range t.recoveryCodes {
+		code := *rc
+		c.recoveryCodes[id] = &code
+	}
+	for id, k := range t.apiKeys {
+		c.apiKeys[id] = copyAPIKey(k)
+	}
+	for k, lt := range t.loginThrottles {
+		throttle := *lt
+		c.loginThrottles[k] = &throttle
+	}
+	for id, le := range t.lockoutEvents {
+		event := *le
+		c.lockoutEvents[id] = &event
+	}
+	for key, rb := range t.rateLimitBuckets {
+		bucket := *rb
+		c.rateLimitBuckets[key] = &bucket
+	}
+	for name, r := range t.roles {
+		role := *r
+		role.Permissions = append([]string(nil), r.Permissions...)
+		c.roles[name] = &role
+	}
+	for userID, names := range t.userRoles {
+		c.userRoles[userID] = make(map[string]bool, len(names))
+		for name := range names {
+			c.userRoles[userID][name] = true
+		}
+	}
+	for id, o := range t.organizations {
+		org := *o
+		c.organizations[id] = &org
+	}
+	for orgID, members := range t.members {
+		c.members[orgID] = make(map[int]map[string]bool, len(members))
+		for userID, names := range members {
+			c.members[orgID][userID] = make(map[string]bool, len(names))
+			for name := range names {
+				c.members[orgID][userID][name] = true
+			}
+		}
+	}
+	for orgID, invited := range t.invitations {
+		c.invitations[orgID] = make(map[int]time.Time, len(invited))
+		for userID, at := range invited {
+			c.invitations[orgID][userID] = at
+		}
+	}
+	for id, m := range t.outbox {
+		mail := *m
+		c.outbox[id] = &mail
+	}
+	for table, id := range t.lastIDs {
+		c.lastIDs[table] = id
+	}
+
+	return c
+}
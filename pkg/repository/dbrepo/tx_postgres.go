@@ -0,0 +1,61 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"web-app/pkg/repository"
+)
+
+// dbtx is what *sql.DB and *sql.Tx have in common, so that every query can run either on its
+// own or as part of a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// conn returns the transaction the repository is part of, or the pool if there is none.
+func (m *PostgresDBRepo) conn() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+// WithTx runs fn in a transaction. Every call fn makes on repo is part of the transaction, which
+// is committed if fn returns nil and rolled back otherwise. Calling WithTx on a repo that is
+// already in a transaction runs fn in that transaction.
+func (m *PostgresDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		return fn(tx)
+	})
+}
+
+func (m *PostgresDBRepo) inTx(ctx context.Context, fn func(tx *PostgresDBRepo) error) (err error) {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return pgError(err)
+	}
+
+	// roll back if fn fails, or panics
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = fn(&PostgresDBRepo{DB: m.DB, Timeout: m.Timeout, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return pgError(tx.Commit())
+}
@@ -0,0 +1,52 @@
+package dbrepo
+
+import (
+	"context"
+	"web-app/pkg/repository"
+)
+
+// conn returns the transaction the repository is part of, or the pool if there is none.
+func (m *SQLiteDBRepo) conn() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+// WithTx runs fn in a transaction. Every call fn makes on repo is part of the transaction, which
+// is committed if fn returns nil and rolled back otherwise. Calling WithTx on a repo that is
+// already in a transaction runs fn in that transaction.
+func (m *SQLiteDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return m.inTx(ctx, func(tx *SQLiteDBRepo) error {
+		return fn(tx)
+	})
+}
+
+func (m *SQLiteDBRepo) inTx(ctx context.Context, fn func(tx *SQLiteDBRepo) error) (err error) {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	// roll back if fn fails, or panics
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = fn(&SQLiteDBRepo{DB: m.DB, Timeout: m.Timeout, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return sqliteError(tx.Commit())
+}
@@ -0,0 +1,73 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// InsertUserToken stores the hash of a newly issued one-time token, and returns the ID of the new row
+func (m *MemoryDBRepo) InsertUserToken(ctx context.Context, t data.UserToken) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	err = m.db.requireUser(t.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, existing := range m.db.userTokens {
+		if existing.TokenHash == t.TokenHash {
+			return 0, &repository.DuplicateError{Field: "token_hash"}
+		}
+	}
+
+	t.ID = m.db.nextID("user_tokens")
+	t.UsedAt = nil
+	t.CreatedAt = time.Now()
+	m.db.userTokens[t.ID] = &t
+
+	return t.ID, nil
+}
+
+// UseUserToken marks a one-time token as used, and returns it, if it is still good for purpose
+func (m *MemoryDBRepo) UseUserToken(ctx context.Context, purpose, tokenHash string) (*data.UserToken, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for _, t := range m.db.userTokens {
+		if t.TokenHash == tokenHash && t.Purpose == purpose && !t.Used() && !t.Expired() {
+			now := time.Now()
+			t.UsedAt = &now
+			used := *t
+			return &used, nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// RevokeUserTokens marks every unused one-time token a user has for purpose as used
+func (m *MemoryDBRepo) RevokeUserTokens(ctx context.Context, userID int, purpose string) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := time.Now()
+	for _, t := range m.db.userTokens {
+		if t.UserID == userID && t.Purpose == purpose && !t.Used() {
+			t.UsedAt = &now
+		}
+	}
+
+	return nil
+}
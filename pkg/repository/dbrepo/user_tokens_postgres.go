@@ -0,0 +1,77 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"web-app/pkg/data"
+)
+
+// InsertUserToken stores the hash of a newly issued one-time token, and returns the ID of the new row
+func (m *PostgresDBRepo) InsertUserToken(ctx context.Context, t data.UserToken) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into user_tokens (user_id, purpose, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	err := m.conn().QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.Purpose,
+		t.TokenHash,
+		t.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, pgError(err)
+	}
+
+	return newID, nil
+}
+
+// UseUserToken marks a one-time token as used, and returns it, if it is still good for purpose.
+// Checking the token and using it is one statement, so only one caller can ever use it.
+func (m *PostgresDBRepo) UseUserToken(ctx context.Context, purpose, tokenHash string) (*data.UserToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		update user_tokens set used_at = $1
+		where token_hash = $2 and purpose = $3 and used_at is null and expires_at > $1
+		returning id, user_id, purpose, token_hash, expires_at, used_at, created_at`
+
+	var t data.UserToken
+	row := m.conn().QueryRowContext(ctx, stmt, time.Now(), tokenHash, purpose)
+
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Purpose,
+		&t.TokenHash,
+		&t.ExpiresAt,
+		&t.UsedAt,
+		&t.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, pgError(err)
+	}
+
+	return &t, nil
+}
+
+// RevokeUserTokens marks every unused one-time token a user has for purpose as used
+func (m *PostgresDBRepo) RevokeUserTokens(ctx context.Context, userID int, purpose string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update user_tokens set used_at = $1 where user_id = $2 and purpose = $3 and used_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID, purpose)
+	if err != nil {
+		return pgError(err)
+	}
+
+	return nil
+}
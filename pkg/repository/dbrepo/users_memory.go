@@ -0,0 +1,423 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemoryDBRepo keeps everything in memory, under the same rules as the database: ids are never
+// reused, user images, roles, memberships, refresh tokens, one-time tokens and api keys must
+// belong to an existing user and go with it when it is deleted, and email addresses (in any case)
+// and token hashes are unique. It starts with the same roles the migrations create. Nothing
+// outlives the process, which makes it suited to tests and to trying the applications out. It is
+// safe for concurrent use.
+type MemoryDBRepo struct {
+	// Timeout bounds each call whose context has no deadline of its own; zero means DefaultTimeout
+	Timeout time.Duration
+
+	db *memoryDB
+	// tx is set on the copy of the repository handed to a WithTx callback
+	tx bool
+}
+
+// memoryDB is the store behind a MemoryDBRepo, and the copies of it handed to transactions.
+type memoryDB struct {
+	// mu guards the tables, and txMu lets one transaction run at a time
+	mu   sync.Mutex
+	txMu sync.Mutex
+	memoryTables
+}
+
+type memoryTables struct {
+	users         map[int]*data.User
+	userImages    map[int]*data.UserImage
+	refreshTokens map[int]*data.RefreshToken
+	userTokens    map[int]*data.UserToken
+	// userMFA is keyed by user id, as each user has at most one authenticator
+	userMFA       map[int]*data.UserMFA
+	recoveryCodes map[int]*data.RecoveryCode
+	apiKeys       map[int]*data.APIKey
+	// loginThrottles is keyed by scope and key; they name an email address or an address, not a
+	// user, so they outlive users
+	loginThrottles map[throttleKey]*data.LoginThrottle
+	lockoutEvents  map[int]*data.LockoutEvent
+	// rateLimitBuckets is keyed by bucket key
+	rateLimitBuckets map[string]*data.RateLimitBucket
+	// roles is keyed by name, and userRoles holds the set of role names of each user id
+	roles     map[string]*data.Role
+	userRoles map[int]map[string]bool
+	// members holds, for each organization id, the user ids of its members and the set of role
+	// names each one has there
+	organizations map[int]*data.Organization
+	members       map[int]map[int]map[string]bool
+	// invitations holds, for each organization id, the user ids invited to it and when
+	invitations map[int]map[int]time.Time
+	// outbox holds every message ever queued, sent or not
+	outbox map[int]*data.Mail
+	// lastIDs holds the last id handed out for each table; like a sequence, it never goes back
+	lastIDs map[string]int
+}
+
+// NewMemoryDBRepo returns an in-memory repository with no users in it. Calls are limited to
+// timeout unless the caller sets its own deadline.
+func NewMemoryDBRepo(timeout time.Duration) *MemoryDBRepo {
+	t := memoryTables{
+		users:            make(map[int]*data.User),
+		userImages:       make(map[int]*data.UserImage),
+		refreshTokens:    make(map[int]*data.RefreshToken),
+		userTokens:       make(map[int]*data.UserToken),
+		userMFA:          make(map[int]*data.UserMFA),
+		recoveryCodes:    make(map[int]*data.RecoveryCode),
+		apiKeys:          make(map[int]*data.APIKey),
+		loginThrottles:   make(map[throttleKey]*data.LoginThrottle),
+		lockoutEvents:    make(map[int]*data.LockoutEvent),
+		rateLimitBuckets: make(map[string]*data.RateLimitBucket),
+		roles:            make(map[string]*data.Role),
+		userRoles:        make(map[int]map[string]bool),
+		organizations:    make(map[int]*data.Organization),
+		members:          make(map[int]map[int]map[string]bool),
+		invitations:      make(map[int]map[int]time.Time),
+		outbox:           make(map[int]*data.Mail),
+		lastIDs:          make(map[string]int),
+	}
+
+	// the roles created by the roles and organizations migrations
+	t.roles[data.RoleAdmin] = &data.Role{
+		ID:          t.nextID("roles"),
+		Name:        data.RoleAdmin,
+		Description: "manages users and their roles",
+		Permissions: []string{
+			data.PermissionManageRoles,
+			data.PermissionManageMembers,
+			data.PermissionDeleteUsers,
+			data.PermissionReadUsers,
+			data.PermissionWriteUsers,
+		},
+	}
+
+	return &MemoryDBRepo{Timeout: timeout, db: &memoryDB{memoryTables: t}}
+}
+
+// withTimeout returns ctx with the repository's timeout applied, unless the caller has already
+// set a deadline, which then wins.
+func (m *MemoryDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return boundContext(ctx, m.Timeout)
+}
+
+// begin locks the tables for one call. If ctx is done, or its deadline has passed, the call
+// fails instead, the way a query would.
+func (m *MemoryDBRepo) begin(ctx context.Context) (unlock func(), err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	err = ctx.Err()
+	if deadline, ok := ctx.Deadline(); ok && err == nil && !time.Now().Before(deadline) {
+		err = context.DeadlineExceeded
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %w", repository.ErrUnavailable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.db.mu.Lock()
+	return m.db.mu.Unlock, nil
+}
+
+// Connection returns nil; there is no database behind the repository.
+func (m *MemoryDBRepo) Connection() *sql.DB {
+	return nil
+}
+
+// nextID returns the next id for table.
+func (t *memoryTables) nextID(table string) int {
+	t.lastIDs[table]++
+	return t.lastIDs[table]
+}
+
+// requireUser returns repository.ErrConflict if there is no user with id, as the foreign keys on
+// user_images and refresh_tokens would.
+func (t *memoryTables) requireUser(id int) error {
+	if _, ok := t.users[id]; !ok {
+		return fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, id)
+	}
+	return nil
+}
+
+// requireUniqueEmail returns a repository.DuplicateError if a user other than exceptID already
+// has email, in any case, as the unique index on lower(email) would.
+func (t *memoryTables) requireUniqueEmail(email string, exceptID int) error {
+	for _, u := range t.users {
+		if u.ID != exceptID && strings.EqualFold(u.Email, data.NormalizeEmail(email)) {
+			return &repository.DuplicateError{Field: "email"}
+		}
+	}
+	return nil
+}
+
+// AllUsers returns one page of users matching the query
+func (m *MemoryDBRepo) AllUsers(ctx context.Context, q repository.UserQuery) (*repository.UserPage, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	users := make([]*data.User, 0, len(m.db.users))
+	for _, u := range m.db.users {
+		if q.OrganizationID != 0 && m.db.members[q.OrganizationID][u.ID] == nil {
+			continue
+		}
+		users = append(users, m.db.withRoles(u))
+	}
+
+	return q.Page(users)
+}
+
+// GetUser returns one user by id
+func (m *MemoryDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	u, ok := m.db.users[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	return m.db.withProfilePic(u), nil
+}
+
+// GetUserByEmail returns one user by email address, whatever its case
+func (m *MemoryDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for _, u := range m.db.users {
+		if strings.EqualFold(u.Email, data.NormalizeEmail(email)) {
+			return m.db.withProfilePic(u), nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// withRoles returns a copy of u with the names of its roles filled in, as the database queries do.
+func (t *memoryTables) withRoles(u *data.User) *data.User {
+	user := *u
+	user.Roles = []string{}
+	for name := range t.userRoles[u.ID] {
+		user.Roles = append(user.Roles, name)
+	}
+	sort.Strings(user.Roles)
+	return &user
+}
+
+// withProfilePic returns a copy of u with its roles and the file name of its profile image
+// filled in, as the database queries do.
+func (t *memoryTables) withProfilePic(u *data.User) *data.User {
+	user := t.withRoles(u)
+	for _, i := range t.userImages {
+		if i.UserID == u.ID {
+			user.ProfilePic.FileName = i.FileName
+		}
+	}
+	return user
+}
+
+// UpdateUser updates one user in the database. Changing the email address marks it as unverified.
+func (m *MemoryDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := m.db.users[u.ID]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	err = m.db.requireUniqueEmail(u.Email, u.ID)
+	if err != nil {
+		return err
+	}
+
+	// a new address has to be verified again
+	if user.Email != data.NormalizeEmail(u.Email) {
+		user.EmailVerifiedAt = nil
+	}
+	user.Email = data.NormalizeEmail(u.Email)
+	user.FirstName = u.FirstName
+	user.LastName = u.LastName
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// DeleteUser deletes one user from the database, by id, along with their images, roles,
+// memberships, invitations, refresh tokens, one-time tokens and api keys
+func (m *MemoryDBRepo) DeleteUser(ctx context.Context, id int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := m.db.users[id]; !ok {
+		return repository.ErrNotFound
+	}
+
+	delete(m.db.users, id)
+	delete(m.db.userRoles, id)
+	for _, members := range m.db.members {
+		delete(members, id)
+	}
+	for _, invited := range m.db.invitations {
+		delete(invited, id)
+	}
+	for imageID, i := range m.db.userImages {
+		if i.UserID == id {
+			delete(m.db.userImages, imageID)
+		}
+	}
+	for tokenID, t := range m.db.refreshTokens {
+		if t.UserID == id {
+			delete(m.db.refreshTokens, tokenID)
+		}
+	}
+	for tokenID, t := range m.db.userTokens {
+		if t.UserID == id {
+			delete(m.db.userTokens, tokenID)
+		}
+	}
+	delete(m.db.userMFA, id)
+	m.db.deleteRecoveryCodes(id)
+	for keyID, k := range m.db.apiKeys {
+		if k.UserID == id {
+			delete(m.db.apiKeys, keyID)
+		}
+	}
+
+	return nil
+}
+
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
+func (m *MemoryDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	err = m.db.requireUniqueEmail(user.Email, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	user.ID = m.db.nextID("users")
+	user.Email = data.NormalizeEmail(user.Email)
+	user.Password = string(hashedPassword)
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = time.Now()
+	user.ProfilePic = data.UserImage{}
+	user.Roles = nil
+	user.PasswordChangedAt = nil
+	user.EmailVerifiedAt = nil
+	m.db.users[user.ID] = &user
+
+	return user.ID, nil
+}
+
+// ResetPassword is the method we will use to change a user's password. It records when the
+// password was changed, so that older sessions can be told apart.
+func (m *MemoryDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := m.db.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	now := time.Now()
+	user.Password = string(hashedPassword)
+	user.PasswordChangedAt = &now
+
+	return nil
+}
+
+// MarkEmailVerified records that a user has proved they own their email address.
+func (m *MemoryDBRepo) MarkEmailVerified(ctx context.Context, id int) error {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := m.db.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+
+	return nil
+}
+
+// InsertUserImage inserts a user profile image into the database, replacing the old one.
+func (m *MemoryDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	unlock, err := m.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	err = m.db.requireUser(i.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	for imageID, old := range m.db.userImages {
+		if old.UserID == i.UserID {
+			delete(m.db.userImages, imageID)
+		}
+	}
+
+	i.ID = m.db.nextID("user_images")
+	i.CreatedAt = time.Now()
+	i.UpdatedAt = time.Now()
+	m.db.userImages[i.ID] = &i
+
+	return i.ID, nil
+}
@@ -0,0 +1,127 @@
+package dbrepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/repository/repotest"
+)
+
+func TestMemoryDBRepo(t *testing.T) {
+	repo := NewMemoryDBRepo(0)
+
+	repotest.Run(t, func(timeout time.Duration) repository.DatabaseRepo {
+		r := *repo
+		r.Timeout = timeout
+		return &r
+	})
+}
+
+func TestMemoryDBRepo_Seed(t *testing.T) {
+	f, err := LoadFixtures("./../../../sql/fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewMemoryDBRepo(0)
+	err = repo.Seed(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	admin, err := repo.GetUserByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatal("seeded admin not found:", err)
+	}
+
+	matches, _ := admin.PasswordMatches("secret")
+	if !matches {
+		t.Error("seeded password hash was not kept as it is")
+	}
+
+	if !admin.HasRole(data.RoleAdmin) {
+		t.Errorf("expected the seeded admin to have the admin role, but got %v", admin.Roles)
+	}
+
+	// new rows carry on after the seeded ids
+	id, _ := repo.InsertUser(ctx, data.User{Email: "new@example.com", Password: "secret"})
+	if id != len(f.Users)+1 {
+		t.Errorf("expected the next id to be %d, but got %d", len(f.Users)+1, id)
+	}
+
+	// seeding breaks the same rules as any other write, and then adds nothing
+	err = repo.Seed(Fixtures{
+		Users:      []FixtureUser{{User: data.User{Email: "another@example.com"}}},
+		UserImages: []data.UserImage{{UserID: 100, FileName: "nobody.png"}},
+	})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict seeding an image for a missing user, but got %v", err)
+	}
+
+	_, err = repo.GetUserByEmail(ctx, "another@example.com")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("user from failed seed was kept: %v", err)
+	}
+
+	err = repo.Seed(Fixtures{Users: []FixtureUser{{User: data.User{ID: 1}}}})
+	if !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("expected ErrDuplicate seeding an id that is taken, but got %v", err)
+	}
+
+	err = repo.Seed(Fixtures{Users: []FixtureUser{{User: data.User{Email: "another@example.com", Roles: []string{"owner"}}}}})
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound seeding an unknown role, but got %v", err)
+	}
+}
+
+func TestMemoryDBRepo_DeleteUserCascades(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryDBRepo(0)
+
+	id, _ := repo.InsertUser(ctx, data.User{Email: "jack@example.com", Password: "secret"})
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "jack.png"})
+	_, _ = repo.InsertRefreshToken(ctx, data.RefreshToken{UserID: id, TokenHash: "jack", FamilyID: "jack"})
+	_ = repo.AssignRole(ctx, id, data.RoleAdmin)
+	_ = repo.SaveUserMFA(ctx, id, "jack")
+	_ = repo.ReplaceRecoveryCodes(ctx, id, []string{"jack"})
+
+	user, _ := repo.GetUser(ctx, id)
+	if user.ProfilePic.FileName != "jack.png" {
+		t.Errorf("expected profile pic jack.png, but got %q", user.ProfilePic.FileName)
+	}
+
+	err := repo.DeleteUser(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.GetRefreshToken(ctx, "jack")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("refresh token of deleted user was kept: %v", err)
+	}
+
+	count, _ := repo.CountUsersWithRole(ctx, data.RoleAdmin)
+	if count != 0 {
+		t.Error("role of deleted user was kept")
+	}
+
+	if len(repo.db.userMFA) != 0 || len(repo.db.recoveryCodes) != 0 {
+		t.Error("authenticator or recovery codes of deleted user were kept")
+	}
+
+	// ids are not reused
+	newID, _ := repo.InsertUser(ctx, data.User{Email: "jack@example.com", Password: "secret"})
+	if newID == id {
+		t.Errorf("id %d was handed out twice", id)
+	}
+
+	user, _ = repo.GetUser(ctx, newID)
+	if user.ProfilePic.FileName != "" {
+		t.Error("image of deleted user was kept")
+	}
+}
@@ -3,71 +3,175 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 	"web-app/pkg/data"
+	"web-app/pkg/repository"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-const dbTimeout = time.Second * 3
+// DefaultTimeout is how long a query may run when neither the caller nor the repository set a
+// deadline.
+const DefaultTimeout = time.Second * 3
 
 type PostgresDBRepo struct {
 	DB *sql.DB
+	// Timeout bounds each query whose context has no deadline of its own; zero means DefaultTimeout
+	Timeout time.Duration
+
+	// tx is set on the copy of the repository handed to a WithTx callback
+	tx *sql.Tx
+}
+
+// withTimeout returns ctx with the repository's timeout applied, unless the caller has already
+// set a deadline, which then wins.
+func (m *PostgresDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return boundContext(ctx, m.Timeout)
 }
 
 func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
-// AllUsers returns all users as a slice of *data.User
-func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// AllUsers returns one page of users matching the query. Pages are found by keyset pagination
+// on the sort field and id, so deep pages are as cheap as the first one.
+func (m *PostgresDBRepo) AllUsers(ctx context.Context, q repository.UserQuery) (*repository.UserPage, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at
-	from users order by last_name`
+	q = q.Normalize()
+
+	field, desc, err := q.SortField()
+	if err != nil {
+		return nil, err
+	}
+
+	// build the where clause and its arguments
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.EmailPrefix != "" {
+		where = append(where, "email ilike "+arg(escapeLike(q.EmailPrefix)+"%"))
+	}
+	if q.Role != "" {
+		where = append(where, `exists (select 1 from user_roles ur join roles r on r.id = ur.role_id
+			where ur.user_id = users.id and r.name = `+arg(q.Role)+`)`)
+	}
+	if q.OrganizationID != 0 {
+		where = append(where, `exists (select 1 from organization_members om
+			where om.user_id = users.id and om.organization_id = `+arg(q.OrganizationID)+`)`)
+	}
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= "+arg(q.CreatedAfter))
+	}
+	if !q.CreatedBefore.IsZero() {
+		where = append(where, "created_at < "+arg(q.CreatedBefore))
+	}
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	// resume after the last user of the previous page
+	afterValue, afterID, hasCursor, err := q.After()
 	if err != nil {
 		return nil, err
 	}
+	if hasCursor {
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		switch field {
+		case "id":
+			where = append(where, fmt.Sprintf("id %s %s", op, arg(afterID)))
+		case "created_at":
+			after, err := time.Parse(time.RFC3339Nano, afterValue)
+			if err != nil {
+				return nil, repository.ErrInvalidCursor
+			}
+			where = append(where, fmt.Sprintf("(created_at, id) %s (%s, %s)", op, arg(after), arg(afterID)))
+		default:
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", field, op, arg(afterValue), arg(afterID)))
+		}
+	}
+
+	direction := "asc"
+	if desc {
+		direction = "desc"
+	}
+
+	query := `select id, email, first_name, last_name, password, created_at, updated_at, password_changed_at, email_verified_at, ` + m.userRolesColumn("users") + `
+	from users`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	// field is one of a fixed set of column names, so it is safe to use here
+	query += fmt.Sprintf(" order by %s %s, id %s limit %s", field, direction, direction, arg(q.Limit+1))
+
+	rows, err := m.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pgError(err)
+	}
 	defer rows.Close()
 
 	var users []*data.User
 
 	for rows.Next() {
 		var user data.User
+		var roles string
 		err := rows.Scan(
 			&user.ID,
 			&user.Email,
 			&user.FirstName,
 			&user.LastName,
 			&user.Password,
-			&user.IsAdmin,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.PasswordChangedAt,
+			&user.EmailVerifiedAt,
+			&roles,
 		)
 		if err != nil {
 			log.Println("Error scanning", err)
-			return nil, err
+			return nil, pgError(err)
 		}
 
+		user.Roles = splitNames(roles)
 		users = append(users, &user)
 	}
 
-	return users, nil
+	if err := rows.Err(); err != nil {
+		return nil, pgError(err)
+	}
+
+	// we asked for one more row than we need, to know if there is a next page
+	page := &repository.UserPage{Users: users}
+	if len(users) > q.Limit {
+		page.Users = users[:q.Limit]
+		page.NextCursor = q.CursorFor(page.Users[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+// escapeLike escapes the wildcard characters of a like pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
 // GetUser returns one user by id
-func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `
 		select 
-			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
-			coalesce(ui.file_name, '')
+			u.id, u.email, u.first_name, u.last_name, u.password, u.created_at, u.updated_at, u.password_changed_at, u.email_verified_at,
+			coalesce(ui.file_name, ''), ` + m.userRolesColumn("u") + `
 		from 
 			users u
 			left join user_images ui on (ui.user_id = u.id)
@@ -75,7 +179,8 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 		    u.id = $1`
 
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, id)
+	var roles string
+	row := m.conn().QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&user.ID,
@@ -83,36 +188,40 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
-		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.PasswordChangedAt,
+		&user.EmailVerifiedAt,
 		&user.ProfilePic.FileName,
+		&roles,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, pgError(err)
 	}
+	user.Roles = splitNames(roles)
 
 	return &user, nil
 }
 
-// GetUserByEmail returns one user by email address
-func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetUserByEmail returns one user by email address, whatever its case
+func (m *PostgresDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `
 		select 
-			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
-			coalesce(ui.file_name, '')
+			u.id, u.email, u.first_name, u.last_name, u.password, u.created_at, u.updated_at, u.password_changed_at, u.email_verified_at,
+			coalesce(ui.file_name, ''), ` + m.userRolesColumn("u") + `
 		from 
 			users u
 			left join user_images ui on (ui.user_id = u.id)
 		where 
-		    u.email = $1`
+		    lower(u.email) = $1`
 
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, email)
+	var roles string
+	row := m.conn().QueryRowContext(ctx, query, data.NormalizeEmail(email))
 
 	err := row.Scan(
 		&user.ID,
@@ -120,67 +229,70 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
-		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.PasswordChangedAt,
+		&user.EmailVerifiedAt,
 		&user.ProfilePic.FileName,
+		&roles,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, pgError(err)
 	}
+	user.Roles = splitNames(roles)
 
 	return &user, nil
 }
 
-// UpdateUser updates one user in the database
-func (m *PostgresDBRepo) UpdateUser(u data.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// UpdateUser updates one user in the database. Changing the email address marks it as unverified.
+func (m *PostgresDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
+	// a new address has to be verified again
 	stmt := `update users set
+		email_verified_at = case when email = $1 then email_verified_at end,
 		email = $1,
 		first_name = $2,
 		last_name = $3,
-		is_admin = $4,
-		updated_at = $5
-		where id = $6
+		updated_at = $4
+		where id = $5
 	`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		u.Email,
+	res, err := m.conn().ExecContext(ctx, stmt,
+		data.NormalizeEmail(u.Email),
 		u.FirstName,
 		u.LastName,
-		u.IsAdmin,
 		time.Now(),
 		u.ID,
 	)
 
 	if err != nil {
-		return err
+		return pgError(err)
 	}
 
-	return nil
+	return requireRows(res)
 }
 
 // DeleteUser deletes one user from the database, by id
-func (m *PostgresDBRepo) DeleteUser(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	stmt := `delete from users where id = $1`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	res, err := m.conn().ExecContext(ctx, stmt, id)
 	if err != nil {
-		return err
+		return pgError(err)
 	}
 
-	return nil
+	return requireRows(res)
 }
 
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
-func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
@@ -189,29 +301,29 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
 
-	err = m.DB.QueryRowContext(ctx, stmt,
-		user.Email,
+	err = m.conn().QueryRowContext(ctx, stmt,
+		data.NormalizeEmail(user.Email),
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
-		user.IsAdmin,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
 
 	if err != nil {
-		return 0, err
+		return 0, pgError(err)
 	}
 
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// ResetPassword is the method we will use to change a user's password. It records when the
+// password was changed, so that older sessions can be told apart.
+func (m *PostgresDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
@@ -219,36 +331,55 @@ func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 		return err
 	}
 
-	stmt := `update users set password = $1 where id = $2`
-	_, err = m.DB.ExecContext(ctx, stmt, hashedPassword, id)
+	stmt := `update users set password = $1, password_changed_at = $2 where id = $3`
+	res, err := m.conn().ExecContext(ctx, stmt, hashedPassword, time.Now(), id)
 	if err != nil {
-		return err
+		return pgError(err)
 	}
 
-	return nil
+	return requireRows(res)
 }
 
-// InsertUserImage inserts a user profile image into the database.
-func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// MarkEmailVerified records that a user has proved they own their email address.
+func (m *PostgresDBRepo) MarkEmailVerified(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	stmt := `delete from user_images where user_id = $1`
-	_, err := m.DB.ExecContext(ctx, stmt, i.UserID)
+	stmt := `update users set email_verified_at = $1 where id = $2`
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now(), id)
 	if err != nil {
-		return 0, err
+		return pgError(err)
 	}
 
+	return requireRows(res)
+}
+
+// InsertUserImage inserts a user profile image into the database.
+func (m *PostgresDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	// replace the old image in one transaction, so a failed insert keeps it
 	var newID int
-	stmt = `insert into user_images (user_id, file_name, created_at, updated_at)
-		values ($1, $2, $3, $4) returning id`
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		stmt := `delete from user_images where user_id = $1`
+		_, err := tx.conn().ExecContext(ctx, stmt, i.UserID)
+		if err != nil {
+			return pgError(err)
+		}
 
-	err = m.DB.QueryRowContext(ctx, stmt,
-		i.UserID,
-		i.FileName,
-		time.Now(),
-		time.Now(),
-	).Scan(&newID)
+		stmt = `insert into user_images (user_id, file_name, created_at, updated_at)
+			values ($1, $2, $3, $4) returning id`
+
+		err = tx.conn().QueryRowContext(ctx, stmt,
+			i.UserID,
+			i.FileName,
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+
+		return pgError(err)
+	})
 
 	if err != nil {
 		return 0, err
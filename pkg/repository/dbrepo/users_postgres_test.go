@@ -7,8 +7,8 @@ import (
 	"os"
 	"testing"
 	"time"
-	"web-app/pkg/data"
 	"web-app/pkg/repository"
+	"web-app/pkg/repository/repotest"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
@@ -28,14 +28,40 @@ var (
 
 var resource *dockertest.Resource
 var pool *dockertest.Pool
-var testDB *sql.DB
-var testRepo repository.DatabaseRepo
+
+// pgDB is the Postgres test database, or nil if docker is not available
+var pgDB *sql.DB
 
 func TestMain(m *testing.M) {
+	err := startPostgres()
+	if err != nil {
+		log.Printf("not running postgres tests: %s", err)
+	}
+
+	// run tests
+	code := m.Run()
+
+	// clean up
+	if resource != nil {
+		if err := pool.Purge(resource); err != nil {
+			log.Fatalf("could not purge resource: %s", err)
+		}
+	}
+
+	os.Exit(code)
+}
+
+// startPostgres starts Postgres in docker, and connects pgDB to it.
+func startPostgres() error {
 	// connect to docker; fail if docker not running
 	p, err := dockertest.NewPool("")
 	if err != nil {
-		log.Fatalf("could not connect to docker; is it running? %s", err)
+		return fmt.Errorf("could not connect to docker; is it running? %w", err)
+	}
+
+	err = p.Client.Ping()
+	if err != nil {
+		return fmt.Errorf("could not connect to docker; is it running? %w", err)
 	}
 
 	pool = p
@@ -60,211 +86,38 @@ func TestMain(m *testing.M) {
 	// get a resource (docker image)
 	resource, err = pool.RunWithOptions(&opts)
 	if err != nil {
-		_ = pool.Purge(resource)
-		log.Fatalf("could not start resource: %s", err)
+		return fmt.Errorf("could not start resource: %w", err)
 	}
 
 	// start the image and wait until it's ready
 	if err := pool.Retry(func() error {
 		var err error
-		testDB, err = sql.Open("pgx", fmt.Sprintf(dsn, host, port, user, password, dbName))
+		pgDB, err = sql.Open("pgx", fmt.Sprintf(dsn, host, port, user, password, dbName))
 		if err != nil {
 			log.Println("Error:", err)
 			return err
 		}
-		return testDB.Ping()
+		return pgDB.Ping()
 	}); err != nil {
-		_ = pool.Purge(resource)
-		log.Fatalf("could not connect to database: %s", err)
-	}
-
-	// populate the database with empty tables
-	err = createTables()
-	if err != nil {
-		log.Fatalf("error creating tables: %s", err)
-	}
-
-	testRepo = &PostgresDBRepo{DB: testDB}
-
-	// run tests
-	code := m.Run()
-
-	// clean up
-	if err := pool.Purge(resource); err != nil {
-		log.Fatalf("could not purge resource: %s", err)
-	}
-
-	os.Exit(code)
-}
-
-func createTables() error {
-	tableSQL, err := os.ReadFile("./testdata/users.sql")
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	_, err = testDB.Exec(string(tableSQL))
-	if err != nil {
-		fmt.Println(err)
-		return err
+		pgDB = nil
+		return fmt.Errorf("could not connect to database: %w", err)
 	}
 
 	return nil
 }
 
-func Test_pingDB(t *testing.T) {
-	err := testDB.Ping()
-	if err != nil {
-		t.Error("can't ping database")
+func TestPostgresDBRepo(t *testing.T) {
+	if pgDB == nil {
+		t.Skip("postgres is not available")
 	}
-}
 
-func TestPostgresDBRepoInsertUser(t *testing.T) {
-	testUser := data.User{
-		FirstName: "Admin",
-		LastName:  "User",
-		Email:     "admin@example.com",
-		Password:  "secret",
-		IsAdmin:   1,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-
-	id, err := testRepo.InsertUser(testUser)
-	if err != nil {
-		t.Errorf("insert user returned an error: %s", err)
-	}
-
-	if id != 1 {
-		t.Errorf("insert user returned wrong id; expected 1, but got %d", id)
-	}
-}
-
-func TestPostgresDBRepoAllUsers(t *testing.T) {
-	users, err := testRepo.AllUsers()
+	// populate the database with empty tables, by applying every migration
+	err := createTables(pgDB, DialectPostgres)
 	if err != nil {
-		t.Errorf("all users reports an error: %s", err)
-	}
-
-	if len(users) != 1 {
-		t.Errorf("all users reports wrong size; expected 1, but got %d", len(users))
+		t.Fatalf("error creating tables: %s", err)
 	}
 
-	testUser := data.User{
-		FirstName: "Jack",
-		LastName:  "Smith",
-		Email:     "jack@smith.com",
-		Password:  "secret",
-		IsAdmin:   1,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-
-	_, _ = testRepo.InsertUser(testUser)
-
-	users, err = testRepo.AllUsers()
-	if err != nil {
-		t.Errorf("all users reports an error: %s", err)
-	}
-
-	if len(users) != 2 {
-		t.Errorf("all users reports wrong size after insert; expected 2, but got %d", len(users))
-	}
-}
-
-func TestPostgresDBRepoGetUser(t *testing.T) {
-	user, err := testRepo.GetUser(1)
-	if err != nil {
-		t.Errorf("error getting user by id: %s", err)
-	}
-
-	if user.Email != "admin@example.com" {
-		t.Errorf("wrong email returned by GetUser; expected admin@example.com but got %s", user.Email)
-	}
-
-	_, err = testRepo.GetUser(3)
-	if err == nil {
-		t.Error("no error reported when getting non existent user by id")
-	}
-
-}
-
-func TestPostgresDBRepoGetUserByEmail(t *testing.T) {
-	user, err := testRepo.GetUserByEmail("jack@smith.com")
-	if err != nil {
-		t.Errorf("error getting user by email: %s", err)
-	}
-
-	if user.ID != 2 {
-		t.Errorf("wrong id returned by GetUserByEmail; expected 2 but got %d", user.ID)
-	}
-}
-
-func TestPostgresDBRepoUpdateUser(t *testing.T) {
-	user, _ := testRepo.GetUser(2)
-	user.FirstName = "Jane"
-	user.Email = "jane@smith.com"
-
-	err := testRepo.UpdateUser(*user)
-	if err != nil {
-		t.Errorf("error updating user %d: %s", 2, err)
-	}
-
-	user, _ = testRepo.GetUser(2)
-	if user.FirstName != "Jane" || user.Email != "jane@smith.com" {
-		t.Errorf("expected updated record to have first name Jane and email jane@smith.com, but got %s %s", user.FirstName, user.Email)
-	}
-}
-
-func TestPostgresDBRepoDeleteUser(t *testing.T) {
-	err := testRepo.DeleteUser(2)
-	if err != nil {
-		t.Errorf("error deleting user id 2: %s", err)
-	}
-
-	_, err = testRepo.GetUser(2)
-	if err == nil {
-		t.Error("retrieved user id 2, who should have been deleted")
-	}
-}
-
-func TestPostgresDBRepoResetPassword(t *testing.T) {
-	err := testRepo.ResetPassword(1, "password")
-	if err != nil {
-		t.Error("error resetting user's password", err)
-	}
-
-	user, _ := testRepo.GetUser(1)
-	matches, err := user.PasswordMatches("password")
-	if err != nil {
-		t.Error(err)
-	}
-
-	if !matches {
-		t.Errorf("password should match 'password', but does not")
-	}
-}
-
-func TestPostgresDBRepoInsertUserImage(t *testing.T) {
-	var image data.UserImage
-	image.UserID = 1
-	image.FileName = "test.jpg"
-	image.CreatedAt = time.Now()
-	image.UpdatedAt = time.Now()
-
-	newID, err := testRepo.InsertUserImage(image)
-	if err != nil {
-		t.Error("inserting user image failed:", err)
-	}
-
-	if newID != 1 {
-		t.Error("got wrong id for image; should be 1, but got", newID)
-	}
-
-	image.UserID = 100
-	_, err = testRepo.InsertUserImage(image)
-	if err == nil {
-		t.Error("inserted a user image with non-existent user id")
-	}
+	repotest.Run(t, func(timeout time.Duration) repository.DatabaseRepo {
+		return New(pgDB, DialectPostgres, timeout)
+	})
 }
@@ -0,0 +1,383 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SQLiteDBRepo keeps everything in a single SQLite file, so that the applications can run
+// without a database server. Times are stored in UTC, as text that sorts in time order.
+type SQLiteDBRepo struct {
+	DB *sql.DB
+	// Timeout bounds each query whose context has no deadline of its own; zero means DefaultTimeout
+	Timeout time.Duration
+
+	// tx is set on the copy of the repository handed to a WithTx callback
+	tx *sql.Tx
+}
+
+// withTimeout returns ctx with the repository's timeout applied, unless the caller has already
+// set a deadline, which then wins.
+func (m *SQLiteDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return boundContext(ctx, m.Timeout)
+}
+
+func (m *SQLiteDBRepo) Connection() *sql.DB {
+	return m.DB
+}
+
+// AllUsers returns one page of users matching the query. Pages are found by keyset pagination
+// on the sort field and id, so deep pages are as cheap as the first one.
+func (m *SQLiteDBRepo) AllUsers(ctx context.Context, q repository.UserQuery) (*repository.UserPage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	q = q.Normalize()
+
+	field, desc, err := q.SortField()
+	if err != nil {
+		return nil, err
+	}
+
+	// build the where clause and its arguments
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.EmailPrefix != "" {
+		// like ignores case in sqlite
+		where = append(where, "email like "+arg(escapeLike(q.EmailPrefix)+"%")+` escape '\'`)
+	}
+	if q.Role != "" {
+		where = append(where, `exists (select 1 from user_roles ur join roles r on r.id = ur.role_id
+			where ur.user_id = users.id and r.name = `+arg(q.Role)+`)`)
+	}
+	if q.OrganizationID != 0 {
+		where = append(where, `exists (select 1 from organization_members om
+			where om.user_id = users.id and om.organization_id = `+arg(q.OrganizationID)+`)`)
+	}
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= "+arg(q.CreatedAfter.UTC()))
+	}
+	if !q.CreatedBefore.IsZero() {
+		where = append(where, "created_at < "+arg(q.CreatedBefore.UTC()))
+	}
+
+	// resume after the last user of the previous page
+	afterValue, afterID, hasCursor, err := q.After()
+	if err != nil {
+		return nil, err
+	}
+	if hasCursor {
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		switch field {
+		case "id":
+			where = append(where, fmt.Sprintf("id %s %s", op, arg(afterID)))
+		case "created_at":
+			after, err := time.Parse(time.RFC3339Nano, afterValue)
+			if err != nil {
+				return nil, repository.ErrInvalidCursor
+			}
+			where = append(where, fmt.Sprintf("(created_at, id) %s (%s, %s)", op, arg(after.UTC()), arg(afterID)))
+		default:
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", field, op, arg(afterValue), arg(afterID)))
+		}
+	}
+
+	direction := "asc"
+	if desc {
+		direction = "desc"
+	}
+
+	query := `select id, email, first_name, last_name, password, created_at, updated_at, password_changed_at, email_verified_at, ` + m.userRolesColumn("users") + `
+	from users`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	// field is one of a fixed set of column names, so it is safe to use here
+	query += fmt.Sprintf(" order by %s %s, id %s limit %s", field, direction, direction, arg(q.Limit+1))
+
+	rows, err := m.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		var roles string
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.PasswordChangedAt,
+			&user.EmailVerifiedAt,
+			&roles,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, sqliteError(err)
+		}
+
+		user.Roles = splitNames(roles)
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteError(err)
+	}
+
+	// we asked for one more row than we need, to know if there is a next page
+	page := &repository.UserPage{Users: users}
+	if len(users) > q.Limit {
+		page.Users = users[:q.Limit]
+		page.NextCursor = q.CursorFor(page.Users[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+// GetUser returns one user by id
+func (m *SQLiteDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select 
+			u.id, u.email, u.first_name, u.last_name, u.password, u.created_at, u.updated_at, u.password_changed_at, u.email_verified_at,
+			coalesce(ui.file_name, ''), ` + m.userRolesColumn("u") + `
+		from 
+			users u
+			left join user_images ui on (ui.user_id = u.id)
+		where 
+		    u.id = $1`
+
+	var user data.User
+	var roles string
+	row := m.conn().QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.PasswordChangedAt,
+		&user.EmailVerifiedAt,
+		&user.ProfilePic.FileName,
+		&roles,
+	)
+
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	user.Roles = splitNames(roles)
+
+	return &user, nil
+}
+
+// GetUserByEmail returns one user by email address, whatever its case
+func (m *SQLiteDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select 
+			u.id, u.email, u.first_name, u.last_name, u.password, u.created_at, u.updated_at, u.password_changed_at, u.email_verified_at,
+			coalesce(ui.file_name, ''), ` + m.userRolesColumn("u") + `
+		from 
+			users u
+			left join user_images ui on (ui.user_id = u.id)
+		where 
+		    lower(u.email) = $1`
+
+	var user data.User
+	var roles string
+	row := m.conn().QueryRowContext(ctx, query, data.NormalizeEmail(email))
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.PasswordChangedAt,
+		&user.EmailVerifiedAt,
+		&user.ProfilePic.FileName,
+		&roles,
+	)
+
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	user.Roles = splitNames(roles)
+
+	return &user, nil
+}
+
+// UpdateUser updates one user in the database. Changing the email address marks it as unverified.
+func (m *SQLiteDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	// a new address has to be verified again
+	stmt := `update users set
+		email_verified_at = case when email = $1 then email_verified_at end,
+		email = $1,
+		first_name = $2,
+		last_name = $3,
+		updated_at = $4
+		where id = $5
+	`
+
+	res, err := m.conn().ExecContext(ctx, stmt,
+		data.NormalizeEmail(u.Email),
+		u.FirstName,
+		u.LastName,
+		time.Now().UTC(),
+		u.ID,
+	)
+
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return requireRows(res)
+}
+
+// DeleteUser deletes one user from the database, by id
+func (m *SQLiteDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from users where id = $1`
+
+	res, err := m.conn().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return requireRows(res)
+}
+
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
+func (m *SQLiteDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into users (email, first_name, last_name, password, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err = m.conn().QueryRowContext(ctx, stmt,
+		data.NormalizeEmail(user.Email),
+		user.FirstName,
+		user.LastName,
+		hashedPassword,
+		time.Now().UTC(),
+		time.Now().UTC(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+
+	return newID, nil
+}
+
+// ResetPassword is the method we will use to change a user's password. It records when the
+// password was changed, so that older sessions can be told apart.
+func (m *SQLiteDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update users set password = $1, password_changed_at = $2 where id = $3`
+	res, err := m.conn().ExecContext(ctx, stmt, hashedPassword, time.Now().UTC(), id)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return requireRows(res)
+}
+
+// MarkEmailVerified records that a user has proved they own their email address.
+func (m *SQLiteDBRepo) MarkEmailVerified(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set email_verified_at = $1 where id = $2`
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now().UTC(), id)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return requireRows(res)
+}
+
+// InsertUserImage inserts a user profile image into the database.
+func (m *SQLiteDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	// replace the old image in one transaction, so a failed insert keeps it
+	var newID int
+	err := m.inTx(ctx, func(tx *SQLiteDBRepo) error {
+		stmt := `delete from user_images where user_id = $1`
+		_, err := tx.conn().ExecContext(ctx, stmt, i.UserID)
+		if err != nil {
+			return sqliteError(err)
+		}
+
+		stmt = `insert into user_images (user_id, file_name, created_at, updated_at)
+			values ($1, $2, $3, $4) returning id`
+
+		err = tx.conn().QueryRowContext(ctx, stmt,
+			i.UserID,
+			i.FileName,
+			time.Now().UTC(),
+			time.Now().UTC(),
+		).Scan(&newID)
+
+		return sqliteError(err)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
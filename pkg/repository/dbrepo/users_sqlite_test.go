@@ -0,0 +1,26 @@
+package dbrepo
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"web-app/pkg/repository"
+	"web-app/pkg/repository/repotest"
+)
+
+func TestSQLiteDBRepo(t *testing.T) {
+	db, err := Open("sqlite:" + filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = createTables(db, DialectSQLite)
+	if err != nil {
+		t.Fatalf("error creating tables: %s", err)
+	}
+
+	repotest.Run(t, func(timeout time.Duration) repository.DatabaseRepo {
+		return New(db, DialectSQLite, timeout)
+	})
+}
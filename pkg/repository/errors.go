@@ -0,0 +1,44 @@
+package repository
+
+import "errors"
+
+// Every DatabaseRepo implementation wraps its errors in one of these, so that callers can tell
+// what went wrong without knowing which database is behind the repository. Test for them with
+// errors.Is; the original driver error is still in the chain, for logging.
+var (
+	// ErrNotFound means the requested record does not exist.
+	ErrNotFound = errors.New("record not found")
+	// ErrDuplicate means the write would break a uniqueness rule, such as one user per email address.
+	ErrDuplicate = errors.New("duplicate record")
+	// ErrConflict means the write conflicts with other data, such as a reference to a record
+	// that does not exist, or with a concurrent transaction.
+	ErrConflict = errors.New("conflicting record")
+	// ErrUnavailable means the database could not be reached, or did not answer in time. The
+	// operation may succeed if retried later.
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// DuplicateError is the error for a write that would break a uniqueness rule. It wraps
+// ErrDuplicate, and names the field that would no longer be unique, so that callers can tell
+// the user what to change.
+type DuplicateError struct {
+	// Field is the field whose value is already taken, such as "email"; empty if it is not known
+	Field string
+	// Err is the error from the database, if there was one
+	Err error
+}
+
+func (e *DuplicateError) Error() string {
+	msg := ErrDuplicate.Error()
+	if e.Field != "" {
+		msg += ": " + e.Field + " already taken"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *DuplicateError) Unwrap() []error {
+	return []error{ErrDuplicate, e.Err}
+}
@@ -0,0 +1,224 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"web-app/pkg/data"
+)
+
+const (
+	DefaultUserPageSize = 20
+	MaxUserPageSize     = 100
+	DefaultUserSort     = "last_name"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort field")
+)
+
+// sortableUserFields are the fields users can be sorted by. Ties are always broken by id, so
+// that every user has a unique position to resume a page from.
+var sortableUserFields = map[string]bool{
+	"id":         true,
+	"email":      true,
+	"first_name": true,
+	"last_name":  true,
+	"created_at": true,
+}
+
+// UserQuery describes which page of users AllUsers should return.
+type UserQuery struct {
+	// Limit is the page size; zero means DefaultUserPageSize
+	Limit int
+	// Cursor is the NextCursor of the previous page, or empty for the first page
+	Cursor string
+	// Sort is a sortable field name, prefixed with "-" for descending order
+	Sort string
+
+	// filters; zero values are ignored
+	EmailPrefix string
+	Role        string
+	// OrganizationID limits the users to the members of one organization. Page does not apply
+	// it, since users do not carry their memberships; the caller has to pick the members out.
+	OrganizationID int
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+}
+
+// UserPage is one page of users, and the cursor of the page after it. NextCursor is empty
+// on the last page.
+type UserPage struct {
+	Users      []*data.User
+	NextCursor string
+}
+
+// userCursor is the position of the last user on a page. It is handed to clients as an opaque,
+// base64 encoded json string.
+type userCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// Normalize fills in defaults, and clamps the limit.
+func (q UserQuery) Normalize() UserQuery {
+	if q.Limit <= 0 {
+		q.Limit = DefaultUserPageSize
+	}
+	if q.Limit > MaxUserPageSize {
+		q.Limit = MaxUserPageSize
+	}
+	if q.Sort == "" {
+		q.Sort = DefaultUserSort
+	}
+	return q
+}
+
+// SortField returns the field to sort by, and whether the order is descending.
+func (q UserQuery) SortField() (string, bool, error) {
+	field := strings.TrimPrefix(q.Sort, "-")
+	if !sortableUserFields[field] {
+		return "", false, fmt.Errorf("%w: %q", ErrInvalidSort, field)
+	}
+	return field, strings.HasPrefix(q.Sort, "-"), nil
+}
+
+// After decodes the cursor, returning the sort value and id of the last user on the previous
+// page. It returns ok == false if there is no cursor.
+func (q UserQuery) After() (value string, id int, ok bool, err error) {
+	if q.Cursor == "" {
+		return "", 0, false, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return "", 0, false, ErrInvalidCursor
+	}
+
+	var c userCursor
+	err = json.Unmarshal(raw, &c)
+	if err != nil {
+		return "", 0, false, ErrInvalidCursor
+	}
+
+	// a cursor only makes sense for the sort order it was created with
+	if c.Sort != q.Sort {
+		return "", 0, false, fmt.Errorf("%w: cursor does not match sort order", ErrInvalidCursor)
+	}
+
+	return c.Value, c.ID, true, nil
+}
+
+// CursorFor returns the cursor that resumes the query after user u.
+func (q UserQuery) CursorFor(u *data.User) string {
+	field, _, _ := q.SortField()
+	raw, _ := json.Marshal(userCursor{Sort: q.Sort, Value: UserSortValue(field, u), ID: u.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// UserSortValue returns the value of a sortable field as a string, as stored in a cursor.
+func UserSortValue(field string, u *data.User) string {
+	switch field {
+	case "email":
+		return u.Email
+	case "first_name":
+		return u.FirstName
+	case "last_name":
+		return u.LastName
+	case "created_at":
+		return u.CreatedAt.UTC().Format(time.RFC3339Nano)
+	default:
+		return strconv.Itoa(u.ID)
+	}
+}
+
+// Page applies the query to a slice of users held in memory. Database backed repositories do
+// the same work in sql; this is for repositories that keep users in memory.
+func (q UserQuery) Page(users []*data.User) (*UserPage, error) {
+	q = q.Normalize()
+
+	field, desc, err := q.SortField()
+	if err != nil {
+		return nil, err
+	}
+
+	afterValue, afterID, hasCursor, err := q.After()
+	if err != nil {
+		return nil, err
+	}
+
+	// compare orders two users by the sort field, then by id
+	compare := func(a, b *data.User) int {
+		var c int
+		switch field {
+		case "created_at":
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		case "id":
+			c = 0
+		default:
+			c = strings.Compare(UserSortValue(field, a), UserSortValue(field, b))
+		}
+		if c == 0 {
+			c = a.ID - b.ID
+		}
+		if desc {
+			c = -c
+		}
+		return c
+	}
+
+	var cursorUser *data.User
+	if hasCursor {
+		cursorUser = &data.User{ID: afterID}
+		switch field {
+		case "email":
+			cursorUser.Email = afterValue
+		case "first_name":
+			cursorUser.FirstName = afterValue
+		case "last_name":
+			cursorUser.LastName = afterValue
+		case "created_at":
+			cursorUser.CreatedAt, err = time.Parse(time.RFC3339Nano, afterValue)
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+		}
+	}
+
+	var matched []*data.User
+	for _, u := range users {
+		if q.EmailPrefix != "" && !strings.HasPrefix(strings.ToLower(u.Email), strings.ToLower(q.EmailPrefix)) {
+			continue
+		}
+		if q.Role != "" && !u.HasRole(q.Role) {
+			continue
+		}
+		if !q.CreatedAfter.IsZero() && u.CreatedAt.Before(q.CreatedAfter) {
+			continue
+		}
+		if !q.CreatedBefore.IsZero() && !u.CreatedAt.Before(q.CreatedBefore) {
+			continue
+		}
+		if cursorUser != nil && compare(u, cursorUser) <= 0 {
+			continue
+		}
+		matched = append(matched, u)
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return compare(matched[i], matched[j]) < 0 })
+
+	page := &UserPage{Users: matched}
+	if len(matched) > q.Limit {
+		page.Users = matched[:q.Limit]
+		page.NextCursor = q.CursorFor(page.Users[q.Limit-1])
+	}
+
+	return page, nil
+}
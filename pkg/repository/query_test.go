@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"testing"
+	"time"
+	"web-app/pkg/data"
+)
+
+func testUsers() []*data.User {
+	now := time.Now()
+	return []*data.User{
+		{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com", Roles: []string{data.RoleAdmin}, CreatedAt: now.Add(-3 * time.Hour)},
+		{ID: 2, FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: 3, FirstName: "Jane", LastName: "Smith", Email: "jane@example.com", CreatedAt: now.Add(-1 * time.Hour)},
+	}
+}
+
+func TestUserQuery_Page(t *testing.T) {
+	var tests = []struct {
+		name        string
+		query       UserQuery
+		expectedIDs []int
+		expectNext  bool
+	}{
+		{"default sort by last name, ties by id", UserQuery{}, []int{2, 3, 1}, false},
+		{"descending", UserQuery{Sort: "-last_name"}, []int{1, 3, 2}, false},
+		{"limit", UserQuery{Limit: 2}, []int{2, 3}, true},
+		{"sort by created_at", UserQuery{Sort: "created_at"}, []int{1, 2, 3}, false},
+		{"email prefix", UserQuery{EmailPrefix: "JA"}, []int{2, 3}, false},
+		{"role filter", UserQuery{Role: data.RoleAdmin}, []int{1}, false},
+		{"created after", UserQuery{CreatedAfter: time.Now().Add(-90 * time.Minute)}, []int{3}, false},
+		{"created before", UserQuery{CreatedBefore: time.Now().Add(-90 * time.Minute)}, []int{2, 1}, false},
+	}
+
+	for _, e := range tests {
+		page, err := e.query.Page(testUsers())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		var ids []int
+		for _, u := range page.Users {
+			ids = append(ids, u.ID)
+		}
+
+		if len(ids) != len(e.expectedIDs) {
+			t.Errorf("%s: expected ids %v, but got %v", e.name, e.expectedIDs, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != e.expectedIDs[i] {
+				t.Errorf("%s: expected ids %v, but got %v", e.name, e.expectedIDs, ids)
+				break
+			}
+		}
+
+		if (page.NextCursor != "") != e.expectNext {
+			t.Errorf("%s: expected next cursor %v, but got %q", e.name, e.expectNext, page.NextCursor)
+		}
+	}
+}
+
+func TestUserQuery_PageWithCursor(t *testing.T) {
+	users := testUsers()
+
+	for _, sort := range []string{"last_name", "-last_name", "created_at", "-created_at", "id", "email"} {
+		q := UserQuery{Limit: 1, Sort: sort}
+		seen := map[int]bool{}
+
+		for i := 0; i < 5; i++ {
+			page, err := q.Page(users)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", sort, err)
+			}
+			for _, u := range page.Users {
+				if seen[u.ID] {
+					t.Errorf("%s: user %d returned twice", sort, u.ID)
+				}
+				seen[u.ID] = true
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+
+		if len(seen) != 3 {
+			t.Errorf("%s: expected to page through 3 users, but saw %d", sort, len(seen))
+		}
+	}
+}
+
+func TestUserQuery_invalid(t *testing.T) {
+	var tests = []struct {
+		name  string
+		query UserQuery
+	}{
+		{"bad sort", UserQuery{Sort: "password"}},
+		{"garbage cursor", UserQuery{Cursor: "not a cursor!"}},
+		{"cursor for another sort", UserQuery{Sort: "email", Cursor: UserQuery{Sort: "last_name"}.CursorFor(&data.User{ID: 1})}},
+	}
+
+	for _, e := range tests {
+		_, err := e.query.Page(testUsers())
+		if err == nil {
+			t.Errorf("%s: expected an error, but did not get one", e.name)
+		}
+	}
+}
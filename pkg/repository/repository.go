@@ -1,18 +1,143 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"time"
 	"web-app/pkg/data"
 )
 
 type DatabaseRepo interface {
 	Connection() *sql.DB
-	AllUsers() ([]*data.User, error)
-	GetUser(id int) (*data.User, error)
-	GetUserByEmail(email string) (*data.User, error)
-	UpdateUser(u data.User) error
-	DeleteUser(id int) error
-	InsertUser(user data.User) (int, error)
-	ResetPassword(id int, password string) error
-	InsertUserImage(i data.UserImage) (int, error)
+	// WithTx runs fn in a transaction: if fn returns an error, none of the changes it made
+	// through repo are kept.
+	WithTx(ctx context.Context, fn func(repo DatabaseRepo) error) error
+
+	AllUsers(ctx context.Context, q UserQuery) (*UserPage, error)
+	GetUser(ctx context.Context, id int) (*data.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*data.User, error)
+	// UpdateUser updates a user's name and email address. A changed address is unverified.
+	UpdateUser(ctx context.Context, u data.User) error
+	DeleteUser(ctx context.Context, id int) error
+	InsertUser(ctx context.Context, user data.User) (int, error)
+	ResetPassword(ctx context.Context, id int, password string) error
+	MarkEmailVerified(ctx context.Context, id int) error
+	InsertUserImage(ctx context.Context, i data.UserImage) (int, error)
+
+	AllRoles(ctx context.Context) ([]*data.Role, error)
+	// AssignRole gives a user a role; giving it again is not an error.
+	AssignRole(ctx context.Context, userID int, role string) error
+	RevokeRole(ctx context.Context, userID int, role string) error
+	// UserPermissions returns every permission granted to a user, in name order, by their roles
+	// and by their roles in the organization with orgID, if it is not zero.
+	UserPermissions(ctx context.Context, userID, orgID int) ([]string, error)
+	CountUsersWithRole(ctx context.Context, role string) (int, error)
+
+	InsertOrganization(ctx context.Context, o data.Organization) (int, error)
+	GetOrganization(ctx context.Context, id int) (*data.Organization, error)
+	// AddMember adds a user to an organization; adding them again is not an error.
+	AddMember(ctx context.Context, orgID, userID int) error
+	// RemoveMember takes a user out of an organization, along with their roles in it.
+	RemoveMember(ctx context.Context, orgID, userID int) error
+	GetMembership(ctx context.Context, orgID, userID int) (*data.Membership, error)
+	// UserMemberships returns every organization a user belongs to, oldest organization first.
+	UserMemberships(ctx context.Context, userID int) ([]*data.Membership, error)
+	// AssignMemberRole gives a member a role in an organization; giving it again is not an error.
+	AssignMemberRole(ctx context.Context, orgID, userID int, role string) error
+	RevokeMemberRole(ctx context.Context, orgID, userID int, role string) error
+	CountMembersWithRole(ctx context.Context, orgID int, role string) (int, error)
+	// InviteMember invites a user to join an organization; inviting them again is not an error.
+	InviteMember(ctx context.Context, orgID, userID int) error
+	// UserInvitations returns the invitations a user has not answered, oldest organization first.
+	UserInvitations(ctx context.Context, userID int) ([]*data.Invitation, error)
+	// DeleteInvitation removes an invitation, once it has been accepted or declined.
+	DeleteInvitation(ctx context.Context, orgID, userID int) error
+
+	InsertRefreshToken(ctx context.Context, t data.RefreshToken) (int, error)
+	GetRefreshToken(ctx context.Context, tokenHash string) (*data.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, id int) (bool, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID int) error
+	// RevokeOtherRefreshTokens revokes every active refresh token of a user outside familyID.
+	RevokeOtherRefreshTokens(ctx context.Context, userID int, familyID string) error
+
+	// InsertUserToken stores the hash of a newly issued one-time token, and returns its ID.
+	InsertUserToken(ctx context.Context, t data.UserToken) (int, error)
+	// UseUserToken marks the token with tokenHash as used and returns it, if it was issued for
+	// purpose and is neither used nor expired; otherwise it returns ErrNotFound. However many
+	// callers try at once, a token is only ever used once.
+	UseUserToken(ctx context.Context, purpose, tokenHash string) (*data.UserToken, error)
+	// RevokeUserTokens marks every unused token issued to a user for purpose as used.
+	RevokeUserTokens(ctx context.Context, userID int, purpose string) error
+
+	// SaveUserMFA starts enrolling a user's authenticator, replacing any they had, confirmed or not.
+	SaveUserMFA(ctx context.Context, userID int, secret string) error
+	// GetUserMFA returns a user's authenticator, or ErrNotFound if they have none.
+	GetUserMFA(ctx context.Context, userID int) (*data.UserMFA, error)
+	// ConfirmUserMFA marks a user's authenticator as confirmed, which turns it on.
+	ConfirmUserMFA(ctx context.Context, userID int) error
+	// UseMFAStep records that a code from the given time step was accepted, and reports whether it
+	// was the first from that step or a later one. However many callers try at once, only one
+	// code from a step is ever accepted.
+	UseMFAStep(ctx context.Context, userID int, step int64) (bool, error)
+	// DeleteUserMFA takes a user's authenticator and recovery codes away.
+	DeleteUserMFA(ctx context.Context, userID int) error
+	// ReplaceRecoveryCodes gives a user a new set of recovery codes, in place of any they had.
+	ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error
+	// UseRecoveryCode marks a user's recovery code as used, or returns ErrNotFound if it is not one
+	// of theirs or has been used already.
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) error
+	// CountRecoveryCodes returns how many unused recovery codes a user has left.
+	CountRecoveryCodes(ctx context.Context, userID int) (int, error)
+
+	// RecordLoginFailure counts a failed login against scope and key, and returns how many there
+	// have been in a row. The count starts again from one if the last failure was before since.
+	RecordLoginFailure(ctx context.Context, scope, key string, since time.Time) (int, error)
+	// LockLogin refuses logins for scope and key until the given time.
+	LockLogin(ctx context.Context, scope, key string, until time.Time) error
+	// GetLoginThrottle returns the failed logins counted against scope and key, or ErrNotFound if
+	// there are none.
+	GetLoginThrottle(ctx context.Context, scope, key string) (*data.LoginThrottle, error)
+	// ClearLoginFailures forgets the failed logins counted against scope and key, and any lock;
+	// clearing none is not an error.
+	ClearLoginFailures(ctx context.Context, scope, key string) error
+	InsertLockoutEvent(ctx context.Context, e data.LockoutEvent) (int, error)
+	// LockoutEvents returns up to limit of the events for scope and key, newest first.
+	LockoutEvents(ctx context.Context, scope, key string, limit int) ([]*data.LockoutEvent, error)
+
+	// InsertAPIKey stores a newly made api key, of which only the hash is kept, and returns its ID.
+	InsertAPIKey(ctx context.Context, k data.APIKey) (int, error)
+	// GetAPIKey returns the api key with keyHash, whether it is active or not, or ErrNotFound if
+	// there is none.
+	GetAPIKey(ctx context.Context, keyHash string) (*data.APIKey, error)
+	// UserAPIKeys returns every api key a user has made, revoked or not, newest first.
+	UserAPIKeys(ctx context.Context, userID int) ([]*data.APIKey, error)
+	// RevokeAPIKey revokes one of a user's api keys, or returns ErrNotFound if they have no such
+	// key or it is revoked already.
+	RevokeAPIKey(ctx context.Context, userID, id int) error
+	// RevokeUserAPIKeys revokes every api key a user has; having none is not an error.
+	RevokeUserAPIKeys(ctx context.Context, userID int) error
+	// TouchAPIKey records that an api key was used at the given time.
+	TouchAPIKey(ctx context.Context, id int, at time.Time) error
+
+	// TakeRateLimitToken takes a token, at the time now, from the bucket for key, which holds up
+	// to burst tokens and gains perSecond of them every second; a new bucket starts full. It
+	// reports whether there was a token to take, and how many are left. However many callers take
+	// at once, no token is taken twice.
+	TakeRateLimitToken(ctx context.Context, key string, burst int, perSecond float64, now time.Time) (bool, float64, error)
+	// PruneRateLimitBuckets deletes the buckets last refilled before the given time.
+	PruneRateLimitBuckets(ctx context.Context, before time.Time) error
+
+	// InsertMail puts a message in the outbox, to be sent at its NextAttemptAt, or straight away
+	// if that is zero.
+	InsertMail(ctx context.Context, m data.Mail) (int, error)
+	// ClaimMail takes up to limit pending messages that are due, oldest first, for sending. Each
+	// counts as an attempt, and is not due again until lease has passed, so that no other caller
+	// claims it while it is being sent.
+	ClaimMail(ctx context.Context, limit int, lease time.Duration) ([]*data.Mail, error)
+	MarkMailSent(ctx context.Context, id int) error
+	// RetryMail records why a message could not be sent, and when to try it again.
+	RetryMail(ctx context.Context, id int, reason string, at time.Time) error
+	// FailMail records why a message could not be sent, and gives up on it.
+	FailMail(ctx context.Context, id int, reason string) error
 }
@@ -0,0 +1,1499 @@
+// Package repotest is the conformance suite for repository.DatabaseRepo. Every implementation
+// runs it against itself, so that they all behave the same as far as their callers can tell:
+//
+//	func TestMyDBRepo(t *testing.T) {
+//		repotest.Run(t, func(timeout time.Duration) repository.DatabaseRepo {
+//			return &MyDBRepo{DB: db, Timeout: timeout}
+//		})
+//	}
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// Factory returns a repository that limits calls to timeout, unless the caller sets a deadline;
+// zero means the repository's default. Every repository it returns during a run must share one
+// store, which is empty when the run starts.
+type Factory func(timeout time.Duration) repository.DatabaseRepo
+
+// suite holds the repository the tests run against.
+type suite struct {
+	repo    repository.DatabaseRepo
+	newRepo Factory
+}
+
+// Run runs every test of the suite against the repositories newRepo returns. The tests run in
+// order, and later tests build on the rows written by earlier ones, so the run stops at the first
+// test that fails.
+func Run(t *testing.T, newRepo Factory) {
+	s := &suite{repo: newRepo(0), newRepo: newRepo}
+
+	var tests = []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{"PingDB", s.testPingDB},
+		{"InsertUser", s.testInsertUser},
+		{"AllUsers", s.testAllUsers},
+		{"AllUsersPagination", s.testAllUsersPagination},
+		{"GetUser", s.testGetUser},
+		{"GetUserByEmail", s.testGetUserByEmail},
+		{"UpdateUser", s.testUpdateUser},
+		{"UniqueEmail", s.testUniqueEmail},
+		{"DeleteUser", s.testDeleteUser},
+		{"ResetPassword", s.testResetPassword},
+		{"InsertUserImage", s.testInsertUserImage},
+		{"ReplaceUserImage", s.testReplaceUserImage},
+		{"RefreshTokens", s.testRefreshTokens},
+		{"Roles", s.testRoles},
+		{"Organizations", s.testOrganizations},
+		{"Invitations", s.testInvitations},
+		{"Outbox", s.testOutbox},
+		{"UserTokens", s.testUserTokens},
+		{"EmailVerification", s.testEmailVerification},
+		{"MFA", s.testMFA},
+		{"LoginThrottles", s.testLoginThrottles},
+		{"RateLimits", s.testRateLimits},
+		{"APIKeys", s.testAPIKeys},
+		{"NotFound", s.testNotFound},
+		{"Ordering", s.testOrdering},
+		{"Context", s.testContext},
+		{"WithTx", s.testWithTx},
+		{"Concurrency", s.testConcurrency},
+	}
+
+	for _, e := range tests {
+		if !t.Run(e.name, e.test) {
+			// later tests depend on this one
+			break
+		}
+	}
+}
+
+func (s *suite) testPingDB(t *testing.T) {
+	db := s.repo.Connection()
+	if db == nil {
+		t.Skip("there is no database behind this repository")
+	}
+
+	err := db.Ping()
+	if err != nil {
+		t.Error("can't ping database")
+	}
+}
+
+func (s *suite) testInsertUser(t *testing.T) {
+	testUser := data.User{
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+		Password:  "secret",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	id, err := s.repo.InsertUser(context.Background(), testUser)
+	if err != nil {
+		t.Errorf("insert user returned an error: %s", err)
+	}
+
+	if id != 1 {
+		t.Errorf("insert user returned wrong id; expected 1, but got %d", id)
+	}
+}
+
+func (s *suite) testAllUsers(t *testing.T) {
+	page, err := s.repo.AllUsers(context.Background(), repository.UserQuery{})
+	if err != nil {
+		t.Errorf("all users reports an error: %s", err)
+	}
+
+	if len(page.Users) != 1 {
+		t.Errorf("all users reports wrong size; expected 1, but got %d", len(page.Users))
+	}
+
+	testUser := data.User{
+		FirstName: "Jack",
+		LastName:  "Smith",
+		Email:     "jack@smith.com",
+		Password:  "secret",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	_, _ = s.repo.InsertUser(context.Background(), testUser)
+
+	page, err = s.repo.AllUsers(context.Background(), repository.UserQuery{})
+	if err != nil {
+		t.Errorf("all users reports an error: %s", err)
+	}
+
+	if len(page.Users) != 2 {
+		t.Errorf("all users reports wrong size after insert; expected 2, but got %d", len(page.Users))
+	}
+}
+
+func (s *suite) testAllUsersPagination(t *testing.T) {
+	// sorted by last name, Smith comes before User
+	q := repository.UserQuery{Limit: 1, Sort: "last_name"}
+	page, err := s.repo.AllUsers(context.Background(), q)
+	if err != nil {
+		t.Fatalf("all users reports an error: %s", err)
+	}
+
+	if len(page.Users) != 1 || page.Users[0].LastName != "Smith" || page.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+
+	q.Cursor = page.NextCursor
+	page, err = s.repo.AllUsers(context.Background(), q)
+	if err != nil {
+		t.Fatalf("all users reports an error on second page: %s", err)
+	}
+
+	if len(page.Users) != 1 || page.Users[0].LastName != "User" || page.NextCursor != "" {
+		t.Errorf("unexpected second page: %+v", page)
+	}
+
+	// descending order reverses the pages
+	page, _ = s.repo.AllUsers(context.Background(), repository.UserQuery{Limit: 1, Sort: "-last_name"})
+	if len(page.Users) != 1 || page.Users[0].LastName != "User" {
+		t.Errorf("unexpected first page in descending order: %+v", page)
+	}
+
+	// filters
+	page, _ = s.repo.AllUsers(context.Background(), repository.UserQuery{EmailPrefix: "JACK"})
+	if len(page.Users) != 1 || page.Users[0].Email != "jack@smith.com" {
+		t.Errorf("email prefix filter returned %+v", page.Users)
+	}
+
+	page, _ = s.repo.AllUsers(context.Background(), repository.UserQuery{CreatedAfter: time.Now().Add(time.Hour)})
+	if len(page.Users) != 0 {
+		t.Errorf("created after filter returned %d users; expected none", len(page.Users))
+	}
+
+	_, err = s.repo.AllUsers(context.Background(), repository.UserQuery{Sort: "password"})
+	if err == nil {
+		t.Error("expected an error sorting by a field that is not sortable")
+	}
+}
+
+func (s *suite) testGetUser(t *testing.T) {
+	user, err := s.repo.GetUser(context.Background(), 1)
+	if err != nil {
+		t.Errorf("error getting user by id: %s", err)
+	}
+
+	if user.Email != "admin@example.com" {
+		t.Errorf("wrong email returned by GetUser; expected admin@example.com but got %s", user.Email)
+	}
+
+	_, err = s.repo.GetUser(context.Background(), 3)
+	if err == nil {
+		t.Error("no error reported when getting non existent user by id")
+	}
+
+}
+
+func (s *suite) testGetUserByEmail(t *testing.T) {
+	user, err := s.repo.GetUserByEmail(context.Background(), "jack@smith.com")
+	if err != nil {
+		t.Errorf("error getting user by email: %s", err)
+	}
+
+	if user.ID != 2 {
+		t.Errorf("wrong id returned by GetUserByEmail; expected 2 but got %d", user.ID)
+	}
+}
+
+func (s *suite) testUpdateUser(t *testing.T) {
+	user, _ := s.repo.GetUser(context.Background(), 2)
+	user.FirstName = "Jane"
+	user.Email = "jane@smith.com"
+
+	err := s.repo.UpdateUser(context.Background(), *user)
+	if err != nil {
+		t.Errorf("error updating user %d: %s", 2, err)
+	}
+
+	user, _ = s.repo.GetUser(context.Background(), 2)
+	if user.FirstName != "Jane" || user.Email != "jane@smith.com" {
+		t.Errorf("expected updated record to have first name Jane and email jane@smith.com, but got %s %s", user.FirstName, user.Email)
+	}
+}
+
+func (s *suite) testUniqueEmail(t *testing.T) {
+	ctx := context.Background()
+
+	// addresses are stored in lower case, and found in any case
+	user, _ := s.repo.GetUser(ctx, 2)
+	user.Email = " Jane.Smith@Example.COM"
+
+	err := s.repo.UpdateUser(ctx, *user)
+	if err != nil {
+		t.Fatal("updating email failed:", err)
+	}
+
+	user, _ = s.repo.GetUser(ctx, 2)
+	if user.Email != "jane.smith@example.com" {
+		t.Errorf("expected email to be stored as jane.smith@example.com, but got %q", user.Email)
+	}
+
+	found, err := s.repo.GetUserByEmail(ctx, "JANE.SMITH@example.com")
+	if err != nil || found.ID != 2 {
+		t.Errorf("expected to find user 2 by email in another case; got %v, %v", found, err)
+	}
+
+	// and an address can only belong to one user, whatever its case
+	_, err = s.repo.InsertUser(ctx, data.User{FirstName: "Admin", LastName: "Again", Email: "ADMIN@example.com", Password: "secret"})
+	expectDuplicateEmail(t, "insert", err)
+
+	user.Email = "Admin@Example.com"
+	err = s.repo.UpdateUser(ctx, *user)
+	expectDuplicateEmail(t, "update", err)
+
+	// changing the case of your own address is not a duplicate
+	user.Email = "JANE.SMITH@EXAMPLE.COM"
+	err = s.repo.UpdateUser(ctx, *user)
+	if err != nil {
+		t.Error("updating the case of a user's own email failed:", err)
+	}
+}
+
+func expectDuplicateEmail(t *testing.T, name string, err error) {
+	t.Helper()
+
+	var dup *repository.DuplicateError
+	if !errors.Is(err, repository.ErrDuplicate) || !errors.As(err, &dup) || dup.Field != "email" {
+		t.Errorf("%s: expected a duplicate email error, but got %v", name, err)
+	}
+}
+
+func (s *suite) testDeleteUser(t *testing.T) {
+	err := s.repo.DeleteUser(context.Background(), 2)
+	if err != nil {
+		t.Errorf("error deleting user id 2: %s", err)
+	}
+
+	_, err = s.repo.GetUser(context.Background(), 2)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for deleted user id 2, but got %v", err)
+	}
+
+	err = s.repo.DeleteUser(context.Background(), 2)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound deleting user id 2 twice, but got %v", err)
+	}
+}
+
+func (s *suite) testResetPassword(t *testing.T) {
+	err := s.repo.ResetPassword(context.Background(), 1, "password")
+	if err != nil {
+		t.Error("error resetting user's password", err)
+	}
+
+	user, _ := s.repo.GetUser(context.Background(), 1)
+	matches, err := user.PasswordMatches("password")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !matches {
+		t.Errorf("password should match 'password', but does not")
+	}
+
+	if user.PasswordChangedAt == nil || time.Since(*user.PasswordChangedAt) > time.Minute {
+		t.Errorf("expected the time the password changed to be recorded, but got %v", user.PasswordChangedAt)
+	}
+}
+
+func (s *suite) testInsertUserImage(t *testing.T) {
+	var image data.UserImage
+	image.UserID = 1
+	image.FileName = "test.jpg"
+	image.CreatedAt = time.Now()
+	image.UpdatedAt = time.Now()
+
+	newID, err := s.repo.InsertUserImage(context.Background(), image)
+	if err != nil {
+		t.Error("inserting user image failed:", err)
+	}
+
+	if newID != 1 {
+		t.Error("got wrong id for image; should be 1, but got", newID)
+	}
+
+	image.UserID = 100
+	_, err = s.repo.InsertUserImage(context.Background(), image)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inserting a user image with non-existent user id, but got %v", err)
+	}
+}
+
+func (s *suite) testRefreshTokens(t *testing.T) {
+	token := data.RefreshToken{
+		UserID:         1,
+		OrganizationID: 7,
+		TokenHash:      "hash-one",
+		FamilyID:       "family",
+		ExpiresAt:      time.Now().Add(time.Hour),
+	}
+
+	id, err := s.repo.InsertRefreshToken(context.Background(), token)
+	if err != nil {
+		t.Fatal("inserting refresh token failed:", err)
+	}
+
+	stored, err := s.repo.GetRefreshToken(context.Background(), "hash-one")
+	if err != nil {
+		t.Fatal("getting refresh token failed:", err)
+	}
+
+	if stored.ID != id || stored.OrganizationID != 7 || stored.Revoked() {
+		t.Errorf("unexpected refresh token returned: %+v", stored)
+	}
+
+	active, err := s.repo.RevokeRefreshToken(context.Background(), id)
+	if err != nil || !active {
+		t.Errorf("first revoke should report an active token; got %v, %v", active, err)
+	}
+
+	active, err = s.repo.RevokeRefreshToken(context.Background(), id)
+	if err != nil || active {
+		t.Errorf("second revoke should report an already used token; got %v, %v", active, err)
+	}
+
+	token.TokenHash = "hash-two"
+	_, _ = s.repo.InsertRefreshToken(context.Background(), token)
+
+	err = s.repo.RevokeRefreshTokenFamily(context.Background(), "family")
+	if err != nil {
+		t.Error("revoking refresh token family failed:", err)
+	}
+
+	stored, _ = s.repo.GetRefreshToken(context.Background(), "hash-two")
+	if !stored.Revoked() {
+		t.Error("refresh token in revoked family is still active")
+	}
+
+	// revoking a user's other tokens keeps those in the family given
+	kept := data.RefreshToken{UserID: 1, TokenHash: "hash-kept", FamilyID: "kept", ExpiresAt: time.Now().Add(time.Hour)}
+	_, _ = s.repo.InsertRefreshToken(context.Background(), kept)
+	other := data.RefreshToken{UserID: 1, TokenHash: "hash-other", FamilyID: "other", ExpiresAt: time.Now().Add(time.Hour)}
+	_, _ = s.repo.InsertRefreshToken(context.Background(), other)
+
+	err = s.repo.RevokeOtherRefreshTokens(context.Background(), 1, "kept")
+	if err != nil {
+		t.Error("revoking other refresh tokens failed:", err)
+	}
+	if stored, _ = s.repo.GetRefreshToken(context.Background(), "hash-kept"); stored.Revoked() {
+		t.Error("refresh token in the kept family was revoked")
+	}
+	if stored, _ = s.repo.GetRefreshToken(context.Background(), "hash-other"); !stored.Revoked() {
+		t.Error("refresh token in another family is still active")
+	}
+
+	_, err = s.repo.InsertRefreshToken(context.Background(), token)
+	var dup *repository.DuplicateError
+	if !errors.Is(err, repository.ErrDuplicate) || !errors.As(err, &dup) || dup.Field != "token_hash" {
+		t.Errorf("expected a duplicate token_hash error inserting the same refresh token twice, but got %v", err)
+	}
+
+	_, err = s.repo.GetRefreshToken(context.Background(), "no-such-hash")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for unknown refresh token, but got %v", err)
+	}
+}
+
+func (s *suite) testRoles(t *testing.T) {
+	ctx := context.Background()
+
+	roles, err := s.repo.AllRoles(ctx)
+	if err != nil {
+		t.Fatal("listing roles failed:", err)
+	}
+	if len(roles) != 1 || roles[0].Name != data.RoleAdmin {
+		t.Fatalf("expected only the admin role, but got %v", roles)
+	}
+	allPermissions := []string{
+		data.PermissionManageMembers,
+		data.PermissionManageRoles,
+		data.PermissionDeleteUsers,
+		data.PermissionReadUsers,
+		data.PermissionWriteUsers,
+	}
+	if !reflect.DeepEqual(roles[0].Permissions, allPermissions) {
+		t.Errorf("expected the admin role to grant %v, but got %v", allPermissions, roles[0].Permissions)
+	}
+
+	// users get no roles when they are inserted
+	count, err := s.repo.CountUsersWithRole(ctx, data.RoleAdmin)
+	if err != nil {
+		t.Error("counting admins failed:", err)
+	}
+	if count != 0 {
+		t.Errorf("expected no admins, but got %d", count)
+	}
+
+	// assigning a role twice is not an error
+	for i := 0; i < 2; i++ {
+		err = s.repo.AssignRole(ctx, 1, data.RoleAdmin)
+		if err != nil {
+			t.Errorf("assigning the admin role failed: %s", err)
+		}
+	}
+
+	count, _ = s.repo.CountUsersWithRole(ctx, data.RoleAdmin)
+	if count != 1 {
+		t.Errorf("expected 1 admin, but got %d", count)
+	}
+
+	user, _ := s.repo.GetUser(ctx, 1)
+	if !reflect.DeepEqual(user.Roles, []string{data.RoleAdmin}) {
+		t.Errorf("expected user 1 to have the admin role, but got %v", user.Roles)
+	}
+
+	permissions, err := s.repo.UserPermissions(ctx, 1, 0)
+	if err != nil {
+		t.Error("listing permissions failed:", err)
+	}
+	if !reflect.DeepEqual(permissions, allPermissions) {
+		t.Errorf("expected permissions %v, but got %v", allPermissions, permissions)
+	}
+
+	page, _ := s.repo.AllUsers(ctx, repository.UserQuery{Role: data.RoleAdmin})
+	if len(page.Users) != 1 || page.Users[0].ID != 1 || !page.Users[0].HasRole(data.RoleAdmin) {
+		t.Errorf("expected the role filter to return user 1, but got %v", page.Users)
+	}
+
+	err = s.repo.AssignRole(ctx, 1, "no-such-role")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound assigning an unknown role, but got %v", err)
+	}
+
+	err = s.repo.AssignRole(ctx, 999, data.RoleAdmin)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict assigning a role to a missing user, but got %v", err)
+	}
+
+	err = s.repo.RevokeRole(ctx, 1, data.RoleAdmin)
+	if err != nil {
+		t.Errorf("revoking the admin role failed: %s", err)
+	}
+
+	err = s.repo.RevokeRole(ctx, 1, data.RoleAdmin)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound revoking a role the user does not have, but got %v", err)
+	}
+
+	permissions, _ = s.repo.UserPermissions(ctx, 1, 0)
+	if len(permissions) != 0 {
+		t.Errorf("expected no permissions once the role is revoked, but got %v", permissions)
+	}
+
+	user, _ = s.repo.GetUser(ctx, 1)
+	if len(user.Roles) != 0 {
+		t.Errorf("expected no roles once the role is revoked, but got %v", user.Roles)
+	}
+}
+
+func (s *suite) testOrganizations(t *testing.T) {
+	ctx := context.Background()
+
+	orgID, err := s.repo.InsertOrganization(ctx, data.Organization{Name: "Acme"})
+	if err != nil {
+		t.Fatal("inserting organization failed:", err)
+	}
+	otherOrgID, _ := s.repo.InsertOrganization(ctx, data.Organization{Name: "Other"})
+
+	org, err := s.repo.GetOrganization(ctx, orgID)
+	if err != nil || org.Name != "Acme" {
+		t.Errorf("expected organization Acme, but got %+v, %v", org, err)
+	}
+
+	_, err = s.repo.GetOrganization(ctx, 999)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for unknown organization, but got %v", err)
+	}
+
+	memberships, err := s.repo.UserMemberships(ctx, 1)
+	if err != nil || len(memberships) != 0 {
+		t.Errorf("expected no memberships, but got %v, %v", memberships, err)
+	}
+
+	// adding a member twice is not an error
+	for i := 0; i < 2; i++ {
+		err = s.repo.AddMember(ctx, orgID, 1)
+		if err != nil {
+			t.Errorf("adding member failed: %s", err)
+		}
+	}
+
+	err = s.repo.AddMember(ctx, 999, 1)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict adding a member to a missing organization, but got %v", err)
+	}
+
+	err = s.repo.AddMember(ctx, orgID, 999)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict adding a missing user, but got %v", err)
+	}
+
+	err = s.repo.AssignMemberRole(ctx, orgID, 1, data.RoleAdmin)
+	if err != nil {
+		t.Errorf("assigning member role failed: %s", err)
+	}
+
+	membership, err := s.repo.GetMembership(ctx, orgID, 1)
+	if err != nil {
+		t.Fatal("getting membership failed:", err)
+	}
+	if membership.OrganizationName != "Acme" || !reflect.DeepEqual(membership.Roles, []string{data.RoleAdmin}) {
+		t.Errorf("unexpected membership: %+v", membership)
+	}
+
+	// roles in an organization only count there
+	permissions, _ := s.repo.UserPermissions(ctx, 1, orgID)
+	if len(permissions) != 5 {
+		t.Errorf("expected the admin permissions in the organization, but got %v", permissions)
+	}
+	permissions, _ = s.repo.UserPermissions(ctx, 1, otherOrgID)
+	if len(permissions) != 0 {
+		t.Errorf("expected no permissions in another organization, but got %v", permissions)
+	}
+
+	count, _ := s.repo.CountMembersWithRole(ctx, orgID, data.RoleAdmin)
+	if count != 1 {
+		t.Errorf("expected 1 admin in the organization, but got %d", count)
+	}
+
+	page, _ := s.repo.AllUsers(ctx, repository.UserQuery{OrganizationID: orgID})
+	if len(page.Users) != 1 || page.Users[0].ID != 1 {
+		t.Errorf("expected only user 1 in the organization, but got %v", page.Users)
+	}
+
+	page, _ = s.repo.AllUsers(ctx, repository.UserQuery{OrganizationID: otherOrgID})
+	if len(page.Users) != 0 {
+		t.Errorf("expected no users in the other organization, but got %v", page.Users)
+	}
+
+	err = s.repo.AssignMemberRole(ctx, otherOrgID, 1, data.RoleAdmin)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict assigning a role to a non-member, but got %v", err)
+	}
+
+	err = s.repo.AssignMemberRole(ctx, orgID, 1, "no-such-role")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound assigning an unknown role, but got %v", err)
+	}
+
+	err = s.repo.RevokeMemberRole(ctx, orgID, 1, data.RoleAdmin)
+	if err != nil {
+		t.Errorf("revoking member role failed: %s", err)
+	}
+
+	err = s.repo.RevokeMemberRole(ctx, orgID, 1, data.RoleAdmin)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound revoking a role the member does not have, but got %v", err)
+	}
+
+	// removing a member takes their roles with them
+	_ = s.repo.AssignMemberRole(ctx, orgID, 1, data.RoleAdmin)
+	err = s.repo.RemoveMember(ctx, orgID, 1)
+	if err != nil {
+		t.Errorf("removing member failed: %s", err)
+	}
+
+	_, err = s.repo.GetMembership(ctx, orgID, 1)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a removed member, but got %v", err)
+	}
+
+	err = s.repo.RemoveMember(ctx, orgID, 1)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound removing a member twice, but got %v", err)
+	}
+
+	_ = s.repo.AddMember(ctx, otherOrgID, 1)
+	_ = s.repo.AddMember(ctx, orgID, 1)
+
+	memberships, _ = s.repo.UserMemberships(ctx, 1)
+	if len(memberships) != 2 || memberships[0].OrganizationID != orgID || memberships[1].OrganizationID != otherOrgID {
+		t.Fatalf("expected memberships of both organizations, oldest first, but got %v", memberships)
+	}
+	if len(memberships[0].Roles) != 0 {
+		t.Errorf("expected no roles after joining again, but got %v", memberships[0].Roles)
+	}
+}
+
+func (s *suite) testInvitations(t *testing.T) {
+	ctx := context.Background()
+
+	orgID, _ := s.repo.InsertOrganization(ctx, data.Organization{Name: "Invites"})
+
+	// inviting a user twice is not an error
+	for i := 0; i < 2; i++ {
+		err := s.repo.InviteMember(ctx, orgID, 1)
+		if err != nil {
+			t.Errorf("inviting member failed: %s", err)
+		}
+	}
+
+	err := s.repo.InviteMember(ctx, 999, 1)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inviting a user to a missing organization, but got %v", err)
+	}
+
+	err = s.repo.InviteMember(ctx, orgID, 999)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inviting a missing user, but got %v", err)
+	}
+
+	invitations, err := s.repo.UserInvitations(ctx, 1)
+	if err != nil {
+		t.Fatal("listing invitations failed:", err)
+	}
+	if len(invitations) != 1 || invitations[0].OrganizationID != orgID || invitations[0].OrganizationName != "Invites" ||
+		invitations[0].UserID != 1 || invitations[0].CreatedAt.IsZero() {
+		t.Fatalf("expected one invitation to Invites, but got %+v", invitations)
+	}
+
+	// an invitation does not make a member
+	_, err = s.repo.GetMembership(ctx, orgID, 1)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected an invited user not to be a member, but got %v", err)
+	}
+
+	err = s.repo.DeleteInvitation(ctx, orgID, 1)
+	if err != nil {
+		t.Errorf("deleting invitation failed: %s", err)
+	}
+
+	err = s.repo.DeleteInvitation(ctx, orgID, 1)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound deleting an invitation twice, but got %v", err)
+	}
+
+	invitations, _ = s.repo.UserInvitations(ctx, 1)
+	if len(invitations) != 0 {
+		t.Errorf("expected no invitations, but got %+v", invitations)
+	}
+}
+
+func (s *suite) testOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	first, err := s.repo.InsertMail(ctx, data.Mail{To: "jack@example.com", Subject: "First", Text: "one", HTML: "<p>one</p>"})
+	if err != nil {
+		t.Fatal("inserting mail failed:", err)
+	}
+	second, _ := s.repo.InsertMail(ctx, data.Mail{To: "jack@example.com", Subject: "Second"})
+	// not due for an hour
+	_, _ = s.repo.InsertMail(ctx, data.Mail{To: "jack@example.com", Subject: "Later", NextAttemptAt: time.Now().Add(time.Hour)})
+
+	claimed, err := s.repo.ClaimMail(ctx, 1, time.Minute)
+	if err != nil {
+		t.Fatal("claiming mail failed:", err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != first || claimed[0].Subject != "First" || claimed[0].HTML != "<p>one</p>" || claimed[0].Attempts != 1 {
+		t.Fatalf("expected to claim the first message on its first attempt, but got %+v", claimed)
+	}
+
+	// claimed messages are not handed out again until their lease is up
+	claimed, _ = s.repo.ClaimMail(ctx, 10, time.Minute)
+	if len(claimed) != 1 || claimed[0].ID != second {
+		t.Fatalf("expected to claim only the second message, but got %+v", claimed)
+	}
+
+	err = s.repo.MarkMailSent(ctx, first)
+	if err != nil {
+		t.Error("marking mail sent failed:", err)
+	}
+
+	err = s.repo.RetryMail(ctx, second, "connection refused", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Error("retrying mail failed:", err)
+	}
+
+	claimed, _ = s.repo.ClaimMail(ctx, 10, time.Minute)
+	if len(claimed) != 1 || claimed[0].ID != second || claimed[0].Attempts != 2 || claimed[0].LastError != "connection refused" {
+		t.Fatalf("expected to claim the second message again, but got %+v", claimed)
+	}
+
+	err = s.repo.FailMail(ctx, second, "mailbox unavailable")
+	if err != nil {
+		t.Error("failing mail failed:", err)
+	}
+	_ = s.repo.RetryMail(ctx, second, "mailbox unavailable", time.Now().Add(-time.Second))
+
+	// sent and failed messages are never claimed
+	claimed, _ = s.repo.ClaimMail(ctx, 10, time.Minute)
+	if len(claimed) != 0 {
+		t.Errorf("expected nothing to claim, but got %+v", claimed)
+	}
+
+	for name, err := range map[string]error{
+		"MarkMailSent": s.repo.MarkMailSent(ctx, 1000),
+		"RetryMail":    s.repo.RetryMail(ctx, 1000, "", time.Now()),
+		"FailMail":     s.repo.FailMail(ctx, 1000, ""),
+	} {
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound for an unknown message, but got %v", name, err)
+		}
+	}
+}
+
+func (s *suite) testUserTokens(t *testing.T) {
+	ctx := context.Background()
+
+	token := data.UserToken{
+		UserID:    1,
+		Purpose:   data.TokenPurposeResetPassword,
+		TokenHash: "reset-one",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	id, err := s.repo.InsertUserToken(ctx, token)
+	if err != nil {
+		t.Fatal("inserting user token failed:", err)
+	}
+
+	// a token only works for the purpose it was issued for
+	_, err = s.repo.UseUserToken(ctx, "other", "reset-one")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound using a token for another purpose, but got %v", err)
+	}
+
+	used, err := s.repo.UseUserToken(ctx, data.TokenPurposeResetPassword, "reset-one")
+	if err != nil {
+		t.Fatal("using user token failed:", err)
+	}
+	if used.ID != id || used.UserID != 1 || !used.Used() {
+		t.Errorf("unexpected user token returned: %+v", used)
+	}
+
+	_, err = s.repo.UseUserToken(ctx, data.TokenPurposeResetPassword, "reset-one")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound using a token twice, but got %v", err)
+	}
+
+	token.TokenHash = "reset-expired"
+	token.ExpiresAt = time.Now().Add(-time.Second)
+	_, _ = s.repo.InsertUserToken(ctx, token)
+
+	_, err = s.repo.UseUserToken(ctx, data.TokenPurposeResetPassword, "reset-expired")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound using an expired token, but got %v", err)
+	}
+
+	token.TokenHash = "reset-two"
+	token.ExpiresAt = time.Now().Add(time.Hour)
+	_, _ = s.repo.InsertUserToken(ctx, token)
+
+	err = s.repo.RevokeUserTokens(ctx, 1, data.TokenPurposeResetPassword)
+	if err != nil {
+		t.Error("revoking user tokens failed:", err)
+	}
+
+	_, err = s.repo.UseUserToken(ctx, data.TokenPurposeResetPassword, "reset-two")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound using a revoked token, but got %v", err)
+	}
+
+	_, err = s.repo.InsertUserToken(ctx, token)
+	var dup *repository.DuplicateError
+	if !errors.As(err, &dup) || dup.Field != "token_hash" {
+		t.Errorf("expected a duplicate token_hash error inserting the same token twice, but got %v", err)
+	}
+
+	token.UserID = 100
+	token.TokenHash = "reset-nobody"
+	_, err = s.repo.InsertUserToken(ctx, token)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inserting a token for a non-existent user, but got %v", err)
+	}
+}
+
+func (s *suite) testEmailVerification(t *testing.T) {
+	ctx := context.Background()
+
+	user, _ := s.repo.GetUser(ctx, 1)
+	if user.EmailVerified() {
+		t.Fatalf("expected a new user's email address to be unverified, but it was verified at %v", user.EmailVerifiedAt)
+	}
+
+	err := s.repo.MarkEmailVerified(ctx, 1)
+	if err != nil {
+		t.Fatal("marking email verified failed:", err)
+	}
+
+	user, _ = s.repo.GetUser(ctx, 1)
+	if !user.EmailVerified() || time.Since(*user.EmailVerifiedAt) > time.Minute {
+		t.Fatalf("expected the email address to be verified just now, but got %v", user.EmailVerifiedAt)
+	}
+
+	// the same address, in another case, stays verified
+	original := user.Email
+	user.Email = strings.ToUpper(original)
+	user.FirstName = "Renamed"
+	_ = s.repo.UpdateUser(ctx, *user)
+	user, _ = s.repo.GetUser(ctx, 1)
+	if !user.EmailVerified() {
+		t.Error("expected the email address to stay verified when only its case changes")
+	}
+
+	user.Email = "changed@example.com"
+	_ = s.repo.UpdateUser(ctx, *user)
+	user, _ = s.repo.GetUser(ctx, 1)
+	if user.EmailVerified() {
+		t.Error("expected a changed email address to be unverified")
+	}
+
+	// put things back for the tests that follow
+	user.Email = original
+	user.FirstName = "Admin"
+	_ = s.repo.UpdateUser(ctx, *user)
+
+	err = s.repo.MarkEmailVerified(ctx, 1000)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound verifying an unknown user, but got %v", err)
+	}
+}
+
+func (s *suite) testMFA(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := s.repo.GetUserMFA(ctx, 1)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a user without an authenticator, but got %v", err)
+	}
+
+	err = s.repo.SaveUserMFA(ctx, 1, "secret-one")
+	if err != nil {
+		t.Fatal("saving user mfa failed:", err)
+	}
+	mfa, err := s.repo.GetUserMFA(ctx, 1)
+	if err != nil || mfa.Secret != "secret-one" || mfa.Enabled() {
+		t.Fatalf("expected an unconfirmed authenticator, but got %+v, %v", mfa, err)
+	}
+
+	err = s.repo.ConfirmUserMFA(ctx, 1)
+	if err != nil {
+		t.Fatal("confirming user mfa failed:", err)
+	}
+
+	// a code is only accepted once, and never one older than the last
+	for _, e := range []struct {
+		step     int64
+		expected bool
+	}{{100, true}, {100, false}, {99, false}, {101, true}} {
+		ok, err := s.repo.UseMFAStep(ctx, 1, e.step)
+		if err != nil || ok != e.expected {
+			t.Errorf("using step %d: expected %t, but got %t, %v", e.step, e.expected, ok, err)
+		}
+	}
+
+	mfa, _ = s.repo.GetUserMFA(ctx, 1)
+	if !mfa.Enabled() || mfa.LastUsedStep != 101 {
+		t.Errorf("expected a confirmed authenticator at step 101, but got %+v", mfa)
+	}
+
+	// enrolling again starts over
+	_ = s.repo.SaveUserMFA(ctx, 1, "secret-two")
+	mfa, _ = s.repo.GetUserMFA(ctx, 1)
+	if mfa.Secret != "secret-two" || mfa.Enabled() || mfa.LastUsedStep != 0 {
+		t.Errorf("expected a new unconfirmed authenticator, but got %+v", mfa)
+	}
+
+	err = s.repo.ReplaceRecoveryCodes(ctx, 1, []string{"code-one", "code-two"})
+	if err != nil {
+		t.Fatal("replacing recovery codes failed:", err)
+	}
+	err = s.repo.UseRecoveryCode(ctx, 1, "code-one")
+	if err != nil {
+		t.Error("using a recovery code failed:", err)
+	}
+	err = s.repo.UseRecoveryCode(ctx, 1, "code-one")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound using a recovery code twice, but got %v", err)
+	}
+	if n, _ := s.repo.CountRecoveryCodes(ctx, 1); n != 1 {
+		t.Errorf("expected 1 recovery code left, but got %d", n)
+	}
+
+	// new codes replace the old ones, used or not
+	_ = s.repo.ReplaceRecoveryCodes(ctx, 1, []string{"code-three"})
+	err = s.repo.UseRecoveryCode(ctx, 1, "code-two")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound using a replaced recovery code, but got %v", err)
+	}
+
+	err = s.repo.DeleteUserMFA(ctx, 1)
+	if err != nil {
+		t.Fatal("deleting user mfa failed:", err)
+	}
+	_, err = s.repo.GetUserMFA(ctx, 1)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a deleted authenticator, but got %v", err)
+	}
+	if n, _ := s.repo.CountRecoveryCodes(ctx, 1); n != 0 {
+		t.Errorf("expected the recovery codes to be deleted too, but %d are left", n)
+	}
+
+	err = s.repo.ConfirmUserMFA(ctx, 1)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound confirming a missing authenticator, but got %v", err)
+	}
+	err = s.repo.SaveUserMFA(ctx, 1000, "secret")
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict enrolling a non-existent user, but got %v", err)
+	}
+}
+
+func (s *suite) testContext(t *testing.T) {
+	// a cancelled request must not reach the database
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.repo.GetUser(ctx, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, but got %v", err)
+	}
+
+	// the caller's deadline wins over the repository's timeout
+	repo := s.newRepo(time.Nanosecond)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err = repo.GetUser(ctx, 1)
+	if err != nil {
+		t.Errorf("expected the caller's deadline to be used, but got %v", err)
+	}
+
+	// without one, the repository's timeout applies
+	_, err = repo.GetUser(context.Background(), 1)
+	if !errors.Is(err, repository.ErrUnavailable) {
+		t.Errorf("expected the query to time out, but got %v", err)
+	}
+}
+
+func (s *suite) testWithTx(t *testing.T) {
+	ctx := context.Background()
+	errRollback := errors.New("roll back")
+
+	// a failing transaction leaves nothing behind
+	err := s.repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		_, err := repo.InsertRefreshToken(ctx, data.RefreshToken{
+			UserID:    1,
+			TokenHash: "tx-rolled-back",
+			FamilyID:  "tx",
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Errorf("expected the callback's error, but got %v", err)
+	}
+
+	_, err = s.repo.GetRefreshToken(ctx, "tx-rolled-back")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("refresh token from rolled back transaction was kept: %v", err)
+	}
+
+	// a successful one is committed, including work done in a nested call
+	err = s.repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		return repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+			_, err := repo.InsertRefreshToken(ctx, data.RefreshToken{
+				UserID:    1,
+				TokenHash: "tx-committed",
+				FamilyID:  "tx",
+				ExpiresAt: time.Now().Add(time.Hour),
+			})
+			return err
+		})
+	})
+	if err != nil {
+		t.Error("transaction failed:", err)
+	}
+
+	_, err = s.repo.GetRefreshToken(ctx, "tx-committed")
+	if err != nil {
+		t.Error("refresh token from committed transaction was not kept:", err)
+	}
+}
+
+func (s *suite) testReplaceUserImage(t *testing.T) {
+	ctx := context.Background()
+
+	newID, err := s.repo.InsertUserImage(ctx, data.UserImage{UserID: 1, FileName: "replacement.jpg"})
+	if err != nil {
+		t.Fatal("replacing user image failed:", err)
+	}
+
+	if newID != 2 {
+		t.Errorf("got wrong id for replacement image; should be 2, but got %d", newID)
+	}
+
+	user, err := s.repo.GetUser(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.ProfilePic.FileName != "replacement.jpg" {
+		t.Errorf("expected profile pic replacement.jpg, but got %q", user.ProfilePic.FileName)
+	}
+
+	// a failed insert keeps the old image
+	_, err = s.repo.InsertUserImage(ctx, data.UserImage{UserID: 100, FileName: "nobody.jpg"})
+	if err == nil {
+		t.Error("expected an error inserting an image for a user that does not exist")
+	}
+
+	user, _ = s.repo.GetUser(ctx, 1)
+	if user.ProfilePic.FileName != "replacement.jpg" {
+		t.Errorf("profile pic changed by a failed insert; got %q", user.ProfilePic.FileName)
+	}
+}
+
+func (s *suite) testLoginThrottles(t *testing.T) {
+	ctx := context.Background()
+	const key = "nobody@example.com"
+
+	_, err := s.repo.GetLoginThrottle(ctx, data.ThrottleAccount, key)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before any failure, but got %v", err)
+	}
+	err = s.repo.LockLogin(ctx, data.ThrottleAccount, key, time.Now().Add(time.Minute))
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound locking without a failure, but got %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		n, err := s.repo.RecordLoginFailure(ctx, data.ThrottleAccount, key, time.Now().Add(-time.Hour))
+		if err != nil || n != i {
+			t.Fatalf("expected failure %d, but got %d, %v", i, n, err)
+		}
+	}
+	// the same key in another scope is counted apart
+	if n, _ := s.repo.RecordLoginFailure(ctx, data.ThrottleIP, key, time.Now().Add(-time.Hour)); n != 1 {
+		t.Errorf("expected the first failure for the ip scope, but got %d", n)
+	}
+
+	until := time.Now().Add(time.Minute).Truncate(time.Second)
+	err = s.repo.LockLogin(ctx, data.ThrottleAccount, key, until)
+	if err != nil {
+		t.Fatal("locking failed:", err)
+	}
+	throttle, err := s.repo.GetLoginThrottle(ctx, data.ThrottleAccount, key)
+	if err != nil || throttle.Failures != 3 || !throttle.Locked(time.Now()) || !throttle.LockedUntil.Equal(until) {
+		t.Fatalf("expected 3 failures, locked until %s, but got %+v, %v", until, throttle, err)
+	}
+
+	// failures older than since are forgotten
+	if n, _ := s.repo.RecordLoginFailure(ctx, data.ThrottleAccount, key, time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("expected the count to start again, but got %d", n)
+	}
+
+	err = s.repo.ClearLoginFailures(ctx, data.ThrottleAccount, key)
+	if err != nil {
+		t.Fatal("clearing failures failed:", err)
+	}
+	_, err = s.repo.GetLoginThrottle(ctx, data.ThrottleAccount, key)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after clearing, but got %v", err)
+	}
+	if err = s.repo.ClearLoginFailures(ctx, data.ThrottleAccount, key); err != nil {
+		t.Errorf("expected clearing twice not to be an error, but got %v", err)
+	}
+	_ = s.repo.ClearLoginFailures(ctx, data.ThrottleIP, key)
+
+	for _, e := range []data.LockoutEvent{
+		{Scope: data.ThrottleAccount, Key: key, Event: data.LockoutEventLocked, Failures: 5, LockedUntil: &until},
+		{Scope: data.ThrottleIP, Key: "192.0.2.1", Event: data.LockoutEventLocked, Failures: 20, LockedUntil: &until},
+		{Scope: data.ThrottleAccount, Key: key, Event: data.LockoutEventUnlocked, ActorID: 1},
+	} {
+		if _, err := s.repo.InsertLockoutEvent(ctx, e); err != nil {
+			t.Fatal("inserting a lockout event failed:", err)
+		}
+	}
+
+	events, err := s.repo.LockoutEvents(ctx, data.ThrottleAccount, key, 10)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("expected 2 events, but got %d, %v", len(events), err)
+	}
+	if events[0].Event != data.LockoutEventUnlocked || events[0].ActorID != 1 || events[0].LockedUntil != nil {
+		t.Errorf("expected the unlock first, but got %+v", events[0])
+	}
+	if events[1].Failures != 5 || events[1].LockedUntil == nil || !events[1].LockedUntil.Equal(until) {
+		t.Errorf("expected the lock, until %s, but got %+v", until, events[1])
+	}
+	if events, _ = s.repo.LockoutEvents(ctx, data.ThrottleAccount, key, 1); len(events) != 1 {
+		t.Errorf("expected the limit to hold, but got %d events", len(events))
+	}
+}
+
+func (s *suite) testRateLimits(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Truncate(time.Second)
+
+	var tests = []struct {
+		name     string
+		key      string
+		at       time.Duration
+		allowed  bool
+		expected float64
+	}{
+		{"new bucket starts full", "a", 0, true, 2},
+		{"second", "a", 0, true, 1},
+		{"third", "a", 0, true, 0},
+		{"empty", "a", 0, false, 0},
+		{"other key", "b", 0, true, 2},
+		{"half refilled", "a", 500 * time.Millisecond, false, 0.5},
+		{"refilled", "a", 1500 * time.Millisecond, true, 0.5},
+		{"never more than the burst", "b", time.Hour, true, 2},
+	}
+
+	for _, e := range tests {
+		allowed, tokens, err := s.repo.TakeRateLimitToken(ctx, e.key, 3, 1, start.Add(e.at))
+		if err != nil {
+			t.Fatalf("%s: taking a token failed: %v", e.name, err)
+		}
+		if allowed != e.allowed || tokens < e.expected-0.001 || tokens > e.expected+0.001 {
+			t.Errorf("%s: expected %t with %.3f tokens left, but got %t with %.3f", e.name, e.allowed, e.expected, allowed, tokens)
+		}
+	}
+
+	// a was last refilled after the cutoff, so it is kept
+	err := s.repo.PruneRateLimitBuckets(ctx, start.Add(time.Second))
+	if err != nil {
+		t.Fatal("pruning failed:", err)
+	}
+	if allowed, tokens, _ := s.repo.TakeRateLimitToken(ctx, "a", 3, 1, start.Add(1500*time.Millisecond)); allowed || tokens > 0.501 {
+		t.Errorf("expected a to be kept, with half a token, but got %t with %.3f tokens", allowed, tokens)
+	}
+	_ = s.repo.PruneRateLimitBuckets(ctx, start.Add(2*time.Hour))
+	if _, tokens, _ := s.repo.TakeRateLimitToken(ctx, "b", 3, 1, start.Add(time.Hour)); tokens < 1.999 {
+		t.Errorf("expected b to be pruned, and start full again, but got %.3f tokens", tokens)
+	}
+}
+
+func (s *suite) testAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	key := data.APIKey{
+		UserID:    1,
+		Name:      "deploys",
+		Prefix:    "wak_one",
+		KeyHash:   "key-one",
+		Scopes:    []string{data.PermissionReadUsers, data.PermissionWriteUsers},
+		ExpiresAt: expires,
+	}
+
+	id, err := s.repo.InsertAPIKey(ctx, key)
+	if err != nil {
+		t.Fatal("inserting api key failed:", err)
+	}
+
+	found, err := s.repo.GetAPIKey(ctx, "key-one")
+	if err != nil {
+		t.Fatal("getting api key failed:", err)
+	}
+	if found.ID != id || found.UserID != 1 || found.Name != "deploys" || found.Prefix != "wak_one" ||
+		!reflect.DeepEqual(found.Scopes, key.Scopes) || !found.ExpiresAt.Equal(expires) || !found.Active(time.Now()) {
+		t.Errorf("unexpected api key returned: %+v", found)
+	}
+	if found.LastUsedAt != nil {
+		t.Errorf("expected a new key not to have been used, but it was used at %v", found.LastUsedAt)
+	}
+
+	// a key with no scopes has none, rather than one empty one
+	key.Prefix, key.KeyHash, key.Scopes = "wak_two", "key-two", nil
+	secondID, _ := s.repo.InsertAPIKey(ctx, key)
+
+	used := time.Now().Truncate(time.Second)
+	err = s.repo.TouchAPIKey(ctx, secondID, used)
+	if err != nil {
+		t.Error("touching api key failed:", err)
+	}
+
+	keys, err := s.repo.UserAPIKeys(ctx, 1)
+	if err != nil {
+		t.Fatal("listing api keys failed:", err)
+	}
+	if len(keys) != 2 || keys[0].ID != secondID || keys[1].ID != id {
+		t.Fatalf("expected the two keys, newest first, but got %+v", keys)
+	}
+	if len(keys[0].Scopes) != 0 || keys[0].LastUsedAt == nil || !keys[0].LastUsedAt.Equal(used) {
+		t.Errorf("unexpected second key: %+v", keys[0])
+	}
+	if others, _ := s.repo.UserAPIKeys(ctx, 2); len(others) != 0 {
+		t.Errorf("expected no keys for another user, but got %d", len(others))
+	}
+
+	// only the user who made a key can revoke it, and only once
+	err = s.repo.RevokeAPIKey(ctx, 2, id)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound revoking another user's key, but got %v", err)
+	}
+	err = s.repo.RevokeAPIKey(ctx, 1, id)
+	if err != nil {
+		t.Error("revoking api key failed:", err)
+	}
+	err = s.repo.RevokeAPIKey(ctx, 1, id)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound revoking a key twice, but got %v", err)
+	}
+	if revoked, _ := s.repo.GetAPIKey(ctx, "key-one"); revoked == nil || revoked.RevokedAt == nil || revoked.Active(time.Now()) {
+		t.Errorf("expected the key to be revoked, but got %+v", revoked)
+	}
+
+	_, err = s.repo.GetAPIKey(ctx, "key-unknown")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound getting an unknown key, but got %v", err)
+	}
+	err = s.repo.TouchAPIKey(ctx, 100, used)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound touching an unknown key, but got %v", err)
+	}
+
+	var dup *repository.DuplicateError
+	key.KeyHash = "key-three"
+	_, err = s.repo.InsertAPIKey(ctx, key)
+	if !errors.As(err, &dup) || dup.Field != "prefix" {
+		t.Errorf("expected a duplicate prefix error, but got %v", err)
+	}
+	key.Prefix, key.KeyHash = "wak_three", "key-two"
+	_, err = s.repo.InsertAPIKey(ctx, key)
+	if !errors.As(err, &dup) || dup.Field != "key_hash" {
+		t.Errorf("expected a duplicate key_hash error, but got %v", err)
+	}
+
+	// revoking all of a user's keys catches the one still active, and can be done again
+	for i := 0; i < 2; i++ {
+		err = s.repo.RevokeUserAPIKeys(ctx, 1)
+		if err != nil {
+			t.Errorf("revoking a user's api keys failed: %s", err)
+		}
+	}
+	if revoked, _ := s.repo.GetAPIKey(ctx, "key-two"); revoked == nil || revoked.RevokedAt == nil {
+		t.Errorf("expected every key of the user to be revoked, but got %+v", revoked)
+	}
+	err = s.repo.RevokeUserAPIKeys(ctx, 100)
+	if err != nil {
+		t.Errorf("expected no error revoking the keys of a user without any, but got %v", err)
+	}
+
+	key.UserID, key.KeyHash = 100, "key-nobody"
+	_, err = s.repo.InsertAPIKey(ctx, key)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inserting a key for a non-existent user, but got %v", err)
+	}
+}
+
+func (s *suite) testNotFound(t *testing.T) {
+	ctx := context.Background()
+	const missing = 100
+
+	var tests = []struct {
+		name string
+		call func() error
+	}{
+		{"GetUser", func() error { _, err := s.repo.GetUser(ctx, missing); return err }},
+		{"GetUserByEmail", func() error { _, err := s.repo.GetUserByEmail(ctx, "nobody@example.com"); return err }},
+		{"UpdateUser", func() error { return s.repo.UpdateUser(ctx, data.User{ID: missing, Email: "nobody@example.com"}) }},
+		{"DeleteUser", func() error { return s.repo.DeleteUser(ctx, missing) }},
+		{"ResetPassword", func() error { return s.repo.ResetPassword(ctx, missing, "password") }},
+		{"GetRefreshToken", func() error { _, err := s.repo.GetRefreshToken(ctx, "no-such-hash"); return err }},
+	}
+
+	for _, e := range tests {
+		err := e.call()
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound, but got %v", e.name, err)
+		}
+	}
+
+	// a reference to a missing user is a conflict, not a missing record
+	_, err := s.repo.InsertRefreshToken(ctx, data.RefreshToken{
+		UserID:    missing,
+		TokenHash: "no-such-user",
+		FamilyID:  "no-such-user",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inserting a refresh token for a missing user, but got %v", err)
+	}
+
+	// so is revoking a token that isn't there; it was simply not active
+	active, err := s.repo.RevokeRefreshToken(ctx, missing)
+	if err != nil || active {
+		t.Errorf("revoking a missing refresh token should report it inactive; got %v, %v", active, err)
+	}
+}
+
+func (s *suite) testOrdering(t *testing.T) {
+	ctx := context.Background()
+
+	// inserted one after the other, so creation order is insertion order; Brown is there twice,
+	// to check that ties are broken by id
+	newUsers := []data.User{
+		{FirstName: "Carol", LastName: "Brown", Email: "order-c@example.com"},
+		{FirstName: "Alice", LastName: "Jones", Email: "order-a@example.com"},
+		{FirstName: "Bob", LastName: "Brown", Email: "order-b@example.com"},
+	}
+
+	ids := make(map[string]int)
+	for _, u := range newUsers {
+		u.Password = "secret"
+		id, err := s.repo.InsertUser(ctx, u)
+		if err != nil {
+			t.Fatal("inserting user failed:", err)
+		}
+		ids[u.FirstName] = id
+	}
+
+	var tests = []struct {
+		sort     string
+		expected []string
+	}{
+		{"id", []string{"Carol", "Alice", "Bob"}},
+		{"-id", []string{"Bob", "Alice", "Carol"}},
+		{"first_name", []string{"Alice", "Bob", "Carol"}},
+		{"email", []string{"Alice", "Bob", "Carol"}},
+		{"-email", []string{"Carol", "Bob", "Alice"}},
+		{"last_name", []string{"Carol", "Bob", "Alice"}},
+		{"-last_name", []string{"Alice", "Bob", "Carol"}},
+		{"created_at", []string{"Carol", "Alice", "Bob"}},
+		{"-created_at", []string{"Bob", "Alice", "Carol"}},
+	}
+
+	for _, e := range tests {
+		// a page at a time, to check that cursors resume in the right place
+		var got []string
+		q := repository.UserQuery{Limit: 1, Sort: e.sort, EmailPrefix: "order-"}
+		for {
+			page, err := s.repo.AllUsers(ctx, q)
+			if err != nil {
+				t.Fatalf("%s: all users reports an error: %s", e.sort, err)
+			}
+			for _, u := range page.Users {
+				got = append(got, u.FirstName)
+			}
+			if page.NextCursor == "" || len(got) > len(e.expected) {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(e.expected) {
+			t.Errorf("%s: expected %v, but got %v", e.sort, e.expected, got)
+		}
+	}
+
+	// a cursor is only good for the sort order it came from
+	page, _ := s.repo.AllUsers(ctx, repository.UserQuery{Limit: 1, Sort: "id", EmailPrefix: "order-"})
+	_, err := s.repo.AllUsers(ctx, repository.UserQuery{Limit: 1, Sort: "email", Cursor: page.NextCursor})
+	if !errors.Is(err, repository.ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for a cursor from another sort order, but got %v", err)
+	}
+
+	_, err = s.repo.AllUsers(ctx, repository.UserQuery{Sort: "password"})
+	if !errors.Is(err, repository.ErrInvalidSort) {
+		t.Errorf("expected ErrInvalidSort, but got %v", err)
+	}
+
+	for _, id := range ids {
+		_ = s.repo.DeleteUser(ctx, id)
+	}
+}
+
+func (s *suite) testConcurrency(t *testing.T) {
+	ctx := context.Background()
+	const workers = 10
+
+	// concurrent inserts all succeed, with ids of their own
+	var wg sync.WaitGroup
+	idCh := make(chan int, workers)
+	errCh := make(chan error, workers*2)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := s.repo.InsertRefreshToken(ctx, data.RefreshToken{
+				UserID:    1,
+				TokenHash: fmt.Sprintf("concurrent-%d", i),
+				FamilyID:  "concurrent",
+				ExpiresAt: time.Now().Add(time.Hour),
+			})
+			if err != nil {
+				errCh <- err
+				return
+			}
+			idCh <- id
+		}(i)
+	}
+	wg.Wait()
+	close(idCh)
+
+	seen := make(map[int]bool)
+	for id := range idCh {
+		if seen[id] {
+			t.Errorf("id %d was handed out twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != workers {
+		t.Fatalf("expected %d refresh tokens, but %d were inserted; first error: %v", workers, len(seen), <-errCh)
+	}
+
+	// a token used by several requests at once is only handed to one of them
+	var token int
+	for id := range seen {
+		token = id
+		break
+	}
+
+	var mu sync.Mutex
+	var winners int
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			active, err := s.repo.RevokeRefreshToken(ctx, token)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if active {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Error("concurrent call failed:", err)
+	}
+
+	if winners != 1 {
+		t.Errorf("expected one request to revoke the token, but %d did", winners)
+	}
+}
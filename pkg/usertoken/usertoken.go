@@ -0,0 +1,63 @@
+// Package usertoken issues and redeems the one-time tokens given to users, to reset a forgotten
+// password, to verify an email address or to finish logging in with a second factor. Tokens are
+// random, and only a hash of each one is stored, so a copy of the database is no use for
+// redeeming them.
+package usertoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+)
+
+// tokenBytes is how many random bytes go into a token.
+const tokenBytes = 32
+
+// How long tokens work for.
+const (
+	ResetPasswordTTL = time.Hour
+	VerifyEmailTTL   = 24 * time.Hour
+	MFAChallengeTTL  = 5 * time.Minute
+)
+
+// Issue creates a token for purpose that expires after ttl, stores its hash in db, and returns
+// the token itself, to be given to the user.
+func Issue(ctx context.Context, db repository.DatabaseRepo, userID int, purpose string, ttl time.Duration) (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	_, err := db.InsertUserToken(ctx, data.UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: Hash(token),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Redeem uses up token, and returns it. It returns repository.ErrNotFound if the token is
+// unknown, was issued for another purpose, or has been used or has expired.
+func Redeem(ctx context.Context, db repository.DatabaseRepo, purpose, token string) (*data.UserToken, error) {
+	if token == "" {
+		return nil, repository.ErrNotFound
+	}
+	return db.UseUserToken(ctx, purpose, Hash(token))
+}
+
+// Hash returns the hex encoded sha256 hash of a token, which is what is stored in the database.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,70 @@
+package usertoken
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"web-app/pkg/data"
+	"web-app/pkg/repository"
+	"web-app/pkg/repository/dbrepo"
+)
+
+func TestIssueAndRedeem(t *testing.T) {
+	ctx := context.Background()
+	db := dbrepo.NewMemoryDBRepo(0)
+	userID, err := db.InsertUser(ctx, data.User{Email: "jack@example.com", FirstName: "Jack", LastName: "Smith", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := Issue(ctx, db, userID, data.TokenPurposeResetPassword, time.Hour)
+	if err != nil {
+		t.Fatal("issuing token failed:", err)
+	}
+
+	other, _ := Issue(ctx, db, userID, data.TokenPurposeResetPassword, time.Hour)
+	if other == token {
+		t.Error("expected every token to be different")
+	}
+
+	var tests = []struct {
+		name    string
+		purpose string
+		token   string
+		valid   bool
+	}{
+		{"empty", data.TokenPurposeResetPassword, "", false},
+		{"unknown", data.TokenPurposeResetPassword, "no-such-token", false},
+		{"other purpose", "other", token, false},
+		{"valid", data.TokenPurposeResetPassword, token, true},
+		{"used", data.TokenPurposeResetPassword, token, false},
+	}
+
+	for _, e := range tests {
+		redeemed, err := Redeem(ctx, db, e.purpose, e.token)
+		if e.valid {
+			if err != nil || redeemed.UserID != userID {
+				t.Errorf("%s: expected the token of user %d, but got %+v, %v", e.name, userID, redeemed, err)
+			}
+		} else if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound, but got %v", e.name, err)
+		}
+	}
+}
+
+func TestRedeemExpired(t *testing.T) {
+	ctx := context.Background()
+	db := dbrepo.NewMemoryDBRepo(0)
+	userID, _ := db.InsertUser(ctx, data.User{Email: "jack@example.com", FirstName: "Jack", LastName: "Smith", Password: "secret"})
+
+	token, err := Issue(ctx, db, userID, data.TokenPurposeResetPassword, -time.Second)
+	if err != nil {
+		t.Fatal("issuing token failed:", err)
+	}
+
+	_, err = Redeem(ctx, db, data.TokenPurposeResetPassword, token)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an expired token, but got %v", err)
+	}
+}
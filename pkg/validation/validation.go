@@ -0,0 +1,252 @@
+// Package validation holds the checks shared by the api and the web front end, so that a user
+// is held to the same rules no matter how they sign up or change their details.
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"web-app/pkg/data"
+)
+
+const (
+	// MaxNameLength and MaxEmailLength match the size of the columns in the users table.
+	MaxNameLength  = 255
+	MaxEmailLength = 255
+	// MaxPasswordLength is the most bcrypt will hash; anything longer is silently truncated.
+	MaxPasswordLength = 72
+)
+
+// Errors maps a field name to the problems found with it.
+type Errors map[string][]string
+
+// Get returns the first error for a field, or an empty string if there is none.
+func (e Errors) Get(field string) string {
+	errorSlice := e[field]
+	if len(errorSlice) == 0 {
+		return ""
+	}
+	return errorSlice[0]
+}
+
+// Add adds an error message for a field.
+func (e Errors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+// Valid reports whether no errors have been added.
+func (e Errors) Valid() bool {
+	return len(e) == 0
+}
+
+// PasswordPolicy describes what makes an acceptable password.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// DefaultPasswordPolicy only asks for a reasonable length.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8}
+
+// Check returns a message for every rule the password breaks.
+func (p PasswordPolicy) Check(password string) []string {
+	var problems []string
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > MaxPasswordLength {
+		problems = append(problems, fmt.Sprintf("must be no more than %d bytes long", MaxPasswordLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireUpper && !upper {
+		problems = append(problems, "must contain an upper case letter")
+	}
+	if p.RequireLower && !lower {
+		problems = append(problems, "must contain a lower case letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "must contain a symbol")
+	}
+
+	return problems
+}
+
+// SignupPolicy decides who may create an account for themselves.
+type SignupPolicy struct {
+	// Open lets anyone sign up; when it is false, only existing users can create accounts
+	Open bool
+	// AllowedDomains, when not empty, limits signup to email addresses at these domains
+	AllowedDomains []string
+}
+
+// ParseDomains splits a comma separated list of email domains, such as "example.com, example.org",
+// dropping blanks and any leading @.
+func ParseDomains(s string) []string {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "@")
+		if d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// AllowsEmail reports whether the policy lets someone sign up with email. It does not check that
+// email is valid, only its domain.
+func (p SignupPolicy) AllowsEmail(email string) bool {
+	if !p.Open {
+		return false
+	}
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, d := range p.AllowedDomains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// EmailVerification is the policy for users who have not verified their email address: what
+// they may do until they follow the link mailed to them. The zero value is VerificationOptional.
+type EmailVerification string
+
+const (
+	// VerificationOptional lets unverified users do anything verified ones can
+	VerificationOptional EmailVerification = "optional"
+	// VerificationRestricted lets unverified users log in, but only to manage their own account
+	VerificationRestricted EmailVerification = "restricted"
+	// VerificationRequired does not let unverified users log in at all
+	VerificationRequired EmailVerification = "required"
+)
+
+// ParseEmailVerification returns the policy called s.
+func ParseEmailVerification(s string) (EmailVerification, error) {
+	switch p := EmailVerification(strings.ToLower(strings.TrimSpace(s))); p {
+	case VerificationOptional, VerificationRestricted, VerificationRequired:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown email verification policy %q; use optional, restricted or required", s)
+	}
+}
+
+// AllowsLogin reports whether a user may log in, given whether their email address is verified.
+func (p EmailVerification) AllowsLogin(verified bool) bool {
+	return verified || p != VerificationRequired
+}
+
+// AllowsFullAccess reports whether a logged in user may do more than manage their own account,
+// given whether their email address is verified. Users who change their address while logged in
+// are restricted under VerificationRequired too, until they verify the new one.
+func (p EmailVerification) AllowsFullAccess(verified bool) bool {
+	return verified || p == VerificationOptional || p == ""
+}
+
+// IsEmail reports whether s is a bare email address, such as jack@example.com.
+func IsEmail(s string) bool {
+	if len(s) > MaxEmailLength {
+		return false
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return false
+	}
+	// insist on a domain with a dot in it; "jack@localhost" is not an address we can mail
+	at := strings.LastIndex(s, "@")
+	return strings.Contains(s[at+1:], ".")
+}
+
+// User checks the fields of a user. The password is only checked if checkPassword is true,
+// since it is not part of an update.
+func User(u data.User, checkPassword bool, policy PasswordPolicy) Errors {
+	errs := Errors{}
+
+	name := func(field, value string) {
+		switch {
+		case strings.TrimSpace(value) == "":
+			errs.Add(field, "this field cannot be blank")
+		case utf8.RuneCountInString(value) > MaxNameLength:
+			errs.Add(field, fmt.Sprintf("must be no more than %d characters long", MaxNameLength))
+		}
+	}
+	name("first_name", u.FirstName)
+	name("last_name", u.LastName)
+
+	switch {
+	case strings.TrimSpace(u.Email) == "":
+		errs.Add("email", "this field cannot be blank")
+	case !IsEmail(u.Email):
+		errs.Add("email", "must be a valid email address")
+	}
+
+	if checkPassword {
+		for _, problem := range policy.Check(u.Password) {
+			errs.Add("password", problem)
+		}
+	}
+
+	return errs
+}
+
+// Organization checks the fields of an organization.
+func Organization(o data.Organization) Errors {
+	errs := Errors{}
+
+	switch {
+	case strings.TrimSpace(o.Name) == "":
+		errs.Add("name", "this field cannot be blank")
+	case utf8.RuneCountInString(o.Name) > MaxNameLength:
+		errs.Add("name", fmt.Sprintf("must be no more than %d characters long", MaxNameLength))
+	}
+
+	return errs
+}
+
+// APIKey checks the fields of an api key a user is making.
+func APIKey(k data.APIKey) Errors {
+	errs := Errors{}
+
+	switch {
+	case strings.TrimSpace(k.Name) == "":
+		errs.Add("name", "this field cannot be blank")
+	case utf8.RuneCountInString(k.Name) > MaxNameLength:
+		errs.Add("name", fmt.Sprintf("must be no more than %d characters long", MaxNameLength))
+	}
+
+	// scopes are stored separated by spaces
+	for _, scope := range k.Scopes {
+		if scope == "" || strings.IndexFunc(scope, unicode.IsSpace) >= 0 {
+			errs.Add("scopes", fmt.Sprintf("%q is not a permission", scope))
+		}
+	}
+
+	return errs
+}
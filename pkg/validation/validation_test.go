@@ -0,0 +1,193 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+	"web-app/pkg/data"
+)
+
+func TestIsEmail(t *testing.T) {
+	var tests = []struct {
+		email string
+		valid bool
+	}{
+		{"jack@example.com", true},
+		{"jack.smith+test@mail.example.co.uk", true},
+		{"", false},
+		{"jack", false},
+		{"jack@", false},
+		{"jack@localhost", false},
+		{"Jack <jack@example.com>", false},
+		{"jack@example.com ", false},
+		{strings.Repeat("a", 250) + "@example.com", false},
+	}
+
+	for _, e := range tests {
+		if IsEmail(e.email) != e.valid {
+			t.Errorf("%q: expected valid to be %v", e.email, e.valid)
+		}
+	}
+}
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	strict := PasswordPolicy{MinLength: 10, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+
+	var tests = []struct {
+		name             string
+		policy           PasswordPolicy
+		password         string
+		expectedProblems int
+	}{
+		{"default ok", DefaultPasswordPolicy, "correcthorse", 0},
+		{"default too short", DefaultPasswordPolicy, "short", 1},
+		{"too long for bcrypt", DefaultPasswordPolicy, strings.Repeat("a", 73), 1},
+		{"strict ok", strict, "Correct-Horse-1", 0},
+		{"strict missing everything", strict, "aaaaaaaaaa", 3},
+		{"strict too short and no symbol", strict, "Abc1", 2},
+	}
+
+	for _, e := range tests {
+		problems := e.policy.Check(e.password)
+		if len(problems) != e.expectedProblems {
+			t.Errorf("%s: expected %d problems, but got %v", e.name, e.expectedProblems, problems)
+		}
+	}
+}
+
+func TestUser(t *testing.T) {
+	valid := data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "password1"}
+
+	errs := User(valid, true, DefaultPasswordPolicy)
+	if !errs.Valid() {
+		t.Errorf("expected valid user, but got %v", errs)
+	}
+
+	invalid := data.User{FirstName: " ", LastName: strings.Repeat("x", 256), Email: "nope", Password: "x"}
+
+	errs = User(invalid, true, DefaultPasswordPolicy)
+	for _, field := range []string{"first_name", "last_name", "email", "password"} {
+		if errs.Get(field) == "" {
+			t.Errorf("expected an error for %s", field)
+		}
+	}
+
+	// passwords are not part of an update
+	errs = User(data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com"}, false, DefaultPasswordPolicy)
+	if !errs.Valid() {
+		t.Errorf("expected password to be ignored, but got %v", errs)
+	}
+}
+
+func TestOrganization(t *testing.T) {
+	tests := []struct {
+		name  string
+		org   data.Organization
+		valid bool
+	}{
+		{"valid", data.Organization{Name: "Example"}, true},
+		{"blank", data.Organization{Name: "  "}, false},
+		{"too long", data.Organization{Name: strings.Repeat("x", MaxNameLength+1)}, false},
+	}
+
+	for _, e := range tests {
+		errs := Organization(e.org)
+		if errs.Valid() != e.valid {
+			t.Errorf("%s: expected valid to be %t, but got errors %v", e.name, e.valid, errs)
+		}
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   data.APIKey
+		valid bool
+	}{
+		{"valid", data.APIKey{Name: "ci", Scopes: []string{data.PermissionReadUsers}}, true},
+		{"no scopes", data.APIKey{Name: "ci"}, true},
+		{"blank", data.APIKey{Name: "  "}, false},
+		{"too long", data.APIKey{Name: strings.Repeat("x", MaxNameLength+1)}, false},
+		{"blank scope", data.APIKey{Name: "ci", Scopes: []string{""}}, false},
+		{"scope with a space", data.APIKey{Name: "ci", Scopes: []string{"users:read users:write"}}, false},
+	}
+
+	for _, e := range tests {
+		errs := APIKey(e.key)
+		if errs.Valid() != e.valid {
+			t.Errorf("%s: expected valid to be %t, but got errors %v", e.name, e.valid, errs)
+		}
+	}
+}
+
+func TestParseDomains(t *testing.T) {
+	domains := ParseDomains(" Example.com, @example.org,, ")
+	if len(domains) != 2 || domains[0] != "example.com" || domains[1] != "example.org" {
+		t.Errorf("expected [example.com example.org], but got %v", domains)
+	}
+
+	if domains := ParseDomains(""); len(domains) != 0 {
+		t.Errorf("expected no domains, but got %v", domains)
+	}
+}
+
+func TestSignupPolicy_AllowsEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  SignupPolicy
+		email   string
+		allowed bool
+	}{
+		{"closed", SignupPolicy{}, "jack@example.com", false},
+		{"closed with domains", SignupPolicy{AllowedDomains: []string{"example.com"}}, "jack@example.com", false},
+		{"open", SignupPolicy{Open: true}, "jack@example.com", true},
+		{"allowed domain", SignupPolicy{Open: true, AllowedDomains: []string{"example.com"}}, "jack@example.com", true},
+		{"allowed domain in another case", SignupPolicy{Open: true, AllowedDomains: []string{"example.com"}}, "jack@EXAMPLE.com", true},
+		{"other domain", SignupPolicy{Open: true, AllowedDomains: []string{"example.com"}}, "jack@example.org", false},
+		{"subdomain", SignupPolicy{Open: true, AllowedDomains: []string{"example.com"}}, "jack@mail.example.com", false},
+	}
+
+	for _, e := range tests {
+		if got := e.policy.AllowsEmail(e.email); got != e.allowed {
+			t.Errorf("%s: expected %t, but got %t", e.name, e.allowed, got)
+		}
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	var tests = []struct {
+		name       string
+		policy     string
+		verified   bool
+		login      bool
+		fullAccess bool
+	}{
+		{"optional, unverified", "optional", false, true, true},
+		{"restricted, unverified", "restricted", false, true, false},
+		{"required, unverified", "Required", false, false, false},
+		{"required, verified", "required", true, true, true},
+	}
+
+	for _, e := range tests {
+		p, err := ParseEmailVerification(e.policy)
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+		if login := p.AllowsLogin(e.verified); login != e.login {
+			t.Errorf("%s: expected AllowsLogin to be %t, but got %t", e.name, e.login, login)
+		}
+		if full := p.AllowsFullAccess(e.verified); full != e.fullAccess {
+			t.Errorf("%s: expected AllowsFullAccess to be %t, but got %t", e.name, e.fullAccess, full)
+		}
+	}
+
+	if _, err := ParseEmailVerification("sometimes"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+
+	// the zero value is optional
+	var zero EmailVerification
+	if !zero.AllowsLogin(false) || !zero.AllowsFullAccess(false) {
+		t.Error("expected the zero policy to let unverified users do anything")
+	}
+}